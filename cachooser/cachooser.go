@@ -2,11 +2,12 @@
 package cachooser
 
 import (
-	"crypto/rsa"
+	"crypto"
 	"crypto/x509"
 )
 
 // Choose the CA to be used to sign this CSR.
+// The CA key may be an RSA or ECDSA key.
 type CAChooser interface {
-	Choose(data []byte, caKeyPass []byte) (*rsa.PrivateKey, []*x509.Certificate, error)
+	Choose(data []byte, caKeyPass []byte) (crypto.Signer, []*x509.Certificate, error)
 }
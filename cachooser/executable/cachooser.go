@@ -3,7 +3,7 @@ package executablecachooser
 
 import (
 	"bufio"
-	"crypto/rsa"
+	"crypto"
 	"crypto/x509"
 	"encoding/pem"
 	"errors"
@@ -50,7 +50,7 @@ type ExecutableCAChooser struct {
 	logger     log.Logger
 }
 
-func (v *ExecutableCAChooser) Choose(data []byte, caKeyPass []byte) (*rsa.PrivateKey, []*x509.Certificate, error) {
+func (v *ExecutableCAChooser) Choose(data []byte, caKeyPass []byte) (crypto.Signer, []*x509.Certificate, error) {
 	cmd := exec.Command(v.executable)
 	cmd.Env = append(os.Environ(), "CAKEYPASS="+string(caKeyPass))
 
@@ -88,14 +88,19 @@ func (v *ExecutableCAChooser) Choose(data []byte, caKeyPass []byte) (*rsa.Privat
 		return nil, nil, err
 	}
 	key, rest := pem.Decode(outputBytes)
-	if key == nil || key.Type != "RSA PRIVATE KEY" {
-		return nil, nil, errors.New("Unrecognized PEM format (no RSA PRIVATE KEY found)")
+	if key == nil || (key.Type != "RSA PRIVATE KEY" && key.Type != "EC PRIVATE KEY") {
+		return nil, nil, errors.New("Unrecognized PEM format (no RSA PRIVATE KEY or EC PRIVATE KEY found)")
 	}
 	decrypted, err := x509.DecryptPEMBlock(key, caKeyPass)
 	if err != nil {
 		return nil, nil, err
 	}
-	rsaKey, err := x509.ParsePKCS1PrivateKey(decrypted)
+	var caKey crypto.Signer
+	if key.Type == "EC PRIVATE KEY" {
+		caKey, err = x509.ParseECPrivateKey(decrypted)
+	} else {
+		caKey, err = x509.ParsePKCS1PrivateKey(decrypted)
+	}
 	if err != nil {
 		return nil, nil, err
 	}
@@ -116,5 +121,5 @@ func (v *ExecutableCAChooser) Choose(data []byte, caKeyPass []byte) (*rsa.Privat
 		return nil, nil, err
 	}
 
-	return rsaKey, certs, err
+	return caKey, certs, err
 }
@@ -0,0 +1,102 @@
+// Package webhookcachooser defines the WebhookCAChooser cachooser.CAChooser.
+package webhookcachooser
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"reflect"
+
+	"github.com/go-kit/kit/log"
+	"github.com/syncsynchalt/scep/webhook"
+)
+
+// New creates a webhookcachooser.WebhookCAChooser.
+func New(config webhook.Config, logger log.Logger) (*WebhookCAChooser, error) {
+	client, err := webhook.NewClient(config)
+	if err != nil {
+		return nil, err
+	}
+	return &WebhookCAChooser{client: client, logger: logger}, nil
+}
+
+// WebhookCAChooser implements a cachooser.CAChooser.
+// It posts the raw decrypted CSR to a webhook, which answers with the CA
+// key in "ca_key", encrypted with the CA key password unless it is empty,
+// and the CA certificate and optional chain in "ca_certs". The CA key
+// password is not sent to the webhook. Use TLS, the key is sent in the
+// response.
+type WebhookCAChooser struct {
+	client *webhook.Client
+	logger log.Logger
+}
+
+func (v *WebhookCAChooser) Choose(data []byte, caKeyPass []byte) (crypto.Signer, []*x509.Certificate, error) {
+	resp, err := v.client.Post(webhook.NewRequest("cachooser", "", data))
+	if err != nil {
+		v.logger.Log("err", err)
+		return nil, nil, err
+	}
+	caKey, err := parseKey([]byte(resp.CAKey), caKeyPass)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certs := []*x509.Certificate{}
+	for cert, rest := pem.Decode([]byte(resp.CACerts)); cert != nil; cert, rest = pem.Decode(rest) {
+		if cert.Type != "CERTIFICATE" && cert.Type != "TRUSTED CERTIFICATE" {
+			return nil, nil, errors.New("Unrecognized PEM format (no CERTIFICATE found)")
+		}
+		certlist, err := x509.ParseCertificates(cert.Bytes)
+		if err != nil {
+			return nil, nil, err
+		}
+		certs = append(certs, certlist...)
+	}
+	if len(certs) == 0 {
+		return nil, nil, errors.New("cachooser webhook returned no CA certificate")
+	}
+	if !reflect.DeepEqual(certs[0].PublicKey, caKey.Public()) {
+		return nil, nil, errors.New("cachooser webhook returned a CA key which does not match the CA certificate")
+	}
+
+	return caKey, certs, nil
+}
+
+// parseKey parses a PEM RSA, ECDSA or PKCS#8 key, decrypting it with pass
+// if it is encrypted.
+func parseKey(data []byte, pass []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("cachooser webhook returned no PEM CA key")
+	}
+	der := block.Bytes
+	if x509.IsEncryptedPEMBlock(block) {
+		var err error
+		if der, err = x509.DecryptPEMBlock(block, pass); err != nil {
+			return nil, err
+		}
+	}
+	var key interface{}
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(der)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(der)
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(der)
+	default:
+		return nil, fmt.Errorf("Unrecognized PEM format %q", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("CA key can not sign")
+	}
+	return signer, nil
+}
@@ -0,0 +1,88 @@
+package webhookcachooser
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/syncsynchalt/scep/webhook"
+)
+
+func TestChoose(t *testing.T) {
+	key, certPEM := newCA(t)
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPEM := string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}))
+	otherKey, _ := newCA(t)
+	der, err = x509.MarshalECPrivateKey(otherKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKeyPEM := string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}))
+
+	var response webhook.Response
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(response)
+	}))
+	defer server.Close()
+
+	c, err := New(webhook.Config{URL: server.URL}, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	response = webhook.Response{CAKey: keyPEM, CACerts: certPEM}
+	signer, certs, err := c.Choose([]byte("csr"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(certs) != 1 || certs[0].Subject.CommonName != "webhook CA" {
+		t.Errorf("have certificates %v", certs)
+	}
+	if _, ok := signer.(*ecdsa.PrivateKey); !ok {
+		t.Errorf("have key %T", signer)
+	}
+
+	for _, response = range []webhook.Response{
+		{CAKey: keyPEM},
+		{CACerts: certPEM},
+		{CAKey: otherKeyPEM, CACerts: certPEM},
+	} {
+		if _, _, err := c.Choose([]byte("csr"), nil); err == nil {
+			t.Errorf("chose the CA of an invalid response %+v", response)
+		}
+	}
+}
+
+func newCA(t *testing.T) (*ecdsa.PrivateKey, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "webhook CA"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, webhook.EncodeCertificate(der)
+}
@@ -0,0 +1,34 @@
+// Package webhookcertfailer defines the WebhookCertFailer certfailer.CertFailer.
+package webhookcertfailer
+
+import (
+	"github.com/go-kit/kit/log"
+	"github.com/syncsynchalt/scep/webhook"
+)
+
+// New creates a webhookcertfailer.WebhookCertFailer.
+func New(config webhook.Config, logger log.Logger) (*WebhookCertFailer, error) {
+	client, err := webhook.NewClient(config)
+	if err != nil {
+		return nil, err
+	}
+	return &WebhookCertFailer{client: client, logger: logger}, nil
+}
+
+// WebhookCertFailer implements a certfailer.CertFailer.
+// It posts the raw decrypted CSR and the error to a webhook, and
+// reports whether the webhook accepted the notification.
+type WebhookCertFailer struct {
+	client *webhook.Client
+	logger log.Logger
+}
+
+func (v *WebhookCertFailer) Fail(transactionID string, data []byte, errmsg string) (bool, error) {
+	req := webhook.NewRequest("certfailer", transactionID, data)
+	req.Error = errmsg
+	if _, err := v.client.Post(req); err != nil {
+		v.logger.Log("err", err)
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,33 @@
+package webhookcertfailer
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/syncsynchalt/scep/webhook"
+)
+
+func TestFail(t *testing.T) {
+	var req webhook.Request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+	}))
+	defer server.Close()
+
+	f, err := New(webhook.Config{URL: server.URL}, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok, err := f.Fail("tid", []byte("csr"), "CN device already exists")
+	if err != nil || !ok {
+		t.Fatalf("have %v, %v", ok, err)
+	}
+	if have, want := req.Error, "CN device already exists"; have != want {
+		t.Errorf("have %s, want %s", have, want)
+	}
+}
@@ -0,0 +1,48 @@
+// Package webhookcertsuccesser defines the WebhookCertSuccesser certsuccesser.CertSuccesser.
+package webhookcertsuccesser
+
+import (
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/go-kit/kit/log"
+	"github.com/syncsynchalt/scep/webhook"
+)
+
+// New creates a webhookcertsuccesser.WebhookCertSuccesser.
+func New(config webhook.Config, logger log.Logger) (*WebhookCertSuccesser, error) {
+	client, err := webhook.NewClient(config)
+	if err != nil {
+		return nil, err
+	}
+	return &WebhookCertSuccesser{client: client, logger: logger}, nil
+}
+
+// WebhookCertSuccesser implements a certsuccesser.CertSuccesser.
+// It posts the raw decrypted CSR and the new certificate to a webhook.
+// The certificate is approved if the webhook answers with "allow": true.
+type WebhookCertSuccesser struct {
+	client *webhook.Client
+	logger log.Logger
+}
+
+func (v *WebhookCertSuccesser) Success(transactionID string, data []byte, certFilename string) (bool, error) {
+	cert, err := ioutil.ReadFile(certFilename)
+	if err != nil {
+		return false, err
+	}
+	if block, _ := pem.Decode(cert); block == nil {
+		return false, fmt.Errorf("no PEM certificate in %s", certFilename)
+	}
+	req := webhook.NewRequest("certsuccesser", transactionID, data)
+	req.Certificate = string(cert)
+	resp, err := v.client.Post(req)
+	if err != nil {
+		return false, err
+	}
+	if !resp.Allow {
+		v.logger.Log("info", "webhook denied the certificate", "transaction_id", transactionID)
+	}
+	return resp.Allow, nil
+}
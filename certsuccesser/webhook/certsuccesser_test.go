@@ -0,0 +1,57 @@
+package webhookcertsuccesser
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/syncsynchalt/scep/webhook"
+)
+
+func TestSuccess(t *testing.T) {
+	var req webhook.Request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintf(w, `{"allow": %v}`, req.TransactionID == "allowed")
+	}))
+	defer server.Close()
+
+	f, err := ioutil.TempFile("", "certsuccesser-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	cert := webhook.EncodeCertificate([]byte("certificate"))
+	if _, err := f.WriteString(cert); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	s, err := New(webhook.Config{URL: server.URL}, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for tid, want := range map[string]bool{"allowed": true, "denied": false} {
+		have, err := s.Success(tid, []byte("csr"), f.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if have != want {
+			t.Errorf("%s: have %v, want %v", tid, have, want)
+		}
+		if req.Certificate != cert {
+			t.Errorf("%s: have certificate %q", tid, req.Certificate)
+		}
+	}
+	if _, err := s.Success("allowed", []byte("csr"), f.Name()+".missing"); err == nil {
+		t.Error("approved a missing certificate file")
+	}
+}
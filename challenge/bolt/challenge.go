@@ -1,12 +1,12 @@
 package challengestore
 
 import (
-	"crypto/rand"
-	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"time"
 
 	"github.com/boltdb/bolt"
-	"github.com/pkg/errors"
+	"github.com/syncsynchalt/scep/challenge"
 )
 
 type Depot struct {
@@ -30,45 +30,123 @@ func NewBoltDepot(db *bolt.DB) (*Depot, error) {
 	return &Depot{db}, nil
 }
 
+// SCEPChallenge stores and returns a new random challenge, which can be
+// used once.
 func (db *Depot) SCEPChallenge() (string, error) {
-	key := make([]byte, 24)
-	_, err := rand.Read(key)
+	return db.NewChallenge(challenge.Options{})
+}
+
+// NewChallenge stores and returns a new random challenge.
+func (db *Depot) NewChallenge(opts challenge.Options) (string, error) {
+	pw, c, err := challenge.New(opts, time.Now())
+	if err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(c)
 	if err != nil {
 		return "", err
 	}
-
-	challenge := base64.StdEncoding.EncodeToString(key)
 	err = db.Update(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte(challengeBucket))
 		if bucket == nil {
 			return fmt.Errorf("bucket %q not found!", challengeBucket)
 		}
-		return bucket.Put([]byte(challenge), []byte(challenge))
+		return bucket.Put([]byte(pw), data)
 	})
 	if err != nil {
 		return "", err
 	}
-	return challenge, nil
+	return pw, nil
 }
 
+// HasChallenge uses the challenge pw for a request without subject and
+// profile.
 func (db *Depot) HasChallenge(pw string) (bool, error) {
-	tx, err := db.Begin(true)
-	if err != nil {
-		return false, errors.Wrap(err, "begin transaction")
-	}
-	bkt := tx.Bucket([]byte(challengeBucket))
-	if bkt == nil {
-		return false, fmt.Errorf("bucket %q not found!", challengeBucket)
-	}
+	return db.UseChallenge(pw, challenge.Request{})
+}
 
-	key := []byte(pw)
+// UseChallenge uses the challenge pw for r and removes it once it is
+// used up.
+func (db *Depot) UseChallenge(pw string, r challenge.Request) (bool, error) {
 	var matches bool
-	if chal := bkt.Get(key); chal != nil {
-		if err := bkt.Delete(key); err != nil {
-			return false, err
+	err := db.Update(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte(challengeBucket))
+		if bkt == nil {
+			return fmt.Errorf("bucket %q not found!", challengeBucket)
+		}
+		key := []byte(pw)
+		c, err := decodeChallenge(bkt.Get(key))
+		if err != nil || c == nil {
+			return err
+		}
+		if c.Expired(time.Now()) {
+			return bkt.Delete(key)
+		}
+		if err := c.Check(r); err != nil {
+			return err
 		}
 		matches = true
+		c.Uses--
+		if c.Uses <= 0 {
+			return bkt.Delete(key)
+		}
+		data, err := json.Marshal(c)
+		if err != nil {
+			return err
+		}
+		return bkt.Put(key, data)
+	})
+	if err != nil {
+		return false, err
 	}
+	return matches, nil
+}
 
-	return matches, tx.Commit()
+// Purge removes the challenges which expired before now.
+func (db *Depot) Purge(now time.Time) (int, error) {
+	var n int
+	err := db.Update(func(tx *bolt.Tx) error {
+		bkt := tx.Bucket([]byte(challengeBucket))
+		if bkt == nil {
+			return fmt.Errorf("bucket %q not found!", challengeBucket)
+		}
+		var expired [][]byte
+		err := bkt.ForEach(func(k, v []byte) error {
+			c, err := decodeChallenge(v)
+			if err != nil {
+				return err
+			}
+			if c.Expired(now) {
+				expired = append(expired, k)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range expired {
+			if err := bkt.Delete(k); err != nil {
+				return err
+			}
+		}
+		n = len(expired)
+		return nil
+	})
+	return n, err
+}
+
+// decodeChallenge decodes a stored challenge, or returns nil if data is
+// nil. Older versions stored the challenge itself, for a single use.
+func decodeChallenge(data []byte) (*challenge.Challenge, error) {
+	if data == nil {
+		return nil, nil
+	}
+	if len(data) == 0 || data[0] != '{' {
+		return &challenge.Challenge{Uses: 1}, nil
+	}
+	c := new(challenge.Challenge)
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, err
+	}
+	return c, nil
 }
@@ -0,0 +1,180 @@
+package challengestore
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/syncsynchalt/scep/challenge"
+)
+
+func TestChallenge(t *testing.T) {
+	db := createDepot(t)
+
+	challenge, err := db.SCEPChallenge()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []bool{true, false} {
+		have, err := db.HasChallenge(challenge)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if have != want {
+			t.Errorf("have %v, want %v", have, want)
+		}
+	}
+	if ok, err := db.HasChallenge("unknown"); err != nil || ok {
+		t.Errorf("unknown challenge: have %v, %v", ok, err)
+	}
+}
+
+func TestBoundChallenge(t *testing.T) {
+	db := createDepot(t)
+	pw, err := db.NewChallenge(challenge.Options{
+		Binding: challenge.Binding{CN: "device", SubjectPattern: "CN=device,O=acme"},
+		Uses:    2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := challenge.Request{CN: "device", Subject: "CN=device,O=acme"}
+	if ok, err := db.UseChallenge(pw, challenge.Request{CN: "device", Subject: "CN=device,O=other"}); err == nil || ok {
+		t.Errorf("subject outside of the pattern: have %v, %v", ok, err)
+	}
+	if ok, err := db.UseChallenge(pw, challenge.Request{CN: "other", Subject: "CN=device,O=acme"}); err == nil || ok {
+		t.Errorf("other CN: have %v, %v", ok, err)
+	}
+	// a refused request does not use up the challenge
+	for _, want := range []bool{true, true, false} {
+		have, err := db.UseChallenge(pw, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if have != want {
+			t.Errorf("have %v, want %v", have, want)
+		}
+	}
+
+	if _, err := db.NewChallenge(challenge.Options{Binding: challenge.Binding{SubjectPattern: "("}}); err == nil {
+		t.Error("stored a challenge with an invalid subject pattern")
+	}
+}
+
+func TestExpiredChallenge(t *testing.T) {
+	db := createDepot(t)
+	put(t, db, "expired", &challenge.Challenge{Expires: time.Now().Add(-time.Minute), Uses: 1})
+	if ok, err := db.HasChallenge("expired"); err != nil || ok {
+		t.Errorf("expired challenge: have %v, %v", ok, err)
+	}
+	if get(t, db, "expired") != nil {
+		t.Error("expired challenge was not removed when it was used")
+	}
+
+	pw, err := db.NewChallenge(challenge.Options{TTL: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := db.HasChallenge(pw); err != nil || !ok {
+		t.Errorf("challenge within its TTL: have %v, %v", ok, err)
+	}
+}
+
+func TestPurge(t *testing.T) {
+	db := createDepot(t)
+	expiring, err := db.NewChallenge(challenge.Options{TTL: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lasting, err := db.SCEPChallenge()
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := db.Purge(time.Now().Add(2 * time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("purged %d challenges, want 1", n)
+	}
+	if get(t, db, expiring) != nil {
+		t.Error("purged challenge is still stored")
+	}
+	if get(t, db, lasting) == nil {
+		t.Error("challenge without TTL was purged")
+	}
+}
+
+func TestLegacyChallenge(t *testing.T) {
+	db := createDepot(t)
+	// older versions stored the challenge itself
+	err := db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(challengeBucket)).Put([]byte("legacy"), []byte("legacy"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := db.Purge(time.Now()); err != nil || n != 0 {
+		t.Errorf("purged legacy challenge: have %d, %v", n, err)
+	}
+	for _, want := range []bool{true, false} {
+		have, err := db.HasChallenge("legacy")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if have != want {
+			t.Errorf("have %v, want %v", have, want)
+		}
+	}
+}
+
+func put(t *testing.T, db *Depot, pw string, c *challenge.Challenge) {
+	t.Helper()
+	data, err := json.Marshal(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(challengeBucket)).Put([]byte(pw), data)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func get(t *testing.T, db *Depot, pw string) *challenge.Challenge {
+	t.Helper()
+	var c *challenge.Challenge
+	err := db.View(func(tx *bolt.Tx) error {
+		var err error
+		c, err = decodeChallenge(tx.Bucket([]byte(challengeBucket)).Get([]byte(pw)))
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func createDepot(t *testing.T) *Depot {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "bolt-challenge-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	db, err := bolt.Open(filepath.Join(dir, "challenges.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	d, err := NewBoltDepot(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
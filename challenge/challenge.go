@@ -1,8 +1,143 @@
 // Package challenge defines an interface for a dynamic challenge password cache.
 package challenge
 
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+)
+
 // Store is a dynamic challenge password cache.
 type Store interface {
 	SCEPChallenge() (string, error)
 	HasChallenge(pw string) (bool, error)
 }
+
+// BindingStore is a Store whose challenges may expire, be used several
+// times and be bound to the requests they can be used for. HasChallenge
+// uses a challenge for a Request without subject and profile.
+type BindingStore interface {
+	Store
+
+	// NewChallenge stores and returns a new random challenge.
+	NewChallenge(opts Options) (string, error)
+
+	// UseChallenge uses the challenge pw for r. It returns false if pw
+	// is not stored, has expired or is used up, and an error if r does
+	// not match the binding of the challenge, which is not used then.
+	UseChallenge(pw string, r Request) (bool, error)
+
+	// Purge removes the challenges which expired before now and
+	// returns how many it removed.
+	Purge(now time.Time) (int, error)
+}
+
+// Binding restricts the requests which a challenge can be used for.
+// Empty fields do not restrict them.
+type Binding struct {
+	CN string `json:"cn,omitempty"`
+
+	// SubjectPattern is a regular expression which the whole subject
+	// of the request, in RFC 4514 format, must match.
+	SubjectPattern string `json:"subject_pattern,omitempty"`
+
+	// Profile is the certificate profile the request must be issued with.
+	Profile string `json:"profile,omitempty"`
+}
+
+// Options configure a new challenge.
+type Options struct {
+	Binding
+	TTL  time.Duration // 0 for a challenge which does not expire
+	Uses int           // 0 for a challenge which can be used once
+
+	// Hex encodes the challenge in upper case hex, like NDES does,
+	// instead of base64.
+	Hex bool
+}
+
+// Challenge is a stored challenge.
+type Challenge struct {
+	Binding
+	Expires time.Time `json:"expires,omitempty"` // zero if the challenge does not expire
+	Uses    int       `json:"uses"`              // remaining uses
+}
+
+// Request describes a certificate request which uses a challenge.
+type Request struct {
+	CN      string
+	Subject string // RFC 4514
+	Profile string
+
+	// SANs requested in the CSR
+	DNSNames       []string
+	EmailAddresses []string
+	IPAddresses    []string
+	URIs           []string
+}
+
+// New returns a new random challenge and how to store it, or an error if
+// the options are not valid.
+func New(opts Options, now time.Time) (string, *Challenge, error) {
+	if opts.SubjectPattern != "" {
+		if _, err := subjectRegexp(opts.SubjectPattern); err != nil {
+			return "", nil, err
+		}
+	}
+	if opts.TTL < 0 || opts.Uses < 0 {
+		return "", nil, fmt.Errorf("invalid challenge TTL %s or uses %d", opts.TTL, opts.Uses)
+	}
+	key := make([]byte, 24)
+	if _, err := rand.Read(key); err != nil {
+		return "", nil, err
+	}
+	c := &Challenge{Binding: opts.Binding, Uses: opts.Uses}
+	if c.Uses == 0 {
+		c.Uses = 1
+	}
+	if opts.TTL > 0 {
+		c.Expires = now.Add(opts.TTL).UTC()
+	}
+	if opts.Hex {
+		return strings.ToUpper(hex.EncodeToString(key)), c, nil
+	}
+	return base64.StdEncoding.EncodeToString(key), c, nil
+}
+
+// Expired reports whether the challenge expired before now.
+func (c *Challenge) Expired(now time.Time) bool {
+	return !c.Expires.IsZero() && now.After(c.Expires)
+}
+
+// Check returns an error if r does not match the binding.
+func (b *Binding) Check(r Request) error {
+	if b.CN != "" && r.CN != b.CN {
+		return fmt.Errorf("challenge is bound to CN %q, not %q", b.CN, r.CN)
+	}
+	if b.SubjectPattern != "" {
+		re, err := subjectRegexp(b.SubjectPattern)
+		if err != nil {
+			return err
+		}
+		if !re.MatchString(r.Subject) {
+			return fmt.Errorf("subject %q does not match the challenge pattern %q", r.Subject, b.SubjectPattern)
+		}
+	}
+	if b.Profile != "" && r.Profile != b.Profile {
+		return fmt.Errorf("challenge is bound to profile %q, not %q", b.Profile, r.Profile)
+	}
+	return nil
+}
+
+// subjectRegexp compiles a subject pattern, which matches whole subjects.
+func subjectRegexp(pattern string) (*regexp.Regexp, error) {
+	re, err := regexp.Compile("^(?:" + pattern + ")$")
+	if err != nil {
+		return nil, fmt.Errorf("invalid subject pattern: %s", err)
+	}
+	return re, nil
+}
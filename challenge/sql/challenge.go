@@ -0,0 +1,123 @@
+// Package sql implements a dynamic challenge store on top of database/sql.
+package sql
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/syncsynchalt/scep/challenge"
+)
+
+// Store keeps challenge passwords in the scep_challenges table.
+type Store struct {
+	db *sql.DB
+}
+
+// expires is 0 for challenges which do not expire
+const schema = `CREATE TABLE IF NOT EXISTS scep_challenges (
+	challenge VARCHAR(64) PRIMARY KEY,
+	created BIGINT NOT NULL,
+	expires BIGINT NOT NULL DEFAULT 0,
+	uses INTEGER NOT NULL DEFAULT 1,
+	cn VARCHAR(255) NOT NULL DEFAULT '',
+	subject_pattern TEXT NOT NULL DEFAULT '',
+	profile VARCHAR(255) NOT NULL DEFAULT ''
+)`
+
+// NewStore creates the challenge table in db if it does not exist.
+func NewStore(db *sql.DB) (*Store, error) {
+	if _, err := db.Exec(schema); err != nil {
+		return nil, fmt.Errorf("create schema: %s", err)
+	}
+	return &Store{db: db}, nil
+}
+
+// SCEPChallenge stores and returns a new random challenge, which can be
+// used once.
+func (s *Store) SCEPChallenge() (string, error) {
+	return s.NewChallenge(challenge.Options{})
+}
+
+// NewChallenge stores and returns a new random challenge.
+func (s *Store) NewChallenge(opts challenge.Options) (string, error) {
+	now := time.Now()
+	pw, c, err := challenge.New(opts, now)
+	if err != nil {
+		return "", err
+	}
+	var expires int64
+	if !c.Expires.IsZero() {
+		expires = c.Expires.Unix()
+	}
+	_, err = s.db.Exec(`INSERT INTO scep_challenges (challenge, created, expires, uses, cn, subject_pattern, profile)
+		VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		pw, now.Unix(), expires, c.Uses, c.CN, c.SubjectPattern, c.Profile)
+	if err != nil {
+		return "", err
+	}
+	return pw, nil
+}
+
+// HasChallenge uses the challenge pw for a request without subject and
+// profile.
+func (s *Store) HasChallenge(pw string) (bool, error) {
+	return s.UseChallenge(pw, challenge.Request{})
+}
+
+// UseChallenge uses the challenge pw for r and removes it once it is
+// used up.
+func (s *Store) UseChallenge(pw string, r challenge.Request) (bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var c challenge.Challenge
+	var expires int64
+	err = tx.QueryRow(`SELECT expires, uses, cn, subject_pattern, profile FROM scep_challenges WHERE challenge = ?`, pw).
+		Scan(&expires, &c.Uses, &c.CN, &c.SubjectPattern, &c.Profile)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if expires != 0 {
+		c.Expires = time.Unix(expires, 0)
+	}
+	if c.Expired(time.Now()) {
+		if _, err := tx.Exec(`DELETE FROM scep_challenges WHERE challenge = ?`, pw); err != nil {
+			return false, err
+		}
+		return false, tx.Commit()
+	}
+	if err := c.Check(r); err != nil {
+		return false, err
+	}
+	// the condition on uses keeps concurrent requests from using more
+	// than the remaining uses
+	res, err := tx.Exec(`UPDATE scep_challenges SET uses = uses - 1 WHERE challenge = ? AND uses > 0`, pw)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil || n == 0 {
+		return false, err
+	}
+	if _, err := tx.Exec(`DELETE FROM scep_challenges WHERE challenge = ? AND uses <= 0`, pw); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// Purge removes the challenges which expired before now.
+func (s *Store) Purge(now time.Time) (int, error) {
+	res, err := s.db.Exec(`DELETE FROM scep_challenges WHERE expires != 0 AND expires < ?`, now.Unix())
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
@@ -0,0 +1,100 @@
+package sql
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/syncsynchalt/scep/challenge"
+)
+
+func TestChallenge(t *testing.T) {
+	store := createStore(t)
+
+	challenge, err := store.SCEPChallenge()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []bool{true, false} {
+		have, err := store.HasChallenge(challenge)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if have != want {
+			t.Errorf("have %v, want %v", have, want)
+		}
+	}
+	if ok, err := store.HasChallenge("unknown"); err != nil || ok {
+		t.Errorf("unknown challenge: have %v, %v", ok, err)
+	}
+}
+
+func TestBoundChallenge(t *testing.T) {
+	store := createStore(t)
+	pw, err := store.NewChallenge(challenge.Options{
+		Binding: challenge.Binding{CN: "device", SubjectPattern: "CN=device,O=acme"},
+		Uses:    2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := challenge.Request{CN: "device", Subject: "CN=device,O=acme"}
+	if ok, err := store.UseChallenge(pw, challenge.Request{CN: "device", Subject: "CN=device,O=other"}); err == nil || ok {
+		t.Errorf("subject outside of the pattern: have %v, %v", ok, err)
+	}
+	for _, want := range []bool{true, true, false} {
+		have, err := store.UseChallenge(pw, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if have != want {
+			t.Errorf("have %v, want %v", have, want)
+		}
+	}
+
+	if _, err := store.NewChallenge(challenge.Options{Binding: challenge.Binding{SubjectPattern: "("}}); err == nil {
+		t.Error("stored a challenge with an invalid subject pattern")
+	}
+}
+
+func TestPurge(t *testing.T) {
+	store := createStore(t)
+	expiring, err := store.NewChallenge(challenge.Options{TTL: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lasting, err := store.SCEPChallenge()
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := store.Purge(time.Now().Add(2 * time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("purged %d challenges, want 1", n)
+	}
+	if ok, _ := store.HasChallenge(expiring); ok {
+		t.Error("purged challenge is still stored")
+	}
+	if ok, _ := store.HasChallenge(lasting); !ok {
+		t.Error("challenge without TTL was purged")
+	}
+}
+
+func createStore(t *testing.T) *Store {
+	t.Helper()
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	// every connection has its own in-memory database
+	db.SetMaxOpenConns(1)
+	store, err := NewStore(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
@@ -0,0 +1,319 @@
+// Package token implements a dynamic challenge store which verifies
+// signed, self-contained challenge passwords instead of looking them up,
+// so that challenges can be issued without a database shared with the
+// server.
+//
+// A token is its JSON encoded claims and the HMAC-SHA256 of the encoded
+// claims with the shared secret, truncated to 16 bytes, both base64url
+// encoded without padding:
+//
+//	base64url(claims) "." base64url(HMAC-SHA256(secret, base64url(claims))[:16])
+//
+// For example, the claims
+//
+//	{"cn":"device-42","exp":1700000000,"nonce":"GQ9vvyYFt8TlJ2cP","dns":["device-42.example.com"]}
+//
+// make a token which can be used once before the Unix time exp, by a
+// request with CN device-42 which asks for no other DNS name.
+//
+// Single use is only enforced within one Store: the nonces of used tokens
+// are kept in memory until the tokens expire. They are lost when the
+// process restarts, and neither servers nor Stores share them, so each
+// accepts a token for its uses. Services which must not accept the same
+// token need secrets of their own.
+package token
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/syncsynchalt/scep/challenge"
+)
+
+// MaxLength is the longest challenge password a CSR can hold.
+const MaxLength = 255
+
+// macLength is the length of the truncated HMAC of a token.
+const macLength = 16
+
+// Claims are the constraints signed into a token. Empty SAN lists do not
+// restrict the SANs of requests.
+type Claims struct {
+	challenge.Binding
+
+	Expires int64  `json:"exp"`            // Unix time, required
+	Nonce   string `json:"nonce"`          // required, unique for each token
+	Uses    int    `json:"uses,omitempty"` // 0 for a token which can be used once
+
+	// SANs which requests may ask for
+	DNSNames       []string `json:"dns,omitempty"`
+	EmailAddresses []string `json:"email,omitempty"`
+	IPAddresses    []string `json:"ip,omitempty"`
+	URIs           []string `json:"uri,omitempty"`
+}
+
+// Store verifies tokens signed with a shared secret. It implements
+// challenge.BindingStore.
+type Store struct {
+	secret    []byte
+	ttl       time.Duration
+	cacheSize int
+
+	mtx  sync.Mutex
+	used map[string]*usedNonce
+}
+
+type usedNonce struct {
+	expires time.Time
+	uses    int // remaining uses
+}
+
+// Option configures a Store.
+type Option func(*Store)
+
+// WithTTL sets the lifetime of tokens created without a TTL. The default
+// is one hour.
+func WithTTL(ttl time.Duration) Option {
+	return func(s *Store) {
+		s.ttl = ttl
+	}
+}
+
+// WithCacheSize sets how many unexpired used tokens the store keeps track
+// of. Once that many are kept, further tokens are refused until some
+// expire. The default is 100000.
+func WithCacheSize(n int) Option {
+	return func(s *Store) {
+		s.cacheSize = n
+	}
+}
+
+// NewStore creates a store for tokens signed with secret.
+func NewStore(secret []byte, opts ...Option) (*Store, error) {
+	if len(secret) < 16 {
+		return nil, errors.New("the token secret must be at least 16 bytes long")
+	}
+	s := &Store{
+		secret:    secret,
+		ttl:       time.Hour,
+		cacheSize: 100000,
+		used:      make(map[string]*usedNonce),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.ttl <= 0 {
+		return nil, fmt.Errorf("invalid token TTL %s", s.ttl)
+	}
+	return s, nil
+}
+
+// SCEPChallenge returns a new token, which can be used once.
+func (s *Store) SCEPChallenge() (string, error) {
+	return s.NewChallenge(challenge.Options{})
+}
+
+// NewChallenge returns a new token. It expires after the TTL of the store
+// if opts has none.
+func (s *Store) NewChallenge(opts challenge.Options) (string, error) {
+	c, err := s.NewClaims(opts)
+	if err != nil {
+		return "", err
+	}
+	return s.Sign(c)
+}
+
+// NewClaims returns the claims of a new token with opts, which can be
+// restricted further before they are signed.
+func (s *Store) NewClaims(opts challenge.Options) (*Claims, error) {
+	if opts.TTL == 0 {
+		opts.TTL = s.ttl
+	}
+	_, c, err := challenge.New(opts, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	// a shorter nonce than a stored challenge leaves room for claims
+	nonce := make([]byte, 12)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	claims := &Claims{
+		Binding: c.Binding,
+		Expires: c.Expires.Unix(),
+		Nonce:   base64.RawURLEncoding.EncodeToString(nonce),
+	}
+	if c.Uses > 1 {
+		claims.Uses = c.Uses
+	}
+	return claims, nil
+}
+
+// Sign returns the token for c.
+func (s *Store) Sign(c *Claims) (string, error) {
+	if c.Expires == 0 || c.Nonce == "" {
+		return "", errors.New("token claims need an expiry and a nonce")
+	}
+	data, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	token := payload + "." + base64.RawURLEncoding.EncodeToString(s.mac(payload))
+	if len(token) > MaxLength {
+		return "", fmt.Errorf("token is %d characters long, a CSR holds at most %d", len(token), MaxLength)
+	}
+	return token, nil
+}
+
+// HasChallenge uses the token pw for a request without subject and
+// profile.
+func (s *Store) HasChallenge(pw string) (bool, error) {
+	return s.UseChallenge(pw, challenge.Request{})
+}
+
+// UseChallenge uses the token pw for r. It returns false if pw is not a
+// valid token, has expired or has been used up in this Store.
+func (s *Store) UseChallenge(pw string, r challenge.Request) (bool, error) {
+	c, ok := s.verify(pw)
+	if !ok {
+		return false, nil
+	}
+	now := time.Now()
+	expires := time.Unix(c.Expires, 0)
+	if now.After(expires) {
+		return false, nil
+	}
+	if err := c.check(r); err != nil {
+		return false, err
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	u, ok := s.used[c.Nonce]
+	if !ok {
+		if len(s.used) >= s.cacheSize {
+			s.purge(now)
+		}
+		if len(s.used) >= s.cacheSize {
+			return false, errors.New("too many used tokens are unexpired")
+		}
+		u = &usedNonce{expires: expires, uses: c.Uses}
+		if u.uses == 0 {
+			u.uses = 1
+		}
+		s.used[c.Nonce] = u
+	}
+	if u.uses == 0 {
+		return false, nil
+	}
+	u.uses--
+	return true, nil
+}
+
+// Purge forgets the used tokens which expired before now.
+func (s *Store) Purge(now time.Time) (int, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.purge(now), nil
+}
+
+func (s *Store) purge(now time.Time) int {
+	var n int
+	for nonce, u := range s.used {
+		if now.After(u.expires) {
+			delete(s.used, nonce)
+			n++
+		}
+	}
+	return n
+}
+
+// verify returns the claims of pw if it is signed with the secret.
+func (s *Store) verify(pw string) (*Claims, bool) {
+	i := strings.LastIndexByte(pw, '.')
+	if i < 0 {
+		return nil, false
+	}
+	payload := pw[:i]
+	mac, err := base64.RawURLEncoding.DecodeString(pw[i+1:])
+	if err != nil || !hmac.Equal(mac, s.mac(payload)) {
+		return nil, false
+	}
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, false
+	}
+	c := new(Claims)
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, false
+	}
+	if c.Expires == 0 || c.Nonce == "" || c.Uses < 0 {
+		return nil, false
+	}
+	return c, true
+}
+
+func (s *Store) mac(payload string) []byte {
+	h := hmac.New(sha256.New, s.secret)
+	h.Write([]byte(payload))
+	return h.Sum(nil)[:macLength]
+}
+
+// check returns an error if r does not match the binding or asks for SANs
+// which the claims do not allow.
+func (c *Claims) check(r challenge.Request) error {
+	if err := c.Binding.Check(r); err != nil {
+		return err
+	}
+	for _, san := range []struct {
+		kind               string
+		allowed, requested []string
+	}{
+		{"DNS name", c.DNSNames, r.DNSNames},
+		{"email address", c.EmailAddresses, r.EmailAddresses},
+		{"IP address", normalizeIPs(c.IPAddresses), normalizeIPs(r.IPAddresses)},
+		{"URI", c.URIs, r.URIs},
+	} {
+		if len(san.allowed) == 0 {
+			continue
+		}
+		for _, name := range san.requested {
+			if !contains(san.allowed, name) {
+				return fmt.Errorf("challenge does not allow the %s %q", san.kind, name)
+			}
+		}
+	}
+	return nil
+}
+
+// normalizeIPs formats IP addresses the same way, so that they can be
+// compared as strings.
+func normalizeIPs(ips []string) []string {
+	normalized := make([]string, len(ips))
+	for i, s := range ips {
+		normalized[i] = s
+		if ip := net.ParseIP(s); ip != nil {
+			normalized[i] = ip.String()
+		}
+	}
+	return normalized
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
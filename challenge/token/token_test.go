@@ -0,0 +1,145 @@
+package token
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/syncsynchalt/scep/challenge"
+)
+
+var secret = []byte("0123456789abcdef0123456789abcdef")
+
+func TestToken(t *testing.T) {
+	store, err := NewStore(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := store.SCEPChallenge()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []bool{true, false} {
+		have, err := store.HasChallenge(token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if have != want {
+			t.Errorf("have %v, want %v", have, want)
+		}
+	}
+
+	// another server with the same secret has not seen the token
+	other, err := NewStore(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := other.HasChallenge(token); err != nil || !ok {
+		t.Errorf("token from another store: have %v, %v", ok, err)
+	}
+
+	wrong, err := NewStore([]byte("fedcba9876543210fedcba9876543210"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fresh, err := wrong.SCEPChallenge()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, pw := range []string{fresh, "unknown", "a.b", token[:len(token)-2]} {
+		if ok, err := store.HasChallenge(pw); err != nil || ok {
+			t.Errorf("%q: have %v, %v", pw, ok, err)
+		}
+	}
+
+	if _, err := NewStore([]byte("short")); err == nil {
+		t.Error("created a store with a short secret")
+	}
+}
+
+func TestTokenClaims(t *testing.T) {
+	store, err := NewStore(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err := store.NewClaims(challenge.Options{
+		Binding: challenge.Binding{CN: "device", SubjectPattern: "CN=device,O=acme"},
+		Uses:    2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims.DNSNames = []string{"device.example.com"}
+	claims.IPAddresses = []string{"2001:db8::1"}
+	token, err := store.Sign(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := challenge.Request{
+		CN:          "device",
+		Subject:     "CN=device,O=acme",
+		DNSNames:    []string{"device.example.com"},
+		IPAddresses: []string{"2001:0db8:0:0:0:0:0:1"},
+	}
+	for _, bad := range []challenge.Request{
+		{CN: "other", Subject: "CN=other,O=acme"},
+		{CN: "device", Subject: "CN=device,O=other"},
+		{CN: "device", Subject: "CN=device,O=acme", DNSNames: []string{"other.example.com"}},
+		{CN: "device", Subject: "CN=device,O=acme", IPAddresses: []string{"192.0.2.1"}},
+	} {
+		if ok, err := store.UseChallenge(token, bad); err == nil || ok {
+			t.Errorf("%+v: have %v, %v", bad, ok, err)
+		}
+	}
+	for _, want := range []bool{true, true, false} {
+		have, err := store.UseChallenge(token, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if have != want {
+			t.Errorf("have %v, want %v", have, want)
+		}
+	}
+
+	claims.SubjectPattern = strings.Repeat("x", MaxLength)
+	if _, err := store.Sign(claims); err == nil {
+		t.Error("signed a token which does not fit in a CSR")
+	}
+}
+
+func TestTokenExpiry(t *testing.T) {
+	store, err := NewStore(secret, WithCacheSize(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, err := store.Sign(&Claims{Expires: time.Now().Add(-time.Minute).Unix(), Nonce: "expired"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := store.HasChallenge(expired); err != nil || ok {
+		t.Errorf("expired token: have %v, %v", ok, err)
+	}
+
+	first, err := store.SCEPChallenge()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := store.SCEPChallenge()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := store.HasChallenge(first); err != nil || !ok {
+		t.Fatalf("first token: have %v, %v", ok, err)
+	}
+	if ok, err := store.HasChallenge(second); err == nil || ok {
+		t.Errorf("token beyond the cache size: have %v, %v", ok, err)
+	}
+	n, err := store.Purge(time.Now().Add(2 * time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("purged %d tokens, want 1", n)
+	}
+}
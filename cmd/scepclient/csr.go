@@ -1,8 +1,8 @@
 package main
 
 import (
+	"crypto"
 	"crypto/rand"
-	"crypto/rsa"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/asn1"
@@ -20,7 +20,7 @@ const (
 
 type csrOptions struct {
 	cn, emailAddress, org, country, ou, locality, province, challenge string
-	key                                                               *rsa.PrivateKey
+	key                                                               crypto.Signer
 	sigAlgo                                                           x509.SignatureAlgorithm
 }
 
@@ -1,17 +1,22 @@
 package main
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
 	"encoding/pem"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"os"
 )
 
 const (
 	rsaPrivateKeyPEMBlockType = "RSA PRIVATE KEY"
+	ecPrivateKeyPEMBlockType  = "EC PRIVATE KEY"
 )
 
 // create a new RSA private key
@@ -23,8 +28,22 @@ func newRSAKey(bits int) (*rsa.PrivateKey, error) {
 	return private, nil
 }
 
+// create a new private key of type rsa, p256 or p384
+func newKey(keyType string, rsaBits int) (crypto.Signer, error) {
+	switch keyType {
+	case "rsa":
+		return newRSAKey(rsaBits)
+	case "p256":
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case "p384":
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	default:
+		return nil, fmt.Errorf("unknown key type %q", keyType)
+	}
+}
+
 // load key if it exists or create a new one
-func loadOrMakeKey(path string, rsaBits int) (*rsa.PrivateKey, error) {
+func loadOrMakeKey(path string, keyType string, rsaBits int) (crypto.Signer, error) {
 	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
 	if err != nil {
 		if os.IsExist(err) {
@@ -35,15 +54,22 @@ func loadOrMakeKey(path string, rsaBits int) (*rsa.PrivateKey, error) {
 	defer file.Close()
 
 	// write key
-	priv, err := newRSAKey(rsaBits)
+	priv, err := newKey(keyType, rsaBits)
 	if err != nil {
+		os.Remove(path)
 		return nil, err
 	}
-	privBytes := x509.MarshalPKCS1PrivateKey(priv)
-	pemBlock := &pem.Block{
-		Type:    rsaPrivateKeyPEMBlockType,
-		Headers: nil,
-		Bytes:   privBytes,
+	pemBlock := &pem.Block{}
+	switch priv := priv.(type) {
+	case *rsa.PrivateKey:
+		pemBlock.Type = rsaPrivateKeyPEMBlockType
+		pemBlock.Bytes = x509.MarshalPKCS1PrivateKey(priv)
+	case *ecdsa.PrivateKey:
+		pemBlock.Type = ecPrivateKeyPEMBlockType
+		pemBlock.Bytes, err = x509.MarshalECPrivateKey(priv)
+		if err != nil {
+			return nil, err
+		}
 	}
 	if err = pem.Encode(file, pemBlock); err != nil {
 		return nil, err
@@ -52,7 +78,7 @@ func loadOrMakeKey(path string, rsaBits int) (*rsa.PrivateKey, error) {
 }
 
 // load a PEM private key from disk
-func loadKeyFromFile(path string) (*rsa.PrivateKey, error) {
+func loadKeyFromFile(path string) (crypto.Signer, error) {
 	data, err := ioutil.ReadFile(path)
 	if err != nil {
 		return nil, err
@@ -62,9 +88,12 @@ func loadKeyFromFile(path string) (*rsa.PrivateKey, error) {
 	if pemBlock == nil {
 		return nil, errors.New("PEM decode failed")
 	}
-	if pemBlock.Type != rsaPrivateKeyPEMBlockType {
+	switch pemBlock.Type {
+	case rsaPrivateKeyPEMBlockType:
+		return x509.ParsePKCS1PrivateKey(pemBlock.Bytes)
+	case ecPrivateKeyPEMBlockType:
+		return x509.ParseECPrivateKey(pemBlock.Bytes)
+	default:
 		return nil, errors.New("unmatched type or headers")
 	}
-
-	return x509.ParsePKCS1PrivateKey(pemBlock.Bytes)
 }
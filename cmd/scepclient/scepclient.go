@@ -2,7 +2,9 @@ package main
 
 import (
 	"context"
+	"crypto"
 	"crypto/md5"
+	"crypto/rsa"
 	"crypto/x509"
 	"flag"
 	"fmt"
@@ -33,6 +35,7 @@ type runCfg struct {
 	csrPath      string
 	keyPath      string
 	keyBits      int
+	keyType      string
 	selfSignPath string
 	certPath     string
 	cn           string
@@ -71,16 +74,20 @@ func run(cfg runCfg) error {
 		return err
 	}
 
-	sigAlgo := x509.SHA1WithRSA
-	if client.Supports("SHA-256") || client.Supports("SCEPStandard") {
-		sigAlgo = x509.SHA256WithRSA
-	}
-
-	key, err := loadOrMakeKey(cfg.keyPath, cfg.keyBits)
+	key, err := loadOrMakeKey(cfg.keyPath, cfg.keyType, cfg.keyBits)
 	if err != nil {
 		return err
 	}
 
+	// ECDSA keys use the default hash for their curve
+	var sigAlgo x509.SignatureAlgorithm
+	if _, ok := key.(*rsa.PrivateKey); ok {
+		sigAlgo = x509.SHA1WithRSA
+		if client.Supports("SHA-256") || client.Supports("SCEPStandard") {
+			sigAlgo = x509.SHA256WithRSA
+		}
+	}
+
 	opts := &csrOptions{
 		cn:           cfg.cn,
 		emailAddress: cfg.emailAddress,
@@ -178,6 +185,22 @@ func run(cfg runCfg) error {
 		SCEPEncryptionAlgorithm: algo,
 	}
 
+	// The response is encrypted with RSA key transport. If our key can't
+	// decrypt it, ask the server to encrypt to a temporary RSA certificate.
+	decryptCert, decryptKey := signerCert, crypto.PrivateKey(key)
+	if _, ok := key.(*rsa.PrivateKey); !ok {
+		transportKey, err := newRSAKey(2048)
+		if err != nil {
+			return err
+		}
+		transportCert, err := selfSign(transportKey, csr)
+		if err != nil {
+			return err
+		}
+		tmpl.EncryptionCert = transportCert
+		decryptCert, decryptKey = transportCert, transportKey
+	}
+
 	if cfg.challenge != "" && msgType == scep.PKCSReq {
 		tmpl.CSRReqMessage = &scep.CSRReqMessage{
 			ChallengePassword: cfg.challenge,
@@ -197,27 +220,35 @@ func run(cfg runCfg) error {
 
 		respBytes, err := client.PKIOperation(ctx, msg.Raw)
 		if err != nil {
-			return errors.Wrapf(err, "PKIOperation for %s", msgType)
+			return errors.Wrapf(err, "PKIOperation for %s", msg.MessageType)
 		}
 
 		respMsg, err = scep.ParsePKIMessage(respBytes, scep.WithLogger(logger))
 		if err != nil {
-			return errors.Wrapf(err, "parsing pkiMessage response %s", msgType)
+			return errors.Wrapf(err, "parsing pkiMessage response %s", msg.MessageType)
 		}
 
 		switch respMsg.PKIStatus {
 		case scep.FAILURE:
-			return errors.Errorf("%s request failed, failInfo: %s", msgType, respMsg.FailInfo)
+			return errors.Errorf("%s request failed, failInfo: %s", msg.MessageType, respMsg.FailInfo)
 		case scep.PENDING:
-			lginfo.Log("pkiStatus", "PENDING", "msg", "sleeping for 30 seconds, then trying again.")
+			lginfo.Log("pkiStatus", "PENDING", "msg", "sleeping for 30 seconds, then polling.")
 			time.Sleep(30 * time.Second)
+			if msg.MessageType != scep.CertPoll {
+				// poll for the pending request using the original transaction ID
+				tmpl.TransactionID = msg.TransactionID
+				msg, err = scep.NewCertPollRequest(csr, issuerCert(certs), tmpl, scep.WithLogger(logger))
+				if err != nil {
+					return errors.Wrap(err, "creating CertPoll pkiMessage")
+				}
+			}
 			continue
 		}
 		lginfo.Log("pkiStatus", "SUCCESS", "msg", "server returned a certificate.")
 		break // on scep.SUCCESS
 	}
 
-	if err := respMsg.DecryptPKIEnvelope(signerCert, key); err != nil {
+	if err := respMsg.DecryptPKIEnvelope(decryptCert, decryptKey); err != nil {
 		return errors.Wrapf(err, "decrypt pkiEnvelope, msgType: %s, status %s", msgType, respMsg.PKIStatus)
 	}
 
@@ -236,6 +267,17 @@ func run(cfg runCfg) error {
 	return nil
 }
 
+// Pick the CA certificate which issues our certificate from the
+// GetCACert response. Intermediates and RA certificates may be included.
+func issuerCert(certs []*x509.Certificate) *x509.Certificate {
+	for _, cert := range certs {
+		if cert.IsCA {
+			return cert
+		}
+	}
+	return certs[0]
+}
+
 // Determine the correct recipient based on the fingerprint.
 // In case of NDES that is the last certificate in the chain, not the RA cert.
 // Return a full chain starting with the cert that matches the fingerprint.
@@ -273,6 +315,7 @@ func main() {
 		flPKeyPath          = flag.String("private-key", "", "private key path, if there is no key, scepclient will create one")
 		flCertPath          = flag.String("certificate", "", "certificate path, if there is no key, scepclient will create one")
 		flKeySize           = flag.Int("keySize", 2048, "rsa key size")
+		flKeyType           = flag.String("key-type", "rsa", "type of a newly created private key: rsa, p256 or p384")
 		flOrg               = flag.String("organization", "scep-client", "organization for cert")
 		flCName             = flag.String("cn", "scepclient", "common name for certificate")
 		flEmailAddress      = flag.String("email-address", "", "emailAddress for certificate")
@@ -318,6 +361,7 @@ func main() {
 		csrPath:      csrPath,
 		keyPath:      *flPKeyPath,
 		keyBits:      *flKeySize,
+		keyType:      *flKeyType,
 		selfSignPath: selfSignPath,
 		certPath:     *flCertPath,
 		cn:           *flCName,
@@ -11,7 +11,7 @@ mkdir -p ${OUTPUT}
 build() {
   set -e
   echo -n "=> $1-$2: "
-  GOOS=$1 GOARCH=$2 go build -o ${OUTPUT}/$NAME-$1-$2 -ldflags "-X main.version=$VERSION -X main.gitHash=`git rev-parse HEAD`" ./*.go
+  GOOS=$1 GOARCH=$2 go build -o ${OUTPUT}/$NAME-$1-$2 -ldflags "-X main.version=$VERSION -X main.gitHash=`git rev-parse HEAD`" .
   du -h ${OUTPUT}/${NAME}-$1-$2
   set +e
 }
@@ -2,40 +2,59 @@ package main
 
 import (
 	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha1"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/asn1"
+	"encoding/json"
 	"encoding/pem"
 	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"math/big"
 	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
+	"github.com/boltdb/bolt"
 	"github.com/go-kit/kit/log"
 	"github.com/go-kit/kit/log/level"
-	"github.com/syncsynchalt/scep/cachooser"
 	"github.com/syncsynchalt/scep/cachooser/executable"
-	"github.com/syncsynchalt/scep/certfailer"
+	"github.com/syncsynchalt/scep/cachooser/webhook"
 	"github.com/syncsynchalt/scep/certfailer/executable"
-	"github.com/syncsynchalt/scep/certsuccesser"
+	"github.com/syncsynchalt/scep/certfailer/webhook"
 	"github.com/syncsynchalt/scep/certsuccesser/executable"
-	"github.com/syncsynchalt/scep/csrverifier"
+	"github.com/syncsynchalt/scep/certsuccesser/webhook"
+	"github.com/syncsynchalt/scep/challenge"
+	"github.com/syncsynchalt/scep/challenge/bolt"
+	sqlchallenge "github.com/syncsynchalt/scep/challenge/sql"
+	"github.com/syncsynchalt/scep/challenge/token"
 	"github.com/syncsynchalt/scep/csrverifier/executable"
+	"github.com/syncsynchalt/scep/csrverifier/webhook"
 	"github.com/syncsynchalt/scep/depot"
+	"github.com/syncsynchalt/scep/depot/archive"
+	boltdepot "github.com/syncsynchalt/scep/depot/bolt"
 	"github.com/syncsynchalt/scep/depot/file"
+	sqldepot "github.com/syncsynchalt/scep/depot/sql"
+	"github.com/syncsynchalt/scep/keyprovider"
+	"github.com/syncsynchalt/scep/keyprovider/pkcs11"
+	"github.com/syncsynchalt/scep/profilechooser/executable"
+	"github.com/syncsynchalt/scep/profilechooser/webhook"
 	"github.com/syncsynchalt/scep/server"
-	"github.com/syncsynchalt/scep/subjectfilter"
 	"github.com/syncsynchalt/scep/subjectfilter/executable"
+	"github.com/syncsynchalt/scep/subjectfilter/webhook"
+	"github.com/syncsynchalt/scep/webhook"
 )
 
 // version info
@@ -46,37 +65,49 @@ var (
 
 func main() {
 	var caCMD = flag.NewFlagSet("ca", flag.ExitOnError)
+	var pendingCMD = flag.NewFlagSet("pending", flag.ExitOnError)
+	var challengeCMD = flag.NewFlagSet("challenge", flag.ExitOnError)
+	var depotCMD = flag.NewFlagSet("depot", flag.ExitOnError)
 	{
 		if len(os.Args) >= 2 {
 			if os.Args[1] == "ca" {
 				status := caMain(caCMD)
 				os.Exit(status)
 			}
+			if os.Args[1] == "pending" {
+				status := pendingMain(pendingCMD)
+				os.Exit(status)
+			}
+			if os.Args[1] == "challenge" {
+				status := challengeMain(challengeCMD)
+				os.Exit(status)
+			}
+			if os.Args[1] == "depot" {
+				status := depotMain(depotCMD)
+				os.Exit(status)
+			}
 		}
 	}
 
 	//main flags
 	var (
-		flVersion           = flag.Bool("version", false, "prints version information")
-		flPort              = flag.String("port", envString("SCEP_HTTP_LISTEN_PORT", "8080"), "port to listen on")
-		flDepotPath         = flag.String("depot", envString("SCEP_FILE_DEPOT", "depot"), "path to ca folder")
-		flCAPass            = flag.String("capass", envString("SCEP_CA_PASS", ""), "passwd for the ca.key")
-		flClDuration        = flag.String("crtvalid", envString("SCEP_CERT_VALID", "365"), "validity for new client certificates in days")
-		flClAllowRenewal    = flag.String("allowrenew", envString("SCEP_CERT_RENEW", "14"), "do not allow renewal until n days before expiry, set to 0 to always allow")
-		flChallengePassword = flag.String("challenge", envString("SCEP_CHALLENGE_PASSWORD", ""), "enforce a challenge password")
-		flCSRVerifierExec   = flag.String("csrverifierexec", envString("SCEP_CSR_VERIFIER_EXEC", ""), "will be passed the CSRs for verification")
-		flCertSuccesserExec = flag.String("certsuccesserexec", envString("SCEP_CERT_SUCCESSER_EXEC", ""), "will be passed the certs on successful generation")
-		flCertFailerExec    = flag.String("certfailerexec", envString("SCEP_CERT_FAILER_EXEC", ""), "will be called for failure to generate cert")
-		flCAChooserExec     = flag.String("cachooserexec", envString("SCEP_CA_CHOOSER_EXEC", ""), "will be called to select/create the CA to sign each cert")
-		flSubjectFilterExec = flag.String("subjectfilterexec", envString("SCEP_SUBJECT_FILTER_EXEC", ""), "will be called to modify the subject to be signed")
-		flDebug             = flag.Bool("debug", envBool("SCEP_LOG_DEBUG"), "enable debug logging")
-		flLogJSON           = flag.Bool("log-json", envBool("SCEP_LOG_JSON"), "output JSON logs")
+		flVersion = flag.Bool("version", false, "prints version information")
+		flPort    = flag.String("port", envString("SCEP_HTTP_LISTEN_PORT", "8080"), "port to listen on")
+		flTenants = flag.String("tenants", envString("SCEP_TENANTS", ""), "JSON file with additional tenants, served at /scep/{name}")
+		flDebug   = flag.Bool("debug", envBool("SCEP_LOG_DEBUG"), "enable debug logging")
+		flLogJSON = flag.Bool("log-json", envBool("SCEP_LOG_JSON"), "output JSON logs")
+
+		flService = serviceFlags(flag.CommandLine)
+		flPKCS11  = pkcs11Flags(flag.CommandLine)
 	)
 	flag.Usage = func() {
 		flag.PrintDefaults()
 
 		fmt.Println("usage: scep [<command>] [<args>]")
 		fmt.Println(" ca <args> create/manage a CA")
+		fmt.Println(" pending <args> list/approve/reject pending requests")
+		fmt.Println(" challenge <args> create dynamic challenge passwords")
+		fmt.Println(" depot <args> export/import/verify a depot archive")
 		fmt.Println("type <command> --help to see usage for each subcommand")
 	}
 	flag.Parse()
@@ -105,100 +136,66 @@ func main() {
 	}
 	lginfo := level.Info(logger)
 
-	var err error
-	var depot depot.Depot // cert storage
-	{
-		depot, err = file.NewFileDepot(*flDepotPath)
-		if err != nil {
-			lginfo.Log("err", err)
+	var keyProvider keyprovider.KeyProvider
+	if flPKCS11.Module != "" {
+		if *flTenants != "" {
+			// each tenant signs with the CA key in its own depot
+			lginfo.Log("err", "-pkcs11-module can not be used with -tenants")
 			os.Exit(1)
 		}
-	}
-	allowRenewal, err := strconv.Atoi(*flClAllowRenewal)
-	if err != nil {
-		lginfo.Log("err", err, "msg", "No valid number for allowed renewal time")
-		os.Exit(1)
-	}
-	clientValidity, err := strconv.Atoi(*flClDuration)
-	if err != nil {
-		lginfo.Log("err", err, "msg", "No valid number for client cert validity")
-		os.Exit(1)
-	}
-	var csrVerifier csrverifier.CSRVerifier
-	if *flCSRVerifierExec > "" {
-		executableCSRVerifier, err := executablecsrverifier.New(*flCSRVerifierExec, lginfo)
-		if err != nil {
-			lginfo.Log("err", err, "msg", "Could not instantiate CSR verifier")
-			os.Exit(1)
-		}
-		csrVerifier = executableCSRVerifier
-	}
-	var certSuccesser certsuccesser.CertSuccesser
-	if *flCertSuccesserExec > "" {
-		executableCertSuccesser, err := executablecertsuccesser.New(*flCertSuccesserExec, lginfo)
-		if err != nil {
-			lginfo.Log("err", err, "msg", "Could not instantiate cert successer")
-			os.Exit(1)
-		}
-		certSuccesser = executableCertSuccesser
-	}
-	var certFailer certfailer.CertFailer
-	if *flCertFailerExec > "" {
-		executableCertFailer, err := executablecertfailer.New(*flCertFailerExec, lginfo)
+		pkcs11Provider, err := pkcs11keyprovider.New(*flPKCS11)
 		if err != nil {
-			lginfo.Log("err", err, "msg", "Could not instantiate cert failer")
+			lginfo.Log("err", err, "msg", "Could not open PKCS#11 token")
 			os.Exit(1)
 		}
-		certFailer = executableCertFailer
+		defer pkcs11Provider.Close()
+		keyProvider = pkcs11Provider
 	}
-	var caChooser cachooser.CAChooser
-	if *flCAChooserExec > "" {
-		executableCAChooser, err := executablecachooser.New(*flCAChooserExec, lginfo)
+
+	mux := http.NewServeMux()
+	var tenants []scepserver.Tenant
+	if *flTenants != "" {
+		configs, err := tenantConfigs(*flTenants, *flService)
 		if err != nil {
-			lginfo.Log("err", err, "msg", "Could not instantiate ca chooser")
+			lginfo.Log("err", err, "msg", "Could not read tenants")
 			os.Exit(1)
 		}
-		caChooser = executableCAChooser
-	}
-	var subjectFilter subjectfilter.SubjectFilter
-	if *flSubjectFilterExec > "" {
-		executableSubjectFilter, err := executablesubjectfilter.New(*flSubjectFilterExec, lginfo)
-		if err != nil {
-			lginfo.Log("err", err, "msg", "Could not instantiate subject filter")
-			os.Exit(1)
+		for _, config := range configs {
+			tenantLogger := log.With(logger, "tenant", config.Name)
+			svc, challenges, err := newService(config, nil, tenantLogger)
+			if err != nil {
+				lginfo.Log("err", err, "tenant", config.Name)
+				os.Exit(1)
+			}
+			if err := mountChallengeAdmin(mux, config, svc, challenges, level.Info(tenantLogger)); err != nil {
+				lginfo.Log("err", err, "tenant", config.Name)
+				os.Exit(1)
+			}
+			tenants = append(tenants, scepserver.Tenant{
+				Name:      config.Name,
+				Endpoints: makeEndpoints(svc, level.Info(tenantLogger)),
+				Service:   svc,
+			})
 		}
-		subjectFilter = executableSubjectFilter
 	}
 
-	var svc scepserver.Service // scep service
-	{
-		svcOptions := []scepserver.ServiceOption{
-			scepserver.ChallengePassword(*flChallengePassword),
-			scepserver.WithCSRVerifier(csrVerifier),
-			scepserver.WithCertSuccesser(certSuccesser),
-			scepserver.WithCertFailer(certFailer),
-			scepserver.WithCAChooser(caChooser),
-			scepserver.WithSubjectFilter(subjectFilter),
-			scepserver.CAKeyPassword([]byte(*flCAPass)),
-			scepserver.ClientValidity(clientValidity),
-			scepserver.AllowRenewal(allowRenewal),
-			scepserver.WithLogger(logger),
-		}
-		svc, err = scepserver.NewService(depot, svcOptions...)
-		if err != nil {
-			lginfo.Log("err", err)
-			os.Exit(1)
-		}
-		svc = scepserver.NewLoggingService(log.With(lginfo, "component", "scep_service"), svc)
+	svc, challenges, err := newService(*flService, keyProvider, logger)
+	if err != nil {
+		lginfo.Log("err", err)
+		os.Exit(1)
 	}
 
 	var h http.Handler // http handler
 	{
-		e := scepserver.MakeServerEndpoints(svc)
-		e.GetEndpoint = scepserver.EndpointLoggingMiddleware(lginfo)(e.GetEndpoint)
-		e.PostEndpoint = scepserver.EndpointLoggingMiddleware(lginfo)(e.PostEndpoint)
-		h = scepserver.MakeHTTPHandler(e, svc, log.With(lginfo, "component", "http"))
+		e := makeEndpoints(svc, lginfo)
+		h = scepserver.MakeHTTPHandler(e, svc, log.With(lginfo, "component", "http"), tenants...)
+	}
+	if err := mountChallengeAdmin(mux, *flService, svc, challenges, lginfo); err != nil {
+		lginfo.Log("err", err)
+		os.Exit(1)
 	}
+	mux.Handle("/", h)
+	h = mux
 
 	// start http server
 	errs := make(chan error, 2)
@@ -207,7 +204,7 @@ func main() {
 		errs <- http.ListenAndServe(port, h)
 	}()
 	go func() {
-		c := make(chan os.Signal)
+		c := make(chan os.Signal, 1)
 		signal.Notify(c, syscall.SIGINT)
 		errs <- fmt.Errorf("%s", <-c)
 	}()
@@ -218,53 +215,975 @@ func main() {
 func caMain(cmd *flag.FlagSet) int {
 	var (
 		flDepotPath = cmd.String("depot", "depot", "path to ca folder")
+		flDepotType = cmd.String("depot-type", "file", "depot type: file, bolt or sqlite")
 		flInit      = cmd.Bool("init", false, "create a new CA")
+		flNext      = cmd.Bool("next", false, "with -init, stage the new CA as next_ca.pem for a rollover")
 		flYears     = cmd.Int("years", 10, "default CA years")
 		flKeySize   = cmd.Int("keySize", 4096, "rsa key size")
+		flKeyType   = cmd.String("key-type", "rsa", "CA key type: rsa, p256 or p384")
 		flOrg       = cmd.String("organization", "scep-ca", "organization for CA cert")
 		flOrgUnit   = cmd.String("organizational_unit", "SCEP CA", "organizational unit (OU) for CA cert")
-		flPassword  = cmd.String("key-password", "", "password to store rsa key")
+		flPassword  = cmd.String("key-password", "", "password to store the private keys")
 		flCountry   = cmd.String("country", "US", "country for CA cert")
+		flPKCS11    = pkcs11Flags(cmd)
 	)
 	cmd.Parse(os.Args[2:])
+	if *flInit && *flDepotType != "file" {
+		fmt.Println("Initializing new CA")
+		if err := initDatabaseCA(serviceConfig{DepotPath: *flDepotPath, DepotType: *flDepotType}, *flKeyType, *flKeySize, []byte(*flPassword), *flYears, *flOrg, *flOrgUnit, *flCountry, *flPKCS11); err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		return 0
+	}
 	if *flInit {
 		fmt.Println("Initializing new CA")
-		key, err := createKey(*flKeySize, []byte(*flPassword), *flDepotPath)
+		name := "ca"
+		if *flNext {
+			name = "next_ca"
+		}
+		var key crypto.Signer
+		var err error
+		if flPKCS11.Module != "" {
+			key, err = pkcs11Key(*flPKCS11)
+		} else {
+			key, err = createKey(*flKeyType, *flKeySize, []byte(*flPassword), *flDepotPath, name+".key")
+		}
 		if err != nil {
 			fmt.Println(err)
 			return 1
 		}
-		if err := createCertificateAuthority(key, *flYears, *flOrg, *flOrgUnit, *flCountry, *flDepotPath); err != nil {
+		caCert, err := createCertificateAuthority(key, *flYears, *flOrg, *flOrgUnit, *flCountry, *flDepotPath, name+".pem")
+		if err != nil {
 			fmt.Println(err)
 			return 1
 		}
+		// SCEP messages are encrypted with RSA, an ECDSA CA needs an RA.
+		// A next CA keeps using the RA of the current CA.
+		if _, ok := key.Public().(*rsa.PublicKey); !ok && !*flNext {
+			fmt.Println("Creating RSA RA certificate")
+			raKey, err := createKey("rsa", *flKeySize, []byte(*flPassword), *flDepotPath, "ra.key")
+			if err != nil {
+				fmt.Println(err)
+				return 1
+			}
+			if err := createRA(raKey, caCert, key, *flYears, *flDepotPath); err != nil {
+				fmt.Println(err)
+				return 1
+			}
+		}
 	}
 
 	return 0
 }
 
+// initDatabaseCA stores a new CA in a bolt or sqlite depot. SCEP messages
+// are encrypted to the CA, these depots have no RA for a CA key which can
+// not decrypt.
+func initDatabaseCA(c serviceConfig, keyType string, keySize int, password []byte, years int, org, orgUnit, country string, pkcs11Config pkcs11keyprovider.Config) error {
+	var key crypto.Signer
+	var err error
+	if pkcs11Config.Module != "" {
+		key, err = pkcs11Key(pkcs11Config)
+	} else {
+		key, err = generateKey(keyType, keySize)
+	}
+	if err != nil {
+		return err
+	}
+	if _, ok := key.Public().(*rsa.PublicKey); !ok {
+		return fmt.Errorf("the %s depot requires an RSA CA key", c.DepotType)
+	}
+	crtBytes, err := newCertificateAuthority(key, years, org, orgUnit, country)
+	if err != nil {
+		return err
+	}
+	caCert, err := x509.ParseCertificate(crtBytes)
+	if err != nil {
+		return err
+	}
+	d, err := openDepot(c)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	importer, ok := d.depot.(depot.Importer)
+	if !ok {
+		return fmt.Errorf("can not store a CA in a %s depot", c.DepotType)
+	}
+	// a key in a PKCS#11 token stays there
+	if pkcs11Config.Module != "" {
+		key = nil
+	}
+	return importer.ImportCA([]*x509.Certificate{caCert}, key, password)
+}
+
+// serviceConfig holds the settings of a SCEP service. The default
+// service is configured by the flags, each tenant by its entry in the
+// -tenants file, on top of the flags.
+type serviceConfig struct {
+	Name              string `json:"name"`
+	DepotPath         string `json:"depot"`
+	DepotType         string `json:"depot-type"`
+	DepotSharded      bool   `json:"depot-sharded"`
+	SerialStrategy    string `json:"serial"`
+	CAPass            string `json:"capass"`
+	ClDuration        string `json:"crtvalid"`
+	ClAllowRenewal    string `json:"allowrenew"`
+	ChallengePassword string `json:"challenge"`
+	DynamicChallenge  bool   `json:"dynamic-challenge"`
+	ChallengeSecret   string `json:"challenge-secret"`
+	CSRVerifierExec   string `json:"csrverifierexec"`
+	CertSuccesserExec string `json:"certsuccesserexec"`
+	CertFailerExec    string `json:"certfailerexec"`
+	CAChooserExec     string `json:"cachooserexec"`
+	SubjectFilterExec string `json:"subjectfilterexec"`
+	Profiles          string `json:"profiles"`
+	ProfileChooser    string `json:"profilechooserexec"`
+	CSRVerifierURL    string `json:"csrverifier-url"`
+	CertSuccesserURL  string `json:"certsuccesser-url"`
+	CertFailerURL     string `json:"certfailer-url"`
+	CAChooserURL      string `json:"cachooser-url"`
+	SubjectFilterURL  string `json:"subjectfilter-url"`
+	ProfileChooserURL string `json:"profilechooser-url"`
+	WebhookSecret     string `json:"webhook-secret"`
+	WebhookTimeout    string `json:"webhook-timeout"`
+	WebhookRetries    string `json:"webhook-retries"`
+	WebhookCA         string `json:"webhook-ca"`
+	WebhookCert       string `json:"webhook-cert"`
+	WebhookKey        string `json:"webhook-key"`
+	WebhookInsecure   bool   `json:"webhook-insecure"`
+	CARollover        string `json:"ca-rollover"`
+	CRLLifetime       string `json:"crl-lifetime"`
+	CRLURL            string `json:"crl-url"`
+	RenewSubject      bool   `json:"renew-subject-change"`
+	RenewSameKey      bool   `json:"renew-same-key"`
+	SANDNS            string `json:"san-dns"`
+	SANIP             string `json:"san-ip"`
+	SANEmail          string `json:"san-email"`
+	SANURI            string `json:"san-uri"`
+	CSRExtensions     string `json:"csr-extensions"`
+	ManualApproval    bool   `json:"manual-approval"`
+	AdminUser         string `json:"challenge-admin-user"`
+	AdminPassword     string `json:"challenge-admin-password"`
+	AdminTTL          string `json:"challenge-admin-ttl"`
+}
+
+// serviceFlags adds the flags configuring the default SCEP service.
+func serviceFlags(fs *flag.FlagSet) *serviceConfig {
+	c := new(serviceConfig)
+	fs.StringVar(&c.DepotPath, "depot", envString("SCEP_FILE_DEPOT", "depot"), "path to ca folder, or the database file of a bolt or sqlite depot")
+	fs.StringVar(&c.DepotType, "depot-type", envString("SCEP_DEPOT_TYPE", "file"), "depot type: file, bolt or sqlite")
+	fs.BoolVar(&c.DepotSharded, "depot-sharded", envBool("SCEP_DEPOT_SHARDED"), "store the certificates of a file depot in 256 subfolders of certs")
+	fs.StringVar(&c.SerialStrategy, "serial", envString("SCEP_SERIAL", "sequential"), "serial numbers of issued certificates, sequential or random")
+	fs.StringVar(&c.CAPass, "capass", envString("SCEP_CA_PASS", ""), "passwd for the ca.key")
+	fs.StringVar(&c.ClDuration, "crtvalid", envString("SCEP_CERT_VALID", "365"), "validity for new client certificates in days")
+	fs.StringVar(&c.ClAllowRenewal, "allowrenew", envString("SCEP_CERT_RENEW", "14"), "do not allow renewal until n days before expiry, set to 0 to always allow")
+	fs.StringVar(&c.ChallengePassword, "challenge", envString("SCEP_CHALLENGE_PASSWORD", ""), "enforce a challenge password")
+	fs.BoolVar(&c.DynamicChallenge, "dynamic-challenge", envBool("SCEP_DYNAMIC_CHALLENGE"), "require one-time challenges created with the challenge subcommand, needs a bolt or sqlite depot")
+	fs.StringVar(&c.ChallengeSecret, "challenge-secret", envString("SCEP_CHALLENGE_SECRET", ""), "require challenges signed with this secret, as created with the challenge subcommand; used challenges are only remembered by this process")
+	fs.StringVar(&c.CSRVerifierExec, "csrverifierexec", envString("SCEP_CSR_VERIFIER_EXEC", ""), "will be passed the CSRs for verification")
+	fs.StringVar(&c.CertSuccesserExec, "certsuccesserexec", envString("SCEP_CERT_SUCCESSER_EXEC", ""), "will be passed the certs on successful generation")
+	fs.StringVar(&c.CertFailerExec, "certfailerexec", envString("SCEP_CERT_FAILER_EXEC", ""), "will be called for failure to generate cert")
+	fs.StringVar(&c.CAChooserExec, "cachooserexec", envString("SCEP_CA_CHOOSER_EXEC", ""), "will be called to select/create the CA to sign each cert")
+	fs.StringVar(&c.SubjectFilterExec, "subjectfilterexec", envString("SCEP_SUBJECT_FILTER_EXEC", ""), "will be called to modify the subject to be signed")
+	fs.StringVar(&c.Profiles, "profiles", envString("SCEP_PROFILES", ""), "JSON file with the certificate profiles")
+	fs.StringVar(&c.ProfileChooser, "profilechooserexec", envString("SCEP_PROFILE_CHOOSER_EXEC", ""), "will be called to select the certificate profile of each CSR")
+	fs.StringVar(&c.CSRVerifierURL, "csrverifier-url", envString("SCEP_CSR_VERIFIER_URL", ""), "webhook to post the CSRs to for verification")
+	fs.StringVar(&c.CertSuccesserURL, "certsuccesser-url", envString("SCEP_CERT_SUCCESSER_URL", ""), "webhook to post the certs to on successful generation")
+	fs.StringVar(&c.CertFailerURL, "certfailer-url", envString("SCEP_CERT_FAILER_URL", ""), "webhook to post failures to generate a cert to")
+	fs.StringVar(&c.CAChooserURL, "cachooser-url", envString("SCEP_CA_CHOOSER_URL", ""), "webhook to select the CA to sign each cert")
+	fs.StringVar(&c.SubjectFilterURL, "subjectfilter-url", envString("SCEP_SUBJECT_FILTER_URL", ""), "webhook to modify the subject to be signed")
+	fs.StringVar(&c.ProfileChooserURL, "profilechooser-url", envString("SCEP_PROFILE_CHOOSER_URL", ""), "webhook to select the certificate profile of each CSR")
+	fs.StringVar(&c.WebhookSecret, "webhook-secret", envString("SCEP_WEBHOOK_SECRET", ""), "sign webhook requests with this secret")
+	fs.StringVar(&c.WebhookTimeout, "webhook-timeout", envString("SCEP_WEBHOOK_TIMEOUT", "10s"), "timeout of each webhook request")
+	fs.StringVar(&c.WebhookRetries, "webhook-retries", envString("SCEP_WEBHOOK_RETRIES", "0"), "retry failed webhook requests n times")
+	fs.StringVar(&c.WebhookCA, "webhook-ca", envString("SCEP_WEBHOOK_CA", ""), "PEM CA certificates to verify webhooks with instead of the system roots")
+	fs.StringVar(&c.WebhookCert, "webhook-cert", envString("SCEP_WEBHOOK_CERT", ""), "PEM client certificate for webhooks")
+	fs.StringVar(&c.WebhookKey, "webhook-key", envString("SCEP_WEBHOOK_KEY", ""), "PEM key of the webhook client certificate")
+	fs.BoolVar(&c.WebhookInsecure, "webhook-insecure", envBool("SCEP_WEBHOOK_INSECURE"), "do not verify the TLS certificates of webhooks")
+	fs.StringVar(&c.CARollover, "ca-rollover", envString("SCEP_CA_ROLLOVER", ""), "replace the CA with next_ca.pem at this time, in RFC 3339 format")
+	fs.StringVar(&c.CRLLifetime, "crl-lifetime", envString("SCEP_CRL_LIFETIME", ""), "generate CRLs valid for this duration, e.g. 24h")
+	fs.StringVar(&c.CRLURL, "crl-url", envString("SCEP_CRL_URL", ""), "CRL distribution point to add to issued certificates")
+	fs.BoolVar(&c.RenewSubject, "renew-subject-change", envBool("SCEP_RENEW_SUBJECT_CHANGE"), "allow renewals to request a different subject, SubjectAltNames and extensions")
+	fs.BoolVar(&c.RenewSameKey, "renew-same-key", envBool("SCEP_RENEW_SAME_KEY"), "require renewals to keep the key of the existing certificate")
+	fs.StringVar(&c.SANDNS, "san-dns", envString("SCEP_SAN_DNS", "drop"), "drop, copy or reject DNS SubjectAltNames requested in CSRs")
+	fs.StringVar(&c.SANIP, "san-ip", envString("SCEP_SAN_IP", "drop"), "drop, copy or reject IP SubjectAltNames requested in CSRs")
+	fs.StringVar(&c.SANEmail, "san-email", envString("SCEP_SAN_EMAIL", "drop"), "drop, copy or reject email SubjectAltNames requested in CSRs")
+	fs.StringVar(&c.SANURI, "san-uri", envString("SCEP_SAN_URI", "drop"), "drop, copy or reject URI SubjectAltNames requested in CSRs")
+	fs.StringVar(&c.CSRExtensions, "csr-extensions", envString("SCEP_CSR_EXTENSIONS", ""), "comma separated oid=copy or oid=reject for other extensions requested in CSRs")
+	fs.BoolVar(&c.ManualApproval, "manual-approval", envBool("SCEP_MANUAL_APPROVAL"), "hold new requests as PENDING until approved with the pending subcommand")
+	fs.StringVar(&c.AdminUser, "challenge-admin-user", envString("SCEP_CHALLENGE_ADMIN_USER", "admin"), "user name for the challenge admin page")
+	fs.StringVar(&c.AdminPassword, "challenge-admin-password", envString("SCEP_CHALLENGE_ADMIN_PASSWORD", ""), "serve new dynamic challenges at "+scepserver.ChallengeAdminPath+", or "+scepserver.ChallengeAdminPath+"{tenant}/, to requests authenticated with this password")
+	fs.StringVar(&c.AdminTTL, "challenge-admin-ttl", envString("SCEP_CHALLENGE_ADMIN_TTL", "1h"), "time after which challenges from the admin page expire, 0 for never")
+	return c
+}
+
+// mountChallengeAdmin serves the challenge admin page of the service
+// configured by c, if it has an admin password. The page of a tenant is
+// served below its name.
+func mountChallengeAdmin(mux *http.ServeMux, c serviceConfig, svc scepserver.Service, challenges challenge.Store, logger log.Logger) error {
+	if c.AdminPassword == "" {
+		return nil
+	}
+	if challenges == nil {
+		return errors.New("the challenge admin page needs -dynamic-challenge or -challenge-secret")
+	}
+	ttl, err := time.ParseDuration(c.AdminTTL)
+	if err != nil {
+		return fmt.Errorf("no valid duration for the challenge admin TTL: %s", err)
+	}
+	path := scepserver.ChallengeAdminPath
+	if c.Name != "" {
+		path += c.Name + "/"
+	}
+	admin := scepserver.ChallengeAdmin{User: c.AdminUser, Password: c.AdminPassword, TTL: ttl, Path: path}
+	mux.Handle(path, scepserver.MakeChallengeAdminHandler(svc, challenges, admin, log.With(logger, "component", "mscep_admin")))
+	return nil
+}
+
+// tenantConfigs reads the tenants from a JSON array of objects, with the
+// names of the flags as keys. Settings which a tenant does not give are
+// taken from the flags, but each tenant needs its own name and depot.
+func tenantConfigs(filename string, defaults serviceConfig) ([]serviceConfig, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var raw []json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, err
+	}
+	depots := map[string]bool{defaults.DepotPath: true}
+	secrets := map[string]bool{defaults.ChallengeSecret: true}
+	names := make(map[string]bool)
+
+	// /scep/{name} selects a tenant or a profile of the default service
+	profiles := map[string]bool{"default": true}
+	if defaults.Profiles != "" {
+		defaultProfiles, err := readProfiles(defaults.Profiles)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range defaultProfiles {
+			profiles[p.Name] = true
+		}
+	}
+	var configs []serviceConfig
+	for _, r := range raw {
+		config := defaults
+		config.Name, config.DepotPath = "", ""
+		if err := json.Unmarshal(r, &config); err != nil {
+			return nil, err
+		}
+		if config.Name == "" || strings.Contains(config.Name, "/") {
+			return nil, fmt.Errorf("invalid tenant name %q", config.Name)
+		}
+		if names[config.Name] {
+			return nil, fmt.Errorf("duplicate tenant %q", config.Name)
+		}
+		if profiles[config.Name] {
+			return nil, fmt.Errorf("tenant %q has the name of a profile", config.Name)
+		}
+		if config.DepotPath == "" || depots[config.DepotPath] {
+			return nil, fmt.Errorf("tenant %q needs a depot of its own", config.Name)
+		}
+		if config.ChallengeSecret != "" && secrets[config.ChallengeSecret] {
+			// each service remembers the challenges used with it only
+			return nil, fmt.Errorf("tenant %q needs a challenge-secret of its own", config.Name)
+		}
+		names[config.Name], depots[config.DepotPath] = true, true
+		secrets[config.ChallengeSecret] = true
+		configs = append(configs, config)
+	}
+	return configs, nil
+}
+
+// readProfiles reads the certificate profiles from a JSON file.
+func readProfiles(filename string) ([]scepserver.Profile, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("could not read profiles: %s", err)
+	}
+	profiles, err := scepserver.ParseProfiles(data)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse profiles: %s", err)
+	}
+	return profiles, nil
+}
+
+// serviceDepot is implemented by the file, bolt and SQL depots.
+type serviceDepot interface {
+	depot.Depot
+	depot.PendingStore
+}
+
+// openedDepot is the depot of a service, with the dynamic challenge
+// store in the same database.
+type openedDepot struct {
+	depot      serviceDepot
+	challenges challenge.BindingStore // nil for the file depot
+	closer     io.Closer              // nil for the file depot
+}
+
+// Close closes the database of the depot.
+func (d *openedDepot) Close() error {
+	if d.closer == nil {
+		return nil
+	}
+	return d.closer.Close()
+}
+
+// openDepot opens the depot of c.
+func openDepot(c serviceConfig) (*openedDepot, error) {
+	var serialStrategy depot.SerialStrategy
+	switch c.SerialStrategy {
+	case "sequential", "":
+		serialStrategy = depot.SerialSequential
+	case "random":
+		serialStrategy = depot.SerialRandom
+	default:
+		return nil, fmt.Errorf("unknown serial strategy %q", c.SerialStrategy)
+	}
+	switch c.DepotType {
+	case "file", "":
+		opts := []file.Option{file.WithSerialStrategy(serialStrategy)}
+		if c.DepotSharded {
+			opts = append(opts, file.WithShardedLayout())
+		}
+		d, err := file.NewFileDepot(c.DepotPath, opts...)
+		if err != nil {
+			return nil, err
+		}
+		return &openedDepot{depot: d}, nil
+	case "bolt":
+		db, err := openBolt(c.DepotPath)
+		if err != nil {
+			return nil, err
+		}
+		d, err := boltdepot.NewBoltDepot(db, boltdepot.WithSerialStrategy(serialStrategy))
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+		challenges, err := challengestore.NewBoltDepot(db)
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+		return &openedDepot{depot: d, challenges: challenges, closer: db}, nil
+	case "sqlite":
+		db, err := openSQLite(c.DepotPath)
+		if err != nil {
+			return nil, err
+		}
+		d, err := sqldepot.NewDepot(db,
+			sqldepot.WithSerialStrategy(serialStrategy),
+			sqldepot.WithCertDir(c.DepotPath+".certs"),
+		)
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+		challenges, err := sqlchallenge.NewStore(db)
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+		return &openedDepot{depot: d, challenges: challenges, closer: db}, nil
+	}
+	return nil, fmt.Errorf("unknown depot type %q", c.DepotType)
+}
+
+// newWebhookConfig checks the webhook settings of c, and returns a
+// function configuring the webhook of a hook from them.
+func newWebhookConfig(c serviceConfig) (func(url string) webhook.Config, error) {
+	for _, hook := range []struct{ name, exec, url string }{
+		{"csrverifier", c.CSRVerifierExec, c.CSRVerifierURL},
+		{"certsuccesser", c.CertSuccesserExec, c.CertSuccesserURL},
+		{"certfailer", c.CertFailerExec, c.CertFailerURL},
+		{"cachooser", c.CAChooserExec, c.CAChooserURL},
+		{"subjectfilter", c.SubjectFilterExec, c.SubjectFilterURL},
+		{"profilechooser", c.ProfileChooser, c.ProfileChooserURL},
+	} {
+		if hook.exec != "" && hook.url != "" {
+			return nil, fmt.Errorf("use either -%sexec or -%s-url", hook.name, hook.name)
+		}
+	}
+	var timeout time.Duration
+	if c.WebhookTimeout != "" {
+		var err error
+		if timeout, err = time.ParseDuration(c.WebhookTimeout); err != nil {
+			return nil, fmt.Errorf("no valid webhook timeout: %s", err)
+		}
+	}
+	var retries int
+	if c.WebhookRetries != "" {
+		var err error
+		if retries, err = strconv.Atoi(c.WebhookRetries); err != nil {
+			return nil, fmt.Errorf("no valid number of webhook retries: %s", err)
+		}
+	}
+	return func(url string) webhook.Config {
+		return webhook.Config{
+			URL:                url,
+			Secret:             c.WebhookSecret,
+			Timeout:            timeout,
+			Retries:            retries,
+			CAFile:             c.WebhookCA,
+			CertFile:           c.WebhookCert,
+			KeyFile:            c.WebhookKey,
+			InsecureSkipVerify: c.WebhookInsecure,
+		}
+	}, nil
+}
+
+// openBolt opens a bolt database, which is locked by the process using it.
+func openBolt(path string) (*bolt.DB, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err == bolt.ErrTimeout {
+		return nil, fmt.Errorf("%s is in use by another process", path)
+	}
+	return db, err
+}
+
+// newService creates a SCEP service with its own depot and hooks.
+// keyProvider may be nil to use the CA key from the depot. The challenge
+// store is nil unless the service uses dynamic challenges.
+func newService(c serviceConfig, keyProvider keyprovider.KeyProvider, logger log.Logger) (scepserver.Service, challenge.Store, error) {
+	lginfo := level.Info(logger)
+	d, err := openDepot(c)
+	if err != nil {
+		return nil, nil, err
+	}
+	allowRenewal, err := strconv.Atoi(c.ClAllowRenewal)
+	if err != nil {
+		return nil, nil, fmt.Errorf("no valid number for allowed renewal time: %s", err)
+	}
+	clientValidity, err := strconv.Atoi(c.ClDuration)
+	if err != nil {
+		return nil, nil, fmt.Errorf("no valid number for client cert validity: %s", err)
+	}
+	extensionPolicy, err := parseExtensionPolicy(c.SANDNS, c.SANIP, c.SANEmail, c.SANURI, c.CSRExtensions)
+	if err != nil {
+		return nil, nil, fmt.Errorf("no valid extension policy: %s", err)
+	}
+
+	svcOptions := []scepserver.ServiceOption{
+		scepserver.ChallengePassword(c.ChallengePassword),
+		scepserver.CAKeyPassword([]byte(c.CAPass)),
+		scepserver.ClientValidity(clientValidity),
+		scepserver.AllowRenewal(allowRenewal),
+		scepserver.WithRenewalPolicy(scepserver.RenewalPolicy{
+			AllowSubjectChange: c.RenewSubject,
+			RequireSameKey:     c.RenewSameKey,
+		}),
+		scepserver.WithExtensionPolicy(extensionPolicy),
+		scepserver.WithLogger(logger),
+	}
+	webhookConfig, err := newWebhookConfig(c)
+	if err != nil {
+		return nil, nil, err
+	}
+	if c.CSRVerifierExec > "" {
+		executableCSRVerifier, err := executablecsrverifier.New(c.CSRVerifierExec, lginfo)
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not instantiate CSR verifier: %s", err)
+		}
+		svcOptions = append(svcOptions, scepserver.WithCSRVerifier(executableCSRVerifier))
+	}
+	if c.CSRVerifierURL > "" {
+		webhookCSRVerifier, err := webhookcsrverifier.New(webhookConfig(c.CSRVerifierURL), lginfo)
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not instantiate CSR verifier: %s", err)
+		}
+		svcOptions = append(svcOptions, scepserver.WithCSRVerifier(webhookCSRVerifier))
+	}
+	if c.CertSuccesserExec > "" {
+		executableCertSuccesser, err := executablecertsuccesser.New(c.CertSuccesserExec, lginfo)
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not instantiate cert successer: %s", err)
+		}
+		svcOptions = append(svcOptions, scepserver.WithCertSuccesser(executableCertSuccesser))
+	}
+	if c.CertSuccesserURL > "" {
+		webhookCertSuccesser, err := webhookcertsuccesser.New(webhookConfig(c.CertSuccesserURL), lginfo)
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not instantiate cert successer: %s", err)
+		}
+		svcOptions = append(svcOptions, scepserver.WithCertSuccesser(webhookCertSuccesser))
+	}
+	if c.CertFailerExec > "" {
+		executableCertFailer, err := executablecertfailer.New(c.CertFailerExec, lginfo)
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not instantiate cert failer: %s", err)
+		}
+		svcOptions = append(svcOptions, scepserver.WithCertFailer(executableCertFailer))
+	}
+	if c.CertFailerURL > "" {
+		webhookCertFailer, err := webhookcertfailer.New(webhookConfig(c.CertFailerURL), lginfo)
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not instantiate cert failer: %s", err)
+		}
+		svcOptions = append(svcOptions, scepserver.WithCertFailer(webhookCertFailer))
+	}
+	if c.CAChooserExec > "" {
+		executableCAChooser, err := executablecachooser.New(c.CAChooserExec, lginfo)
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not instantiate ca chooser: %s", err)
+		}
+		svcOptions = append(svcOptions, scepserver.WithCAChooser(executableCAChooser))
+	}
+	if c.CAChooserURL > "" {
+		webhookCAChooser, err := webhookcachooser.New(webhookConfig(c.CAChooserURL), lginfo)
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not instantiate ca chooser: %s", err)
+		}
+		svcOptions = append(svcOptions, scepserver.WithCAChooser(webhookCAChooser))
+	}
+	if c.SubjectFilterExec > "" {
+		executableSubjectFilter, err := executablesubjectfilter.New(c.SubjectFilterExec, lginfo)
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not instantiate subject filter: %s", err)
+		}
+		svcOptions = append(svcOptions, scepserver.WithSubjectFilter(executableSubjectFilter))
+	}
+	if c.SubjectFilterURL > "" {
+		webhookSubjectFilter, err := webhooksubjectfilter.New(webhookConfig(c.SubjectFilterURL), lginfo)
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not instantiate subject filter: %s", err)
+		}
+		svcOptions = append(svcOptions, scepserver.WithSubjectFilter(webhookSubjectFilter))
+	}
+	if c.Profiles != "" {
+		profiles, err := readProfiles(c.Profiles)
+		if err != nil {
+			return nil, nil, err
+		}
+		svcOptions = append(svcOptions, scepserver.WithProfiles(profiles...))
+	}
+	if c.ProfileChooser > "" {
+		executableProfileChooser, err := executableprofilechooser.New(c.ProfileChooser, lginfo)
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not instantiate profile chooser: %s", err)
+		}
+		svcOptions = append(svcOptions, scepserver.WithProfileChooser(executableProfileChooser))
+	}
+	if c.ProfileChooserURL > "" {
+		webhookProfileChooser, err := webhookprofilechooser.New(webhookConfig(c.ProfileChooserURL), lginfo)
+		if err != nil {
+			return nil, nil, fmt.Errorf("could not instantiate profile chooser: %s", err)
+		}
+		svcOptions = append(svcOptions, scepserver.WithProfileChooser(webhookProfileChooser))
+	}
+	if c.ManualApproval {
+		svcOptions = append(svcOptions, scepserver.WithManualApproval(d.depot))
+	}
+	var challenges challenge.Store
+	if c.DynamicChallenge && c.ChallengeSecret != "" {
+		return nil, nil, errors.New("use either dynamic challenges or a challenge secret")
+	}
+	if c.DynamicChallenge {
+		if d.challenges == nil {
+			return nil, nil, errors.New("dynamic challenges need a bolt or sqlite depot")
+		}
+		challenges = d.challenges
+	}
+	if c.ChallengeSecret != "" {
+		challenges, err = token.NewStore([]byte(c.ChallengeSecret))
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	if challenges != nil {
+		svcOptions = append(svcOptions, scepserver.WithDynamicChallenges(challenges))
+	}
+	if c.CRLLifetime != "" {
+		crlLifetime, err := time.ParseDuration(c.CRLLifetime)
+		if err != nil {
+			return nil, nil, fmt.Errorf("no valid duration for CRL lifetime: %s", err)
+		}
+		svcOptions = append(svcOptions, scepserver.WithCRL(crlLifetime))
+	}
+	if c.CARollover != "" {
+		caRollover, err := time.Parse(time.RFC3339, c.CARollover)
+		if err != nil {
+			return nil, nil, fmt.Errorf("no valid time for CA rollover: %s", err)
+		}
+		svcOptions = append(svcOptions, scepserver.WithCARollover(caRollover))
+	}
+	if c.CRLURL != "" {
+		svcOptions = append(svcOptions, scepserver.CRLDistributionPoints(c.CRLURL))
+	}
+	if keyProvider != nil {
+		svcOptions = append(svcOptions, scepserver.WithCAKeyProvider(keyProvider))
+	}
+
+	svc, err := scepserver.NewService(d.depot, svcOptions...)
+	if err != nil {
+		return nil, nil, err
+	}
+	return scepserver.NewLoggingService(log.With(lginfo, "component", "scep_service"), svc), challenges, nil
+}
+
+// makeEndpoints creates the server endpoints of svc with request logging.
+func makeEndpoints(svc scepserver.Service, lginfo log.Logger) *scepserver.Endpoints {
+	e := scepserver.MakeServerEndpoints(svc)
+	e.GetEndpoint = scepserver.EndpointLoggingMiddleware(lginfo)(e.GetEndpoint)
+	e.PostEndpoint = scepserver.EndpointLoggingMiddleware(lginfo)(e.PostEndpoint)
+	return e
+}
+
+// parseExtensionPolicy builds the policy for SubjectAltNames and
+// extensions requested in CSRs from the command line flags.
+func parseExtensionPolicy(dns, ip, email, uri, extensions string) (scepserver.ExtensionPolicy, error) {
+	var policy scepserver.ExtensionPolicy
+	for _, san := range []struct {
+		action string
+		policy *scepserver.SANPolicy
+	}{
+		{dns, &policy.DNSNames},
+		{ip, &policy.IPAddresses},
+		{email, &policy.EmailAddresses},
+		{uri, &policy.URIs},
+	} {
+		action, err := scepserver.ParseExtensionAction(san.action)
+		if err != nil {
+			return policy, err
+		}
+		san.policy.Action = action
+	}
+	if extensions == "" {
+		return policy, nil
+	}
+	policy.Extensions = make(map[string]scepserver.ExtensionAction)
+	for _, ext := range strings.Split(extensions, ",") {
+		parts := strings.SplitN(ext, "=", 2)
+		if len(parts) != 2 {
+			return policy, fmt.Errorf("extension %q is not in the form oid=action", ext)
+		}
+		action, err := scepserver.ParseExtensionAction(parts[1])
+		if err != nil {
+			return policy, err
+		}
+		policy.Extensions[strings.TrimSpace(parts[0])] = action
+	}
+	return policy, nil
+}
+
+// pkcs11Flags adds the flags selecting a CA key held in a PKCS#11 token.
+func pkcs11Flags(fs *flag.FlagSet) *pkcs11keyprovider.Config {
+	config := new(pkcs11keyprovider.Config)
+	fs.StringVar(&config.Module, "pkcs11-module", envString("SCEP_PKCS11_MODULE", ""), "path to the PKCS#11 module holding the CA key, instead of ca.key")
+	fs.StringVar(&config.TokenLabel, "pkcs11-token", envString("SCEP_PKCS11_TOKEN", ""), "label of the PKCS#11 token")
+	fs.StringVar(&config.PIN, "pkcs11-pin", envString("SCEP_PKCS11_PIN", ""), "user PIN of the PKCS#11 token")
+	fs.StringVar(&config.KeyLabel, "pkcs11-key-label", envString("SCEP_PKCS11_KEY_LABEL", "scep-ca"), "label of the CA key pair in the PKCS#11 token")
+	return config
+}
+
+// pkcs11Key returns an existing key pair from a PKCS#11 token. The session
+// with the token stays open until the program exits.
+func pkcs11Key(config pkcs11keyprovider.Config) (crypto.Signer, error) {
+	keyProvider, err := pkcs11keyprovider.New(config)
+	if err != nil {
+		return nil, err
+	}
+	return keyProvider.CAKey(nil)
+}
+
+func pendingMain(cmd *flag.FlagSet) int {
+	var (
+		flDepotPath = cmd.String("depot", "depot", "path to ca folder, or the database file of a bolt or sqlite depot")
+		flDepotType = cmd.String("depot-type", "file", "depot type: file, bolt or sqlite")
+		flApprove   = cmd.String("approve", "", "approve the request with this transaction ID")
+		flReject    = cmd.String("reject", "", "reject the request with this transaction ID")
+		flDelete    = cmd.String("delete", "", "delete the request with this transaction ID")
+	)
+	cmd.Parse(os.Args[2:])
+	d, err := openDepot(serviceConfig{DepotPath: *flDepotPath, DepotType: *flDepotType})
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	defer d.Close()
+	store := d.depot
+	switch {
+	case *flApprove != "":
+		err = setPendingStatus(store, *flApprove, depot.StatusApproved)
+	case *flReject != "":
+		err = setPendingStatus(store, *flReject, depot.StatusRejected)
+	case *flDelete != "":
+		err = store.DeletePending(*flDelete)
+	default:
+		err = listPending(store)
+	}
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	return 0
+}
+
+func challengeMain(cmd *flag.FlagSet) int {
+	var (
+		flDepotPath = cmd.String("depot", "depot.db", "path to the database file of the depot")
+		flDepotType = cmd.String("depot-type", "bolt", "depot type, bolt or sqlite")
+		flCount     = cmd.Int("count", 1, "number of challenges to create")
+		flTTL       = cmd.Duration("ttl", 0, "time after which the challenges expire, e.g. 24h, 0 for never or one hour with -secret")
+		flUses      = cmd.Int("uses", 1, "number of requests which can use each challenge")
+		flCN        = cmd.String("cn", "", "CN which requests using the challenges must have")
+		flSubject   = cmd.String("subject", "", "regular expression which the RFC 4514 subject of requests using the challenges must match")
+		flProfile   = cmd.String("profile", "", "certificate profile which requests using the challenges must be issued with")
+		flSecret    = cmd.String("secret", "", "create challenges signed with this secret instead of storing them in the depot")
+		flDNS       = cmd.String("dns", "", "with -secret, comma separated DNS names which requests may ask for")
+		flEmail     = cmd.String("email", "", "with -secret, comma separated email addresses which requests may ask for")
+		flIP        = cmd.String("ip", "", "with -secret, comma separated IP addresses which requests may ask for")
+		flURI       = cmd.String("uri", "", "with -secret, comma separated URIs which requests may ask for")
+	)
+	cmd.Parse(os.Args[2:])
+	opts := challenge.Options{
+		Binding: challenge.Binding{
+			CN:             *flCN,
+			SubjectPattern: *flSubject,
+			Profile:        *flProfile,
+		},
+		TTL:  *flTTL,
+		Uses: *flUses,
+	}
+	if *flSecret != "" {
+		store, err := token.NewStore([]byte(*flSecret))
+		if err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		for i := 0; i < *flCount; i++ {
+			claims, err := store.NewClaims(opts)
+			if err != nil {
+				fmt.Println(err)
+				return 1
+			}
+			claims.DNSNames = splitList(*flDNS)
+			claims.EmailAddresses = splitList(*flEmail)
+			claims.IPAddresses = splitList(*flIP)
+			claims.URIs = splitList(*flURI)
+			pw, err := store.Sign(claims)
+			if err != nil {
+				fmt.Println(err)
+				return 1
+			}
+			fmt.Println(pw)
+		}
+		return 0
+	}
+	d, err := openDepot(serviceConfig{DepotPath: *flDepotPath, DepotType: *flDepotType})
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	defer d.Close()
+	if d.challenges == nil {
+		fmt.Println("dynamic challenges need a bolt or sqlite depot")
+		return 1
+	}
+	for i := 0; i < *flCount; i++ {
+		pw, err := d.challenges.NewChallenge(opts)
+		if err != nil {
+			fmt.Println(err)
+			return 1
+		}
+		fmt.Println(pw)
+	}
+	return 0
+}
+
+// splitList splits a comma separated list, which may be empty.
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func depotMain(cmd *flag.FlagSet) int {
+	var (
+		flDepotPath = cmd.String("depot", "depot", "path to ca folder, or the database file of a bolt or sqlite depot")
+		flDepotType = cmd.String("depot-type", "file", "depot type: file, bolt or sqlite")
+		flPassword  = cmd.String("capass", "", "password of the CA key, also used for the key in the archive")
+		flExport    = cmd.String("export", "", "write the depot to this archive file")
+		flImport    = cmd.String("import", "", "import this archive file into the empty depot")
+		flVerify    = cmd.String("verify", "", "check that the depot holds the contents of this archive file")
+	)
+	cmd.Parse(os.Args[2:])
+	d, err := openDepot(serviceConfig{DepotPath: *flDepotPath, DepotType: *flDepotType})
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	defer d.Close()
+	importer, ok := d.depot.(depot.Importer)
+	if !ok {
+		fmt.Println("depot does not support migrations")
+		return 1
+	}
+	pass := []byte(*flPassword)
+	switch {
+	case *flExport != "":
+		err = exportDepot(importer, pass, *flExport)
+	case *flImport != "":
+		err = importDepot(importer, pass, *flImport)
+	case *flVerify != "":
+		err = verifyDepot(importer, pass, *flVerify)
+	default:
+		fmt.Println("usage: scep depot -export|-import|-verify <archive> [<args>]")
+		cmd.PrintDefaults()
+		return 1
+	}
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	return 0
+}
+
+func exportDepot(d depot.Exporter, pass []byte, filename string) error {
+	a, err := archive.Export(d, pass)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if err := a.Write(file); err != nil {
+		file.Close()
+		os.Remove(filename)
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	fmt.Printf("exported %d certificates\n", len(a.Certificates))
+	return nil
+}
+
+func importDepot(d depot.Importer, pass []byte, filename string) error {
+	a, err := readArchive(filename)
+	if err != nil {
+		return err
+	}
+	if err := a.Import(d, pass); err != nil {
+		return err
+	}
+	if err := a.Verify(d, pass); err != nil {
+		return fmt.Errorf("verifying the import: %s", err)
+	}
+	fmt.Printf("imported %d certificates\n", len(a.Certificates))
+	return nil
+}
+
+func verifyDepot(d depot.Exporter, pass []byte, filename string) error {
+	a, err := readArchive(filename)
+	if err != nil {
+		return err
+	}
+	if err := a.Verify(d, pass); err != nil {
+		return err
+	}
+	fmt.Printf("verified %d certificates\n", len(a.Certificates))
+	return nil
+}
+
+func readArchive(filename string) (*archive.Archive, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return archive.Read(file)
+}
+
+// setPendingStatus approves or rejects a request which was not issued yet.
+func setPendingStatus(store depot.PendingStore, tid string, status depot.PendingStatus) error {
+	req, err := store.Pending(tid)
+	if err != nil {
+		return err
+	}
+	if req.Status == depot.StatusIssued {
+		return fmt.Errorf("request %q was already issued", tid)
+	}
+	return store.SetPendingStatus(tid, status)
+}
+
+// print the pending requests with the subject of each CSR
+func listPending(store depot.PendingStore) error {
+	reqs, err := store.ListPending()
+	if err != nil {
+		return err
+	}
+	for _, req := range reqs {
+		var subject string
+		if csr, err := x509.ParseCertificateRequest(req.CSR); err == nil {
+			subject = csr.Subject.CommonName
+		}
+		fmt.Printf("%s\t%s\t%s\t%s\n", req.TransactionID, req.Status, req.Created.Format(time.RFC3339), subject)
+	}
+	return nil
+}
+
+// generate a key of keyType: rsa, p256 or p384.
+func generateKey(keyType string, bits int) (crypto.Signer, error) {
+	switch keyType {
+	case "rsa":
+		return rsa.GenerateKey(rand.Reader, bits)
+	case "p256":
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case "p384":
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	}
+	return nil, fmt.Errorf("unknown key type %q", keyType)
+}
+
 // create a key, save it to depot and return it for further usage.
-func createKey(bits int, password []byte, depot string) (*rsa.PrivateKey, error) {
+func createKey(keyType string, bits int, password []byte, depot, filename string) (crypto.Signer, error) {
 	// create depot folder if missing
 	if err := os.MkdirAll(depot, 0755); err != nil {
 		return nil, err
 	}
-	name := filepath.Join(depot, "ca.key")
-	file, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0400)
+
+	// create key and save as PEM file
+	key, err := generateKey(keyType, bits)
 	if err != nil {
 		return nil, err
 	}
-	defer file.Close()
+	var (
+		keyBytes  []byte
+		blockType string
+	)
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		keyBytes, blockType = x509.MarshalPKCS1PrivateKey(key), rsaPrivateKeyPEMBlockType
+	case *ecdsa.PrivateKey:
+		keyBytes, err = x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		blockType = ecPrivateKeyPEMBlockType
+	}
 
-	// create RSA key and save as PEM file
-	key, err := rsa.GenerateKey(rand.Reader, bits)
+	name := filepath.Join(depot, filename)
+	file, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0400)
 	if err != nil {
 		return nil, err
 	}
+	defer file.Close()
+
 	privPEMBlock, err := x509.EncryptPEMBlock(
 		rand.Reader,
-		rsaPrivateKeyPEMBlockType,
-		x509.MarshalPKCS1PrivateKey(key),
+		blockType,
+		keyBytes,
 		password,
 		x509.PEMCipher3DES,
 	)
@@ -279,7 +1198,19 @@ func createKey(bits int, password []byte, depot string) (*rsa.PrivateKey, error)
 	return key, nil
 }
 
-func createCertificateAuthority(key *rsa.PrivateKey, years int, organization string, organizationalUnit string, country string, depot string) error {
+func createCertificateAuthority(key crypto.Signer, years int, organization string, organizationalUnit string, country string, depot string, filename string) (*x509.Certificate, error) {
+	crtBytes, err := newCertificateAuthority(key, years, organization, organizationalUnit, country)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeCert(crtBytes, filepath.Join(depot, filename)); err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(crtBytes)
+}
+
+// newCertificateAuthority returns a new DER encoded self-signed CA certificate.
+func newCertificateAuthority(key crypto.Signer, years int, organization string, organizationalUnit string, country string) ([]byte, error) {
 	var (
 		authPkixName = pkix.Name{
 			Country:            nil,
@@ -324,21 +1255,53 @@ func createCertificateAuthority(key *rsa.PrivateKey, years int, organization str
 		}
 	)
 
-	subjectKeyID, err := generateSubjectKeyID(&key.PublicKey)
+	subjectKeyID, err := generateSubjectKeyID(key.Public())
 	if err != nil {
-		return err
+		return nil, err
+	}
+	// a next CA has the same name, it must not repeat the serial number
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
 	}
+	authTemplate.SerialNumber = serial
 	authTemplate.SubjectKeyId = subjectKeyID
 	authTemplate.NotAfter = time.Now().AddDate(years, 0, 0).UTC()
 	authTemplate.Subject.Country = []string{country}
 	authTemplate.Subject.Organization = []string{organization}
 	authTemplate.Subject.OrganizationalUnit = []string{organizationalUnit}
-	crtBytes, err := x509.CreateCertificate(rand.Reader, &authTemplate, &authTemplate, &key.PublicKey, key)
+	return x509.CreateCertificate(rand.Reader, &authTemplate, &authTemplate, key.Public(), key)
+}
+
+// createRA creates the RA certificate used to decrypt and sign SCEP
+// messages on behalf of a CA whose key can not be used for encryption.
+func createRA(key crypto.Signer, caCert *x509.Certificate, caKey crypto.Signer, years int, depot string) error {
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return err
+	}
+	subjectKeyID, err := generateSubjectKeyID(key.Public())
 	if err != nil {
 		return err
 	}
+	subject := caCert.Subject
+	subject.CommonName = "SCEP RA"
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      subject,
+		NotBefore:    time.Now().Add(-600).UTC(),
+		NotAfter:     time.Now().AddDate(years, 0, 0).UTC(),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment | x509.KeyUsageDataEncipherment,
+		SubjectKeyId: subjectKeyID,
+	}
+	crtBytes, err := x509.CreateCertificate(rand.Reader, tmpl, caCert, key.Public(), caKey)
+	if err != nil {
+		return err
+	}
+	return writeCert(crtBytes, filepath.Join(depot, "ra.pem"))
+}
 
-	name := filepath.Join(depot, "ca.pem")
+func writeCert(crtBytes []byte, name string) error {
 	file, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0400)
 	if err != nil {
 		return err
@@ -350,12 +1313,12 @@ func createCertificateAuthority(key *rsa.PrivateKey, years int, organization str
 		os.Remove(name)
 		return err
 	}
-
 	return nil
 }
 
 const (
 	rsaPrivateKeyPEMBlockType = "RSA PRIVATE KEY"
+	ecPrivateKeyPEMBlockType  = "EC PRIVATE KEY"
 	certificatePEMBlockType   = "CERTIFICATE"
 )
 
@@ -379,8 +1342,10 @@ func generateSubjectKeyID(pub crypto.PublicKey) ([]byte, error) {
 		if err != nil {
 			return nil, err
 		}
+	case *ecdsa.PublicKey:
+		pubBytes = elliptic.Marshal(pub.Curve, pub.X, pub.Y)
 	default:
-		return nil, errors.New("only RSA public key is supported")
+		return nil, errors.New("only RSA and ECDSA public keys are supported")
 	}
 
 	hash := sha1.Sum(pubBytes)
@@ -0,0 +1,17 @@
+//go:build sqlite
+// +build sqlite
+
+package main
+
+import (
+	"database/sql"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// openSQLite opens the database file of a sqlite depot.
+func openSQLite(path string) (*sql.DB, error) {
+	// immediate transactions wait for other writers instead of
+	// failing when they upgrade to a write lock
+	return sql.Open("sqlite3", "file:"+path+"?_busy_timeout=10000&_txlock=immediate")
+}
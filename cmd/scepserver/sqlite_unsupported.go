@@ -0,0 +1,14 @@
+//go:build !sqlite
+// +build !sqlite
+
+package main
+
+import (
+	"database/sql"
+	"errors"
+)
+
+// openSQLite always fails, sqlite support is not built in.
+func openSQLite(path string) (*sql.DB, error) {
+	return nil, errors.New("sqlite support is not built in, rebuild with -tags sqlite")
+}
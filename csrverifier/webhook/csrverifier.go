@@ -0,0 +1,35 @@
+// Package webhookcsrverifier defines the WebhookCSRVerifier csrverifier.CSRVerifier.
+package webhookcsrverifier
+
+import (
+	"github.com/go-kit/kit/log"
+	"github.com/syncsynchalt/scep/webhook"
+)
+
+// New creates a webhookcsrverifier.WebhookCSRVerifier.
+func New(config webhook.Config, logger log.Logger) (*WebhookCSRVerifier, error) {
+	client, err := webhook.NewClient(config)
+	if err != nil {
+		return nil, err
+	}
+	return &WebhookCSRVerifier{client: client, logger: logger}, nil
+}
+
+// WebhookCSRVerifier implements a csrverifier.CSRVerifier.
+// It posts the raw decrypted CSR to a webhook. The CSR is considered
+// valid if the webhook answers with "allow": true.
+type WebhookCSRVerifier struct {
+	client *webhook.Client
+	logger log.Logger
+}
+
+func (v *WebhookCSRVerifier) Verify(transactionID string, data []byte) (bool, error) {
+	resp, err := v.client.Post(webhook.NewRequest("csrverifier", transactionID, data))
+	if err != nil {
+		return false, err
+	}
+	if !resp.Allow {
+		v.logger.Log("info", "webhook denied the CSR", "transaction_id", transactionID)
+	}
+	return resp.Allow, nil
+}
@@ -0,0 +1,38 @@
+package webhookcsrverifier
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/syncsynchalt/scep/webhook"
+)
+
+func TestVerify(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req webhook.Request
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		fmt.Fprintf(w, `{"allow": %v}`, req.Hook == "csrverifier" && req.TransactionID == "allowed")
+	}))
+	defer server.Close()
+
+	v, err := New(webhook.Config{URL: server.URL}, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for tid, want := range map[string]bool{"allowed": true, "denied": false} {
+		have, err := v.Verify(tid, []byte("csr"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if have != want {
+			t.Errorf("%s: have %v, want %v", tid, have, want)
+		}
+	}
+}
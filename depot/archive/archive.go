@@ -0,0 +1,242 @@
+// Package archive copies the CA and the issued certificates of a depot to
+// another depot, through a portable JSON archive.
+package archive
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"time"
+
+	"github.com/syncsynchalt/scep/depot"
+)
+
+// version is the format version of archives written by this package.
+const version = 1
+
+// Archive holds the contents of a depot.
+type Archive struct {
+	Version int `json:"version"`
+	// CA is the DER encoded CA certificate chain.
+	CA [][]byte `json:"ca"`
+	// CAKey is the PEM encoded CA key, encrypted with the CA key password.
+	CAKey        []byte        `json:"ca_key"`
+	NextSerial   *big.Int      `json:"next_serial"`
+	Certificates []Certificate `json:"certificates"`
+}
+
+// Certificate is an issued certificate in an Archive.
+type Certificate struct {
+	Name        string                 `json:"name"`
+	Certificate []byte                 `json:"certificate"` // DER encoded
+	RevokedAt   *time.Time             `json:"revoked_at,omitempty"`
+	Reason      depot.RevocationReason `json:"reason,omitempty"`
+}
+
+// Export returns the contents of d. The CA key is decrypted with pass
+// and encrypted with it again in the archive.
+func Export(d depot.Exporter, pass []byte) (*Archive, error) {
+	chain, err := d.CACerts()
+	if err != nil {
+		return nil, err
+	}
+	key, err := d.CAKey(pass)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := depot.EncodeKey(key, pass)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := d.NextSerial()
+	if err != nil {
+		return nil, err
+	}
+	records, err := d.List(depot.CertFilter{})
+	if err != nil {
+		return nil, err
+	}
+
+	a := &Archive{
+		Version:    version,
+		CAKey:      keyPEM,
+		NextSerial: serial,
+	}
+	for _, cert := range chain {
+		a.CA = append(a.CA, cert.Raw)
+	}
+	for _, r := range records {
+		c := Certificate{Name: r.Name, Certificate: r.Certificate.Raw}
+		if r.Status == depot.CertRevoked {
+			revokedAt := r.RevokedAt.UTC()
+			c.RevokedAt, c.Reason = &revokedAt, r.RevocationReason
+		}
+		a.Certificates = append(a.Certificates, c)
+	}
+	return a, nil
+}
+
+// Read decodes an archive written by Write.
+func Read(r io.Reader) (*Archive, error) {
+	var a Archive
+	if err := json.NewDecoder(r).Decode(&a); err != nil {
+		return nil, err
+	}
+	if a.Version != version {
+		return nil, fmt.Errorf("unsupported archive version %d", a.Version)
+	}
+	return &a, nil
+}
+
+// Write encodes the archive.
+func (a *Archive) Write(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(a)
+}
+
+// Import stores the contents of the archive in d, which must be empty.
+// The CA key is decrypted with pass and stored encrypted with it.
+func (a *Archive) Import(d depot.Importer, pass []byte) error {
+	if _, err := d.CACerts(); err == nil {
+		return errors.New("depot already has a CA")
+	}
+	records, err := d.List(depot.CertFilter{})
+	if err != nil {
+		return err
+	}
+	if len(records) > 0 {
+		return errors.New("depot already has certificates")
+	}
+
+	chain, err := a.chain()
+	if err != nil {
+		return err
+	}
+	key, err := depot.ParseKey(a.CAKey, pass)
+	if err != nil {
+		return err
+	}
+	if err := d.ImportCA(chain, key, pass); err != nil {
+		return err
+	}
+	for _, c := range a.Certificates {
+		record, err := c.record()
+		if err != nil {
+			return err
+		}
+		if err := d.ImportCert(record); err != nil {
+			return err
+		}
+	}
+	return d.SetNextSerial(a.NextSerial)
+}
+
+// Verify checks that d holds the contents of the archive: the CA, the
+// certificates with their names and revocations, and a next serial number
+// which is not lower than the one in the archive.
+func (a *Archive) Verify(d depot.Exporter, pass []byte) error {
+	chain, err := d.CACerts()
+	if err != nil {
+		return err
+	}
+	// depots may keep only the CA certificate of the chain
+	if len(chain) == 0 || len(a.CA) == 0 || !bytes.Equal(chain[0].Raw, a.CA[0]) {
+		return errors.New("CA certificate differs")
+	}
+	key, err := d.CAKey(pass)
+	if err != nil {
+		return err
+	}
+	archived, err := depot.ParseKey(a.CAKey, pass)
+	if err != nil {
+		return err
+	}
+	if !publicKeyEqual(key, archived) {
+		return errors.New("CA key differs")
+	}
+	serial, err := d.NextSerial()
+	if err != nil {
+		return err
+	}
+	if serial.Cmp(a.NextSerial) < 0 {
+		return fmt.Errorf("next serial %s is lower than %s", serial, a.NextSerial)
+	}
+
+	records, err := d.List(depot.CertFilter{})
+	if err != nil {
+		return err
+	}
+	if len(records) != len(a.Certificates) {
+		return fmt.Errorf("depot has %d certificates, archive %d", len(records), len(a.Certificates))
+	}
+	stored := make(map[string]*depot.CertRecord)
+	for _, r := range records {
+		stored[r.Certificate.SerialNumber.String()] = r
+	}
+	for _, c := range a.Certificates {
+		want, err := c.record()
+		if err != nil {
+			return err
+		}
+		serial := want.Certificate.SerialNumber
+		have, ok := stored[serial.String()]
+		switch {
+		case !ok || !bytes.Equal(have.Certificate.Raw, want.Certificate.Raw):
+			return fmt.Errorf("certificate %s is missing", serial)
+		case have.Name != want.Name:
+			return fmt.Errorf("certificate %s is stored as %q, not %q", serial, have.Name, want.Name)
+		case (have.Status == depot.CertRevoked) != (want.Status == depot.CertRevoked):
+			return fmt.Errorf("certificate %s is %s", serial, have.Status)
+		case want.Status != depot.CertRevoked:
+		case !have.RevokedAt.Equal(want.RevokedAt) || have.RevocationReason != want.RevocationReason:
+			return fmt.Errorf("revocation of certificate %s differs", serial)
+		}
+	}
+	return nil
+}
+
+func (a *Archive) chain() ([]*x509.Certificate, error) {
+	if len(a.CA) == 0 {
+		return nil, errors.New("archive without a CA certificate")
+	}
+	var chain []*x509.Certificate
+	for _, der := range a.CA {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, cert)
+	}
+	return chain, nil
+}
+
+// record returns the depot record of c. The revocation time is truncated
+// to seconds, which is what depots store.
+func (c *Certificate) record() (*depot.CertRecord, error) {
+	cert, err := x509.ParseCertificate(c.Certificate)
+	if err != nil {
+		return nil, err
+	}
+	r := &depot.CertRecord{
+		Name:        c.Name,
+		Certificate: cert,
+		Status:      depot.CertStatusAt(cert, time.Now()),
+	}
+	if c.RevokedAt != nil {
+		r.Status = depot.CertRevoked
+		r.RevokedAt = c.RevokedAt.UTC().Truncate(time.Second)
+		r.RevocationReason = c.Reason
+	}
+	return r, nil
+}
+
+func publicKeyEqual(a, b crypto.Signer) bool {
+	pub, ok := a.Public().(interface{ Equal(crypto.PublicKey) bool })
+	return ok && pub.Equal(b.Public())
+}
@@ -0,0 +1,151 @@
+package archive
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/syncsynchalt/scep/depot"
+	boltdepot "github.com/syncsynchalt/scep/depot/bolt"
+	"github.com/syncsynchalt/scep/depot/file"
+)
+
+func TestMigrate(t *testing.T) {
+	pass := []byte("secret")
+	dir, err := ioutil.TempDir("", "scep-archive-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := boltDepot(t, filepath.Join(dir, "src.db"))
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := testCert(t, big.NewInt(1), "ca", key)
+	if err := src.ImportCA([]*x509.Certificate{ca}, key, pass); err != nil {
+		t.Fatal(err)
+	}
+	for _, cn := range []string{"alice", "bob", "bob"} {
+		serial, err := src.Serial()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := src.Put(cn, testCert(t, serial, cn, key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := src.Revoke(big.NewInt(2), depot.ReasonKeyCompromise); err != nil {
+		t.Fatal(err)
+	}
+
+	// bolt to file and back
+	a := export(t, src, pass)
+	if have, want := len(a.Certificates), 3; have != want {
+		t.Fatalf("have %d certificates, want %d", have, want)
+	}
+	if err := os.Mkdir(filepath.Join(dir, "file"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	fileDepot, err := file.NewFileDepot(filepath.Join(dir, "file"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Import(fileDepot, pass); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Verify(fileDepot, pass); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Import(fileDepot, pass); err == nil {
+		t.Error("import into a depot which is not empty")
+	}
+
+	a = export(t, fileDepot, pass)
+	dst := boltDepot(t, filepath.Join(dir, "dst.db"))
+	if err := a.Import(dst, pass); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Verify(dst, pass); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Verify(src, pass); err != nil {
+		t.Errorf("source depot differs after migrating back: %s", err)
+	}
+
+	serial, err := dst.Serial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := serial.Int64(), int64(5); have != want {
+		t.Errorf("have next serial %d, want %d", have, want)
+	}
+	revoked, err := dst.List(depot.CertFilter{Status: depot.CertRevoked})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the first certificate of bob was superseded by the second
+	if have, want := len(revoked), 2; have != want {
+		t.Errorf("have %d revoked certificates, want %d", have, want)
+	}
+}
+
+func export(t *testing.T, d depot.Exporter, pass []byte) *Archive {
+	t.Helper()
+	a, err := Export(d, pass)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := a.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+	a, err = Read(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func boltDepot(t *testing.T, path string) *boltdepot.Depot {
+	t.Helper()
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	d, err := boltdepot.NewBoltDepot(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func testCert(t *testing.T, serial *big.Int, cn string, key *rsa.PrivateKey) *x509.Certificate {
+	t.Helper()
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
@@ -3,24 +3,45 @@ package bolt
 import (
 	"bytes"
 	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha1"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/asn1"
+	"encoding/pem"
 	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"math/big"
+	"os"
+	"path/filepath"
 	"time"
 
 	"github.com/boltdb/bolt"
+	"github.com/syncsynchalt/scep/depot"
 )
 
 // Depot implements a SCEP certifiacte store using boltdb.
 // https://github.com/boltdb/bolt
 type Depot struct {
 	*bolt.DB
+	serialStrategy depot.SerialStrategy
+	rand           io.Reader // source of random serials
+}
+
+// Option is an optional argument to NewBoltDepot.
+type Option func(*Depot)
+
+// WithSerialStrategy selects how serial numbers are allocated,
+// the default is depot.SerialSequential.
+func WithSerialStrategy(strategy depot.SerialStrategy) Option {
+	return func(db *Depot) {
+		db.serialStrategy = strategy
+	}
 }
 
 const (
@@ -28,23 +49,41 @@ const (
 )
 
 // NewBoltDepot creates a depot.Depot backed by BoltDB.
-func NewBoltDepot(db *bolt.DB) (*Depot, error) {
+func NewBoltDepot(db *bolt.DB, opts ...Option) (*Depot, error) {
 	err := db.Update(func(tx *bolt.Tx) error {
-		_, err := tx.CreateBucketIfNotExists([]byte(certBucket))
-		if err != nil {
-			return fmt.Errorf("create bucket: %s", err)
+		for _, name := range []string{certBucket, pendingBucket, revocationBucket} {
+			_, err := tx.CreateBucketIfNotExists([]byte(name))
+			if err != nil {
+				return fmt.Errorf("create bucket: %s", err)
+			}
 		}
 		return nil
 	})
 	if err != nil {
 		return nil, err
 	}
-	return &Depot{db}, nil
+	d := &Depot{DB: db, rand: rand.Reader}
+	for _, opt := range opts {
+		opt(d)
+	}
+	return d, nil
+}
+
+func (db *Depot) CA(pass []byte) ([]*x509.Certificate, crypto.Signer, error) {
+	chain, err := db.CACerts()
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := db.CAKey(pass)
+	if err != nil {
+		return nil, nil, err
+	}
+	return chain, key, nil
 }
 
-func (db *Depot) CA(pass []byte) ([]*x509.Certificate, *rsa.PrivateKey, error) {
+// CACerts returns the CA certificate stored in the database.
+func (db *Depot) CACerts() ([]*x509.Certificate, error) {
 	chain := []*x509.Certificate{}
-	var key *rsa.PrivateKey
 	err := db.View(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte(certBucket))
 		if bucket == nil {
@@ -64,65 +103,263 @@ func (db *Depot) CA(pass []byte) ([]*x509.Certificate, *rsa.PrivateKey, error) {
 			return err
 		}
 		chain = append(chain, cert)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return chain, nil
+}
 
+// CAKey returns the CA key stored in the database, decrypted with pass.
+func (db *Depot) CAKey(pass []byte) (crypto.Signer, error) {
+	var key crypto.Signer
+	err := db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(certBucket))
+		if bucket == nil {
+			return fmt.Errorf("bucket %q not found!", certBucket)
+		}
 		// get ca_key
 		caKey := bucket.Get([]byte("ca_key"))
 		if caKey == nil {
 			return fmt.Errorf("no ca_key in bucket")
 		}
-		key, err = x509.ParsePKCS1PrivateKey(caKey)
+		var err error
+		key, err = parseKey(caKey, pass)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// ImportCA stores the CA certificate and key, replacing the existing ones.
+// Only the first certificate of chain is stored. The key is stored
+// encrypted with pass, it may be nil when the CA key is held by a
+// keyprovider.KeyProvider.
+func (db *Depot) ImportCA(chain []*x509.Certificate, key crypto.Signer, pass []byte) error {
+	var keyPEM []byte
+	if key != nil {
+		var err error
+		keyPEM, err = depot.EncodeKey(key, pass)
 		if err != nil {
 			return err
 		}
-		return nil
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(certBucket))
+		if bucket == nil {
+			return fmt.Errorf("bucket %q not found!", certBucket)
+		}
+		if keyPEM != nil {
+			if err := bucket.Put([]byte("ca_key"), keyPEM); err != nil {
+				return err
+			}
+		}
+		return bucket.Put([]byte("ca_certificate"), chain[0].Raw)
 	})
-	if err != nil {
-		return nil, nil, err
+}
+
+// parseKey parses a key stored by ImportCA, or a PKCS#1 key stored
+// unencrypted by CreateOrLoadKey.
+func parseKey(data, pass []byte) (crypto.Signer, error) {
+	if block, _ := pem.Decode(data); block == nil {
+		return x509.ParsePKCS1PrivateKey(data)
 	}
-	return chain, key, nil
+	return depot.ParseKey(data, pass)
+}
+
+// CertFilename returns the name of a PEM file with the certificate, for
+// hooks which expect one. The file is written to the folder <db>.certs
+// next to the database.
+func (db *Depot) CertFilename(cn string, crt *x509.Certificate) (string, error) {
+	if crt == nil || crt.Raw == nil {
+		return "", fmt.Errorf("%q does not specify a valid certificate", cn)
+	}
+	dir := db.Path() + ".certs"
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	name := filepath.Join(dir, depot.CertFileName(cn, crt.SerialNumber))
+	if _, err := os.Stat(name); err == nil {
+		return name, nil
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: crt.Raw})
+	if err := ioutil.WriteFile(name, data, 0444); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// Stage writes the file of a certificate for hooks, as CertFilename does.
+func (db *Depot) Stage(cn string, crt *x509.Certificate) (string, error) {
+	return db.CertFilename(cn, crt)
+}
+
+// Unstage removes the file of a certificate which is not stored.
+func (db *Depot) Unstage(cn string, crt *x509.Certificate) error {
+	if _, err := db.GetCert(crt.SerialNumber); err != depot.ErrNotFound {
+		return err
+	}
+	err := os.Remove(filepath.Join(db.Path() + ".certs", depot.CertFileName(cn, crt.SerialNumber)))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
 }
 
+// Put stores a certificate and revokes older certificates with the same
+// name as superseded. The certificate and the next serial number are
+// updated in one transaction.
 func (db *Depot) Put(cn string, crt *x509.Certificate) error {
+	return db.put(cn, crt, true)
+}
+
+// PutWithoutSuperseding stores a certificate like Put, but keeps the
+// certificates with the same name valid.
+func (db *Depot) PutWithoutSuperseding(cn string, crt *x509.Certificate) error {
+	return db.put(cn, crt, false)
+}
+
+// Supersede revokes the valid certificates with the same name, except crt.
+func (db *Depot) Supersede(cn string, crt *x509.Certificate) (bool, error) {
+	var revoked bool
+	err := db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(certBucket))
+		if bucket == nil {
+			return fmt.Errorf("bucket %q not found!", certBucket)
+		}
+		revocations := tx.Bucket([]byte(revocationBucket))
+		if revocations == nil {
+			return fmt.Errorf("bucket %q not found!", revocationBucket)
+		}
+		var err error
+		revoked, err = hasCN(bucket, revocations, cn, 0, crt, true)
+		return err
+	})
+	return revoked, err
+}
+
+func (db *Depot) put(cn string, crt *x509.Certificate, supersede bool) error {
 	if crt == nil || crt.Raw == nil {
 		return fmt.Errorf("%q does not specify a valid certificate for storage", cn)
 	}
-	serial, err := db.Serial()
+	serial := crt.SerialNumber
+
+	return db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(certBucket))
+		if bucket == nil {
+			return fmt.Errorf("bucket %q not found!", certBucket)
+		}
+		revocations := tx.Bucket([]byte(revocationBucket))
+		if revocations == nil {
+			return fmt.Errorf("bucket %q not found!", revocationBucket)
+		}
+		if _, err := hasCN(bucket, revocations, cn, 0, crt, supersede); err != nil {
+			return err
+		}
+		name := cn + "." + serial.String()
+		if err := bucket.Put([]byte(name), crt.Raw); err != nil {
+			return err
+		}
+		if db.serialStrategy == depot.SerialRandom {
+			return nil
+		}
+		// keep the next serial above certificates which were not
+		// issued with a serial reserved by Serial
+		next := big.NewInt(2)
+		if k := bucket.Get([]byte("serial")); k != nil {
+			next.SetBytes(k)
+		}
+		if next.Cmp(serial) > 0 {
+			return nil
+		}
+		return bucket.Put([]byte("serial"), new(big.Int).Add(serial, big.NewInt(1)).Bytes())
+	})
+}
+
+// Serial reserves the next serial number, concurrent callers get
+// different serial numbers.
+func (db *Depot) Serial() (*big.Int, error) {
+	s := big.NewInt(2)
+	err := db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(certBucket))
+		if bucket == nil {
+			return fmt.Errorf("bucket %q not found!", certBucket)
+		}
+		if db.serialStrategy == depot.SerialRandom {
+			var err error
+			s, err = db.randomSerial(bucket)
+			return err
+		}
+		if k := bucket.Get([]byte("serial")); k != nil {
+			s.SetBytes(k)
+		}
+		return bucket.Put([]byte("serial"), new(big.Int).Add(s, big.NewInt(1)).Bytes())
+	})
 	if err != nil {
-		return err
+		return nil, err
 	}
+	return s, nil
+}
 
-	err = db.Update(func(tx *bolt.Tx) error {
+// CRLNumber reserves the number of the next CRL, counting up from 1.
+func (db *Depot) CRLNumber() (*big.Int, error) {
+	n := big.NewInt(1)
+	err := db.Update(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte(certBucket))
 		if bucket == nil {
 			return fmt.Errorf("bucket %q not found!", certBucket)
 		}
-		name := cn + "." + serial.String()
-		return bucket.Put([]byte(name), crt.Raw)
+		if k := bucket.Get([]byte("crlnumber")); k != nil {
+			n.SetBytes(k)
+		}
+		return bucket.Put([]byte("crlnumber"), new(big.Int).Add(n, big.NewInt(1)).Bytes())
 	})
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return db.incrementSerial(serial)
+	return n, nil
 }
 
-func (db *Depot) Serial() (*big.Int, error) {
-	s := big.NewInt(2)
-	if !db.hasKey([]byte("serial")) {
-		if err := db.writeSerial(s); err != nil {
+// randomSerial returns a random serial which is not used by a stored
+// certificate.
+func (db *Depot) randomSerial(bucket *bolt.Bucket) (*big.Int, error) {
+	for {
+		serial, err := depot.RandomSerial(db.rand)
+		if err != nil {
+			return nil, err
+		}
+		// certificates are stored as <cn>.<serial>
+		suffix := []byte("." + serial.String())
+		used := false
+		err = bucket.ForEach(func(k, v []byte) error {
+			if bytes.HasSuffix(k, suffix) {
+				used = true
+			}
+			return nil
+		})
+		if err != nil {
 			return nil, err
 		}
-		return s, nil
+		if !used {
+			return serial, nil
+		}
 	}
+}
+
+// NextSerial returns the next serial number without reserving it.
+func (db *Depot) NextSerial() (*big.Int, error) {
+	s := big.NewInt(2)
 	err := db.View(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte(certBucket))
 		if bucket == nil {
 			return fmt.Errorf("bucket %q not found!", certBucket)
 		}
-		k := bucket.Get([]byte("serial"))
-		if k == nil {
-			return fmt.Errorf("key %q not found", "serial")
+		if k := bucket.Get([]byte("serial")); k != nil {
+			s.SetBytes(k)
 		}
-		s = s.SetBytes(k)
 		return nil
 	})
 	if err != nil {
@@ -131,6 +368,11 @@ func (db *Depot) Serial() (*big.Int, error) {
 	return s, nil
 }
 
+// SetNextSerial sets the next serial number.
+func (db *Depot) SetNextSerial(s *big.Int) error {
+	return db.writeSerial(s)
+}
+
 func (db *Depot) writeSerial(s *big.Int) error {
 	err := db.Update(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte(certBucket))
@@ -142,55 +384,125 @@ func (db *Depot) writeSerial(s *big.Int) error {
 	return err
 }
 
-func (db *Depot) hasKey(name []byte) bool {
-	var present bool
-	db.View(func(tx *bolt.Tx) error {
+func (db *Depot) incrementSerial(s *big.Int) error {
+	serial := s.Add(s, big.NewInt(1))
+	err := db.Update(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte(certBucket))
 		if bucket == nil {
 			return fmt.Errorf("bucket %q not found!", certBucket)
 		}
-		k := bucket.Get([]byte("serial"))
-		if k != nil {
-			present = true
-		}
-		return nil
+		return bucket.Put([]byte("serial"), []byte(serial.Bytes()))
 	})
-	return present
+	return err
 }
 
-func (db *Depot) incrementSerial(s *big.Int) error {
-	serial := s.Add(s, big.NewInt(1))
-	err := db.Update(func(tx *bolt.Tx) error {
+// GetCert looks up an issued certificate by serial number.
+func (db *Depot) GetCert(serial *big.Int) (*x509.Certificate, error) {
+	var cert *x509.Certificate
+	err := db.View(func(tx *bolt.Tx) error {
 		bucket := tx.Bucket([]byte(certBucket))
 		if bucket == nil {
 			return fmt.Errorf("bucket %q not found!", certBucket)
 		}
-		return bucket.Put([]byte("serial"), []byte(serial.Bytes()))
+		var err error
+		cert, err = getCert(bucket, serial)
+		return err
 	})
-	return err
+	if err != nil {
+		return nil, err
+	}
+	if cert == nil {
+		return nil, depot.ErrNotFound
+	}
+	return cert, nil
+}
+
+// getCert returns the certificate with serial, or nil.
+func getCert(bucket *bolt.Bucket, serial *big.Int) (*x509.Certificate, error) {
+	var cert *x509.Certificate
+	// certificates are stored as <cn>.<serial>
+	suffix := []byte("." + serial.String())
+	err := bucket.ForEach(func(k, v []byte) error {
+		if cert != nil || !bytes.HasSuffix(k, suffix) {
+			return nil
+		}
+		c, err := x509.ParseCertificate(append([]byte(nil), v...))
+		if err != nil || c.SerialNumber.Cmp(serial) != 0 {
+			return nil
+		}
+		cert = c
+		return nil
+	})
+	return cert, err
 }
 
+// HasCN checks whether a certificate for cn may be issued: it fails if
+// a valid certificate with the same name does not expire within allowTime
+// days, unless allowTime is 0. With revokeOldCertificate, the valid
+// certificates with the same name are revoked as superseded.
 func (db *Depot) HasCN(cn string, allowTime int, cert *x509.Certificate, revokeOldCertificate bool) (bool, error) {
-	// TODO: implement allowTime
-	// TODO: implement revocation
 	if cert == nil {
 		return false, errors.New("nil certificate provided")
 	}
-	var hasCN bool
-	err := db.View(func(tx *bolt.Tx) error {
-		// TODO: "scep_certificates" is internal const in micromdm/scep
-		curs := tx.Bucket([]byte("scep_certificates")).Cursor()
-		prefix := []byte(cert.Subject.CommonName)
-		for k, v := curs.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = curs.Next() {
-			if bytes.Compare(v, cert.Raw) == 0 {
-				hasCN = true
-				return nil
-			}
+	check := func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(certBucket))
+		if bucket == nil {
+			return fmt.Errorf("bucket %q not found!", certBucket)
+		}
+		revocations := tx.Bucket([]byte(revocationBucket))
+		if revocations == nil {
+			return fmt.Errorf("bucket %q not found!", revocationBucket)
 		}
+		_, err := hasCN(bucket, revocations, cn, allowTime, cert, revokeOldCertificate)
+		return err
+	}
+	var err error
+	if revokeOldCertificate {
+		err = db.Update(check)
+	} else {
+		err = db.View(check)
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
 
-		return nil
-	})
-	return hasCN, err
+// hasCN implements HasCN within a transaction, and reports whether
+// certificates were revoked.
+func hasCN(bucket, revocations *bolt.Bucket, cn string, allowTime int, cert *x509.Certificate, revokeOldCertificate bool) (bool, error) {
+	now := time.Now().UTC()
+	renewable := now.AddDate(0, 0, allowTime)
+	var old []*big.Int
+	// certificates are stored as <cn>.<serial>
+	prefix := []byte(cn + ".")
+	curs := bucket.Cursor()
+	for k, v := curs.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = curs.Next() {
+		// skip names which only start with cn
+		if bytes.IndexByte(k[len(prefix):], '.') >= 0 {
+			continue
+		}
+		c, err := x509.ParseCertificate(append([]byte(nil), v...))
+		if err != nil {
+			return false, err
+		}
+		if c.SerialNumber.Cmp(cert.SerialNumber) == 0 || revocations.Get(c.SerialNumber.Bytes()) != nil {
+			continue
+		}
+		if allowTime > 0 && c.NotAfter.After(renewable) {
+			return false, fmt.Errorf("CN %s already exists", cn)
+		}
+		old = append(old, c.SerialNumber)
+	}
+	if !revokeOldCertificate {
+		return false, nil
+	}
+	for _, serial := range old {
+		if err := revoke(revocations, serial, depot.ReasonSuperseded, now); err != nil {
+			return false, err
+		}
+	}
+	return len(old) > 0, nil
 }
 
 func (db *Depot) CreateOrLoadKey(bits int) (*rsa.PrivateKey, error) {
@@ -207,8 +519,15 @@ func (db *Depot) CreateOrLoadKey(bits int) (*rsa.PrivateKey, error) {
 		if priv == nil {
 			return nil
 		}
-		key, err = x509.ParsePKCS1PrivateKey(priv)
-		return err
+		signer, err := parseKey(priv, nil)
+		if err != nil {
+			return err
+		}
+		var ok bool
+		if key, ok = signer.(*rsa.PrivateKey); !ok {
+			return errors.New("ca_key is not an RSA key")
+		}
+		return nil
 	})
 	if err != nil {
 		return nil, err
@@ -279,7 +598,7 @@ func (db *Depot) CreateOrLoadCA(key *rsa.PrivateKey, years int, org, country str
 		Subject:            subject,
 		NotBefore:          time.Now().Add(-600).UTC(),
 		NotAfter:           time.Now().AddDate(years, 0, 0).UTC(),
-		KeyUsage:           x509.KeyUsageCertSign,
+		KeyUsage:           x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
 		ExtKeyUsage:        nil,
 		UnknownExtKeyUsage: nil,
 
@@ -330,8 +649,10 @@ func generateSubjectKeyID(pub crypto.PublicKey) ([]byte, error) {
 		if err != nil {
 			return nil, err
 		}
+	case *ecdsa.PublicKey:
+		pubBytes = elliptic.Marshal(pub.Curve, pub.X, pub.Y)
 	default:
-		return nil, errors.New("only RSA public key is supported")
+		return nil, errors.New("only RSA and ECDSA public keys are supported")
 	}
 
 	hash := sha1.Sum(pubBytes)
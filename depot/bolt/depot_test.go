@@ -1,13 +1,23 @@
 package bolt
 
 import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
 	"io/ioutil"
 	"math/big"
 	"os"
+	"path/filepath"
 	"reflect"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/boltdb/bolt"
+	"github.com/syncsynchalt/scep/depot"
 )
 
 // createDepot creates a Bolt database in a temporary location.
@@ -52,6 +62,47 @@ func TestDepot_Serial(t *testing.T) {
 	}
 }
 
+func TestDepot_CRLNumber(t *testing.T) {
+	db := createDB(0666, nil)
+	for _, want := range []int64{1, 2, 3} {
+		got, err := db.CRLNumber()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Cmp(big.NewInt(want)) != 0 {
+			t.Errorf("Depot.CRLNumber() = %v, want %d", got, want)
+		}
+	}
+}
+
+func TestDepot_SerialConcurrent(t *testing.T) {
+	db := createDB(0666, nil)
+	const n = 50
+	serials := make(chan *big.Int, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s, err := db.Serial()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			serials <- s
+		}()
+	}
+	wg.Wait()
+	close(serials)
+	seen := make(map[string]bool)
+	for s := range serials {
+		if seen[s.String()] {
+			t.Errorf("serial %s reserved twice", s)
+		}
+		seen[s.String()] = true
+	}
+}
+
 func TestDepot_writeSerial(t *testing.T) {
 	db := createDB(0666, nil)
 	type args struct {
@@ -146,3 +197,140 @@ func TestDepot_CreateOrLoadCA(t *testing.T) {
 		}
 	}
 }
+
+func TestDepot_ImportCA(t *testing.T) {
+	db := createDB(0666, nil)
+	key, err := db.CreateOrLoadKey(1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := db.CreateOrLoadCA(key, 10, "MicroMDM", "US")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// keys created by CreateOrLoadKey are not encrypted
+	if _, _, err := db.CA([]byte("ignored")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.ImportCA([]*x509.Certificate{ca}, key, []byte("secret")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.CAKey([]byte("wrong")); err == nil {
+		t.Error("CA key decrypted with the wrong password")
+	}
+	chain, caKey, err := db.CA([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !chain[0].Equal(ca) {
+		t.Error("CA certificate changed")
+	}
+	if !key.PublicKey.Equal(caKey.Public()) {
+		t.Error("CA key changed")
+	}
+}
+
+func TestDepot_HasCN(t *testing.T) {
+	db := createDB(0666, nil)
+	now := time.Now()
+	old := namedCert(t, big.NewInt(2), "device", now.Add(10*24*time.Hour))
+	other := namedCert(t, big.NewInt(3), "device.local", now.Add(30*24*time.Hour))
+	for _, cert := range []*x509.Certificate{old, other} {
+		if err := db.Put(cert.Subject.CommonName, cert); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	renewal := namedCert(t, big.NewInt(4), "device", now.Add(365*24*time.Hour))
+	if _, err := db.HasCN("device", 7, renewal, false); err == nil {
+		t.Error("renewal allowed outside of the renewal window")
+	}
+	if _, err := db.HasCN("device", 14, renewal, false); err != nil {
+		t.Errorf("renewal within the renewal window: %s", err)
+	}
+	if _, err := db.HasCN("device", 0, renewal, false); err != nil {
+		t.Errorf("renewal without a renewal window: %s", err)
+	}
+
+	// Put revokes the old certificate, but not the one of device.local
+	if err := db.Put("device", renewal); err != nil {
+		t.Fatal(err)
+	}
+	records, err := db.List(depot.CertFilter{Status: depot.CertRevoked})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].Certificate.SerialNumber.Cmp(old.SerialNumber) != 0 {
+		t.Fatalf("have %d revoked certificates, want serial %s", len(records), old.SerialNumber)
+	}
+	if have, want := records[0].RevocationReason, depot.ReasonSuperseded; have != want {
+		t.Errorf("have reason %d, want %d", have, want)
+	}
+
+	name, err := db.CertFilename("device", renewal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(filepath.Dir(name))
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if block, _ := pem.Decode(data); block == nil || !bytes.Equal(block.Bytes, renewal.Raw) {
+		t.Errorf("%s does not hold the certificate", name)
+	}
+}
+
+func TestDepot_RandomSerial(t *testing.T) {
+	db := createDB(0666, nil)
+	db.serialStrategy = depot.SerialRandom
+	// the first two serials collide
+	db.rand = bytes.NewReader(append(bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 16)...))
+
+	first, err := db.Serial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.BitLen() < 64 {
+		t.Errorf("serial %s has less than 64 bits", first)
+	}
+	if err := db.Put("random", testCert(t, first)); err != nil {
+		t.Fatal(err)
+	}
+	second, err := db.Serial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.Cmp(first) == 0 {
+		t.Errorf("serial %s was reserved twice", first)
+	}
+}
+
+func testCert(t *testing.T, serial *big.Int) *x509.Certificate {
+	return namedCert(t, serial, "random", time.Now().Add(time.Hour))
+}
+
+func namedCert(t *testing.T, serial *big.Int, cn string, notAfter time.Time) *x509.Certificate {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn},
+		SubjectKeyId: serial.Bytes(),
+		NotBefore:    notAfter.Add(-2 * time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
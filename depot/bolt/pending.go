@@ -0,0 +1,139 @@
+package bolt
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/syncsynchalt/scep/depot"
+)
+
+const pendingBucket = "scep_pending"
+
+// PutPending stores a new pending request.
+func (db *Depot) PutPending(tid string, csr []byte) error {
+	req := &depot.PendingRequest{
+		TransactionID: tid,
+		CSR:           csr,
+		Status:        depot.StatusPending,
+		Created:       time.Now().UTC(),
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(pendingBucket))
+		if bucket == nil {
+			return fmt.Errorf("bucket %q not found!", pendingBucket)
+		}
+		if bucket.Get([]byte(tid)) != nil {
+			return fmt.Errorf("pending request %q already exists", tid)
+		}
+		return putPending(bucket, req)
+	})
+}
+
+// Pending returns the pending request for the transaction ID.
+func (db *Depot) Pending(tid string) (*depot.PendingRequest, error) {
+	var req *depot.PendingRequest
+	err := db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(pendingBucket))
+		if bucket == nil {
+			return fmt.Errorf("bucket %q not found!", pendingBucket)
+		}
+		var err error
+		req, err = getPending(bucket, tid)
+		return err
+	})
+	return req, err
+}
+
+// ListPending returns all stored requests.
+func (db *Depot) ListPending() ([]*depot.PendingRequest, error) {
+	var reqs []*depot.PendingRequest
+	err := db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(pendingBucket))
+		if bucket == nil {
+			return fmt.Errorf("bucket %q not found!", pendingBucket)
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			var req depot.PendingRequest
+			if err := json.Unmarshal(v, &req); err != nil {
+				return err
+			}
+			reqs = append(reqs, &req)
+			return nil
+		})
+	})
+	return reqs, err
+}
+
+// SetPendingStatus updates the status of a stored request.
+func (db *Depot) SetPendingStatus(tid string, status depot.PendingStatus) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(pendingBucket))
+		if bucket == nil {
+			return fmt.Errorf("bucket %q not found!", pendingBucket)
+		}
+		req, err := getPending(bucket, tid)
+		if err != nil {
+			return err
+		}
+		req.Status = status
+		return putPending(bucket, req)
+	})
+}
+
+// SwapPendingStatus updates the status of a stored request if it is old.
+func (db *Depot) SwapPendingStatus(tid string, old, new depot.PendingStatus) (bool, error) {
+	var swapped bool
+	err := db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(pendingBucket))
+		if bucket == nil {
+			return fmt.Errorf("bucket %q not found!", pendingBucket)
+		}
+		req, err := getPending(bucket, tid)
+		if err != nil {
+			return err
+		}
+		if req.Status != old {
+			return nil
+		}
+		req.Status = new
+		swapped = true
+		return putPending(bucket, req)
+	})
+	return swapped, err
+}
+
+// DeletePending removes a stored request.
+func (db *Depot) DeletePending(tid string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(pendingBucket))
+		if bucket == nil {
+			return fmt.Errorf("bucket %q not found!", pendingBucket)
+		}
+		if bucket.Get([]byte(tid)) == nil {
+			return depot.ErrNotFound
+		}
+		return bucket.Delete([]byte(tid))
+	})
+}
+
+func getPending(bucket *bolt.Bucket, tid string) (*depot.PendingRequest, error) {
+	v := bucket.Get([]byte(tid))
+	if v == nil {
+		return nil, depot.ErrNotFound
+	}
+	var req depot.PendingRequest
+	if err := json.Unmarshal(v, &req); err != nil {
+		return nil, err
+	}
+	return &req, nil
+}
+
+func putPending(bucket *bolt.Bucket, req *depot.PendingRequest) error {
+	data, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	return bucket.Put([]byte(req.TransactionID), data)
+}
@@ -0,0 +1,173 @@
+package bolt
+
+import (
+	"bytes"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/syncsynchalt/scep/depot"
+)
+
+// revocationBucket holds a revocation for each revoked certificate,
+// keyed by serial number.
+const revocationBucket = "scep_revocations"
+
+type revocation struct {
+	RevokedAt time.Time              `json:"revoked_at"`
+	Reason    depot.RevocationReason `json:"reason"`
+}
+
+// Revoke marks a certificate as revoked.
+func (db *Depot) Revoke(serial *big.Int, reason depot.RevocationReason) error {
+	// the RFC 5280 reason codes which the file depot can store, 7 is not used
+	if reason < 0 || reason > 8 || reason == 7 {
+		return fmt.Errorf("unknown revocation reason %d", reason)
+	}
+	return db.Update(func(tx *bolt.Tx) error {
+		certs := tx.Bucket([]byte(certBucket))
+		if certs == nil {
+			return fmt.Errorf("bucket %q not found!", certBucket)
+		}
+		revocations := tx.Bucket([]byte(revocationBucket))
+		if revocations == nil {
+			return fmt.Errorf("bucket %q not found!", revocationBucket)
+		}
+		cert, err := getCert(certs, serial)
+		if err != nil {
+			return err
+		}
+		if cert == nil {
+			return depot.ErrNotFound
+		}
+		return revoke(revocations, serial, reason, time.Now().UTC())
+	})
+}
+
+// revoke adds a revocation unless the certificate is already revoked.
+func revoke(revocations *bolt.Bucket, serial *big.Int, reason depot.RevocationReason, now time.Time) error {
+	if revocations.Get(serial.Bytes()) != nil {
+		return nil
+	}
+	data, err := json.Marshal(revocation{
+		RevokedAt: now.Truncate(time.Second),
+		Reason:    reason,
+	})
+	if err != nil {
+		return err
+	}
+	return revocations.Put(serial.Bytes(), data)
+}
+
+// RevokedCerts returns the revoked certificates.
+func (db *Depot) RevokedCerts() ([]pkix.RevokedCertificate, error) {
+	var revoked []pkix.RevokedCertificate
+	err := db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket([]byte(revocationBucket))
+		if bucket == nil {
+			return fmt.Errorf("bucket %q not found!", revocationBucket)
+		}
+		return bucket.ForEach(func(k, v []byte) error {
+			var r revocation
+			if err := json.Unmarshal(v, &r); err != nil {
+				return err
+			}
+			rc := pkix.RevokedCertificate{
+				SerialNumber:   new(big.Int).SetBytes(k),
+				RevocationTime: r.RevokedAt,
+			}
+			ext, err := r.Reason.Extension()
+			if err != nil {
+				return err
+			}
+			if ext != nil {
+				rc.Extensions = []pkix.Extension{*ext}
+			}
+			revoked = append(revoked, rc)
+			return nil
+		})
+	})
+	return revoked, err
+}
+
+// List returns the stored certificates selected by filter.
+func (db *Depot) List(filter depot.CertFilter) ([]*depot.CertRecord, error) {
+	now := time.Now()
+	var records []*depot.CertRecord
+	err := db.View(func(tx *bolt.Tx) error {
+		certs := tx.Bucket([]byte(certBucket))
+		if certs == nil {
+			return fmt.Errorf("bucket %q not found!", certBucket)
+		}
+		revocations := tx.Bucket([]byte(revocationBucket))
+		if revocations == nil {
+			return fmt.Errorf("bucket %q not found!", revocationBucket)
+		}
+		// certificates are stored as <cn>.<serial>, next to the serial
+		// and the CA certificate and key
+		prefix := []byte(filter.CN + ".")
+		return certs.ForEach(func(k, v []byte) error {
+			if bytes.IndexByte(k, '.') < 0 || filter.CN != "" && !bytes.HasPrefix(k, prefix) {
+				return nil
+			}
+			cert, err := x509.ParseCertificate(append([]byte(nil), v...))
+			if err != nil {
+				return err
+			}
+			record := &depot.CertRecord{
+				Name:        strings.TrimSuffix(string(k), "."+cert.SerialNumber.String()),
+				Certificate: cert,
+				Status:      depot.CertStatusAt(cert, now),
+			}
+			if data := revocations.Get(cert.SerialNumber.Bytes()); data != nil {
+				var r revocation
+				if err := json.Unmarshal(data, &r); err != nil {
+					return err
+				}
+				record.Status = depot.CertRevoked
+				record.RevokedAt = r.RevokedAt
+				record.RevocationReason = r.Reason
+			}
+			if filter.Match(record) {
+				records = append(records, record)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Certificate.SerialNumber.Cmp(records[j].Certificate.SerialNumber) < 0
+	})
+	return records, nil
+}
+
+// ImportCert stores a certificate under its name, with its revocation.
+func (db *Depot) ImportCert(record *depot.CertRecord) error {
+	cert := record.Certificate
+	return db.Update(func(tx *bolt.Tx) error {
+		certs := tx.Bucket([]byte(certBucket))
+		if certs == nil {
+			return fmt.Errorf("bucket %q not found!", certBucket)
+		}
+		revocations := tx.Bucket([]byte(revocationBucket))
+		if revocations == nil {
+			return fmt.Errorf("bucket %q not found!", revocationBucket)
+		}
+		name := record.Name + "." + cert.SerialNumber.String()
+		if err := certs.Put([]byte(name), cert.Raw); err != nil {
+			return err
+		}
+		if record.Status != depot.CertRevoked {
+			return nil
+		}
+		return revoke(revocations, cert.SerialNumber, record.RevocationReason, record.RevokedAt)
+	})
+}
@@ -1,16 +1,402 @@
 package depot
 
 import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
 	"math/big"
+	"net/url"
+	"strings"
+	"time"
 )
 
+// ErrNotFound is returned by depot lookups when no matching entry exists.
+var ErrNotFound = errors.New("depot: not found")
+
 // Depot is a repository for managing certificates
 type Depot interface {
-	CA(pass []byte) ([]*x509.Certificate, *rsa.PrivateKey, error)
+	// CA returns the CA certificate chain and the CA key,
+	// which may be an RSA or ECDSA key.
+	CA(pass []byte) ([]*x509.Certificate, crypto.Signer, error)
 	Put(name string, crt *x509.Certificate) error
 	CertFilename(name string, crt *x509.Certificate) (string, error)
 	Serial() (*big.Int, error)
 	HasCN(cn string, allowTime int, cert *x509.Certificate, revokeOldCertificate bool) (bool, error)
 }
+
+// SerialStrategy selects how a depot allocates serial numbers.
+type SerialStrategy int
+
+// Possible serial strategies.
+const (
+	SerialSequential SerialStrategy = iota // counting up from 2
+	SerialRandom                           // random 128 bit serials
+)
+
+// RandomSerial returns a random positive serial number of up to 128 bits.
+// Depots check it against the serials they already issued.
+func RandomSerial(r io.Reader) (*big.Int, error) {
+	max := new(big.Int).Lsh(big.NewInt(1), 128)
+	for {
+		serial, err := rand.Int(r, max)
+		if err != nil {
+			return nil, err
+		}
+		if serial.Sign() > 0 {
+			return serial, nil
+		}
+	}
+}
+
+// CACertDepot is implemented by depots which can load the CA certificate
+// chain on its own, for use with a CA key held by a keyprovider.KeyProvider.
+type CACertDepot interface {
+	CACerts() ([]*x509.Certificate, error)
+}
+
+// NextCADepot is implemented by depots which can stage the next CA
+// certificate and key, which replace the current ones at a CA rollover.
+type NextCADepot interface {
+	// NextCA returns nil certificates if no next CA is staged.
+	NextCA(pass []byte) ([]*x509.Certificate, crypto.Signer, error)
+}
+
+// RolloverDepot is implemented by depots which record a CA rollover. The
+// replaced CA is kept as the previous CA, which still signs the CRL of the
+// certificates it issued.
+type RolloverDepot interface {
+	NextCADepot
+
+	// RolloverCA makes the next CA the current one, and the current CA
+	// the previous one. It does nothing if no next CA is staged, such as
+	// after another server sharing the depot rolled over.
+	RolloverCA() error
+
+	// PreviousCA returns nil certificates if the CA was never rolled over.
+	PreviousCA(pass []byte) ([]*x509.Certificate, crypto.Signer, error)
+}
+
+// RADepot is implemented by depots which hold an RA (registration
+// authority) certificate and key. SCEP messages are encrypted to and signed
+// by the RA instead of the CA, which is required when the CA key can not be
+// used for RSA key transport, such as an ECDSA CA key.
+type RADepot interface {
+	// RA returns a nil certificate if no RA is configured.
+	RA(pass []byte) (*x509.Certificate, *rsa.PrivateKey, error)
+}
+
+// CertGetter is implemented by depots which can look up
+// issued certificates by serial number.
+type CertGetter interface {
+	// GetCert returns ErrNotFound if there is no such certificate.
+	GetCert(serial *big.Int) (*x509.Certificate, error)
+}
+
+// RevocationLister is implemented by depots which keep track of
+// revoked certificates. It is used to build CRLs.
+type RevocationLister interface {
+	RevokedCerts() ([]pkix.RevokedCertificate, error)
+}
+
+// CRLNumberer is implemented by depots which count the CRLs of the CA,
+// so that CRL numbers keep increasing across restarts and between
+// servers sharing the depot.
+type CRLNumberer interface {
+	// CRLNumber reserves the number of the next CRL.
+	CRLNumber() (*big.Int, error)
+}
+
+// RevocationReason is a CRL reason code as defined in RFC 5280, 5.3.1.
+type RevocationReason int
+
+// Revocation reasons used by the SCEP server.
+const (
+	ReasonUnspecified          RevocationReason = 0
+	ReasonKeyCompromise        RevocationReason = 1
+	ReasonSuperseded           RevocationReason = 4
+	ReasonCessationOfOperation RevocationReason = 5
+)
+
+var oidCRLReason = asn1.ObjectIdentifier{2, 5, 29, 21}
+
+// Extension returns the reason code extension of a CRL entry, or nil for
+// ReasonUnspecified, which should not be included (RFC 5280, 5.3.1).
+func (r RevocationReason) Extension() (*pkix.Extension, error) {
+	if r == ReasonUnspecified {
+		return nil, nil
+	}
+	value, err := asn1.Marshal(asn1.Enumerated(r))
+	if err != nil {
+		return nil, err
+	}
+	return &pkix.Extension{Id: oidCRLReason, Value: value}, nil
+}
+
+// Stager is implemented by depots which can write the file of a signed
+// certificate before it is put, so that a CertSuccesser can check it
+// before the certificate is recorded as issued.
+type Stager interface {
+	// Stage writes the certificate file and returns its name, which
+	// CertFilename returns as well.
+	Stage(name string, crt *x509.Certificate) (string, error)
+
+	// Unstage removes the file of a staged certificate which was not
+	// put. It does nothing for a certificate which was put.
+	Unstage(name string, crt *x509.Certificate) error
+}
+
+// Superseder is implemented by depots which can put a certificate without
+// revoking the valid certificates with the same name, as Put does, so that
+// they are only superseded once the certificate is delivered.
+type Superseder interface {
+	// PutWithoutSuperseding stores the certificate like Put, but keeps
+	// the other certificates with the same name valid.
+	PutWithoutSuperseding(name string, crt *x509.Certificate) error
+
+	// Supersede revokes the valid certificates with the same name as
+	// superseded, except crt, and reports whether there were any.
+	Supersede(name string, crt *x509.Certificate) (bool, error)
+}
+
+// Revoker is implemented by depots which can revoke an issued certificate.
+type Revoker interface {
+	// Revoke returns ErrNotFound if there is no such certificate.
+	// Revoking a certificate which is already revoked is not an error.
+	Revoke(serial *big.Int, reason RevocationReason) error
+}
+
+// CertStatus is the state of an issued certificate.
+type CertStatus string
+
+// Possible states of an issued certificate.
+const (
+	CertValid   CertStatus = "valid"
+	CertRevoked CertStatus = "revoked"
+	CertExpired CertStatus = "expired"
+)
+
+// CertRecord is an issued certificate and its state in the depot.
+type CertRecord struct {
+	Name             string // the name the certificate was stored under
+	Certificate      *x509.Certificate
+	Status           CertStatus
+	RevokedAt        time.Time // zero unless revoked
+	RevocationReason RevocationReason
+}
+
+// CertFilter selects certificates from a Repository.
+// Fields with their zero value match any certificate.
+type CertFilter struct {
+	CN            string
+	Status        CertStatus
+	ExpiresAfter  time.Time
+	ExpiresBefore time.Time
+	SubjectKeyID  []byte
+	PublicKeyHash []byte // see PublicKeyHash
+}
+
+// Match reports whether the record is selected by the filter.
+func (f *CertFilter) Match(r *CertRecord) bool {
+	cert := r.Certificate
+	switch {
+	case f.CN != "" && cert.Subject.CommonName != f.CN:
+		return false
+	case f.Status != "" && r.Status != f.Status:
+		return false
+	case !f.ExpiresAfter.IsZero() && !cert.NotAfter.After(f.ExpiresAfter):
+		return false
+	case !f.ExpiresBefore.IsZero() && !cert.NotAfter.Before(f.ExpiresBefore):
+		return false
+	case f.SubjectKeyID != nil && !bytes.Equal(cert.SubjectKeyId, f.SubjectKeyID):
+		return false
+	case f.PublicKeyHash != nil && !bytes.Equal(PublicKeyHash(cert), f.PublicKeyHash):
+		return false
+	}
+	return true
+}
+
+// PublicKeyHash returns the SHA-256 hash of the SubjectPublicKeyInfo
+// of the certificate.
+func PublicKeyHash(cert *x509.Certificate) []byte {
+	hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return hash[:]
+}
+
+// CertStatusAt returns the status of a certificate which is not revoked.
+func CertStatusAt(cert *x509.Certificate, now time.Time) CertStatus {
+	if now.After(cert.NotAfter) {
+		return CertExpired
+	}
+	return CertValid
+}
+
+// Repository is implemented by depots which can be queried for the
+// certificates they issued.
+type Repository interface {
+	CertGetter
+	RevocationLister
+	Revoker
+
+	// List returns the certificates selected by filter, ordered by
+	// serial number.
+	List(filter CertFilter) ([]*CertRecord, error)
+}
+
+// Exporter is implemented by depots whose CA and certificates can be
+// copied to another depot.
+type Exporter interface {
+	Repository
+	CACertDepot
+	CAKey(pass []byte) (crypto.Signer, error)
+	// NextSerial returns the next sequential serial number without
+	// reserving it.
+	NextSerial() (*big.Int, error)
+}
+
+// Importer is implemented by depots which can take over the CA and the
+// certificates of another depot.
+type Importer interface {
+	Exporter
+	// ImportCA stores the CA, with the key encrypted with pass.
+	// key may be nil when it is held by a keyprovider.KeyProvider.
+	ImportCA(chain []*x509.Certificate, key crypto.Signer, pass []byte) error
+	// ImportCert stores a certificate under its name with its revocation,
+	// unlike Put it does not revoke older certificates.
+	ImportCert(record *CertRecord) error
+	SetNextSerial(serial *big.Int) error
+}
+
+const (
+	rsaPrivateKeyPEMBlockType = "RSA PRIVATE KEY"
+	ecPrivateKeyPEMBlockType  = "EC PRIVATE KEY"
+)
+
+// EncodeKey returns the PEM encoded key, encrypted with pass unless it
+// is empty.
+func EncodeKey(key crypto.Signer, pass []byte) ([]byte, error) {
+	var block *pem.Block
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		block = &pem.Block{Type: rsaPrivateKeyPEMBlockType, Bytes: x509.MarshalPKCS1PrivateKey(key)}
+	case *ecdsa.PrivateKey:
+		der, err := x509.MarshalECPrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		block = &pem.Block{Type: ecPrivateKeyPEMBlockType, Bytes: der}
+	default:
+		return nil, errors.New("only RSA and ECDSA keys are supported")
+	}
+	if len(pass) > 0 {
+		var err error
+		block, err = x509.EncryptPEMBlock(rand.Reader, block.Type, block.Bytes, pass, x509.PEMCipherAES256)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return pem.EncodeToMemory(block), nil
+}
+
+// ParseKey parses a PEM encoded RSA or ECDSA key, which is decrypted
+// with pass if it is encrypted.
+func ParseKey(data, pass []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("PEM decode failed")
+	}
+	der := block.Bytes
+	if x509.IsEncryptedPEMBlock(block) {
+		var err error
+		der, err = x509.DecryptPEMBlock(block, pass)
+		if err != nil {
+			return nil, err
+		}
+	}
+	switch block.Type {
+	case rsaPrivateKeyPEMBlockType:
+		return x509.ParsePKCS1PrivateKey(der)
+	case ecPrivateKeyPEMBlockType:
+		return x509.ParseECPrivateKey(der)
+	}
+	return nil, fmt.Errorf("unknown key type %q", block.Type)
+}
+
+// CertFileName returns the name of a PEM file for a certificate stored
+// under name, which is safe to create in a folder of certificates.
+// Characters of name other than letters, digits and "-_.@" are percent
+// encoded, as is a leading ".", and the serial number keeps the files of
+// different certificates apart.
+func CertFileName(name string, serial *big.Int) string {
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '@', c == '.' && i > 0:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String() + "." + serial.String() + ".pem"
+}
+
+// NameFromCertFileName returns the name under which the certificate with
+// serial was stored in the file from CertFileName.
+func NameFromCertFileName(filename string, serial *big.Int) (string, error) {
+	escaped := strings.TrimSuffix(filename, "."+serial.String()+".pem")
+	if escaped == filename {
+		return "", fmt.Errorf("%q is not a file name for serial %s", filename, serial)
+	}
+	return url.PathUnescape(escaped)
+}
+
+// PendingStatus is the approval state of a pending certificate request.
+type PendingStatus string
+
+// Possible states of a pending certificate request.
+const (
+	StatusPending  PendingStatus = "pending"
+	StatusApproved PendingStatus = "approved"
+	StatusRejected PendingStatus = "rejected"
+	StatusIssued   PendingStatus = "issued" // kept to answer retransmitted polls
+)
+
+// PendingRequest is a certificate request awaiting manual approval.
+type PendingRequest struct {
+	TransactionID string
+	CSR           []byte // DER encoded PKCS#10 request
+	Status        PendingStatus
+	Created       time.Time
+}
+
+// PendingStore persists certificate requests which await manual approval,
+// keyed by their SCEP transaction ID.
+type PendingStore interface {
+	PutPending(transactionID string, csr []byte) error
+	// Pending returns ErrNotFound if there is no such request.
+	Pending(transactionID string) (*PendingRequest, error)
+	ListPending() ([]*PendingRequest, error)
+	SetPendingStatus(transactionID string, status PendingStatus) error
+	DeletePending(transactionID string) error
+}
+
+// PendingSwapper is implemented by PendingStores which can change the
+// status of a request atomically, so that only one of concurrent polls
+// issues the certificate of an approved request.
+type PendingSwapper interface {
+	// SwapPendingStatus sets the status of the request to new if it is
+	// old, and reports whether it did. It returns ErrNotFound if there is
+	// no such request.
+	SwapPendingStatus(transactionID string, old, new PendingStatus) (bool, error)
+}
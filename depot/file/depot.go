@@ -3,8 +3,11 @@ package file
 import (
 	"bufio"
 	"bytes"
+	"crypto"
+	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/pem"
 	"errors"
 	"fmt"
@@ -13,28 +16,131 @@ import (
 	"math/big"
 	"os"
 	"path/filepath"
-	"strconv"
 	"strings"
+	"sync"
 	"time"
+
+	"github.com/syncsynchalt/scep/depot"
 )
 
+// Option is an optional argument to NewFileDepot.
+type Option func(*fileDepot)
+
+// WithSerialStrategy selects how serial numbers are allocated,
+// the default is depot.SerialSequential.
+func WithSerialStrategy(strategy depot.SerialStrategy) Option {
+	return func(d *fileDepot) {
+		d.serialStrategy = strategy
+	}
+}
+
+// WithShardedLayout stores new certificate files in 256 folders
+// certs/00 to certs/ff, by the last byte of their serial number. Once the
+// certs folder exists, the depot is sharded without the option as well.
+func WithShardedLayout() Option {
+	return func(d *fileDepot) {
+		d.sharded = true
+	}
+}
+
 // NewFileDepot returns a new cert depot.
-func NewFileDepot(path string) (*fileDepot, error) {
+func NewFileDepot(path string, opts ...Option) (*fileDepot, error) {
 	f, err := os.OpenFile(fmt.Sprintf("%s/index.txt", path),
 		os.O_RDONLY|os.O_CREATE, 0666)
 	if err != nil {
 		return nil, err
 	}
 	defer f.Close()
-	return &fileDepot{dirPath: path}, nil
+	d := &fileDepot{dirPath: path, rand: rand.Reader}
+	for _, opt := range opts {
+		opt(d)
+	}
+	if d.sharded {
+		if err := os.MkdirAll(d.path(certsDir), 0755); err != nil {
+			return nil, err
+		}
+	} else if fi, err := os.Stat(d.path(certsDir)); err == nil && fi.IsDir() {
+		d.sharded = true
+	}
+	// load the index of the CA database
+	if err := d.migrateIndex(); err != nil {
+		return nil, err
+	}
+	if err := d.finishRollover(); err != nil {
+		return nil, err
+	}
+	return d, nil
 }
 
 type fileDepot struct {
-	dirPath string
+	dirPath        string
+	serialStrategy depot.SerialStrategy
+	rand           io.Reader // source of random serials
+	sharded        bool      // see WithShardedLayout
+
+	// mtx serializes writes within the process, the lock file
+	// between processes sharing the depot.
+	mtx sync.Mutex
+
+	// idxMtx guards idx, it is taken after mtx.
+	idxMtx sync.Mutex
+	idx    dbIndex
+}
+
+func (d *fileDepot) CA(pass []byte) ([]*x509.Certificate, crypto.Signer, error) {
+	chain, err := d.CACerts()
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := d.CAKey(pass)
+	if err != nil {
+		return nil, nil, err
+	}
+	return chain, key, nil
 }
 
-func (d *fileDepot) CA(pass []byte) ([]*x509.Certificate, *rsa.PrivateKey, error) {
+// CACerts returns the CA certificate from ca.pem.
+func (d *fileDepot) CACerts() ([]*x509.Certificate, error) {
 	caPEM, err := d.getFile("ca.pem")
+	if err != nil {
+		return nil, err
+	}
+	cert, err := loadCert(caPEM.Data)
+	if err != nil {
+		return nil, err
+	}
+	return []*x509.Certificate{cert}, nil
+}
+
+// CAKey returns the CA key from ca.key, decrypted with pass.
+func (d *fileDepot) CAKey(pass []byte) (crypto.Signer, error) {
+	keyPEM, err := d.getFile("ca.key")
+	if err != nil {
+		return nil, err
+	}
+	return loadKey(keyPEM.Data, pass)
+}
+
+// NextCA returns the next CA certificate and key from next_ca.pem and
+// next_ca.key, if present. The key is encrypted with the same password as
+// the CA key.
+func (d *fileDepot) NextCA(pass []byte) ([]*x509.Certificate, crypto.Signer, error) {
+	return d.optionalCA("next_ca", pass)
+}
+
+// PreviousCA returns the CA certificate and key which were replaced by the
+// last rollover from prev_ca.pem and prev_ca.key, if present.
+func (d *fileDepot) PreviousCA(pass []byte) ([]*x509.Certificate, crypto.Signer, error) {
+	return d.optionalCA("prev_ca", pass)
+}
+
+// optionalCA loads the CA certificate and key from name.pem and name.key,
+// or returns nil certificates if name.pem does not exist.
+func (d *fileDepot) optionalCA(name string, pass []byte) ([]*x509.Certificate, crypto.Signer, error) {
+	caPEM, err := d.getFile(name + ".pem")
+	if os.IsNotExist(err) {
+		return nil, nil, nil
+	}
 	if err != nil {
 		return nil, nil, err
 	}
@@ -42,7 +148,7 @@ func (d *fileDepot) CA(pass []byte) ([]*x509.Certificate, *rsa.PrivateKey, error
 	if err != nil {
 		return nil, nil, err
 	}
-	keyPEM, err := d.getFile("ca.key")
+	keyPEM, err := d.getFile(name + ".key")
 	if err != nil {
 		return nil, nil, err
 	}
@@ -53,6 +159,106 @@ func (d *fileDepot) CA(pass []byte) ([]*x509.Certificate, *rsa.PrivateKey, error
 	return []*x509.Certificate{cert}, key, nil
 }
 
+// rolloverRenames are the renames of RolloverCA in their order. Each
+// rename is atomic and next_ca.pem is renamed last, so a rollover which
+// was interrupted still has a next CA, and the renames which were done
+// are told by their missing files.
+var rolloverRenames = [][2]string{
+	{"ca.pem", "prev_ca.pem"},
+	{"ca.key", "prev_ca.key"},
+	{"next_ca.key", "ca.key"},
+	{"next_ca.pem", "ca.pem"},
+}
+
+// RolloverCA renames ca.pem and ca.key to prev_ca.pem and prev_ca.key,
+// replacing the CA before, and next_ca.pem and next_ca.key to ca.pem and
+// ca.key. A rollover which was interrupted is finished here, or when the
+// depot is opened.
+func (d *fileDepot) RolloverCA() error {
+	unlock, err := d.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return d.rolloverCA()
+}
+
+// rolloverCA implements RolloverCA, the caller must hold the lock.
+func (d *fileDepot) rolloverCA() error {
+	if _, err := os.Stat(d.path("next_ca.pem")); os.IsNotExist(err) {
+		return nil
+	}
+	done, err := d.rolloverProgress()
+	if err != nil {
+		return err
+	}
+	for _, rename := range rolloverRenames[done:] {
+		if err := os.Rename(d.path(rename[0]), d.path(rename[1])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rolloverProgress returns how many of the rolloverRenames were done: a
+// rename was done if its file, or the file of a later one, is missing.
+func (d *fileDepot) rolloverProgress() (int, error) {
+	var done int
+	for i, rename := range rolloverRenames {
+		_, err := os.Stat(d.path(rename[0]))
+		if os.IsNotExist(err) {
+			done = i + 1
+		} else if err != nil {
+			return 0, err
+		}
+	}
+	return done, nil
+}
+
+// finishRollover finishes a CA rollover which was interrupted, without
+// it the CA can not be loaded.
+func (d *fileDepot) finishRollover() error {
+	unlock, err := d.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	done, err := d.rolloverProgress()
+	if err != nil || done == 0 {
+		return err
+	}
+	return d.rolloverCA()
+}
+
+// RA returns the RA certificate and key from ra.pem and ra.key, if present.
+// The key is encrypted with the same password as the CA key.
+func (d *fileDepot) RA(pass []byte) (*x509.Certificate, *rsa.PrivateKey, error) {
+	raPEM, err := d.getFile("ra.pem")
+	if os.IsNotExist(err) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := loadCert(raPEM.Data)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyPEM, err := d.getFile("ra.key")
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := loadKey(keyPEM.Data, pass)
+	if err != nil {
+		return nil, nil, err
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, nil, errors.New("ra.key is not an RSA key")
+	}
+	return cert, rsaKey, nil
+}
+
 // file permissions
 const (
 	certPerm   = 0444
@@ -60,19 +266,112 @@ const (
 	dbPerm     = 0600
 )
 
-// Generate filename for a certificate in the depot
+// certsDir is the folder of a sharded depot with the certificate files.
+const certsDir = "certs"
+
+// CertFilename returns the name of the file with the certificate, which
+// was written by Put.
 func (d *fileDepot) CertFilename(cn string, crt *x509.Certificate) (string, error) {
 	if crt == nil {
 		return "", errors.New("crt is nil")
 	}
 
-	serial := crt.SerialNumber
-	filename := d.path(cn) + "." + serial.String() + ".pem"
-	return filename, nil
+	// the file of a stored certificate is in the CA database
+	var filename string
+	err := d.withIndex(func(idx *dbIndex) error {
+		if entry := idx.get(crt.SerialNumber); entry != nil {
+			filename = entry.filename()
+		}
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	if filename == "" {
+		filename = d.certFile(cn, crt.SerialNumber)
+	}
+	return d.path(filename), nil
+}
+
+// certFile returns the name of a new certificate file, relative to the
+// depot folder and with "/" separators as in the CA database.
+func (d *fileDepot) certFile(cn string, serial *big.Int) string {
+	filename := depot.CertFileName(cn, serial)
+	if !d.sharded {
+		return filename
+	}
+	var shard byte
+	if b := serial.Bytes(); len(b) > 0 {
+		shard = b[len(b)-1]
+	}
+	return fmt.Sprintf("%s/%02x/%s", certsDir, shard, filename)
+}
+
+// Stage writes the file of a certificate before it is put.
+func (d *fileDepot) Stage(cn string, crt *x509.Certificate) (string, error) {
+	if crt == nil || crt.Raw == nil {
+		return "", errors.New("crt is nil")
+	}
+	if err := os.MkdirAll(d.dirPath, 0755); err != nil {
+		return "", err
+	}
+	unlock, err := d.lock()
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+	filename := d.certFile(cn, crt.SerialNumber)
+	if err := d.writeCert(filename, crt.Raw); err != nil {
+		return "", err
+	}
+	return d.path(filename), nil
+}
+
+// Unstage removes the file of a certificate which is not in the CA
+// database.
+func (d *fileDepot) Unstage(cn string, crt *x509.Certificate) error {
+	unlock, err := d.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	var stored bool
+	err = d.withIndex(func(idx *dbIndex) error {
+		stored = idx.get(crt.SerialNumber) != nil
+		return nil
+	})
+	if err != nil || stored {
+		return err
+	}
+	err = os.Remove(d.path(d.certFile(cn, crt.SerialNumber)))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
 }
 
 // Put adds a certificate to the depot
 func (d *fileDepot) Put(cn string, crt *x509.Certificate) error {
+	return d.put(cn, crt, true)
+}
+
+// PutWithoutSuperseding stores a certificate like Put, but keeps the
+// certificates with the same DN valid.
+func (d *fileDepot) PutWithoutSuperseding(cn string, crt *x509.Certificate) error {
+	return d.put(cn, crt, false)
+}
+
+// Supersede revokes the valid certificates with the DN of crt, except crt.
+func (d *fileDepot) Supersede(cn string, crt *x509.Certificate) (bool, error) {
+	unlock, err := d.lock()
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+	return d.hasCN(cn, 0, crt, true)
+}
+
+func (d *fileDepot) put(cn string, crt *x509.Certificate, supersede bool) error {
 	if crt == nil {
 		return errors.New("crt is nil")
 	}
@@ -84,42 +383,136 @@ func (d *fileDepot) Put(cn string, crt *x509.Certificate) error {
 	if err := os.MkdirAll(d.dirPath, 0755); err != nil {
 		return err
 	}
-
-	serial := crt.SerialNumber
-	name := d.path(cn) + "." + serial.String() + ".pem"
-	file, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, certPerm)
+	unlock, err := d.lock()
 	if err != nil {
 		return err
 	}
-	defer file.Close()
+	defer unlock()
 
-	if _, err := file.Write(pemCert(data)); err != nil {
-		os.Remove(name)
+	serial := crt.SerialNumber
+	filename := d.certFile(cn, serial)
+	if err := d.writeCert(filename, data); err != nil {
 		return err
 	}
-	if err := d.writeDB(cn, serial, cn+"."+serial.String()+".pem", crt); err != nil {
+	if err := d.writeDB(cn, serial, filename, crt, supersede); err != nil {
 		// TODO : remove certificate in case of writeDB problems
 		return err
 	}
 
-	if err := d.incrementSerial(serial); err != nil {
+	if d.serialStrategy == depot.SerialRandom {
+		return nil
+	}
+	// keep the next serial above certificates which were not
+	// issued with a serial reserved by Serial
+	next, err := d.readSerial()
+	if err != nil {
+		return err
+	}
+	if next.Cmp(serial) <= 0 {
+		return d.incrementSerial(serial)
+	}
+	return nil
+}
+
+// writeCert creates a PEM file with the certificate. A file with the same
+// certificate, which was staged, is kept.
+func (d *fileDepot) writeCert(filename string, der []byte) error {
+	name := d.path(filename)
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
 		return err
 	}
+	file, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, certPerm)
+	if os.IsExist(err) {
+		if existing, rerr := ioutil.ReadFile(name); rerr == nil && bytes.Equal(existing, pemCert(der)) {
+			return nil
+		}
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
 
+	if _, err := file.Write(pemCert(der)); err != nil {
+		os.Remove(name)
+		return err
+	}
 	return nil
 }
 
+// Serial reserves the next serial number, concurrent callers in this or
+// other processes get different serial numbers.
 func (d *fileDepot) Serial() (*big.Int, error) {
-	name := d.path("serial")
-	s := big.NewInt(2)
-	if err := d.check("serial"); err != nil {
-		// assuming it doesnt exist, create
-		if err := d.writeSerial(s); err != nil {
+	unlock, err := d.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	if d.serialStrategy == depot.SerialRandom {
+		return d.randomSerial()
+	}
+	serial, err := d.readSerial()
+	if err != nil {
+		return nil, err
+	}
+	if err := d.incrementSerial(serial); err != nil {
+		return nil, err
+	}
+	return serial, nil
+}
+
+// CRLNumber reserves the number of the next CRL, counting up from 1 in
+// the crlnumber file.
+func (d *fileDepot) CRLNumber() (*big.Int, error) {
+	unlock, err := d.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	number, err := d.readNumber("crlnumber", 1)
+	if err != nil {
+		return nil, err
+	}
+	next := new(big.Int).Add(number, big.NewInt(1))
+	if err := d.writeFile("crlnumber", []byte(fmt.Sprintf("%x\n", next.Bytes())), serialPerm); err != nil {
+		return nil, err
+	}
+	return number, nil
+}
+
+// randomSerial returns a random serial which is not in the CA database.
+func (d *fileDepot) randomSerial() (*big.Int, error) {
+	for {
+		serial, err := depot.RandomSerial(d.rand)
+		if err != nil {
 			return nil, err
 		}
-		return s, nil
+		var found bool
+		err = d.withIndex(func(idx *dbIndex) error {
+			found = idx.get(serial) != nil
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		if !found {
+			return serial, nil
+		}
 	}
+}
+
+// readSerial returns the next serial number, 2 if there is no serial file.
+func (d *fileDepot) readSerial() (*big.Int, error) {
+	return d.readNumber("serial", 2)
+}
+
+// readNumber reads a hex number from the file, first if there is no file.
+func (d *fileDepot) readNumber(filename string, first int64) (*big.Int, error) {
+	name := d.path(filename)
+	s := big.NewInt(first)
 	file, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -131,136 +524,197 @@ func (d *fileDepot) Serial() (*big.Int, error) {
 	}
 	data = strings.TrimSuffix(data, "\r")
 	data = strings.TrimSuffix(data, "\n")
-	serial, ok := s.SetString(data, 16)
+	n, ok := s.SetString(data, 16)
 	if !ok {
-		return nil, errors.New("could not convert " + string(data) + " to serial number")
+		return nil, errors.New("could not convert " + string(data) + " to a number")
 	}
-	return serial, nil
+	return n, nil
 }
 
-func makeOpenSSLTime(t time.Time) string {
-	y := (int(t.Year()) % 100)
-	validDate := fmt.Sprintf("%02d%02d%02d%02d%02d%02dZ", y, t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second())
-	return validDate
-}
-
-func makeDn(cert *x509.Certificate) string {
-	var dn bytes.Buffer
-
-	if len(cert.Subject.Country) > 0 && len(cert.Subject.Country[0]) > 0 {
-		dn.WriteString("/C=" + cert.Subject.Country[0])
+// GetCert looks up a certificate by serial number in the CA database.
+func (d *fileDepot) GetCert(serial *big.Int) (*x509.Certificate, error) {
+	var filename string
+	err := d.withIndex(func(idx *dbIndex) error {
+		if entry := idx.get(serial); entry != nil {
+			filename = entry.filename()
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
-	if len(cert.Subject.Province) > 0 && len(cert.Subject.Province[0]) > 0 {
-		dn.WriteString("/ST=" + cert.Subject.Province[0])
+	if filename == "" {
+		return nil, depot.ErrNotFound
 	}
-	if len(cert.Subject.Locality) > 0 && len(cert.Subject.Locality[0]) > 0 {
-		dn.WriteString("/L=" + cert.Subject.Locality[0])
+	certPEM, err := d.getFile(filename)
+	if err != nil {
+		return nil, err
 	}
-	if len(cert.Subject.Organization) > 0 && len(cert.Subject.Organization[0]) > 0 {
-		dn.WriteString("/O=" + cert.Subject.Organization[0])
+	return loadCert(certPEM.Data)
+}
+
+// RevokedCerts returns the revoked entries of the CA database.
+func (d *fileDepot) RevokedCerts() ([]pkix.RevokedCertificate, error) {
+	var revoked []pkix.RevokedCertificate
+	err := d.withIndex(func(idx *dbIndex) error {
+		for _, entry := range idx.entries {
+			if entry.serial == nil || entry.flag() != "R" {
+				continue
+			}
+			// the revocation field is "date[,reason]"
+			fields := strings.SplitN(entry.revocation(), ",", 2)
+			revokedAt, err := parseOpenSSLTime(fields[0])
+			if err != nil {
+				return err
+			}
+			rc := pkix.RevokedCertificate{
+				SerialNumber:   entry.serial,
+				RevocationTime: revokedAt,
+			}
+			if len(fields) == 2 {
+				reason, err := parseReason(fields[1])
+				if err != nil {
+					return err
+				}
+				ext, err := reason.Extension()
+				if err != nil {
+					return err
+				}
+				if ext != nil {
+					rc.Extensions = []pkix.Extension{*ext}
+				}
+			}
+			revoked = append(revoked, rc)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return revoked, nil
+}
+
+// Revoke marks a certificate as revoked in the CA database.
+func (d *fileDepot) Revoke(serial *big.Int, reason depot.RevocationReason) error {
+	if int(reason) < 0 || int(reason) >= len(crlReasons) || crlReasons[reason] == "" {
+		return fmt.Errorf("unknown revocation reason %d", reason)
 	}
-	if len(cert.Subject.OrganizationalUnit) > 0 && len(cert.Subject.OrganizationalUnit[0]) > 0 {
-		dn.WriteString("/OU=" + cert.Subject.OrganizationalUnit[0])
+	unlock, err := d.lock()
+	if err != nil {
+		return err
 	}
-	if len(cert.Subject.CommonName) > 0 {
-		dn.WriteString("/CN=" + cert.Subject.CommonName)
+	defer unlock()
+	return d.withIndex(func(idx *dbIndex) error {
+		entry := idx.get(serial)
+		if entry == nil {
+			return depot.ErrNotFound
+		}
+		if entry.flag() != "V" {
+			return nil
+		}
+		entry.revoke(time.Now().UTC(), crlReasons[reason])
+		return d.writeIndex(idx)
+	})
+}
+
+// revocation reasons as written by openssl ca, indexed by CRL reason code
+var crlReasons = []string{
+	"unspecified",
+	"keyCompromise",
+	"CACompromise",
+	"affiliationChanged",
+	"superseded",
+	"cessationOfOperation",
+	"certificateHold",
+	"",
+	"removeFromCRL",
+}
+
+func parseReason(reason string) (depot.RevocationReason, error) {
+	for code, name := range crlReasons {
+		if name != "" && name == reason {
+			return depot.RevocationReason(code), nil
+		}
 	}
-	if len(cert.EmailAddresses) > 0 {
-		dn.WriteString("/emailAddress=" + cert.EmailAddresses[0])
+	return 0, errors.New("unknown revocation reason " + reason)
+}
+
+func parseOpenSSLTime(s string) (time.Time, error) {
+	if len(s) == len("20060102150405Z") {
+		return time.Parse("20060102150405Z", s)
 	}
-	return dn.String()
+	return time.Parse("060102150405Z", s)
+}
+
+func makeOpenSSLTime(t time.Time) string {
+	y := (int(t.Year()) % 100)
+	validDate := fmt.Sprintf("%02d%02d%02d%02d%02d%02dZ", y, t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second())
+	return validDate
 }
 
 // Determine if the cadb already has a valid certificate with the same name
 func (d *fileDepot) HasCN(cn string, allowTime int, cert *x509.Certificate, revokeOldCertificate bool) (bool, error) {
+	unlock, err := d.lock()
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+	if _, err := d.hasCN(cn, allowTime, cert, revokeOldCertificate); err != nil {
+		return false, err
+	}
+	return true, nil
+}
 
-	var addDB bytes.Buffer
-	candidates := make(map[string]string)
-
+// hasCN implements HasCN and reports whether certificates were revoked,
+// the caller must hold the lock.
+func (d *fileDepot) hasCN(cn string, allowTime int, cert *x509.Certificate, revokeOldCertificate bool) (bool, error) {
 	dn := makeDn(cert)
 
 	if err := os.MkdirAll(d.dirPath, 0755); err != nil {
 		return false, err
 	}
 
-	name := d.path("index.txt")
-	file, err := os.Open(name)
-	if err != nil {
-		return false, err
-	}
-	defer file.Close()
-
-	// Loop over index.txt, determine if a certificate is valid and can be revoked
-	// revoke certificate in DB if requested
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := scanner.Text()
-		if strings.HasSuffix(line, dn) {
-			// Removing revoked certificate from candidates, if any
-			if strings.HasPrefix(line, "R\t") {
-				entries := strings.Split(line, "\t")
-				serial := strings.ToUpper(entries[3])
-				candidates[serial] = line
-				delete(candidates, serial)
-				addDB.WriteString(line + "\n")
-				// Test & add certificate candidates, if any
-			} else if strings.HasPrefix(line, "V\t") {
-				issueDate, err := strconv.Atoi(strings.Replace(strings.Split(line, "\t")[1], "Z", "", 1))
-				if err != nil {
-					return false, errors.New("Could not get expiry date from ca db")
-				}
-				minimalRenewDate, err := strconv.Atoi(strings.Replace(makeOpenSSLTime(time.Now().AddDate(0, 0, allowTime).UTC()), "Z", "", 1))
-				if err != nil {
-					return false, errors.New("Could not calculate expiry date")
-				}
-				entries := strings.Split(line, "\t")
-				serial := strings.ToUpper(entries[3])
-
-				// all non renewable certificates
-				if minimalRenewDate < issueDate && allowTime > 0 {
-					candidates[serial] = "no"
-				} else {
-					candidates[serial] = line
-				}
+	var revoked bool
+	err := d.withIndex(func(idx *dbIndex) error {
+		// valid certificates with the DN which may be renewed
+		var candidates []*dbEntry
+		minimalRenewDate := time.Now().AddDate(0, 0, allowTime).UTC()
+		for _, entry := range idx.byDN[dn] {
+			if entry.flag() != "V" || entry.serial.Cmp(cert.SerialNumber) == 0 {
+				continue
+			}
+			if allowTime > 0 && entry.expiry.After(minimalRenewDate) {
+				return errors.New("DN " + dn + " already exists")
 			}
-		} else {
-			addDB.WriteString(line + "\n")
+			candidates = append(candidates, entry)
 		}
-	}
-	file.Close()
-	for key, value := range candidates {
-		if value == "no" {
-			return false, errors.New("DN " + dn + " already exists")
+		if !revokeOldCertificate || len(candidates) == 0 {
+			return nil
 		}
-		if revokeOldCertificate {
-			fmt.Println("Revoking certificate with serial " + key + " from DB. Recreation of CRL needed.")
-			entries := strings.Split(value, "\t")
-			addDB.WriteString("R\t" + entries[1] + "\t" + makeOpenSSLTime(time.Now()) + "\t" + strings.ToUpper(entries[3]) + "\t" + entries[4] + "\t" + entries[5] + "\n")
+		for _, entry := range candidates {
+			entry.revoke(time.Now().UTC(), "superseded")
 		}
-	}
-	if err := scanner.Err(); err != nil {
+		revoked = true
+		return d.writeIndex(idx)
+	})
+	if err != nil {
 		return false, err
 	}
-	if revokeOldCertificate {
-		file, err := os.OpenFile(name, os.O_CREATE|os.O_RDWR, dbPerm)
-		if err != nil {
-			return false, err
-		}
-		if _, err := file.Write(addDB.Bytes()); err != nil {
-			return false, err
-		}
-	}
-	return true, nil
+	return revoked, nil
 }
 
-func (d *fileDepot) writeDB(cn string, serial *big.Int, filename string, cert *x509.Certificate) error {
-
-	var dbEntry bytes.Buffer
-
+func (d *fileDepot) writeDB(cn string, serial *big.Int, filename string, cert *x509.Certificate, supersede bool) error {
 	// Revoke old certificate
-	if _, err := d.HasCN(cn, 0, cert, true); err != nil {
-		return err
+	if supersede {
+		if _, err := d.hasCN(cn, 0, cert, true); err != nil {
+			return err
+		}
 	}
+	return d.appendDB(indexLine("V", "", filename, cert))
+}
+
+// appendDB appends a line to the CA database.
+func (d *fileDepot) appendDB(line string) error {
 	if err := os.MkdirAll(d.dirPath, 0755); err != nil {
 		return err
 	}
@@ -272,6 +726,17 @@ func (d *fileDepot) writeDB(cn string, serial *big.Int, filename string, cert *x
 	}
 	defer file.Close()
 
+	if _, err := file.WriteString(line); err != nil {
+		return err
+	}
+	return nil
+}
+
+// indexLine returns the CA database entry of cert with the status flag
+// and revocation field.
+func indexLine(flag, revocation, filename string, cert *x509.Certificate) string {
+	var dbEntry bytes.Buffer
+
 	// Format of the caDB, see http://pki-tutorial.readthedocs.io/en/latest/cadb.html
 	//   STATUSFLAG  EXPIRATIONDATE  REVOCATIONDATE(or emtpy)	SERIAL_IN_HEX   CERTFILENAME_OR_'unknown'   Certificate_DN
 
@@ -284,12 +749,12 @@ func (d *fileDepot) writeDB(cn string, serial *big.Int, filename string, cert *x
 
 	dn := makeDn(cert)
 
-	// Valid
-	dbEntry.WriteString("V\t")
+	// Valid or Revoked
+	dbEntry.WriteString(flag + "\t")
 	// Valid till
 	dbEntry.WriteString(validDate + "\t")
-	// Empty (not revoked)
-	dbEntry.WriteString("\t")
+	// Revocation date and reason, empty if not revoked
+	dbEntry.WriteString(revocation + "\t")
 	// Serial in Hex
 	dbEntry.WriteString(serialHex + "\t")
 	// Certificate file name
@@ -297,31 +762,60 @@ func (d *fileDepot) writeDB(cn string, serial *big.Int, filename string, cert *x
 	// Certificate DN
 	dbEntry.WriteString(dn)
 	dbEntry.WriteString("\n")
-
-	if _, err := file.Write(dbEntry.Bytes()); err != nil {
-		return err
-	}
-	return nil
+	return dbEntry.String()
 }
 
 func (d *fileDepot) writeSerial(serial *big.Int) error {
 	if err := os.MkdirAll(d.dirPath, 0755); err != nil {
 		return err
 	}
-	name := d.path("serial")
-	os.Remove(name)
+	return d.writeFile("serial", []byte(fmt.Sprintf("%x\n", serial.Bytes())), serialPerm)
+}
 
-	file, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, serialPerm)
+// writeFile replaces a file of the depot by renaming a temporary file
+// over it, so that readers never see a partially written file.
+func (d *fileDepot) writeFile(name string, data []byte, perm os.FileMode) error {
+	tmp, err := ioutil.TempFile(d.dirPath, "."+name+".")
 	if err != nil {
 		return err
 	}
-	defer file.Close()
-
-	if _, err := file.WriteString(fmt.Sprintf("%x\n", serial.Bytes())); err != nil {
-		os.Remove(name)
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
 		return err
 	}
-	return nil
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), d.path(name))
+}
+
+// lock serializes changes to the serial file and the CA database, also
+// between processes. The returned function releases the lock.
+func (d *fileDepot) lock() (func(), error) {
+	d.mtx.Lock()
+	file, err := os.OpenFile(d.path(".lock"), os.O_RDWR|os.O_CREATE, dbPerm)
+	if err != nil {
+		d.mtx.Unlock()
+		return nil, err
+	}
+	if err := lockFile(file); err != nil {
+		file.Close()
+		d.mtx.Unlock()
+		return nil, err
+	}
+	return func() {
+		unlockFile(file)
+		file.Close()
+		d.mtx.Unlock()
+	}, nil
 }
 
 // read serial and increment
@@ -366,16 +860,17 @@ func (d *fileDepot) path(name string) string {
 
 const (
 	rsaPrivateKeyPEMBlockType = "RSA PRIVATE KEY"
+	ecPrivateKeyPEMBlockType  = "EC PRIVATE KEY"
 	certificatePEMBlockType   = "CERTIFICATE"
 )
 
-// load an encrypted private key from disk
-func loadKey(data []byte, password []byte) (*rsa.PrivateKey, error) {
+// load an encrypted RSA or ECDSA private key from disk
+func loadKey(data []byte, password []byte) (crypto.Signer, error) {
 	pemBlock, _ := pem.Decode(data)
 	if pemBlock == nil {
 		return nil, errors.New("PEM decode failed")
 	}
-	if pemBlock.Type != rsaPrivateKeyPEMBlockType {
+	if pemBlock.Type != rsaPrivateKeyPEMBlockType && pemBlock.Type != ecPrivateKeyPEMBlockType {
 		return nil, errors.New("unmatched type or headers")
 	}
 
@@ -383,6 +878,9 @@ func loadKey(data []byte, password []byte) (*rsa.PrivateKey, error) {
 	if err != nil {
 		return nil, err
 	}
+	if pemBlock.Type == ecPrivateKeyPEMBlockType {
+		return x509.ParseECPrivateKey(b)
+	}
 	return x509.ParsePKCS1PrivateKey(b)
 }
 
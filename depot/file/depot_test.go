@@ -0,0 +1,241 @@
+package file
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/syncsynchalt/scep/depot"
+)
+
+func TestSerialStrategy(t *testing.T) {
+	d := createDepot(t)
+	for _, want := range []int64{2, 3} {
+		have, err := d.Serial()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if have.Cmp(big.NewInt(want)) != 0 {
+			t.Errorf("have %s, want %d", have, want)
+		}
+	}
+
+	d = createDepot(t, WithSerialStrategy(depot.SerialRandom))
+	// the first two serials collide
+	d.rand = bytes.NewReader(append(bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 16)...))
+	first, err := d.Serial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.BitLen() < 64 {
+		t.Errorf("serial %s has less than 64 bits", first)
+	}
+	if err := d.Put("random", testCert(t, first)); err != nil {
+		t.Fatal(err)
+	}
+	second, err := d.Serial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second.Cmp(first) == 0 {
+		t.Errorf("serial %s was reserved twice", first)
+	}
+	if _, err := os.Stat(d.path("serial")); !os.IsNotExist(err) {
+		t.Error("random serials should not write the serial file")
+	}
+}
+
+func TestCertFiles(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    []Option
+		cn      string
+		serial  int64
+		want    string
+		reopens bool
+	}{
+		{"plain", nil, "device", 2, "device.2.pem", false},
+		{"path separators", nil, "../a/b", 2, "%2E.%2Fa%2Fb.2.pem", false},
+		{"escaped", nil, "a b%c", 2, "a%20b%25c.2.pem", false},
+		{"sharded", []Option{WithShardedLayout()}, "device", 258, "certs/02/device.258.pem", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := createDepot(t, tt.opts...)
+			cert := namedCert(t, big.NewInt(tt.serial), tt.cn, time.Now().Add(time.Hour))
+			if err := d.Put(tt.cn, cert); err != nil {
+				t.Fatal(err)
+			}
+			if tt.reopens {
+				// the layout is kept without the option
+				var err error
+				if d, err = NewFileDepot(d.dirPath); err != nil {
+					t.Fatal(err)
+				}
+			}
+			have, err := d.CertFilename(tt.cn, cert)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := d.path(tt.want); have != want {
+				t.Errorf("have file %s, want %s", have, want)
+			}
+			if _, err := os.Stat(have); err != nil {
+				t.Error(err)
+			}
+			if next := d.certFile(tt.cn, big.NewInt(tt.serial+1)); tt.reopens && !strings.HasPrefix(next, certsDir+"/") {
+				t.Errorf("new certificate file %s is not sharded", next)
+			}
+			records, err := d.List(depot.CertFilter{CN: tt.cn})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(records) != 1 || records[0].Name != tt.cn {
+				t.Errorf("have records %v, want name %q", records, tt.cn)
+			}
+		})
+	}
+}
+
+func TestStage(t *testing.T) {
+	d := createDepot(t)
+	denied := namedCert(t, big.NewInt(2), "denied", time.Now().Add(time.Hour))
+	name, err := d.Stage("denied", denied)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, err := d.CertFilename("denied", denied); err != nil || have != name {
+		t.Errorf("have file %s, %v, want %s", have, err, name)
+	}
+	if err := d.Unstage("denied", denied); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(name); !os.IsNotExist(err) {
+		t.Errorf("staged file was not removed: %v", err)
+	}
+
+	approved := namedCert(t, big.NewInt(3), "approved", time.Now().Add(time.Hour))
+	name, err = d.Stage("approved", approved)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Put("approved", approved); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Unstage("approved", approved); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(name); err != nil {
+		t.Errorf("file of a stored certificate was removed: %v", err)
+	}
+}
+
+func TestRolloverCA(t *testing.T) {
+	files := map[string]string{
+		"ca.pem":      "old certificate",
+		"ca.key":      "old key",
+		"next_ca.pem": "new certificate",
+		"next_ca.key": "new key",
+	}
+	want := map[string]string{
+		"ca.pem":      "new certificate",
+		"ca.key":      "new key",
+		"prev_ca.pem": "old certificate",
+		"prev_ca.key": "old key",
+	}
+	// the rollover is interrupted after some of the renames, opening the
+	// depot finishes it
+	for interrupted := 0; interrupted <= len(rolloverRenames); interrupted++ {
+		d := createDepot(t)
+		for name, data := range files {
+			if err := ioutil.WriteFile(d.path(name), []byte(data), 0600); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, rename := range rolloverRenames[:interrupted] {
+			if err := os.Rename(d.path(rename[0]), d.path(rename[1])); err != nil {
+				t.Fatal(err)
+			}
+		}
+		d, err := NewFileDepot(d.dirPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if interrupted == 0 {
+			if _, err := os.Stat(d.path("next_ca.pem")); err != nil {
+				t.Fatalf("the depot was rolled over when it was opened: %v", err)
+			}
+			if err := d.RolloverCA(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for name, data := range want {
+			have, err := ioutil.ReadFile(d.path(name))
+			if err != nil {
+				t.Fatalf("interrupted after %d renames: %v", interrupted, err)
+			}
+			if string(have) != data {
+				t.Errorf("interrupted after %d renames: %s has %q, want %q", interrupted, name, have, data)
+			}
+		}
+		for _, name := range []string{"next_ca.pem", "next_ca.key"} {
+			if _, err := os.Stat(d.path(name)); !os.IsNotExist(err) {
+				t.Errorf("interrupted after %d renames: %s is still there", interrupted, name)
+			}
+		}
+		// without a next CA there is nothing to do
+		if err := d.RolloverCA(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func createDepot(t *testing.T, opts ...Option) *fileDepot {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "scep-depot-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	d, err := NewFileDepot(dir, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func testCert(t *testing.T, serial *big.Int) *x509.Certificate {
+	return namedCert(t, serial, "random", time.Now().Add(time.Hour))
+}
+
+func namedCert(t testing.TB, serial *big.Int, cn string, notAfter time.Time) *x509.Certificate {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn},
+		SubjectKeyId: serial.Bytes(),
+		NotBefore:    notAfter.Add(-2 * time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
@@ -0,0 +1,130 @@
+package file
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// attribute type names of RFC 4514, and the ones openssl prints
+var dnAttributeNames = map[string]string{
+	"2.5.4.3":                    "CN",
+	"2.5.4.5":                    "SERIALNUMBER",
+	"2.5.4.6":                    "C",
+	"2.5.4.7":                    "L",
+	"2.5.4.8":                    "ST",
+	"2.5.4.9":                    "STREET",
+	"2.5.4.10":                   "O",
+	"2.5.4.11":                   "OU",
+	"2.5.4.17":                   "POSTALCODE",
+	"0.9.2342.19200300.100.1.1":  "UID",
+	"0.9.2342.19200300.100.1.25": "DC",
+	"1.2.840.113549.1.9.1":       "emailAddress",
+}
+
+// makeDn returns the subject of cert as an RFC 4514 string, with all
+// attributes in the order of the certificate, most specific first.
+func makeDn(cert *x509.Certificate) string {
+	var rdns pkix.RDNSequence
+	if rest, err := asn1.Unmarshal(cert.RawSubject, &rdns); err != nil || len(rest) > 0 {
+		// a certificate which was not parsed
+		rdns = cert.Subject.ToRDNSequence()
+	}
+	return formatDN(rdns)
+}
+
+// formatDN formats rdns as RFC 4514 does. Attribute values which are not
+// strings, and the values of unknown attribute types, are written as
+// "#" and their hex encoded DER.
+func formatDN(rdns pkix.RDNSequence) string {
+	var dn strings.Builder
+	for i := len(rdns) - 1; i >= 0; i-- {
+		if i < len(rdns)-1 {
+			dn.WriteByte(',')
+		}
+		for j, atv := range rdns[i] {
+			if j > 0 {
+				dn.WriteByte('+')
+			}
+			dn.WriteString(formatAttribute(atv))
+		}
+	}
+	return dn.String()
+}
+
+func formatAttribute(atv pkix.AttributeTypeAndValue) string {
+	oid := atv.Type.String()
+	name, known := dnAttributeNames[oid]
+	value, isString := atv.Value.(string)
+	if known && isString {
+		return name + "=" + escapeDNValue(value)
+	}
+	if !known {
+		name = oid
+	}
+	der, err := asn1.Marshal(atv.Value)
+	if err != nil {
+		return name + "=" + escapeDNValue(fmt.Sprint(atv.Value))
+	}
+	return name + "=#" + hex.EncodeToString(der)
+}
+
+// escapeDNValue escapes an attribute value as in RFC 4514 section 2.4.
+// Control characters are hex escaped as well, so that a DN is always a
+// single field of index.txt.
+func escapeDNValue(value string) string {
+	var b strings.Builder
+	for i, r := range value {
+		switch {
+		case strings.ContainsRune(`,+"\<>;`, r),
+			r == ' ' && (i == 0 || i == len(value)-1),
+			r == '#' && i == 0:
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case unicode.IsControl(r):
+			for _, c := range []byte(string(r)) {
+				fmt.Fprintf(&b, "\\%02X", c)
+			}
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// legacy attribute names of the "/C=US/O=org/CN=name" DNs which older
+// versions wrote to index.txt
+var legacyDNAttributes = map[string]bool{
+	"C": true, "ST": true, "L": true, "O": true, "OU": true, "CN": true, "emailAddress": true,
+}
+
+// isLegacyDN reports whether dn was written by an older version.
+func isLegacyDN(dn string) bool {
+	return strings.HasPrefix(dn, "/")
+}
+
+// convertLegacyDN converts a DN written by an older version, for index
+// entries without a certificate file. Values containing "/" can not be
+// told apart from the next attribute and stay part of the value.
+func convertLegacyDN(legacy string) string {
+	var attrs []string
+	for _, part := range strings.Split(strings.TrimPrefix(legacy, "/"), "/") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) == 2 && legacyDNAttributes[kv[0]] {
+			attrs = append(attrs, kv[0]+"="+escapeDNValue(kv[1]))
+			continue
+		}
+		if len(attrs) == 0 {
+			return legacy
+		}
+		attrs[len(attrs)-1] += escapeDNValue("/" + part)
+	}
+	for i, j := 0, len(attrs)-1; i < j; i, j = i+1, j-1 {
+		attrs[i], attrs[j] = attrs[j], attrs[i]
+	}
+	return strings.Join(attrs, ",")
+}
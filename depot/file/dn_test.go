@@ -0,0 +1,164 @@
+package file
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"io/ioutil"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFormatDN(t *testing.T) {
+	var (
+		oidCN = asn1.ObjectIdentifier{2, 5, 4, 3}
+		oidO  = asn1.ObjectIdentifier{2, 5, 4, 10}
+		oidOU = asn1.ObjectIdentifier{2, 5, 4, 11}
+	)
+	tests := []struct {
+		name string
+		rdns pkix.RDNSequence
+		want string
+	}{
+		{"order", pkix.RDNSequence{
+			{{Type: oidO, Value: "acme"}},
+			{{Type: oidCN, Value: "foo"}},
+		}, "CN=foo,O=acme"},
+		{"multi-valued", pkix.RDNSequence{
+			{{Type: oidOU, Value: "a"}, {Type: oidOU, Value: "b"}},
+		}, "OU=a+OU=b"},
+		{"escaped", pkix.RDNSequence{
+			{{Type: oidCN, Value: ` #a,b+c"d\e<f>g;h `}},
+		}, `CN=\ #a\,b\+c\"d\\e\<f\>g\;h\ `},
+		{"leading hash", pkix.RDNSequence{
+			{{Type: oidCN, Value: "#1"}},
+		}, `CN=\#1`},
+		{"control characters", pkix.RDNSequence{
+			{{Type: oidCN, Value: "a\tb\nc"}},
+		}, `CN=a\09b\0Ac`},
+		{"unknown type", pkix.RDNSequence{
+			{{Type: asn1.ObjectIdentifier{1, 2, 3}, Value: "x"}},
+		}, "1.2.3=#130178"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if have := formatDN(tt.rdns); have != tt.want {
+				t.Errorf("have %q, want %q", have, tt.want)
+			}
+		})
+	}
+}
+
+func TestMakeDn(t *testing.T) {
+	cert := subjectCert(t, big.NewInt(2), pkix.Name{
+		Country:            []string{"US"},
+		Organization:       []string{"acme"},
+		OrganizationalUnit: []string{"eng", "ops"},
+		CommonName:         "foo",
+		ExtraNames: []pkix.AttributeTypeAndValue{
+			{Type: asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 1}, Value: "foo@example.com"},
+		},
+	})
+	have := makeDn(cert)
+	want := "emailAddress=foo@example.com,CN=foo,OU=eng+OU=ops,O=acme,C=US"
+	if have != want {
+		t.Errorf("have %q, want %q", have, want)
+	}
+}
+
+func TestHasCNExact(t *testing.T) {
+	d := createDepot(t)
+	now := time.Now()
+	if err := d.Put("barfoo", namedCert(t, big.NewInt(2), "barfoo", now.Add(365*24*time.Hour))); err != nil {
+		t.Fatal(err)
+	}
+	foo := namedCert(t, big.NewInt(3), "foo", now.Add(365*24*time.Hour))
+	if _, err := d.HasCN("foo", 14, foo, false); err != nil {
+		t.Errorf("CN=foo collides with CN=barfoo: %s", err)
+	}
+	if err := d.Put("foo", foo); err != nil {
+		t.Fatal(err)
+	}
+	renewal := namedCert(t, big.NewInt(4), "foo", now.Add(365*24*time.Hour))
+	if _, err := d.HasCN("foo", 14, renewal, false); err == nil {
+		t.Error("renewal allowed outside of the renewal window")
+	}
+}
+
+func TestConvertLegacyDN(t *testing.T) {
+	tests := []struct {
+		legacy string
+		want   string
+	}{
+		{"/C=US/O=acme/CN=foo", "CN=foo,O=acme,C=US"},
+		{"/CN=a,b", `CN=a\,b`},
+		{"/O=a/b/CN=foo", "CN=foo,O=a/b"},
+		{"/CN=foo/emailAddress=foo@example.com", "emailAddress=foo@example.com,CN=foo"},
+	}
+	for _, tt := range tests {
+		if have := convertLegacyDN(tt.legacy); have != tt.want {
+			t.Errorf("%s: have %q, want %q", tt.legacy, have, tt.want)
+		}
+	}
+}
+
+func TestMigrateIndex(t *testing.T) {
+	d := createDepot(t)
+	cert := subjectCert(t, big.NewInt(2), pkix.Name{
+		Organization: []string{"acme"},
+		CommonName:   "foo",
+	})
+	if err := d.writeCert("foo.2.pem", cert.Raw); err != nil {
+		t.Fatal(err)
+	}
+	legacy := "V\t301231000000Z\t\t02\tfoo.2.pem\t/O=acme/CN=foo\n" +
+		"V\t301231000000Z\t\t03\tunknown\t/O=acme/CN=bar\n"
+	if err := ioutil.WriteFile(d.path("index.txt"), []byte(legacy), dbPerm); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := NewFileDepot(d.dirPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(d.path("index.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "V\t301231000000Z\t\t02\tfoo.2.pem\tCN=foo,O=acme\n" +
+		"V\t301231000000Z\t\t03\tunknown\tCN=bar,O=acme\n"
+	if have := string(data); have != want {
+		t.Errorf("have index.txt\n%s\nwant\n%s", have, want)
+	}
+	renewal := subjectCert(t, big.NewInt(4), cert.Subject)
+	if _, err := d.HasCN("foo", 14, renewal, false); err == nil || !strings.Contains(err.Error(), "already exists") {
+		t.Errorf("migrated entry was not found: %v", err)
+	}
+}
+
+func subjectCert(t *testing.T, serial *big.Int, subject pkix.Name) *x509.Certificate {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      subject,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(365 * 24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
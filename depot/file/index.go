@@ -0,0 +1,245 @@
+package file
+
+import (
+	"io/ioutil"
+	"math/big"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// dbIndex is an in-memory index of the CA database, so that issuance does
+// not have to read all of index.txt. It is loaded when the depot is opened
+// and kept current by reading only the lines appended since, also by other
+// processes. When index.txt is replaced, it is read again.
+type dbIndex struct {
+	entries      []*dbEntry // in file order, including malformed lines
+	bySerial     map[string]*dbEntry
+	byDN         map[string][]*dbEntry
+	byExpiry     []*dbEntry // sorted by expiry if expirySorted
+	expirySorted bool
+
+	info os.FileInfo // index.txt when it was last read
+	size int64       // bytes of index.txt in the index
+}
+
+// dbEntry is a line of the CA database.
+type dbEntry struct {
+	fields []string
+	serial *big.Int // nil for malformed lines
+	expiry time.Time
+}
+
+func (e *dbEntry) flag() string       { return e.fields[0] }
+func (e *dbEntry) revocation() string { return e.fields[2] }
+func (e *dbEntry) filename() string   { return e.fields[4] }
+func (e *dbEntry) dn() string         { return e.fields[5] }
+
+func (e *dbEntry) line() string {
+	return strings.Join(e.fields, "\t") + "\n"
+}
+
+// revoke marks the entry as revoked with the revocation field
+// "date,reason".
+func (e *dbEntry) revoke(at time.Time, reason string) {
+	e.fields[0] = "R"
+	e.fields[2] = makeOpenSSLTime(at) + "," + reason
+}
+
+func (idx *dbIndex) reset() {
+	*idx = dbIndex{
+		bySerial: make(map[string]*dbEntry),
+		byDN:     make(map[string][]*dbEntry),
+	}
+}
+
+// refresh brings the index up to date with the file name.
+func (idx *dbIndex) refresh(name string) error {
+	fi, err := os.Stat(name)
+	if os.IsNotExist(err) {
+		idx.reset()
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if idx.info != nil && os.SameFile(idx.info, fi) && fi.Size() == idx.size {
+		return nil
+	}
+	if idx.info == nil || !os.SameFile(idx.info, fi) || fi.Size() < idx.size {
+		idx.reset()
+	}
+
+	file, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if idx.size > 0 {
+		// the file was appended to if it still ends a line where
+		// the index stopped
+		last := make([]byte, 1)
+		if _, err := file.ReadAt(last, idx.size-1); err != nil {
+			return err
+		}
+		if last[0] != '\n' {
+			idx.reset()
+		}
+	}
+	if _, err := file.Seek(idx.size, 0); err != nil {
+		return err
+	}
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		return err
+	}
+	// a line without newline is still being written
+	n := strings.LastIndexByte(string(data), '\n') + 1
+	for _, line := range strings.SplitAfter(string(data[:n]), "\n") {
+		if line != "" {
+			idx.add(strings.TrimSuffix(line, "\n"))
+		}
+	}
+	idx.info = fi
+	idx.size += int64(n)
+	return nil
+}
+
+// add indexes a line of the CA database.
+func (idx *dbIndex) add(line string) {
+	e := &dbEntry{fields: strings.Split(line, "\t")}
+	idx.entries = append(idx.entries, e)
+	if len(e.fields) < 6 {
+		return
+	}
+	serial, ok := new(big.Int).SetString(e.fields[3], 16)
+	if !ok {
+		return
+	}
+	e.serial = serial
+	e.expiry, _ = parseOpenSSLTime(e.fields[1])
+	idx.bySerial[serial.String()] = e
+	idx.byDN[e.dn()] = append(idx.byDN[e.dn()], e)
+	idx.byExpiry = append(idx.byExpiry, e)
+	idx.expirySorted = false
+}
+
+// get returns the entry for serial, or nil if there is none.
+func (idx *dbIndex) get(serial *big.Int) *dbEntry {
+	return idx.bySerial[serial.String()]
+}
+
+// expiring returns the entries which expire after after and before
+// before, a zero time does not limit the range.
+func (idx *dbIndex) expiring(after, before time.Time) []*dbEntry {
+	if !idx.expirySorted {
+		sort.SliceStable(idx.byExpiry, func(i, j int) bool {
+			return idx.byExpiry[i].expiry.Before(idx.byExpiry[j].expiry)
+		})
+		idx.expirySorted = true
+	}
+	entries := idx.byExpiry
+	if !after.IsZero() {
+		i := sort.Search(len(entries), func(i int) bool {
+			return entries[i].expiry.After(after)
+		})
+		entries = entries[i:]
+	}
+	if !before.IsZero() {
+		i := sort.Search(len(entries), func(i int) bool {
+			return !entries[i].expiry.Before(before)
+		})
+		entries = entries[:i]
+	}
+	return entries
+}
+
+// bytes returns the contents of index.txt.
+func (idx *dbIndex) bytes() []byte {
+	var b strings.Builder
+	for _, e := range idx.entries {
+		b.WriteString(e.line())
+	}
+	return []byte(b.String())
+}
+
+// withIndex calls fn with the CA database index brought up to date.
+func (d *fileDepot) withIndex(fn func(idx *dbIndex) error) error {
+	d.idxMtx.Lock()
+	defer d.idxMtx.Unlock()
+	if err := d.idx.refresh(d.path("index.txt")); err != nil {
+		return err
+	}
+	return fn(&d.idx)
+}
+
+// writeIndex replaces index.txt with the entries of idx, which were
+// changed in place. The caller must hold the lock and be in withIndex.
+func (d *fileDepot) writeIndex(idx *dbIndex) error {
+	data := idx.bytes()
+	if err := d.writeFile("index.txt", data, dbPerm); err != nil {
+		// the index has changes which are not in the file
+		idx.reset()
+		return err
+	}
+	fi, err := os.Stat(d.path("index.txt"))
+	if err != nil {
+		idx.reset()
+		return err
+	}
+	idx.info = fi
+	idx.size = int64(len(data))
+	return nil
+}
+
+// migrateIndex replaces the DNs which older versions wrote to index.txt
+// with the DNs of the certificate files, see makeDn.
+func (d *fileDepot) migrateIndex() error {
+	var legacy bool
+	err := d.withIndex(func(idx *dbIndex) error {
+		for _, entry := range idx.entries {
+			if entry.serial != nil && isLegacyDN(entry.dn()) {
+				legacy = true
+				break
+			}
+		}
+		return nil
+	})
+	if err != nil || !legacy {
+		return err
+	}
+
+	unlock, err := d.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return d.withIndex(func(idx *dbIndex) error {
+		var lines []string
+		for _, entry := range idx.entries {
+			if entry.serial != nil && isLegacyDN(entry.dn()) {
+				entry.fields[5] = d.migratedDN(entry)
+			}
+			lines = append(lines, strings.Join(entry.fields, "\t"))
+		}
+		// index the entries by their new DN
+		idx.reset()
+		for _, line := range lines {
+			idx.add(line)
+		}
+		return d.writeIndex(idx)
+	})
+}
+
+// migratedDN returns the DN of the certificate file of entry, or the
+// converted legacy DN if the file can not be read.
+func (d *fileDepot) migratedDN(entry *dbEntry) string {
+	certPEM, err := d.getFile(entry.filename())
+	if err == nil {
+		if cert, err := loadCert(certPEM.Data); err == nil {
+			return makeDn(cert)
+		}
+	}
+	return convertLegacyDN(entry.dn())
+}
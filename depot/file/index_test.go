@@ -0,0 +1,139 @@
+package file
+
+import (
+	"bufio"
+	"fmt"
+	"math/big"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/syncsynchalt/scep/depot"
+)
+
+func TestIndexRefresh(t *testing.T) {
+	d := createDepot(t)
+	// another process sharing the depot
+	other, err := NewFileDepot(d.dirPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	alice := namedCert(t, big.NewInt(2), "alice", now.Add(time.Hour))
+	if err := other.Put("alice", alice); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.GetCert(alice.SerialNumber); err != nil {
+		t.Errorf("appended certificate: %s", err)
+	}
+
+	if err := other.Revoke(alice.SerialNumber, depot.ReasonKeyCompromise); err != nil {
+		t.Fatal(err)
+	}
+	records, err := d.List(depot.CertFilter{Status: depot.CertRevoked})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 {
+		t.Errorf("have %d revoked certificates after index.txt was replaced, want 1", len(records))
+	}
+
+	bob := namedCert(t, big.NewInt(3), "bob", now.Add(time.Hour))
+	if err := d.Put("bob", bob); err != nil {
+		t.Fatal(err)
+	}
+	// renewing bob in the other process supersedes the first certificate
+	renewal := namedCert(t, big.NewInt(4), "bob", now.Add(2*time.Hour))
+	if err := other.Put("bob", renewal); err != nil {
+		t.Fatal(err)
+	}
+	records, err = d.List(depot.CertFilter{CN: "bob", Status: depot.CertValid})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].Certificate.SerialNumber.Int64() != 4 {
+		t.Errorf("have valid certificates %v, want serial 4", records)
+	}
+}
+
+// benchmarkDepot returns a depot with n certificates in its CA database.
+// Only the index lines are written, the certificate files are not.
+func benchmarkDepot(b *testing.B, n int) *fileDepot {
+	b.Helper()
+	dir := b.TempDir()
+	file, err := os.Create(dir + "/index.txt")
+	if err != nil {
+		b.Fatal(err)
+	}
+	w := bufio.NewWriter(file)
+	expiry := makeOpenSSLTime(time.Now().AddDate(1, 0, 0).UTC())
+	for i := 0; i < n; i++ {
+		serial := i + 2
+		name := "device-" + strconv.Itoa(i)
+		fmt.Fprintf(w, "V\t%s\t\t%04X\t%s.%d.pem\t/CN=%s\n", expiry, serial, name, serial, name)
+	}
+	if err := w.Flush(); err != nil {
+		b.Fatal(err)
+	}
+	file.Close()
+	d, err := NewFileDepot(dir)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return d
+}
+
+var benchmarkSizes = []int{1000, 10000, 100000}
+
+func BenchmarkHasCN(b *testing.B) {
+	for _, n := range benchmarkSizes {
+		b.Run(strconv.Itoa(n), func(b *testing.B) {
+			d := benchmarkDepot(b, n)
+			cert := namedCert(b, big.NewInt(int64(n+2)), "device-new", time.Now().Add(time.Hour))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := d.HasCN("device-new", 14, cert, false); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkGetCert(b *testing.B) {
+	for _, n := range benchmarkSizes {
+		b.Run(strconv.Itoa(n), func(b *testing.B) {
+			d := benchmarkDepot(b, n)
+			cert := namedCert(b, big.NewInt(int64(n+2)), "device-new", time.Now().Add(time.Hour))
+			if err := d.Put("device-new", cert); err != nil {
+				b.Fatal(err)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := d.GetCert(cert.SerialNumber); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkPut(b *testing.B) {
+	for _, n := range benchmarkSizes {
+		b.Run(strconv.Itoa(n), func(b *testing.B) {
+			d := benchmarkDepot(b, n)
+			cert := namedCert(b, big.NewInt(1), "device-new", time.Now().Add(time.Hour))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				// a new DN does not supersede earlier certificates
+				name := "device-new-" + strconv.Itoa(i)
+				cert.SerialNumber = big.NewInt(int64(n + 2 + i))
+				cert.Subject.CommonName = name
+				if err := d.Put(name, cert); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,168 @@
+package file
+
+import (
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/syncsynchalt/scep/depot"
+)
+
+const csrPEMBlockType = "CERTIFICATE REQUEST"
+
+// Pending requests are kept as PEM files in one directory per status,
+// so that an operator can review and approve them with the usual tools.
+var pendingDirs = []depot.PendingStatus{
+	depot.StatusPending,
+	depot.StatusApproved,
+	depot.StatusRejected,
+	depot.StatusIssued,
+}
+
+// PutPending stores a new pending request.
+func (d *fileDepot) PutPending(tid string, csr []byte) error {
+	dir := d.path(string(depot.StatusPending))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	name := filepath.Join(dir, pendingFilename(tid))
+	file, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, dbPerm)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	pemBlock := &pem.Block{
+		Type:  csrPEMBlockType,
+		Bytes: csr,
+	}
+	if err := pem.Encode(file, pemBlock); err != nil {
+		os.Remove(name)
+		return err
+	}
+	return nil
+}
+
+// Pending looks up a pending request in any of the status directories.
+func (d *fileDepot) Pending(tid string) (*depot.PendingRequest, error) {
+	for _, status := range pendingDirs {
+		name := filepath.Join(d.path(string(status)), pendingFilename(tid))
+		req, err := loadPending(name, tid, status)
+		if os.IsNotExist(err) {
+			continue
+		}
+		return req, err
+	}
+	return nil, depot.ErrNotFound
+}
+
+// ListPending returns the requests in all status directories.
+func (d *fileDepot) ListPending() ([]*depot.PendingRequest, error) {
+	var reqs []*depot.PendingRequest
+	for _, status := range pendingDirs {
+		files, err := ioutil.ReadDir(d.path(string(status)))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, fi := range files {
+			if !strings.HasSuffix(fi.Name(), ".pem") {
+				continue
+			}
+			tid, err := hex.DecodeString(strings.TrimSuffix(fi.Name(), ".pem"))
+			if err != nil {
+				continue
+			}
+			name := filepath.Join(d.path(string(status)), fi.Name())
+			req, err := loadPending(name, string(tid), status)
+			if err != nil {
+				return nil, err
+			}
+			reqs = append(reqs, req)
+		}
+	}
+	return reqs, nil
+}
+
+// SetPendingStatus moves a pending request to the directory of the new status.
+func (d *fileDepot) SetPendingStatus(tid string, status depot.PendingStatus) error {
+	req, err := d.Pending(tid)
+	if err != nil {
+		return err
+	}
+	if req.Status == status {
+		return nil
+	}
+	if err := os.MkdirAll(d.path(string(status)), 0755); err != nil {
+		return err
+	}
+	return os.Rename(
+		filepath.Join(d.path(string(req.Status)), pendingFilename(tid)),
+		filepath.Join(d.path(string(status)), pendingFilename(tid)),
+	)
+}
+
+// SwapPendingStatus moves a request from the directory of the old status
+// to the one of the new status, the rename fails if another process moved
+// it first.
+func (d *fileDepot) SwapPendingStatus(tid string, old, new depot.PendingStatus) (bool, error) {
+	if err := os.MkdirAll(d.path(string(new)), 0755); err != nil {
+		return false, err
+	}
+	err := os.Rename(
+		filepath.Join(d.path(string(old)), pendingFilename(tid)),
+		filepath.Join(d.path(string(new)), pendingFilename(tid)),
+	)
+	if os.IsNotExist(err) {
+		if _, err := d.Pending(tid); err != nil {
+			return false, err
+		}
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// DeletePending removes a request regardless of its status.
+func (d *fileDepot) DeletePending(tid string) error {
+	req, err := d.Pending(tid)
+	if err != nil {
+		return err
+	}
+	return os.Remove(filepath.Join(d.path(string(req.Status)), pendingFilename(tid)))
+}
+
+// transaction IDs are client chosen strings, hex encode them
+// to get a safe filename.
+func pendingFilename(tid string) string {
+	return hex.EncodeToString([]byte(tid)) + ".pem"
+}
+
+func loadPending(name, tid string, status depot.PendingStatus) (*depot.PendingRequest, error) {
+	fi, err := os.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	pemBlock, _ := pem.Decode(data)
+	if pemBlock == nil || pemBlock.Type != csrPEMBlockType {
+		return nil, errors.New("PEM decode failed for " + name)
+	}
+	return &depot.PendingRequest{
+		TransactionID: tid,
+		CSR:           pemBlock.Bytes,
+		Status:        status,
+		Created:       fi.ModTime(),
+	}, nil
+}
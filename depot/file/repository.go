@@ -0,0 +1,173 @@
+package file
+
+import (
+	"crypto"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/syncsynchalt/scep/depot"
+)
+
+// List returns the certificates of the CA database selected by filter.
+func (d *fileDepot) List(filter depot.CertFilter) ([]*depot.CertRecord, error) {
+	var selected [][]string
+	// files are named as the CN escaped, or the CN in older depots
+	escapedCN := strings.TrimSuffix(depot.CertFileName(filter.CN, big.NewInt(0)), ".0.pem")
+	err := d.withIndex(func(idx *dbIndex) error {
+		entries := idx.entries
+		if !filter.ExpiresAfter.IsZero() || !filter.ExpiresBefore.IsZero() {
+			entries = idx.expiring(filter.ExpiresAfter, filter.ExpiresBefore)
+		}
+		for _, entry := range entries {
+			if entry.serial == nil {
+				continue
+			}
+			// the CN is part of the file name, skip loading others
+			if filter.CN != "" {
+				base := path.Base(entry.filename())
+				if !strings.HasPrefix(base, escapedCN+".") && !strings.HasPrefix(base, filter.CN+".") {
+					continue
+				}
+			}
+			selected = append(selected, append([]string(nil), entry.fields...))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	var records []*depot.CertRecord
+	for _, entries := range selected {
+		record, err := d.record(entries, now)
+		if err != nil {
+			return nil, err
+		}
+		if filter.Match(record) {
+			records = append(records, record)
+		}
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Certificate.SerialNumber.Cmp(records[j].Certificate.SerialNumber) < 0
+	})
+	return records, nil
+}
+
+// record loads the certificate of a CA database entry.
+func (d *fileDepot) record(entries []string, now time.Time) (*depot.CertRecord, error) {
+	certPEM, err := d.getFile(entries[4])
+	if err != nil {
+		return nil, err
+	}
+	cert, err := loadCert(certPEM.Data)
+	if err != nil {
+		return nil, err
+	}
+	name, err := depot.NameFromCertFileName(path.Base(entries[4]), cert.SerialNumber)
+	if err != nil {
+		// a file which was not named by this depot
+		name = strings.TrimSuffix(path.Base(entries[4]), "."+cert.SerialNumber.String()+".pem")
+	}
+	record := &depot.CertRecord{
+		Name:        name,
+		Certificate: cert,
+	}
+	if entries[0] != "R" {
+		record.Status = depot.CertStatusAt(cert, now)
+		return record, nil
+	}
+	record.Status = depot.CertRevoked
+	// the revocation field is "date[,reason]"
+	fields := strings.SplitN(entries[2], ",", 2)
+	record.RevokedAt, err = parseOpenSSLTime(fields[0])
+	if err != nil {
+		return nil, err
+	}
+	if len(fields) == 2 {
+		record.RevocationReason, err = parseReason(fields[1])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return record, nil
+}
+
+// NextSerial returns the next serial number from the serial file
+// without reserving it.
+func (d *fileDepot) NextSerial() (*big.Int, error) {
+	unlock, err := d.lock()
+	if err != nil {
+		return nil, err
+	}
+	defer unlock()
+	return d.readSerial()
+}
+
+// SetNextSerial writes the next serial number to the serial file.
+func (d *fileDepot) SetNextSerial(serial *big.Int) error {
+	unlock, err := d.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return d.writeSerial(serial)
+}
+
+// ImportCA writes ca.pem and ca.key, it fails if the depot has a CA.
+func (d *fileDepot) ImportCA(chain []*x509.Certificate, key crypto.Signer, pass []byte) error {
+	unlock, err := d.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if _, err := os.Stat(d.path("ca.pem")); !os.IsNotExist(err) {
+		return errors.New("depot already has a CA")
+	}
+	if key != nil {
+		keyPEM, err := depot.EncodeKey(key, pass)
+		if err != nil {
+			return err
+		}
+		if err := d.writeFile("ca.key", keyPEM, 0400); err != nil {
+			return err
+		}
+	}
+	var certs []byte
+	for _, cert := range chain {
+		certs = append(certs, pemCert(cert.Raw)...)
+	}
+	return d.writeFile("ca.pem", certs, certPerm)
+}
+
+// ImportCert writes the certificate file and its entry in the CA database.
+func (d *fileDepot) ImportCert(record *depot.CertRecord) error {
+	cert := record.Certificate
+	filename := d.certFile(record.Name, cert.SerialNumber)
+	line := indexLine("V", "", filename, cert)
+	if record.Status == depot.CertRevoked {
+		reason := record.RevocationReason
+		if int(reason) < 0 || int(reason) >= len(crlReasons) || crlReasons[reason] == "" {
+			return fmt.Errorf("unknown revocation reason %d", reason)
+		}
+		revocation := makeOpenSSLTime(record.RevokedAt.UTC()) + "," + crlReasons[reason]
+		line = indexLine("R", revocation, filename, cert)
+	}
+
+	unlock, err := d.lock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	if err := d.writeCert(filename, cert.Raw); err != nil {
+		return err
+	}
+	return d.appendDB(line)
+}
@@ -0,0 +1,80 @@
+package file
+
+import (
+	"crypto/x509"
+	"math/big"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/syncsynchalt/scep/depot"
+)
+
+func TestList(t *testing.T) {
+	d := createDepot(t)
+	now := time.Now()
+	alice := namedCert(t, big.NewInt(2), "alice", now.Add(time.Hour))
+	bob := namedCert(t, big.NewInt(3), "bob", now.Add(-time.Hour))
+	carol := namedCert(t, big.NewInt(4), "carol", now.Add(2*time.Hour))
+	for _, cert := range []*x509.Certificate{carol, alice, bob} {
+		if err := d.Put(cert.Subject.CommonName, cert); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Revoke(carol.SerialNumber, depot.ReasonKeyCompromise); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Revoke(big.NewInt(5), depot.ReasonKeyCompromise); err != depot.ErrNotFound {
+		t.Errorf("revoking unknown serial: have %v, want %v", err, depot.ErrNotFound)
+	}
+
+	tests := []struct {
+		name   string
+		filter depot.CertFilter
+		want   []int64
+	}{
+		{"all", depot.CertFilter{}, []int64{2, 3, 4}},
+		{"cn", depot.CertFilter{CN: "alice"}, []int64{2}},
+		{"unknown cn", depot.CertFilter{CN: "dave"}, nil},
+		{"valid", depot.CertFilter{Status: depot.CertValid}, []int64{2}},
+		{"expired", depot.CertFilter{Status: depot.CertExpired}, []int64{3}},
+		{"revoked", depot.CertFilter{Status: depot.CertRevoked}, []int64{4}},
+		{"expires after", depot.CertFilter{ExpiresAfter: now}, []int64{2, 4}},
+		{"expires before", depot.CertFilter{ExpiresBefore: now.Add(90 * time.Minute)}, []int64{2, 3}},
+		{"ski", depot.CertFilter{SubjectKeyID: bob.SubjectKeyId}, []int64{3}},
+		{"public key", depot.CertFilter{PublicKeyHash: depot.PublicKeyHash(alice)}, []int64{2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			records, err := d.List(tt.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var have []int64
+			for _, r := range records {
+				have = append(have, r.Certificate.SerialNumber.Int64())
+			}
+			if !reflect.DeepEqual(have, tt.want) {
+				t.Errorf("have %v, want %v", have, tt.want)
+			}
+		})
+	}
+
+	records, err := d.List(depot.CertFilter{Status: depot.CertRevoked})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := records[0].RevocationReason, depot.ReasonKeyCompromise; have != want {
+		t.Errorf("have reason %d, want %d", have, want)
+	}
+	if records[0].RevokedAt.IsZero() {
+		t.Error("revoked certificate without revocation time")
+	}
+	revoked, err := d.RevokedCerts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revoked) != 1 || revoked[0].SerialNumber.Cmp(carol.SerialNumber) != 0 {
+		t.Errorf("have revoked certificates %v, want serial %s", revoked, carol.SerialNumber)
+	}
+}
@@ -0,0 +1,471 @@
+// Package sql implements a SCEP depot on top of database/sql. Queries use
+// ? placeholders, the schema is tested with SQLite.
+package sql
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"database/sql"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/syncsynchalt/scep/depot"
+)
+
+// Depot is a SCEP certificate store in a SQL database.
+type Depot struct {
+	db             *sql.DB
+	serialStrategy depot.SerialStrategy
+	rand           io.Reader // source of random serials
+	certDir        string
+}
+
+// Option is an optional argument to NewDepot.
+type Option func(*Depot)
+
+// WithSerialStrategy selects how serial numbers are allocated,
+// the default is depot.SerialSequential.
+func WithSerialStrategy(strategy depot.SerialStrategy) Option {
+	return func(d *Depot) {
+		d.serialStrategy = strategy
+	}
+}
+
+// WithCertDir sets the folder which CertFilename writes certificate
+// files to, for hooks which expect one.
+func WithCertDir(dir string) Option {
+	return func(d *Depot) {
+		d.certDir = dir
+	}
+}
+
+// schema creates the tables of the depot. Serial numbers are stored as
+// hex strings and times as Unix seconds.
+var schema = []string{
+	`CREATE TABLE IF NOT EXISTS scep_ca (
+		name VARCHAR(32) PRIMARY KEY,
+		data BLOB NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS scep_serial (
+		id INTEGER PRIMARY KEY,
+		next_serial BIGINT NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS scep_crl_number (
+		id INTEGER PRIMARY KEY,
+		next_number BIGINT NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS scep_certificates (
+		serial VARCHAR(64) PRIMARY KEY,
+		name VARCHAR(255) NOT NULL,
+		not_after BIGINT NOT NULL,
+		certificate BLOB NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS scep_certificates_name ON scep_certificates (name)`,
+	`CREATE TABLE IF NOT EXISTS scep_revocations (
+		serial VARCHAR(64) PRIMARY KEY REFERENCES scep_certificates (serial),
+		revoked_at BIGINT NOT NULL,
+		reason INTEGER NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS scep_pending (
+		transaction_id VARCHAR(255) PRIMARY KEY,
+		csr BLOB NOT NULL,
+		status VARCHAR(16) NOT NULL,
+		created BIGINT NOT NULL
+	)`,
+}
+
+// NewDepot creates the tables of the depot in db if they do not exist.
+func NewDepot(db *sql.DB, opts ...Option) (*Depot, error) {
+	for _, stmt := range schema {
+		if _, err := db.Exec(stmt); err != nil {
+			return nil, fmt.Errorf("create schema: %s", err)
+		}
+	}
+	d := &Depot{db: db, rand: rand.Reader}
+	for _, opt := range opts {
+		opt(d)
+	}
+	return d, nil
+}
+
+// transact runs fn in a transaction, which is committed if fn succeeds.
+func (d *Depot) transact(fn func(tx *sql.Tx) error) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err := fn(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (d *Depot) CA(pass []byte) ([]*x509.Certificate, crypto.Signer, error) {
+	chain, err := d.CACerts()
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := d.CAKey(pass)
+	if err != nil {
+		return nil, nil, err
+	}
+	return chain, key, nil
+}
+
+// CACerts returns the CA certificate stored in the database.
+func (d *Depot) CACerts() ([]*x509.Certificate, error) {
+	var der []byte
+	err := d.db.QueryRow(`SELECT data FROM scep_ca WHERE name = 'ca_certificate'`).Scan(&der)
+	if err == sql.ErrNoRows {
+		return nil, errors.New("no CA certificate in the database")
+	}
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return []*x509.Certificate{cert}, nil
+}
+
+// CAKey returns the CA key stored in the database, decrypted with pass.
+func (d *Depot) CAKey(pass []byte) (crypto.Signer, error) {
+	var keyPEM []byte
+	err := d.db.QueryRow(`SELECT data FROM scep_ca WHERE name = 'ca_key'`).Scan(&keyPEM)
+	if err == sql.ErrNoRows {
+		return nil, errors.New("no CA key in the database")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return depot.ParseKey(keyPEM, pass)
+}
+
+// ImportCA stores the CA certificate and key, replacing the existing ones.
+// Only the first certificate of chain is stored. The key is stored
+// encrypted with pass, it may be nil when the CA key is held by a
+// keyprovider.KeyProvider.
+func (d *Depot) ImportCA(chain []*x509.Certificate, key crypto.Signer, pass []byte) error {
+	var keyPEM []byte
+	if key != nil {
+		var err error
+		keyPEM, err = depot.EncodeKey(key, pass)
+		if err != nil {
+			return err
+		}
+	}
+	return d.transact(func(tx *sql.Tx) error {
+		if keyPEM != nil {
+			if err := putCA(tx, "ca_key", keyPEM); err != nil {
+				return err
+			}
+		}
+		return putCA(tx, "ca_certificate", chain[0].Raw)
+	})
+}
+
+func putCA(tx *sql.Tx, name string, data []byte) error {
+	if _, err := tx.Exec(`DELETE FROM scep_ca WHERE name = ?`, name); err != nil {
+		return err
+	}
+	_, err := tx.Exec(`INSERT INTO scep_ca (name, data) VALUES (?, ?)`, name, data)
+	return err
+}
+
+// CertFilename returns the name of a PEM file with the certificate, for
+// hooks which expect one. The file is written to the folder set with
+// WithCertDir.
+func (d *Depot) CertFilename(cn string, crt *x509.Certificate) (string, error) {
+	if crt == nil || crt.Raw == nil {
+		return "", fmt.Errorf("%q does not specify a valid certificate", cn)
+	}
+	if d.certDir == "" {
+		return "", errors.New("no folder for certificate files")
+	}
+	if err := os.MkdirAll(d.certDir, 0755); err != nil {
+		return "", err
+	}
+	name := filepath.Join(d.certDir, depot.CertFileName(cn, crt.SerialNumber))
+	if _, err := os.Stat(name); err == nil {
+		return name, nil
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: crt.Raw})
+	if err := ioutil.WriteFile(name, data, 0444); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// Stage writes the file of a certificate for hooks, as CertFilename does.
+func (d *Depot) Stage(cn string, crt *x509.Certificate) (string, error) {
+	return d.CertFilename(cn, crt)
+}
+
+// Unstage removes the file of a certificate which is not stored.
+func (d *Depot) Unstage(cn string, crt *x509.Certificate) error {
+	if _, err := d.GetCert(crt.SerialNumber); err != depot.ErrNotFound || d.certDir == "" {
+		return err
+	}
+	err := os.Remove(filepath.Join(d.certDir, depot.CertFileName(cn, crt.SerialNumber)))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// Put stores a certificate and revokes older certificates with the same
+// name as superseded, in one transaction with the next serial number.
+func (d *Depot) Put(cn string, crt *x509.Certificate) error {
+	return d.put(cn, crt, true)
+}
+
+// PutWithoutSuperseding stores a certificate like Put, but keeps the
+// certificates with the same name valid.
+func (d *Depot) PutWithoutSuperseding(cn string, crt *x509.Certificate) error {
+	return d.put(cn, crt, false)
+}
+
+// Supersede revokes the valid certificates with the same name, except crt.
+func (d *Depot) Supersede(cn string, crt *x509.Certificate) (bool, error) {
+	var revoked bool
+	err := d.transact(func(tx *sql.Tx) error {
+		var err error
+		revoked, err = hasCN(tx, cn, 0, crt, true)
+		return err
+	})
+	return revoked, err
+}
+
+func (d *Depot) put(cn string, crt *x509.Certificate, supersede bool) error {
+	if crt == nil || crt.Raw == nil {
+		return fmt.Errorf("%q does not specify a valid certificate for storage", cn)
+	}
+	return d.transact(func(tx *sql.Tx) error {
+		if _, err := hasCN(tx, cn, 0, crt, supersede); err != nil {
+			return err
+		}
+		if err := putCert(tx, cn, crt); err != nil {
+			return err
+		}
+		if d.serialStrategy == depot.SerialRandom || !crt.SerialNumber.IsInt64() {
+			return nil
+		}
+		// keep the next serial above certificates which were not
+		// issued with a serial reserved by Serial
+		next, err := nextSerial(tx)
+		if err != nil {
+			return err
+		}
+		if next.Cmp(crt.SerialNumber) > 0 {
+			return nil
+		}
+		return setNextSerial(tx, crt.SerialNumber.Int64()+1)
+	})
+}
+
+func putCert(tx *sql.Tx, name string, crt *x509.Certificate) error {
+	_, err := tx.Exec(`INSERT INTO scep_certificates (serial, name, not_after, certificate) VALUES (?, ?, ?, ?)`,
+		serialKey(crt.SerialNumber), name, crt.NotAfter.Unix(), crt.Raw)
+	return err
+}
+
+// serialKey returns the key of a serial number in the database.
+func serialKey(serial *big.Int) string {
+	return fmt.Sprintf("%x", serial)
+}
+
+// Serial reserves the next serial number, concurrent callers get
+// different serial numbers.
+func (d *Depot) Serial() (*big.Int, error) {
+	var serial *big.Int
+	err := d.transact(func(tx *sql.Tx) error {
+		if d.serialStrategy == depot.SerialRandom {
+			var err error
+			serial, err = d.randomSerial(tx)
+			return err
+		}
+		// the update comes first to lock the row, or the database
+		res, err := tx.Exec(`UPDATE scep_serial SET next_serial = next_serial + 1 WHERE id = 1`)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			if _, err := tx.Exec(`INSERT INTO scep_serial (id, next_serial) VALUES (1, 3)`); err != nil {
+				return err
+			}
+		}
+		next, err := nextSerial(tx)
+		if err != nil {
+			return err
+		}
+		serial = next.Sub(next, big.NewInt(1))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return serial, nil
+}
+
+// CRLNumber reserves the number of the next CRL, counting up from 1.
+func (d *Depot) CRLNumber() (*big.Int, error) {
+	var n int64
+	err := d.transact(func(tx *sql.Tx) error {
+		// the update comes first to lock the row, as in Serial
+		res, err := tx.Exec(`UPDATE scep_crl_number SET next_number = next_number + 1 WHERE id = 1`)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			if _, err := tx.Exec(`INSERT INTO scep_crl_number (id, next_number) VALUES (1, 2)`); err != nil {
+				return err
+			}
+		}
+		if err := tx.QueryRow(`SELECT next_number FROM scep_crl_number WHERE id = 1`).Scan(&n); err != nil {
+			return err
+		}
+		n--
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return big.NewInt(n), nil
+}
+
+// randomSerial returns a random serial which is not used by a stored
+// certificate.
+func (d *Depot) randomSerial(tx *sql.Tx) (*big.Int, error) {
+	for {
+		serial, err := depot.RandomSerial(d.rand)
+		if err != nil {
+			return nil, err
+		}
+		var n int
+		err = tx.QueryRow(`SELECT COUNT(*) FROM scep_certificates WHERE serial = ?`, serialKey(serial)).Scan(&n)
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			return serial, nil
+		}
+	}
+}
+
+// NextSerial returns the next serial number without reserving it.
+func (d *Depot) NextSerial() (*big.Int, error) {
+	var serial *big.Int
+	err := d.transact(func(tx *sql.Tx) error {
+		var err error
+		serial, err = nextSerial(tx)
+		return err
+	})
+	return serial, err
+}
+
+// SetNextSerial sets the next serial number.
+func (d *Depot) SetNextSerial(serial *big.Int) error {
+	if !serial.IsInt64() {
+		return fmt.Errorf("serial %s is too large", serial)
+	}
+	return d.transact(func(tx *sql.Tx) error {
+		return setNextSerial(tx, serial.Int64())
+	})
+}
+
+// nextSerial returns the next serial number, 2 if none is stored.
+func nextSerial(tx *sql.Tx) (*big.Int, error) {
+	var next int64
+	err := tx.QueryRow(`SELECT next_serial FROM scep_serial WHERE id = 1`).Scan(&next)
+	if err == sql.ErrNoRows {
+		return big.NewInt(2), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return big.NewInt(next), nil
+}
+
+func setNextSerial(tx *sql.Tx, next int64) error {
+	res, err := tx.Exec(`UPDATE scep_serial SET next_serial = ? WHERE id = 1`, next)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil || n > 0 {
+		return err
+	}
+	_, err = tx.Exec(`INSERT INTO scep_serial (id, next_serial) VALUES (1, ?)`, next)
+	return err
+}
+
+// HasCN checks whether a certificate for cn may be issued: it fails if
+// a valid certificate with the same name does not expire within allowTime
+// days, unless allowTime is 0. With revokeOldCertificate, the valid
+// certificates with the same name are revoked as superseded.
+func (d *Depot) HasCN(cn string, allowTime int, cert *x509.Certificate, revokeOldCertificate bool) (bool, error) {
+	if cert == nil {
+		return false, errors.New("nil certificate provided")
+	}
+	err := d.transact(func(tx *sql.Tx) error {
+		_, err := hasCN(tx, cn, allowTime, cert, revokeOldCertificate)
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// hasCN implements HasCN within a transaction, and reports whether
+// certificates were revoked.
+func hasCN(tx *sql.Tx, cn string, allowTime int, cert *x509.Certificate, revokeOldCertificate bool) (bool, error) {
+	now := time.Now().UTC()
+	rows, err := tx.Query(`SELECT c.serial, c.not_after FROM scep_certificates c
+		LEFT JOIN scep_revocations r ON r.serial = c.serial
+		WHERE c.name = ? AND c.serial <> ? AND r.serial IS NULL`,
+		cn, serialKey(cert.SerialNumber))
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	renewable := now.AddDate(0, 0, allowTime).Unix()
+	var old []string
+	for rows.Next() {
+		var serial string
+		var notAfter int64
+		if err := rows.Scan(&serial, &notAfter); err != nil {
+			return false, err
+		}
+		if allowTime > 0 && notAfter > renewable {
+			return false, fmt.Errorf("CN %s already exists", cn)
+		}
+		old = append(old, serial)
+	}
+	if err := rows.Err(); err != nil {
+		return false, err
+	}
+	rows.Close()
+	if !revokeOldCertificate {
+		return false, nil
+	}
+	for _, serial := range old {
+		if err := revoke(tx, serial, depot.ReasonSuperseded, now); err != nil {
+			return false, err
+		}
+	}
+	return len(old) > 0, nil
+}
@@ -0,0 +1,323 @@
+package sql
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"database/sql"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/syncsynchalt/scep/depot"
+)
+
+func TestSerial(t *testing.T) {
+	d := createDepot(t)
+	for _, want := range []int64{2, 3} {
+		have, err := d.Serial()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if have.Cmp(big.NewInt(want)) != 0 {
+			t.Errorf("have %s, want %d", have, want)
+		}
+	}
+	// Put keeps the next serial above imported certificates
+	if err := d.Put("imported", namedCert(t, big.NewInt(10), "imported", time.Now().Add(time.Hour))); err != nil {
+		t.Fatal(err)
+	}
+	next, err := d.NextSerial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := next.Int64(), int64(11); have != want {
+		t.Errorf("have next serial %d, want %d", have, want)
+	}
+
+	var wg sync.WaitGroup
+	var mtx sync.Mutex
+	seen := make(map[string]bool)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			serial, err := d.Serial()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			mtx.Lock()
+			defer mtx.Unlock()
+			if seen[serial.String()] {
+				t.Errorf("serial %s was reserved twice", serial)
+			}
+			seen[serial.String()] = true
+		}()
+	}
+	wg.Wait()
+}
+
+func TestCRLNumber(t *testing.T) {
+	d := createDepot(t)
+	for _, want := range []int64{1, 2, 3} {
+		have, err := d.CRLNumber()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if have.Cmp(big.NewInt(want)) != 0 {
+			t.Errorf("have %s, want %d", have, want)
+		}
+	}
+}
+
+func TestRandomSerial(t *testing.T) {
+	d := createDepot(t, WithSerialStrategy(depot.SerialRandom))
+	serial, err := d.Serial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if serial.BitLen() < 64 {
+		t.Errorf("serial %s has less than 64 bits", serial)
+	}
+	cert := namedCert(t, serial, "random", time.Now().Add(time.Hour))
+	if err := d.Put("random", cert); err != nil {
+		t.Fatal(err)
+	}
+	have, err := d.GetCert(serial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !have.Equal(cert) {
+		t.Error("GetCert returned another certificate")
+	}
+}
+
+func TestList(t *testing.T) {
+	d := createDepot(t)
+	now := time.Now()
+	alice := namedCert(t, big.NewInt(2), "alice", now.Add(time.Hour))
+	bob := namedCert(t, big.NewInt(3), "bob", now.Add(-time.Hour))
+	carol := namedCert(t, big.NewInt(4), "carol", now.Add(2*time.Hour))
+	for _, cert := range []*x509.Certificate{carol, alice, bob} {
+		if err := d.Put(cert.Subject.CommonName, cert); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Revoke(carol.SerialNumber, depot.ReasonKeyCompromise); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Revoke(big.NewInt(5), depot.ReasonKeyCompromise); err != depot.ErrNotFound {
+		t.Errorf("revoking unknown serial: have %v, want %v", err, depot.ErrNotFound)
+	}
+
+	tests := []struct {
+		name   string
+		filter depot.CertFilter
+		want   []int64
+	}{
+		{"all", depot.CertFilter{}, []int64{2, 3, 4}},
+		{"cn", depot.CertFilter{CN: "alice"}, []int64{2}},
+		{"valid", depot.CertFilter{Status: depot.CertValid}, []int64{2}},
+		{"expired", depot.CertFilter{Status: depot.CertExpired}, []int64{3}},
+		{"revoked", depot.CertFilter{Status: depot.CertRevoked}, []int64{4}},
+		{"ski", depot.CertFilter{SubjectKeyID: bob.SubjectKeyId}, []int64{3}},
+		{"public key", depot.CertFilter{PublicKeyHash: depot.PublicKeyHash(alice)}, []int64{2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			records, err := d.List(tt.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var have []int64
+			for _, r := range records {
+				have = append(have, r.Certificate.SerialNumber.Int64())
+			}
+			if !reflect.DeepEqual(have, tt.want) {
+				t.Errorf("have %v, want %v", have, tt.want)
+			}
+		})
+	}
+
+	revoked, err := d.RevokedCerts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revoked) != 1 || revoked[0].SerialNumber.Cmp(carol.SerialNumber) != 0 {
+		t.Errorf("have revoked certificates %v, want serial %s", revoked, carol.SerialNumber)
+	}
+}
+
+func TestHasCN(t *testing.T) {
+	d := createDepot(t)
+	now := time.Now()
+	old := namedCert(t, big.NewInt(2), "device", now.Add(10*24*time.Hour))
+	if err := d.Put("device", old); err != nil {
+		t.Fatal(err)
+	}
+	renewal := namedCert(t, big.NewInt(3), "device", now.Add(365*24*time.Hour))
+	if _, err := d.HasCN("device", 7, renewal, false); err == nil {
+		t.Error("renewal allowed outside of the renewal window")
+	}
+	if _, err := d.HasCN("device", 14, renewal, false); err != nil {
+		t.Errorf("renewal within the renewal window: %s", err)
+	}
+	if err := d.Put("device", renewal); err != nil {
+		t.Fatal(err)
+	}
+	records, err := d.List(depot.CertFilter{Status: depot.CertRevoked})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].RevocationReason != depot.ReasonSuperseded {
+		t.Errorf("old certificate was not superseded: %v", records)
+	}
+}
+
+func TestSupersede(t *testing.T) {
+	d := createDepot(t)
+	now := time.Now()
+	old := namedCert(t, big.NewInt(2), "device", now.Add(10*24*time.Hour))
+	if err := d.Put("device", old); err != nil {
+		t.Fatal(err)
+	}
+	renewal := namedCert(t, big.NewInt(3), "device", now.Add(365*24*time.Hour))
+	if err := d.PutWithoutSuperseding("device", renewal); err != nil {
+		t.Fatal(err)
+	}
+	records, err := d.List(depot.CertFilter{Status: depot.CertValid})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := len(records), 2; have != want {
+		t.Errorf("have %d valid certificates, want %d", have, want)
+	}
+	superseded, err := d.Supersede("device", renewal)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !superseded {
+		t.Error("Supersede reported no superseded certificate")
+	}
+	records, err = d.List(depot.CertFilter{Status: depot.CertValid})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].Certificate.SerialNumber.Cmp(renewal.SerialNumber) != 0 {
+		t.Errorf("old certificate was not superseded: %v", records)
+	}
+	if superseded, err := d.Supersede("device", renewal); err != nil || superseded {
+		t.Errorf("superseded again: %v, %v", superseded, err)
+	}
+}
+
+func TestPending(t *testing.T) {
+	d := createDepot(t)
+	if err := d.PutPending("tid", []byte("csr")); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.PutPending("tid", []byte("csr")); err == nil {
+		t.Error("stored a pending request twice")
+	}
+	if err := d.SetPendingStatus("tid", depot.StatusApproved); err != nil {
+		t.Fatal(err)
+	}
+	req, err := d.Pending("tid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Status != depot.StatusApproved || string(req.CSR) != "csr" {
+		t.Errorf("have %+v", req)
+	}
+	for i, want := range []bool{true, false} {
+		swapped, err := d.SwapPendingStatus("tid", depot.StatusApproved, depot.StatusIssued)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if swapped != want {
+			t.Errorf("swap %d: have %v, want %v", i+1, swapped, want)
+		}
+	}
+	if _, err := d.SwapPendingStatus("other", depot.StatusApproved, depot.StatusIssued); err != depot.ErrNotFound {
+		t.Errorf("swapping an unknown request: have %v, want %v", err, depot.ErrNotFound)
+	}
+	if err := d.DeletePending("tid"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Pending("tid"); err != depot.ErrNotFound {
+		t.Errorf("have %v, want %v", err, depot.ErrNotFound)
+	}
+}
+
+func TestImportCA(t *testing.T) {
+	d := createDepot(t)
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := namedCert(t, big.NewInt(1), "ca", time.Now().Add(time.Hour))
+	if err := d.ImportCA([]*x509.Certificate{ca}, key, []byte("secret")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.CAKey([]byte("wrong")); err == nil {
+		t.Error("CA key decrypted with the wrong password")
+	}
+	chain, caKey, err := d.CA([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !chain[0].Equal(ca) || !key.PublicKey.Equal(caKey.Public()) {
+		t.Error("CA changed")
+	}
+}
+
+func createDepot(t *testing.T, opts ...Option) *Depot {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "scep-sql-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	db, err := sql.Open("sqlite3", "file:"+filepath.Join(dir, "scep.db")+"?_busy_timeout=5000&_txlock=immediate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	d, err := NewDepot(db, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func namedCert(t *testing.T, serial *big.Int, cn string, notAfter time.Time) *x509.Certificate {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn},
+		SubjectKeyId: serial.Bytes(),
+		NotBefore:    notAfter.Add(-2 * time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
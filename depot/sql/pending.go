@@ -0,0 +1,112 @@
+package sql
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/syncsynchalt/scep/depot"
+)
+
+// PutPending stores a new pending request.
+func (d *Depot) PutPending(tid string, csr []byte) error {
+	return d.transact(func(tx *sql.Tx) error {
+		var n int
+		err := tx.QueryRow(`SELECT COUNT(*) FROM scep_pending WHERE transaction_id = ?`, tid).Scan(&n)
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			return fmt.Errorf("pending request %q already exists", tid)
+		}
+		_, err = tx.Exec(`INSERT INTO scep_pending (transaction_id, csr, status, created) VALUES (?, ?, ?, ?)`,
+			tid, csr, string(depot.StatusPending), time.Now().Unix())
+		return err
+	})
+}
+
+// Pending returns the pending request for the transaction ID.
+func (d *Depot) Pending(tid string) (*depot.PendingRequest, error) {
+	row := d.db.QueryRow(`SELECT transaction_id, csr, status, created FROM scep_pending WHERE transaction_id = ?`, tid)
+	req, err := scanPending(row)
+	if err == sql.ErrNoRows {
+		return nil, depot.ErrNotFound
+	}
+	return req, err
+}
+
+// ListPending returns all stored requests.
+func (d *Depot) ListPending() ([]*depot.PendingRequest, error) {
+	rows, err := d.db.Query(`SELECT transaction_id, csr, status, created FROM scep_pending ORDER BY created`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var reqs []*depot.PendingRequest
+	for rows.Next() {
+		req, err := scanPending(rows)
+		if err != nil {
+			return nil, err
+		}
+		reqs = append(reqs, req)
+	}
+	return reqs, rows.Err()
+}
+
+// SetPendingStatus updates the status of a stored request.
+func (d *Depot) SetPendingStatus(tid string, status depot.PendingStatus) error {
+	res, err := d.db.Exec(`UPDATE scep_pending SET status = ? WHERE transaction_id = ?`, string(status), tid)
+	if err != nil {
+		return err
+	}
+	return notFound(res)
+}
+
+// SwapPendingStatus updates the status of a stored request if it is old.
+func (d *Depot) SwapPendingStatus(tid string, old, new depot.PendingStatus) (bool, error) {
+	res, err := d.db.Exec(`UPDATE scep_pending SET status = ? WHERE transaction_id = ? AND status = ?`,
+		string(new), tid, string(old))
+	if err != nil {
+		return false, err
+	}
+	if err := notFound(res); err != depot.ErrNotFound {
+		return err == nil, err
+	}
+	if _, err := d.Pending(tid); err != nil {
+		return false, err
+	}
+	return false, nil
+}
+
+// DeletePending removes a stored request.
+func (d *Depot) DeletePending(tid string) error {
+	res, err := d.db.Exec(`DELETE FROM scep_pending WHERE transaction_id = ?`, tid)
+	if err != nil {
+		return err
+	}
+	return notFound(res)
+}
+
+// notFound returns depot.ErrNotFound if no row was changed.
+func notFound(res sql.Result) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return depot.ErrNotFound
+	}
+	return nil
+}
+
+func scanPending(row interface{ Scan(...interface{}) error }) (*depot.PendingRequest, error) {
+	var req depot.PendingRequest
+	var status string
+	var created int64
+	if err := row.Scan(&req.TransactionID, &req.CSR, &status, &created); err != nil {
+		return nil, err
+	}
+	req.Status = depot.PendingStatus(status)
+	req.Created = time.Unix(created, 0).UTC()
+	return &req, nil
+}
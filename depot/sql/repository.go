@@ -0,0 +1,157 @@
+package sql
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"database/sql"
+	"fmt"
+	"math/big"
+	"sort"
+	"time"
+
+	"github.com/syncsynchalt/scep/depot"
+)
+
+// GetCert looks up an issued certificate by serial number.
+func (d *Depot) GetCert(serial *big.Int) (*x509.Certificate, error) {
+	var der []byte
+	err := d.db.QueryRow(`SELECT certificate FROM scep_certificates WHERE serial = ?`, serialKey(serial)).Scan(&der)
+	if err == sql.ErrNoRows {
+		return nil, depot.ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(der)
+}
+
+// Revoke marks a certificate as revoked.
+func (d *Depot) Revoke(serial *big.Int, reason depot.RevocationReason) error {
+	// the RFC 5280 reason codes which the file depot can store, 7 is not used
+	if reason < 0 || reason > 8 || reason == 7 {
+		return fmt.Errorf("unknown revocation reason %d", reason)
+	}
+	return d.transact(func(tx *sql.Tx) error {
+		var n int
+		err := tx.QueryRow(`SELECT COUNT(*) FROM scep_certificates WHERE serial = ?`, serialKey(serial)).Scan(&n)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return depot.ErrNotFound
+		}
+		return revoke(tx, serialKey(serial), reason, time.Now().UTC())
+	})
+}
+
+// revoke adds a revocation unless the certificate is already revoked.
+func revoke(tx *sql.Tx, serial string, reason depot.RevocationReason, now time.Time) error {
+	var n int
+	err := tx.QueryRow(`SELECT COUNT(*) FROM scep_revocations WHERE serial = ?`, serial).Scan(&n)
+	if err != nil || n > 0 {
+		return err
+	}
+	_, err = tx.Exec(`INSERT INTO scep_revocations (serial, revoked_at, reason) VALUES (?, ?, ?)`,
+		serial, now.Unix(), int(reason))
+	return err
+}
+
+// RevokedCerts returns the revoked certificates.
+func (d *Depot) RevokedCerts() ([]pkix.RevokedCertificate, error) {
+	rows, err := d.db.Query(`SELECT serial, revoked_at, reason FROM scep_revocations`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var revoked []pkix.RevokedCertificate
+	for rows.Next() {
+		var serial string
+		var revokedAt int64
+		var reason depot.RevocationReason
+		if err := rows.Scan(&serial, &revokedAt, &reason); err != nil {
+			return nil, err
+		}
+		rc := pkix.RevokedCertificate{
+			SerialNumber:   parseSerial(serial),
+			RevocationTime: time.Unix(revokedAt, 0).UTC(),
+		}
+		ext, err := reason.Extension()
+		if err != nil {
+			return nil, err
+		}
+		if ext != nil {
+			rc.Extensions = []pkix.Extension{*ext}
+		}
+		revoked = append(revoked, rc)
+	}
+	return revoked, rows.Err()
+}
+
+// List returns the stored certificates selected by filter.
+func (d *Depot) List(filter depot.CertFilter) ([]*depot.CertRecord, error) {
+	query := `SELECT c.name, c.certificate, r.revoked_at, r.reason FROM scep_certificates c
+		LEFT JOIN scep_revocations r ON r.serial = c.serial`
+	var args []interface{}
+	if filter.CN != "" {
+		query += ` WHERE c.name = ?`
+		args = append(args, filter.CN)
+	}
+	rows, err := d.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	now := time.Now()
+	var records []*depot.CertRecord
+	for rows.Next() {
+		var name string
+		var der []byte
+		var revokedAt, reason sql.NullInt64
+		if err := rows.Scan(&name, &der, &revokedAt, &reason); err != nil {
+			return nil, err
+		}
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, err
+		}
+		record := &depot.CertRecord{
+			Name:        name,
+			Certificate: cert,
+			Status:      depot.CertStatusAt(cert, now),
+		}
+		if revokedAt.Valid {
+			record.Status = depot.CertRevoked
+			record.RevokedAt = time.Unix(revokedAt.Int64, 0).UTC()
+			record.RevocationReason = depot.RevocationReason(reason.Int64)
+		}
+		if filter.Match(record) {
+			records = append(records, record)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Certificate.SerialNumber.Cmp(records[j].Certificate.SerialNumber) < 0
+	})
+	return records, nil
+}
+
+// ImportCert stores a certificate under its name, with its revocation.
+func (d *Depot) ImportCert(record *depot.CertRecord) error {
+	return d.transact(func(tx *sql.Tx) error {
+		if err := putCert(tx, record.Name, record.Certificate); err != nil {
+			return err
+		}
+		if record.Status != depot.CertRevoked {
+			return nil
+		}
+		return revoke(tx, serialKey(record.Certificate.SerialNumber), record.RevocationReason, record.RevokedAt)
+	})
+}
+
+func parseSerial(s string) *big.Int {
+	serial, _ := new(big.Int).SetString(s, 16)
+	return serial
+}
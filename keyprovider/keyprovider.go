@@ -0,0 +1,13 @@
+// Package keyprovider defines an interface for the source of the CA private key.
+package keyprovider
+
+import "crypto"
+
+// KeyProvider gives access to the CA private key. The key is only used
+// through crypto.Signer, and through crypto.Decrypter when SCEP messages
+// are decrypted with it, so it does not need to be held in process memory.
+//
+// The file and bolt depots are KeyProviders for the key they store.
+type KeyProvider interface {
+	CAKey(pass []byte) (crypto.Signer, error)
+}
@@ -0,0 +1,12 @@
+// Package pkcs11keyprovider provides a CA key held in a PKCS#11 token,
+// such as an HSM. PKCS#11 support requires cgo and is only built with the
+// pkcs11 build tag.
+package pkcs11keyprovider
+
+// Config selects the token and the key pair in it.
+type Config struct {
+	Module     string // path to the PKCS#11 module
+	TokenLabel string
+	PIN        string
+	KeyLabel   string // label of the CA key pair
+}
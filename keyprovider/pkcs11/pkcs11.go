@@ -0,0 +1,53 @@
+//go:build pkcs11
+// +build pkcs11
+
+package pkcs11keyprovider
+
+import (
+	"crypto"
+	"errors"
+	"fmt"
+
+	"github.com/ThalesIgnite/crypto11"
+)
+
+// KeyProvider is a keyprovider.KeyProvider for a key in a PKCS#11 token.
+type KeyProvider struct {
+	ctx      *crypto11.Context
+	keyLabel string
+}
+
+// New opens a session with the token described by config.
+func New(config Config) (*KeyProvider, error) {
+	if config.Module == "" || config.TokenLabel == "" || config.KeyLabel == "" {
+		return nil, errors.New("PKCS#11 module, token label and key label are required")
+	}
+	ctx, err := crypto11.Configure(&crypto11.Config{
+		Path:       config.Module,
+		TokenLabel: config.TokenLabel,
+		Pin:        config.PIN,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &KeyProvider{ctx: ctx, keyLabel: config.KeyLabel}, nil
+}
+
+// CAKey returns the key pair with the configured label. The token is
+// unlocked with the PIN of the config, pass is ignored.
+func (p *KeyProvider) CAKey(pass []byte) (crypto.Signer, error) {
+	key, err := p.ctx.FindKeyPair(nil, []byte(p.keyLabel))
+	if err != nil {
+		return nil, err
+	}
+	if key == nil {
+		return nil, fmt.Errorf("no key pair labeled %q in PKCS#11 token", p.keyLabel)
+	}
+	return key, nil
+}
+
+// Close ends the session with the token. Keys returned by CAKey can not
+// be used afterwards.
+func (p *KeyProvider) Close() error {
+	return p.ctx.Close()
+}
@@ -0,0 +1,108 @@
+//go:build pkcs11
+// +build pkcs11
+
+package pkcs11keyprovider
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"os"
+	"testing"
+
+	"github.com/ThalesIgnite/crypto11"
+)
+
+// The test runs against an initialized token, e.g. with SoftHSM:
+//
+//	softhsm2-util --init-token --free --label scep --pin 1234 --so-pin 1234
+//	SCEP_PKCS11_MODULE=/usr/lib/softhsm/libsofthsm2.so SCEP_PKCS11_TOKEN=scep \
+//	SCEP_PKCS11_PIN=1234 go test -tags pkcs11 ./keyprovider/pkcs11
+func testConfig(t *testing.T) Config {
+	config := Config{
+		Module:     os.Getenv("SCEP_PKCS11_MODULE"),
+		TokenLabel: os.Getenv("SCEP_PKCS11_TOKEN"),
+		PIN:        os.Getenv("SCEP_PKCS11_PIN"),
+		KeyLabel:   "scep-test-ca",
+	}
+	if config.Module == "" {
+		t.Skip("SCEP_PKCS11_MODULE not set")
+	}
+	return config
+}
+
+func TestCAKey(t *testing.T) {
+	config := testConfig(t)
+
+	ctx, err := crypto11.Configure(&crypto11.Config{
+		Path:       config.Module,
+		TokenLabel: config.TokenLabel,
+		Pin:        config.PIN,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctx.Close()
+	generated, err := ctx.GenerateRSAKeyPairWithLabel([]byte("scep-test"), []byte(config.KeyLabel), 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer generated.Delete()
+
+	provider, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer provider.Close()
+	key, err := provider.CAKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, ok := key.Public().(*rsa.PublicKey)
+	if !ok {
+		t.Fatalf("have %T, want *rsa.PublicKey", key.Public())
+	}
+
+	digest := sha256.Sum256([]byte("scep"))
+	sig, err := key.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], sig); err != nil {
+		t.Fatal(err)
+	}
+
+	// SCEP messages are encrypted to the CA with PKCS#1 v1.5
+	decrypter, ok := key.(crypto.Decrypter)
+	if !ok {
+		t.Fatal("PKCS#11 RSA key is not a crypto.Decrypter")
+	}
+	want := []byte("content encryption key")
+	ciphertext, err := rsa.EncryptPKCS1v15(rand.Reader, pub, want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	have, err := decrypter.Decrypt(rand.Reader, ciphertext, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(have, want) {
+		t.Errorf("have %q, want %q", have, want)
+	}
+}
+
+func TestMissingKey(t *testing.T) {
+	config := testConfig(t)
+	config.KeyLabel = "scep-test-missing"
+
+	provider, err := New(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer provider.Close()
+	if _, err := provider.CAKey(nil); err == nil {
+		t.Error("expected an error for a missing key pair")
+	}
+}
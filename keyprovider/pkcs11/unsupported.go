@@ -0,0 +1,27 @@
+//go:build !pkcs11
+// +build !pkcs11
+
+package pkcs11keyprovider
+
+import (
+	"crypto"
+	"errors"
+)
+
+var errNotSupported = errors.New("PKCS#11 support is not built in, rebuild with -tags pkcs11")
+
+// KeyProvider is a keyprovider.KeyProvider for a key in a PKCS#11 token.
+type KeyProvider struct{}
+
+// New always fails, PKCS#11 support is not built in.
+func New(config Config) (*KeyProvider, error) {
+	return nil, errNotSupported
+}
+
+func (p *KeyProvider) CAKey(pass []byte) (crypto.Signer, error) {
+	return nil, errNotSupported
+}
+
+func (p *KeyProvider) Close() error {
+	return nil
+}
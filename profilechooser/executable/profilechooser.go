@@ -0,0 +1,67 @@
+// Package executableprofilechooser defines the ExecutableProfileChooser profilechooser.ProfileChooser.
+package executableprofilechooser
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/go-kit/kit/log"
+)
+
+const (
+	userExecute os.FileMode = 1 << (6 - 3*iota)
+	groupExecute
+	otherExecute
+)
+
+// New creates a executableprofilechooser.ExecutableProfileChooser.
+func New(path string, logger log.Logger) (*ExecutableProfileChooser, error) {
+	fileInfo, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	fileMode := fileInfo.Mode()
+	if fileMode.IsDir() {
+		return nil, errors.New("Profile Chooser executable is a directory")
+	}
+
+	filePerm := fileMode.Perm()
+	if filePerm&(userExecute|groupExecute|otherExecute) == 0 {
+		return nil, errors.New("Profile Chooser executable is not executable")
+	}
+
+	return &ExecutableProfileChooser{executable: path, logger: logger}, nil
+}
+
+// ExecutableProfileChooser implements a profilechooser.ProfileChooser.
+// It executes a command, and passes it the raw decrypted CSR.
+// The command prints the name of the profile on the first line of
+// its output, or nothing to leave the choice to the server.
+type ExecutableProfileChooser struct {
+	executable string
+	logger     log.Logger
+}
+
+func (v *ExecutableProfileChooser) Choose(data []byte) (string, error) {
+	cmd := exec.Command(v.executable)
+	cmd.Stdin = bytes.NewReader(data)
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	scanner := bufio.NewScanner(&stderr)
+	for scanner.Scan() {
+		v.logger.Log("info", "profilechooser stderr: "+scanner.Text())
+	}
+	if err != nil {
+		v.logger.Log("err", err)
+		return "", err
+	}
+	line := strings.SplitN(string(out), "\n", 2)[0]
+	return strings.TrimSpace(line), nil
+}
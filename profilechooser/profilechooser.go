@@ -0,0 +1,8 @@
+// Package profilechooser defines an interface for the program that chooses the certificate profile.
+package profilechooser
+
+// Choose the name of the certificate profile used to issue this CSR.
+// An empty name leaves the choice to the server.
+type ProfileChooser interface {
+	Choose(csrData []byte) (string, error)
+}
@@ -0,0 +1,36 @@
+// Package webhookprofilechooser defines the WebhookProfileChooser profilechooser.ProfileChooser.
+package webhookprofilechooser
+
+import (
+	"strings"
+
+	"github.com/go-kit/kit/log"
+	"github.com/syncsynchalt/scep/webhook"
+)
+
+// New creates a webhookprofilechooser.WebhookProfileChooser.
+func New(config webhook.Config, logger log.Logger) (*WebhookProfileChooser, error) {
+	client, err := webhook.NewClient(config)
+	if err != nil {
+		return nil, err
+	}
+	return &WebhookProfileChooser{client: client, logger: logger}, nil
+}
+
+// WebhookProfileChooser implements a profilechooser.ProfileChooser.
+// It posts the raw decrypted CSR to a webhook, which answers with the
+// name of the profile in "profile", or none to leave the choice to the
+// server.
+type WebhookProfileChooser struct {
+	client *webhook.Client
+	logger log.Logger
+}
+
+func (v *WebhookProfileChooser) Choose(data []byte) (string, error) {
+	resp, err := v.client.Post(webhook.NewRequest("profilechooser", "", data))
+	if err != nil {
+		v.logger.Log("err", err)
+		return "", err
+	}
+	return strings.TrimSpace(resp.Profile), nil
+}
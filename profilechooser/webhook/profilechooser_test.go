@@ -0,0 +1,29 @@
+package webhookprofilechooser
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/syncsynchalt/scep/webhook"
+)
+
+func TestChoose(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"profile": "wifi"}`))
+	}))
+	defer server.Close()
+
+	c, err := New(webhook.Config{URL: server.URL}, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	have, err := c.Choose([]byte("csr"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "wifi"; have != want {
+		t.Errorf("have %s, want %s", have, want)
+	}
+}
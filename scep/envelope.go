@@ -0,0 +1,292 @@
+package scep
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	oidEnvelopedData  = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 3}
+	oidRSAEncryption  = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+	oidDESCBC         = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 7}
+	oidDESEDE3CBC     = asn1.ObjectIdentifier{1, 2, 840, 113549, 3, 7}
+	oidAES128CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES192CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidAES256CBC      = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+	errNoRecipient    = errors.New("scep: pkiEnvelope is not encrypted to the certificate")
+	errBadContentType = errors.New("scep: pkiEnvelope is not enveloped data")
+)
+
+// envelope is the pkcs#7 ContentInfo of a pkiEnvelope.
+type envelope struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"explicit,optional,tag:0"`
+}
+
+type envelopedData struct {
+	Version              int
+	RecipientInfos       []recipientInfo `asn1:"set"`
+	EncryptedContentInfo encryptedContentInfo
+}
+
+type recipientInfo struct {
+	Version                int
+	IssuerAndSerialNumber  issuerAndSerial
+	KeyEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedKey           []byte
+}
+
+type encryptedContentInfo struct {
+	ContentType                asn1.ObjectIdentifier
+	ContentEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedContent           asn1.RawValue `asn1:"tag:0,optional"`
+}
+
+// decryptEnvelope decrypts a pkiEnvelope with a key which only implements
+// crypto.Decrypter, such as a key held in an HSM, which pkcs7 can not
+// decrypt with. Like pkcs7, it supports RSA key transport and DES, 3DES
+// and AES-CBC content encryption.
+func decryptEnvelope(data []byte, cert *x509.Certificate, key crypto.Decrypter) ([]byte, error) {
+	ed, err := parseEnvelope(data)
+	if err != nil {
+		return nil, err
+	}
+	recipient := ed.recipient(cert)
+	if recipient == nil {
+		return nil, errNoRecipient
+	}
+	if !recipient.KeyEncryptionAlgorithm.Algorithm.Equal(oidRSAEncryption) {
+		return nil, errors.Errorf("scep: unsupported key encryption algorithm %s", recipient.KeyEncryptionAlgorithm.Algorithm)
+	}
+	contentKey, err := key.Decrypt(rand.Reader, recipient.EncryptedKey, &rsa.PKCS1v15DecryptOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return ed.EncryptedContentInfo.decrypt(contentKey)
+}
+
+// EncryptedTo reports whether the pkiEnvelope of msg is encrypted to
+// cert, without decrypting it.
+func (msg *PKIMessage) EncryptedTo(cert *x509.Certificate) bool {
+	ed, err := parseEnvelope(msg.p7.Content)
+	return err == nil && ed.recipient(cert) != nil
+}
+
+// parseEnvelope parses the enveloped data of a pkiEnvelope.
+func parseEnvelope(data []byte) (*envelopedData, error) {
+	der, err := berToDER(data)
+	if err != nil {
+		return nil, err
+	}
+	var env envelope
+	if _, err := asn1.Unmarshal(der, &env); err != nil {
+		return nil, err
+	}
+	if !env.ContentType.Equal(oidEnvelopedData) {
+		return nil, errBadContentType
+	}
+	var ed envelopedData
+	if _, err := asn1.Unmarshal(env.Content.Bytes, &ed); err != nil {
+		return nil, err
+	}
+	return &ed, nil
+}
+
+// recipient returns the recipient info for cert, or nil.
+func (ed *envelopedData) recipient(cert *x509.Certificate) *recipientInfo {
+	for i, r := range ed.RecipientInfos {
+		if bytes.Equal(r.IssuerAndSerialNumber.Issuer.FullBytes, cert.RawIssuer) &&
+			r.IssuerAndSerialNumber.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+			return &ed.RecipientInfos[i]
+		}
+	}
+	return nil
+}
+
+// decrypt decrypts the content with the content encryption key.
+func (eci encryptedContentInfo) decrypt(key []byte) ([]byte, error) {
+	var block cipher.Block
+	var err error
+	alg := eci.ContentEncryptionAlgorithm.Algorithm
+	switch {
+	case alg.Equal(oidDESCBC):
+		block, err = des.NewCipher(key)
+	case alg.Equal(oidDESEDE3CBC):
+		block, err = des.NewTripleDESCipher(key)
+	case alg.Equal(oidAES128CBC), alg.Equal(oidAES192CBC), alg.Equal(oidAES256CBC):
+		block, err = aes.NewCipher(key)
+	default:
+		return nil, errors.Errorf("scep: unsupported content encryption algorithm %s", alg)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var iv []byte
+	if _, err := asn1.Unmarshal(eci.ContentEncryptionAlgorithm.Parameters.FullBytes, &iv); err != nil {
+		return nil, err
+	}
+	if len(iv) != block.BlockSize() {
+		return nil, errors.New("scep: invalid IV of the content encryption")
+	}
+
+	// the content is either one OCTET STRING or a constructed one
+	ciphertext := eci.EncryptedContent.Bytes
+	if eci.EncryptedContent.IsCompound {
+		var buf bytes.Buffer
+		for rest := ciphertext; len(rest) > 0; {
+			var part []byte
+			var err error
+			if rest, err = asn1.Unmarshal(rest, &part); err != nil {
+				return nil, err
+			}
+			buf.Write(part)
+		}
+		ciphertext = buf.Bytes()
+	}
+	if len(ciphertext) == 0 || len(ciphertext)%block.BlockSize() != 0 {
+		return nil, errors.New("scep: invalid length of the encrypted content")
+	}
+
+	plaintext := make([]byte, len(ciphertext))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plaintext, ciphertext)
+	return unpad(plaintext, block.BlockSize())
+}
+
+// unpad removes the PKCS#7 padding of data.
+func unpad(data []byte, blockSize int) ([]byte, error) {
+	n := int(data[len(data)-1])
+	if n == 0 || n > blockSize || n > len(data) {
+		return nil, errors.New("scep: invalid padding of the encrypted content")
+	}
+	for _, b := range data[len(data)-n:] {
+		if int(b) != n {
+			return nil, errors.New("scep: invalid padding of the encrypted content")
+		}
+	}
+	return data[:len(data)-n], nil
+}
+
+// maxBERDepth limits the nesting of BER encoded data.
+const maxBERDepth = 32
+
+// berToDER replaces the indefinite lengths of BER encoded data, which some
+// clients send, with definite ones, so that encoding/asn1 can parse it.
+func berToDER(data []byte) ([]byte, error) {
+	der, rest, err := berElement(data, 0)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) > 0 {
+		return nil, errors.New("scep: trailing data after BER element")
+	}
+	return der, nil
+}
+
+// berElement converts the first element of data and returns the rest.
+func berElement(data []byte, depth int) ([]byte, []byte, error) {
+	if depth > maxBERDepth {
+		return nil, nil, errors.New("scep: BER data is nested too deeply")
+	}
+	errTruncated := errors.New("scep: truncated BER data")
+
+	// identifier octets
+	if len(data) < 2 {
+		return nil, nil, errTruncated
+	}
+	i := 1
+	if data[0]&0x1f == 0x1f {
+		for i < len(data) && data[i]&0x80 != 0 {
+			i++
+		}
+		i++
+	}
+	if i >= len(data) {
+		return nil, nil, errTruncated
+	}
+	tag := data[:i]
+	constructed := data[0]&0x20 != 0
+
+	// length octets
+	var content, rest []byte
+	switch l := data[i]; {
+	case l == 0x80:
+		if !constructed {
+			return nil, nil, errors.New("scep: indefinite length of a primitive BER element")
+		}
+		var children []byte
+		rest = data[i+1:]
+		for {
+			if len(rest) < 2 {
+				return nil, nil, errTruncated
+			}
+			if rest[0] == 0 && rest[1] == 0 {
+				rest = rest[2:]
+				break
+			}
+			child, r, err := berElement(rest, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			children = append(children, child...)
+			rest = r
+		}
+		return append(append(tag[:len(tag):len(tag)], derLength(len(children))...), children...), rest, nil
+	case l&0x80 == 0:
+		content, rest = data[i+1:], nil
+		if int(l) > len(content) {
+			return nil, nil, errTruncated
+		}
+		content, rest = content[:l], content[l:]
+	default:
+		n := int(l & 0x7f)
+		if n > 4 || i+1+n > len(data) {
+			return nil, nil, errTruncated
+		}
+		length := 0
+		for _, b := range data[i+1 : i+1+n] {
+			length = length<<8 | int(b)
+		}
+		content = data[i+1+n:]
+		if length < 0 || length > len(content) {
+			return nil, nil, errTruncated
+		}
+		content, rest = content[:length], content[length:]
+	}
+
+	if constructed {
+		var children []byte
+		for r := content; len(r) > 0; {
+			child, next, err := berElement(r, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			children = append(children, child...)
+			r = next
+		}
+		content = children
+	}
+	return append(append(tag[:len(tag):len(tag)], derLength(len(content))...), content...), rest, nil
+}
+
+// derLength returns the DER length octets of n.
+func derLength(n int) []byte {
+	if n < 0x80 {
+		return []byte{byte(n)}
+	}
+	var b []byte
+	for ; n > 0; n >>= 8 {
+		b = append([]byte{byte(n)}, b...)
+	}
+	return append([]byte{0x80 | byte(len(b))}, b...)
+}
@@ -6,13 +6,17 @@ package scep
 import (
 	"bytes"
 	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha1"
 	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/asn1"
 	"encoding/base64"
 	"math/big"
+	"time"
 
 	"github.com/fullsailor/pkcs7"
 	"github.com/go-kit/kit/log"
@@ -24,7 +28,6 @@ import (
 
 // errors
 var (
-	errNotImplemented     = errors.New("not implemented")
 	errUnknownMessageType = errors.New("unknown messageType")
 )
 
@@ -158,6 +161,9 @@ type PKIMessage struct {
 	SenderNonce
 	*CertRepMessage
 	*CSRReqMessage
+	*CertPollMessage
+	*GetCertMessage
+	*GetCRLMessage
 
 	// DER Encoded PKIMessage
 	Raw []byte
@@ -172,9 +178,14 @@ type PKIMessage struct {
 	Recipients []*x509.Certificate
 
 	// Signer info
-	SignerKey  *rsa.PrivateKey
+	SignerKey  crypto.Signer
 	SignerCert *x509.Certificate
 
+	// Optional RSA certificate the response is encrypted to. It is
+	// required when the SignerCert key can not be used for key
+	// transport, such as an ECDSA key.
+	EncryptionCert *x509.Certificate
+
 	SCEPEncryptionAlgorithm int
 
 	logger log.Logger
@@ -188,6 +199,9 @@ type CertRepMessage struct {
 
 	Certificate *x509.Certificate
 
+	// CRL returned in response to a GetCRL message
+	CRL *pkix.CertificateList
+
 	degenerate []byte
 }
 
@@ -204,6 +218,45 @@ type CSRReqMessage struct {
 	ChallengePassword string
 }
 
+// CertPollMessage is a CertPoll (GetCertInitial) PKIMessage.
+// It is sent by a client to poll for the outcome of a request
+// which was answered with a PENDING status, and must reuse the
+// TransactionID of the original request.
+type CertPollMessage struct {
+	// Name of the issuing CA and the subject of the original request
+	Issuer  pkix.Name
+	Subject pkix.Name
+}
+
+// GetCertMessage is a GetCert PKIMessage. It is sent by a client to
+// retrieve a previously issued certificate.
+type GetCertMessage struct {
+	// Issuer and serial number of the requested certificate
+	Issuer       pkix.Name
+	SerialNumber *big.Int
+}
+
+// GetCRLMessage is a GetCRL PKIMessage. It is sent by a client to
+// retrieve the current CRL of the CA which issued a certificate.
+type GetCRLMessage struct {
+	// Issuer and serial number of the certificate whose revocation
+	// status is being checked
+	Issuer       pkix.Name
+	SerialNumber *big.Int
+}
+
+// issuerAndSerial is the pkcsPKIEnvelope content of GetCert and GetCRL messages.
+type issuerAndSerial struct {
+	Issuer       asn1.RawValue
+	SerialNumber *big.Int
+}
+
+// issuerAndSubject is the pkcsPKIEnvelope content of a CertPoll message.
+type issuerAndSubject struct {
+	Issuer  asn1.RawValue
+	Subject asn1.RawValue
+}
+
 // ParsePKIMessage unmarshals a PKCS#7 signed data into a PKI message struct
 func ParsePKIMessage(data []byte, opts ...Option) (*PKIMessage, error) {
 	conf := &config{logger: log.NewNopLogger()}
@@ -287,7 +340,7 @@ func (msg *PKIMessage) parseMessageType() error {
 		}
 		msg.CertRepMessage = cr
 		return nil
-	case PKCSReq, UpdateReq, RenewalReq:
+	case PKCSReq, UpdateReq, RenewalReq, CertPoll, GetCert, GetCRL:
 		var sn SenderNonce
 		if err := msg.p7.UnmarshalSignedAttribute(oidSCEPsenderNonce, &sn); err != nil {
 			return err
@@ -297,20 +350,84 @@ func (msg *PKIMessage) parseMessageType() error {
 		}
 		msg.SenderNonce = sn
 		return nil
-	case GetCRL, GetCert, CertPoll:
-		return errNotImplemented
 	default:
 		return errUnknownMessageType
 	}
 }
 
-// DecryptPKIEnvelope decrypts the pkcs envelopedData inside the SCEP PKIMessage
-func (msg *PKIMessage) DecryptPKIEnvelope(cert *x509.Certificate, key *rsa.PrivateKey) error {
+// Verify checks the signature of the PKIMessage over its content and signed
+// attributes, that the messageType, transactionID and, for requests, the
+// senderNonce attributes are present, and that the signer certificate is
+// valid at the current time.
+// On success the signer certificate is stored in SignerCert.
+func (msg *PKIMessage) Verify() error {
+	signer := msg.p7.GetOnlySigner()
+	if signer == nil {
+		return errors.New("scep: pkiMessage must have exactly one signer with a certificate")
+	}
+	if err := msg.p7.Verify(); err != nil {
+		return errors.Wrap(err, "scep: verify pkiMessage signature")
+	}
+	if msg.MessageType == "" {
+		return errors.New("scep: pkiMessage must include messageType attribute")
+	}
+	if msg.TransactionID == "" {
+		return errors.New("scep: pkiMessage must include transactionID attribute")
+	}
+	if msg.MessageType != CertRep && len(msg.SenderNonce) == 0 {
+		return errors.New("scep: pkiMessage must include senderNonce attribute")
+	}
+	now := time.Now()
+	if now.Before(signer.NotBefore) || now.After(signer.NotAfter) {
+		return errors.New("scep: signer certificate is not valid at the current time")
+	}
+	msg.SignerCert = signer
+	return nil
+}
+
+// VerifyCSR checks the proof-of-possession of the private key for the
+// decrypted CSR. The CSR must be signed by its key, and a PKCSReq must also
+// be signed with the same key, usually using a self-signed certificate.
+// A RenewalReq is signed by the certificate being renewed instead.
+// Verify must be called first.
+func (msg *PKIMessage) VerifyCSR() error {
+	if msg.CSRReqMessage == nil || msg.CSRReqMessage.CSR == nil {
+		return errors.New("scep: pkiMessage has no decrypted CSR")
+	}
+	csr := msg.CSRReqMessage.CSR
+	if err := csr.CheckSignature(); err != nil {
+		return errors.Wrap(err, "scep: verify CSR signature")
+	}
+	if msg.MessageType != PKCSReq {
+		return nil
+	}
+	if msg.SignerCert == nil {
+		return errors.New("scep: pkiMessage signer has not been verified")
+	}
+	pub, ok := msg.SignerCert.PublicKey.(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !pub.Equal(csr.PublicKey) {
+		return errors.New("scep: pkiMessage is not signed by the key of the CSR")
+	}
+	return nil
+}
+
+// DecryptPKIEnvelope decrypts the pkcs envelopedData inside the SCEP PKIMessage.
+// Only RSA key transport is supported, so key must be an RSA private key, or
+// a crypto.Decrypter of an RSA key such as a key held in an HSM.
+func (msg *PKIMessage) DecryptPKIEnvelope(cert *x509.Certificate, key crypto.PrivateKey) error {
 	p7, err := pkcs7.Parse(msg.p7.Content)
 	if err != nil {
 		return err
 	}
-	msg.pkiEnvelope, err = p7.Decrypt(cert, key)
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		msg.pkiEnvelope, err = p7.Decrypt(cert, key)
+	case crypto.Decrypter:
+		// pkcs7 only decrypts with an *rsa.PrivateKey
+		msg.pkiEnvelope, err = decryptEnvelope(msg.p7.Content, cert, key)
+	default:
+		err = errors.New("scep: key can not decrypt the pkiEnvelope")
+	}
 	if err != nil {
 		return err
 	}
@@ -329,12 +446,20 @@ func (msg *PKIMessage) DecryptPKIEnvelope(cert *x509.Certificate, key *rsa.Priva
 
 	switch msg.MessageType {
 	case CertRep:
-		certs, err := CACerts(msg.pkiEnvelope)
+		p7, err := pkcs7.Parse(msg.pkiEnvelope)
 		if err != nil {
 			return err
 		}
-		msg.CertRepMessage.Certificate = certs[0]
-		logKeyVals = append(logKeyVals, "ca_certs", len(certs))
+		// the reply to GetCRL carries a CRL instead of certificates
+		if len(p7.CRLs) > 0 {
+			msg.CertRepMessage.CRL = &p7.CRLs[0]
+		}
+		if len(p7.Certificates) > 0 {
+			msg.CertRepMessage.Certificate = p7.Certificates[0]
+		} else if msg.CertRepMessage.CRL == nil {
+			return errors.New("scep: CertRep contains neither certificates nor a CRL")
+		}
+		logKeyVals = append(logKeyVals, "ca_certs", len(p7.Certificates), "crls", len(p7.CRLs))
 		return nil
 	case PKCSReq, UpdateReq, RenewalReq:
 		csr, err := x509.ParseCertificateRequest(msg.pkiEnvelope)
@@ -353,14 +478,52 @@ func (msg *PKIMessage) DecryptPKIEnvelope(cert *x509.Certificate, key *rsa.Priva
 		}
 		logKeyVals = append(logKeyVals, "has_challenge", cp != "")
 		return nil
-	case GetCRL, GetCert, CertPoll:
-		return errNotImplemented
+	case CertPoll:
+		var ias issuerAndSubject
+		if _, err := asn1.Unmarshal(msg.pkiEnvelope, &ias); err != nil {
+			return errors.Wrap(err, "scep: parse issuerAndSubject in pkiEnvelope")
+		}
+		issuer, err := parseName(ias.Issuer.FullBytes)
+		if err != nil {
+			return errors.Wrap(err, "scep: parse issuer name")
+		}
+		subject, err := parseName(ias.Subject.FullBytes)
+		if err != nil {
+			return errors.Wrap(err, "scep: parse subject name")
+		}
+		msg.CertPollMessage = &CertPollMessage{
+			Issuer:  issuer,
+			Subject: subject,
+		}
+		return nil
+	case GetCert, GetCRL:
+		var ias issuerAndSerial
+		if _, err := asn1.Unmarshal(msg.pkiEnvelope, &ias); err != nil {
+			return errors.Wrap(err, "scep: parse issuerAndSerialNumber in pkiEnvelope")
+		}
+		issuer, err := parseName(ias.Issuer.FullBytes)
+		if err != nil {
+			return errors.Wrap(err, "scep: parse issuer name")
+		}
+		if msg.MessageType == GetCert {
+			msg.GetCertMessage = &GetCertMessage{
+				Issuer:       issuer,
+				SerialNumber: ias.SerialNumber,
+			}
+		} else {
+			msg.GetCRLMessage = &GetCRLMessage{
+				Issuer:       issuer,
+				SerialNumber: ias.SerialNumber,
+			}
+		}
+		logKeyVals = append(logKeyVals, "serial", ias.SerialNumber)
+		return nil
 	default:
 		return errUnknownMessageType
 	}
 }
 
-func (msg *PKIMessage) Fail(crtAuth *x509.Certificate, keyAuth *rsa.PrivateKey, info FailInfo) (*PKIMessage, error) {
+func (msg *PKIMessage) Fail(crtAuth *x509.Certificate, keyAuth crypto.Signer, info FailInfo) (*PKIMessage, error) {
 	config := pkcs7.SignerInfoConfig{
 		ExtraSignedAttributes: []pkcs7.Attribute{
 			pkcs7.Attribute{
@@ -386,24 +549,63 @@ func (msg *PKIMessage) Fail(crtAuth *x509.Certificate, keyAuth *rsa.PrivateKey,
 		},
 	}
 
-	sd, err := pkcs7.NewSignedData(nil)
+	// sign the attributes
+	certRepBytes, err := signData(nil, crtAuth, keyAuth, config)
 	if err != nil {
 		return nil, err
 	}
 
-	// sign the attributes
-	if err := sd.AddSigner(crtAuth, keyAuth, config); err != nil {
-		return nil, err
+	cr := &CertRepMessage{
+		PKIStatus:      FAILURE,
+		FailInfo:       info,
+		RecipientNonce: RecipientNonce(msg.SenderNonce),
 	}
 
-	certRepBytes, err := sd.Finish()
+	// create a CertRep message from the original
+	crepMsg := &PKIMessage{
+		Raw:            certRepBytes,
+		TransactionID:  msg.TransactionID,
+		MessageType:    CertRep,
+		CertRepMessage: cr,
+	}
+
+	return crepMsg, nil
+
+}
+
+// Pending creates a CertRep message with a PENDING pkiStatus.
+// The client is expected to poll for the result using a CertPoll
+// message with the same TransactionID.
+func (msg *PKIMessage) Pending(crtAuth *x509.Certificate, keyAuth crypto.Signer) (*PKIMessage, error) {
+	config := pkcs7.SignerInfoConfig{
+		ExtraSignedAttributes: []pkcs7.Attribute{
+			pkcs7.Attribute{
+				Type:  oidSCEPtransactionID,
+				Value: msg.TransactionID,
+			},
+			pkcs7.Attribute{
+				Type:  oidSCEPpkiStatus,
+				Value: PENDING,
+			},
+			pkcs7.Attribute{
+				Type:  oidSCEPmessageType,
+				Value: CertRep,
+			},
+			pkcs7.Attribute{
+				Type:  oidSCEPrecipientNonce,
+				Value: msg.SenderNonce,
+			},
+		},
+	}
+
+	// sign the attributes
+	certRepBytes, err := signData(nil, crtAuth, keyAuth, config)
 	if err != nil {
 		return nil, err
 	}
 
 	cr := &CertRepMessage{
-		PKIStatus:      FAILURE,
-		FailInfo:       BadRequest,
+		PKIStatus:      PENDING,
 		RecipientNonce: RecipientNonce(msg.SenderNonce),
 	}
 
@@ -416,7 +618,6 @@ func (msg *PKIMessage) Fail(crtAuth *x509.Certificate, keyAuth *rsa.PrivateKey,
 	}
 
 	return crepMsg, nil
-
 }
 
 // golang's pkix.Name.ToRDNSequence() only looks for the following nine OIDs in Names,
@@ -446,8 +647,8 @@ func shouldCopyOid(oid asn1.ObjectIdentifier) bool {
 
 // SignCSR creates an x509.Certificate based on a template and Cert Authority credentials
 // returns a new PKIMessage with CertRep data
-func (msg *PKIMessage) SignCSR(crtAuth *x509.Certificate, keyAuth *rsa.PrivateKey,
-	signerCA *x509.Certificate, signerCAKey *rsa.PrivateKey,
+func (msg *PKIMessage) SignCSR(crtAuth *x509.Certificate, keyAuth crypto.Signer,
+	signerCA *x509.Certificate, signerCAKey crypto.Signer,
 	template *x509.Certificate) (*PKIMessage, error) {
 
 	// check if CSRReqMessage has already been decrypted
@@ -475,13 +676,36 @@ func (msg *PKIMessage) SignCSR(crtAuth *x509.Certificate, keyAuth *rsa.PrivateKe
 	if crtAuth != signerCA {
 		responseCerts = append(responseCerts, signerCA)
 	}
-	deg, err := DegenerateCertificates(responseCerts)
+	return msg.Success(crtAuth, keyAuth, responseCerts)
+}
+
+// Success creates a CertRep message with a SUCCESS pkiStatus which returns
+// certs to the client. The first certificate is the one requested by the
+// client, any others are part of its chain. The response is encrypted to
+// the signer of the original message.
+func (msg *PKIMessage) Success(crtAuth *x509.Certificate, keyAuth crypto.Signer, certs []*x509.Certificate) (*PKIMessage, error) {
+	deg, err := DegenerateCertificates(certs)
 	if err != nil {
 		return nil, err
 	}
+	return msg.success(crtAuth, keyAuth, deg, certs[0])
+}
 
+// SuccessCRL creates a CertRep message with a SUCCESS pkiStatus which
+// returns a DER encoded CRL to the client in response to GetCRL.
+func (msg *PKIMessage) SuccessCRL(crtAuth *x509.Certificate, keyAuth crypto.Signer, crl []byte) (*PKIMessage, error) {
+	deg, err := DegenerateCRL(crl)
+	if err != nil {
+		return nil, err
+	}
+	return msg.success(crtAuth, keyAuth, deg, nil)
+}
+
+// success builds a SUCCESS CertRep around the degenerate pkcs#7 deg.
+// If crt is not nil it is also added to the outer signed data.
+func (msg *PKIMessage) success(crtAuth *x509.Certificate, keyAuth crypto.Signer, deg []byte, crt *x509.Certificate) (*PKIMessage, error) {
 	// encrypt degenerate data using the original messages recipients
-	e7, err := pkcs7.Encrypt(deg, msg.p7.Certificates, pkcs7.WithEncryptionAlgorithm(msg.SCEPEncryptionAlgorithm))
+	e7, err := encrypt(deg, msg.p7.Certificates, msg.SCEPEncryptionAlgorithm)
 	if err != nil {
 		return nil, err
 	}
@@ -508,20 +732,15 @@ func (msg *PKIMessage) SignCSR(crtAuth *x509.Certificate, keyAuth *rsa.PrivateKe
 		},
 	}
 
-	signedData, err := pkcs7.NewSignedData(e7)
-	if err != nil {
-		return nil, err
-	}
 	// add the certificate into the signed data type
 	// this cert must be added before the signedData because the recipient will expect it
 	// as the first certificate in the array
-	signedData.AddCertificate(crt)
-	// sign the attributes
-	if err := signedData.AddSigner(crtAuth, keyAuth, config); err != nil {
-		return nil, err
+	var certs []*x509.Certificate
+	if crt != nil {
+		certs = append(certs, crt)
 	}
-
-	certRepBytes, err := signedData.Finish()
+	// sign the attributes
+	certRepBytes, err := signData(e7, crtAuth, keyAuth, config, certs...)
 	if err != nil {
 		return nil, err
 	}
@@ -557,6 +776,99 @@ func DegenerateCertificates(certs []*x509.Certificate) ([]byte, error) {
 	return degenerate, nil
 }
 
+// SignNextCACerts creates the response to GetNextCACert: a degenerate
+// certificates-only PKCS#7 of the next CA certificates, signed by the
+// current CA.
+func SignNextCACerts(certs []*x509.Certificate, crtAuth *x509.Certificate, keyAuth crypto.Signer) ([]byte, error) {
+	deg, err := DegenerateCertificates(certs)
+	if err != nil {
+		return nil, err
+	}
+	return signData(deg, crtAuth, keyAuth, pkcs7.SignerInfoConfig{})
+}
+
+// NextCACerts verifies the signature of a GetNextCACert response and
+// returns the next CA certificates and the signer, which the caller must
+// check is the current CA.
+func NextCACerts(data []byte) ([]*x509.Certificate, *x509.Certificate, error) {
+	p7, err := pkcs7.Parse(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	signer := p7.GetOnlySigner()
+	if signer == nil {
+		return nil, nil, errors.New("scep: GetNextCACert response must have exactly one signer")
+	}
+	if err := p7.Verify(); err != nil {
+		return nil, nil, errors.Wrap(err, "scep: verify GetNextCACert response")
+	}
+	certs, err := CACerts(p7.Content)
+	if err != nil {
+		return nil, nil, err
+	}
+	return certs, signer, nil
+}
+
+// encrypt creates a pkcs#7 envelope for the recipients which support RSA
+// key transport. Other recipients, such as ECDSA certificates, are skipped.
+func encrypt(content []byte, recipients []*x509.Certificate, algo int) ([]byte, error) {
+	var rsaRecipients []*x509.Certificate
+	for _, cert := range recipients {
+		if cert.PublicKeyAlgorithm == x509.RSA {
+			rsaRecipients = append(rsaRecipients, cert)
+		}
+	}
+	if len(rsaRecipients) == 0 {
+		return nil, errors.New("scep: no recipient certificate with an RSA key")
+	}
+	return pkcs7.Encrypt(content, rsaRecipients, pkcs7.WithEncryptionAlgorithm(algo))
+}
+
+// degenerateSignedData is a pkcs#7 SignedData without signers,
+// used to transport a CRL.
+type degenerateSignedData struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	ContentInfo      struct {
+		ContentType asn1.ObjectIdentifier
+	}
+	CRLs        []asn1.RawValue `asn1:"optional,tag:1"`
+	SignerInfos []asn1.RawValue `asn1:"set"`
+}
+
+var (
+	oidData       = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidSignedData = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+)
+
+// DegenerateCRL creates a degenerate pkcs#7 signed data which
+// contains the DER encoded crl.
+func DegenerateCRL(crl []byte) ([]byte, error) {
+	sd := degenerateSignedData{
+		Version:          1,
+		DigestAlgorithms: []pkix.AlgorithmIdentifier{},
+		CRLs:             []asn1.RawValue{{FullBytes: crl}},
+		SignerInfos:      []asn1.RawValue{},
+	}
+	sd.ContentInfo.ContentType = oidData
+	inner, err := asn1.Marshal(sd)
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(struct {
+		ContentType asn1.ObjectIdentifier
+		Content     asn1.RawValue
+	}{
+		ContentType: oidSignedData,
+		Content: asn1.RawValue{
+			Class:      asn1.ClassContextSpecific,
+			Tag:        0,
+			IsCompound: true,
+			Bytes:      inner,
+		},
+	})
+}
+
 // CACerts extract CA Certificate or chain from pkcs7 degenerate signed data
 func CACerts(data []byte) ([]*x509.Certificate, error) {
 	p7, err := pkcs7.Parse(data)
@@ -574,12 +886,7 @@ func NewCSRRequest(csr *x509.CertificateRequest, tmpl *PKIMessage, opts ...Optio
 	}
 
 	derBytes := csr.Raw
-	e7, err := pkcs7.Encrypt(derBytes, tmpl.Recipients, pkcs7.WithEncryptionAlgorithm(tmpl.SCEPEncryptionAlgorithm))
-	if err != nil {
-		return nil, err
-	}
-
-	signedData, err := pkcs7.NewSignedData(e7)
+	e7, err := encrypt(derBytes, tmpl.Recipients, tmpl.SCEPEncryptionAlgorithm)
 	if err != nil {
 		return nil, err
 	}
@@ -621,11 +928,11 @@ func NewCSRRequest(csr *x509.CertificateRequest, tmpl *PKIMessage, opts ...Optio
 	}
 
 	// sign attributes
-	if err := signedData.AddSigner(tmpl.SignerCert, tmpl.SignerKey, config); err != nil {
-		return nil, err
+	var certs []*x509.Certificate
+	if tmpl.EncryptionCert != nil {
+		certs = append(certs, tmpl.EncryptionCert)
 	}
-
-	rawPKIMessage, err := signedData.Finish()
+	rawPKIMessage, err := signData(e7, tmpl.SignerCert, tmpl.SignerKey, config, certs...)
 	if err != nil {
 		return nil, err
 	}
@@ -646,6 +953,212 @@ func NewCSRRequest(csr *x509.CertificateRequest, tmpl *PKIMessage, opts ...Optio
 	return newMsg, nil
 }
 
+// NewCertPollRequest creates a scep PKI CertPoll (GetCertInitial) message
+// which polls for the result of a pending PKCSReq for csr.
+// The issuer is the CA certificate which is expected to sign the request.
+// The TransactionID of tmpl is used if set, otherwise it is derived from the
+// CSR public key the same way as in NewCSRRequest.
+func NewCertPollRequest(csr *x509.CertificateRequest, issuer *x509.Certificate, tmpl *PKIMessage, opts ...Option) (*PKIMessage, error) {
+	conf := &config{logger: log.NewNopLogger()}
+	for _, opt := range opts {
+		opt(conf)
+	}
+
+	derBytes, err := asn1.Marshal(issuerAndSubject{
+		Issuer:  asn1.RawValue{FullBytes: issuer.RawSubject},
+		Subject: asn1.RawValue{FullBytes: csr.RawSubject},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	e7, err := encrypt(derBytes, tmpl.Recipients, tmpl.SCEPEncryptionAlgorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	tID := tmpl.TransactionID
+	if tID == "" {
+		tID, err = newTransactionID(csr.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sn, err := newNonce()
+	if err != nil {
+		return nil, err
+	}
+
+	level.Debug(conf.logger).Log(
+		"msg", "creating SCEP CertPoll request",
+		"transaction_id", tID,
+		"encryption_algorithm", tmpl.SCEPEncryptionAlgorithm,
+		"signer_cn", tmpl.SignerCert.Subject.CommonName,
+	)
+
+	// PKIMessageAttributes to be signed
+	config := pkcs7.SignerInfoConfig{
+		ExtraSignedAttributes: []pkcs7.Attribute{
+			pkcs7.Attribute{
+				Type:  oidSCEPtransactionID,
+				Value: tID,
+			},
+			pkcs7.Attribute{
+				Type:  oidSCEPmessageType,
+				Value: CertPoll,
+			},
+			pkcs7.Attribute{
+				Type:  oidSCEPsenderNonce,
+				Value: sn,
+			},
+		},
+	}
+
+	// sign attributes
+	var certs []*x509.Certificate
+	if tmpl.EncryptionCert != nil {
+		certs = append(certs, tmpl.EncryptionCert)
+	}
+	rawPKIMessage, err := signData(e7, tmpl.SignerCert, tmpl.SignerKey, config, certs...)
+	if err != nil {
+		return nil, err
+	}
+
+	newMsg := &PKIMessage{
+		Raw:           rawPKIMessage,
+		MessageType:   CertPoll,
+		TransactionID: tID,
+		SenderNonce:   sn,
+		CertPollMessage: &CertPollMessage{
+			Issuer:  issuer.Subject,
+			Subject: csr.Subject,
+		},
+		logger: conf.logger,
+	}
+
+	return newMsg, nil
+}
+
+// NewGetCertRequest creates a scep PKI GetCert message which requests the
+// certificate with the given serial number issued by the issuer CA.
+// The response is encrypted to tmpl.SignerCert.
+func NewGetCertRequest(issuer *x509.Certificate, serial *big.Int, tmpl *PKIMessage, opts ...Option) (*PKIMessage, error) {
+	return newIssuerAndSerialRequest(GetCert, issuer, serial, tmpl, opts...)
+}
+
+// NewGetCRLRequest creates a scep PKI GetCRL message which requests the
+// current CRL of the issuer CA. serial is the serial number of the
+// certificate whose revocation status is being checked.
+// The response is encrypted to tmpl.SignerCert.
+func NewGetCRLRequest(issuer *x509.Certificate, serial *big.Int, tmpl *PKIMessage, opts ...Option) (*PKIMessage, error) {
+	return newIssuerAndSerialRequest(GetCRL, issuer, serial, tmpl, opts...)
+}
+
+func newIssuerAndSerialRequest(msgType MessageType, issuer *x509.Certificate, serial *big.Int, tmpl *PKIMessage, opts ...Option) (*PKIMessage, error) {
+	conf := &config{logger: log.NewNopLogger()}
+	for _, opt := range opts {
+		opt(conf)
+	}
+
+	derBytes, err := asn1.Marshal(issuerAndSerial{
+		Issuer:       asn1.RawValue{FullBytes: issuer.RawSubject},
+		SerialNumber: serial,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	e7, err := encrypt(derBytes, tmpl.Recipients, tmpl.SCEPEncryptionAlgorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	tID := tmpl.TransactionID
+	if tID == "" {
+		tID, err = newRandomTransactionID()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sn, err := newNonce()
+	if err != nil {
+		return nil, err
+	}
+
+	level.Debug(conf.logger).Log(
+		"msg", "creating SCEP "+msgType.String()+" request",
+		"transaction_id", tID,
+		"serial", serial,
+		"encryption_algorithm", tmpl.SCEPEncryptionAlgorithm,
+		"signer_cn", tmpl.SignerCert.Subject.CommonName,
+	)
+
+	// PKIMessageAttributes to be signed
+	config := pkcs7.SignerInfoConfig{
+		ExtraSignedAttributes: []pkcs7.Attribute{
+			pkcs7.Attribute{
+				Type:  oidSCEPtransactionID,
+				Value: tID,
+			},
+			pkcs7.Attribute{
+				Type:  oidSCEPmessageType,
+				Value: msgType,
+			},
+			pkcs7.Attribute{
+				Type:  oidSCEPsenderNonce,
+				Value: sn,
+			},
+		},
+	}
+
+	// sign attributes
+	var certs []*x509.Certificate
+	if tmpl.EncryptionCert != nil {
+		certs = append(certs, tmpl.EncryptionCert)
+	}
+	rawPKIMessage, err := signData(e7, tmpl.SignerCert, tmpl.SignerKey, config, certs...)
+	if err != nil {
+		return nil, err
+	}
+
+	newMsg := &PKIMessage{
+		Raw:           rawPKIMessage,
+		MessageType:   msgType,
+		TransactionID: tID,
+		SenderNonce:   sn,
+		logger:        conf.logger,
+	}
+	if msgType == GetCert {
+		newMsg.GetCertMessage = &GetCertMessage{
+			Issuer:       issuer.Subject,
+			SerialNumber: serial,
+		}
+	} else {
+		newMsg.GetCRLMessage = &GetCRLMessage{
+			Issuer:       issuer.Subject,
+			SerialNumber: serial,
+		}
+	}
+
+	return newMsg, nil
+}
+
+// parseName parses a DER encoded X.501 Name.
+func parseName(der []byte) (pkix.Name, error) {
+	var rdn pkix.RDNSequence
+	var name pkix.Name
+	rest, err := asn1.Unmarshal(der, &rdn)
+	if err != nil {
+		return name, err
+	} else if len(rest) != 0 {
+		return name, errors.New("trailing data after name")
+	}
+	name.FillFromRDNSequence(&rdn)
+	return name, nil
+}
+
 func newNonce() (SenderNonce, error) {
 	size := 16
 	b := make([]byte, size)
@@ -667,6 +1180,15 @@ func newTransactionID(key crypto.PublicKey) (TransactionID, error) {
 	return TransactionID(encHash), nil
 }
 
+// transactionID for messages which are not tied to a key, such as GetCert
+func newRandomTransactionID() (TransactionID, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return TransactionID(base64.StdEncoding.EncodeToString(b)), nil
+}
+
 // rsaPublicKey reflects the ASN.1 structure of a PKCS#1 public key.
 type rsaPublicKey struct {
 	N *big.Int
@@ -687,8 +1209,10 @@ func generateSubjectKeyID(pub crypto.PublicKey) ([]byte, error) {
 		if err != nil {
 			return nil, err
 		}
+	case *ecdsa.PublicKey:
+		pubBytes = elliptic.Marshal(pub.Curve, pub.X, pub.Y)
 	default:
-		return nil, errors.New("only RSA public key is supported")
+		return nil, errors.New("only RSA and ECDSA public keys are supported")
 	}
 
 	hash := sha1.Sum(pubBytes)
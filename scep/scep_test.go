@@ -1,7 +1,10 @@
 package scep_test
 
 import (
+	"bytes"
 	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha1"
@@ -15,6 +18,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/fullsailor/pkcs7"
 	"github.com/syncsynchalt/scep/scep"
 )
 
@@ -34,7 +38,7 @@ func testParsePKIMessage(t *testing.T, data []byte) *scep.PKIMessage {
 		if len(msg.RecipientNonce) == 0 {
 			t.Errorf("expected RecipientNonce attribute")
 		}
-	case scep.PKCSReq, scep.UpdateReq, scep.RenewalReq:
+	case scep.PKCSReq, scep.UpdateReq, scep.RenewalReq, scep.CertPoll, scep.GetCert:
 		if len(msg.SenderNonce) == 0 {
 			t.Errorf("expected SenderNonce attribute")
 		}
@@ -55,6 +59,45 @@ func TestDecryptPKIEnvelopeCSR(t *testing.T) {
 	}
 }
 
+// opaqueKey hides the *rsa.PrivateKey behind crypto.Signer and
+// crypto.Decrypter, like a key held in an HSM.
+type opaqueKey struct {
+	crypto.Signer
+	crypto.Decrypter
+}
+
+func (k opaqueKey) Public() crypto.PublicKey {
+	return k.Signer.Public()
+}
+
+func TestDecryptPKIEnvelopeDecrypter(t *testing.T) {
+	pkcsReq := loadTestFile(t, "testdata/PKCSReq.der")
+	cacert, cakey := loadCACredentials(t)
+
+	want := testParsePKIMessage(t, pkcsReq)
+	if err := want.DecryptPKIEnvelope(cacert, cakey); err != nil {
+		t.Fatal(err)
+	}
+
+	msg := testParsePKIMessage(t, pkcsReq)
+	if err := msg.DecryptPKIEnvelope(cacert, opaqueKey{cakey, cakey}); err != nil {
+		t.Fatal(err)
+	}
+	if msg.CSRReqMessage.CSR == nil {
+		t.Fatal("expected non-nil CSR field")
+	}
+	if have, want := msg.CSRReqMessage.RawDecrypted, want.CSRReqMessage.RawDecrypted; !bytes.Equal(have, want) {
+		t.Error("have different decrypted content than with the *rsa.PrivateKey")
+	}
+
+	other := *cacert
+	other.SerialNumber = big.NewInt(0).Add(cacert.SerialNumber, big.NewInt(1))
+	msg = testParsePKIMessage(t, pkcsReq)
+	if err := msg.DecryptPKIEnvelope(&other, opaqueKey{cakey, cakey}); err == nil {
+		t.Error("expected an error for a certificate which is not a recipient")
+	}
+}
+
 func TestDecryptPKIEnvelopeCert(t *testing.T) {
 	certRep := loadTestFile(t, "testdata/CertRep.der")
 	testParsePKIMessage(t, certRep)
@@ -96,6 +139,143 @@ func TestSignCSR(t *testing.T) {
 	testParsePKIMessage(t, certRep.Raw)
 }
 
+func TestSignCSROpaqueKey(t *testing.T) {
+	cakey, err := newRSAKey(2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cacert := selfSign(t, cakey, "hsm ca")
+	key := opaqueKey{cakey, cakey}
+
+	clientKey, err := newRSAKey(2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csrBytes, err := newCSR(clientKey, "john.doe@example.com", "US", "hsm client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.ParseCertificateRequest(csrBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCert := selfSign(t, clientKey, "hsm client")
+	pkcsreq, err := scep.NewCSRRequest(csr, &scep.PKIMessage{
+		MessageType: scep.PKCSReq,
+		Recipients:  []*x509.Certificate{cacert},
+		SignerKey:   clientKey,
+		SignerCert:  clientCert,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := testParsePKIMessage(t, pkcsreq.Raw)
+	if err := msg.DecryptPKIEnvelope(cacert, key); err != nil {
+		t.Fatal(err)
+	}
+	if have, want := msg.CSRReqMessage.CSR.Raw, csr.Raw; !bytes.Equal(have, want) {
+		t.Fatal("have different CSR than was sent")
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(4),
+		Subject:      csr.Subject,
+		NotBefore:    time.Now().Add(-600).UTC(),
+		NotAfter:     time.Now().AddDate(1, 0, 0).UTC(),
+	}
+	certRep, err := msg.SignCSR(cacert, key, cacert, key, tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fail, err := msg.Fail(cacert, key, scep.BadRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rep := range []*scep.PKIMessage{certRep, fail} {
+		parsed := testParsePKIMessage(t, rep.Raw)
+		if err := parsed.Verify(); err != nil {
+			t.Fatal(err)
+		}
+		if have, want := parsed.SignerCert.Raw, cacert.Raw; !bytes.Equal(have, want) {
+			t.Error("have different signer certificate than the CA")
+		}
+		if have, want := parsed.PKIStatus, rep.PKIStatus; have != want {
+			t.Errorf("have %s, want %s", have, want)
+		}
+		if have, want := parsed.TransactionID, msg.TransactionID; have != want {
+			t.Errorf("have %s, want %s", have, want)
+		}
+	}
+
+	rep := testParsePKIMessage(t, certRep.Raw)
+	if err := rep.DecryptPKIEnvelope(clientCert, clientKey); err != nil {
+		t.Fatal(err)
+	}
+	crt := rep.CertRepMessage.Certificate
+	if err := cacert.CheckSignature(crt.SignatureAlgorithm, crt.RawTBSCertificate, crt.Signature); err != nil {
+		t.Error(err)
+	}
+}
+
+// ecdsaSigner hides the *ecdsa.PrivateKey behind crypto.Signer, like an
+// EC key held in an HSM.
+type ecdsaSigner struct {
+	crypto.Signer
+}
+
+func TestSignECDSAKey(t *testing.T) {
+	rsaKey, err := newRSAKey(2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	racert := selfSign(t, rsaKey, "ra")
+	eccert := selfSign(t, ecKey, "ecdsa ra")
+
+	clientKey, err := newRSAKey(2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csrBytes, err := newCSR(clientKey, "john.doe@example.com", "US", "ecdsa client")
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.ParseCertificateRequest(csrBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkcsreq, err := scep.NewCSRRequest(csr, &scep.PKIMessage{
+		MessageType: scep.PKCSReq,
+		Recipients:  []*x509.Certificate{racert},
+		SignerKey:   clientKey,
+		SignerCert:  selfSign(t, clientKey, "ecdsa client"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := testParsePKIMessage(t, pkcsreq.Raw)
+
+	for _, key := range []crypto.Signer{ecKey, ecdsaSigner{ecKey}} {
+		fail, err := msg.Fail(eccert, key, scep.BadRequest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		parsed := testParsePKIMessage(t, fail.Raw)
+		if err := parsed.Verify(); err != nil {
+			t.Fatalf("%T: %s", key, err)
+		}
+		if have, want := parsed.SignerCert.Raw, eccert.Raw; !bytes.Equal(have, want) {
+			t.Errorf("%T: have different signer certificate than the RA", key)
+		}
+		if have, want := parsed.FailInfo, scep.FailInfo(scep.BadRequest); have != want {
+			t.Errorf("%T: have %s, want %s", key, have, want)
+		}
+	}
+}
+
 func TestNewCSRRequest(t *testing.T) {
 	key, err := newRSAKey(2048)
 	if err != nil {
@@ -129,6 +309,377 @@ func TestNewCSRRequest(t *testing.T) {
 	}
 }
 
+func TestVerify(t *testing.T) {
+	key, err := newRSAKey(2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	derBytes, err := newCSR(key, "john.doe@example.com", "US", "verify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.ParseCertificateRequest(derBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cacert, cakey := loadCACredentials(t)
+
+	parse := func(signerCert *x509.Certificate, signerKey crypto.Signer) *scep.PKIMessage {
+		t.Helper()
+		tmpl := &scep.PKIMessage{
+			MessageType: scep.PKCSReq,
+			Recipients:  []*x509.Certificate{cacert},
+			SignerCert:  signerCert,
+			SignerKey:   signerKey,
+		}
+		pkcsreq, err := scep.NewCSRRequest(csr, tmpl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg := testParsePKIMessage(t, pkcsreq.Raw)
+		if err := msg.DecryptPKIEnvelope(cacert, cakey); err != nil {
+			t.Fatal(err)
+		}
+		return msg
+	}
+
+	signerCert := selfSign(t, key, "verify")
+	msg := parse(signerCert, key)
+	if err := msg.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(msg.SignerCert.Raw, signerCert.Raw) {
+		t.Error("expected SignerCert to be set to the verified signer")
+	}
+	if err := msg.VerifyCSR(); err != nil {
+		t.Fatal(err)
+	}
+
+	// signed by a different key than the one in the CSR
+	otherKey, err := newRSAKey(2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg = parse(selfSign(t, otherKey, "verify"), otherKey)
+	if err := msg.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	if err := msg.VerifyCSR(); err == nil {
+		t.Error("expected proof-of-possession to fail for a different signer key")
+	}
+
+	// signer certificate which is no longer valid
+	expiredTmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "verify"},
+		NotBefore:    time.Now().Add(-2 * time.Hour).UTC(),
+		NotAfter:     time.Now().Add(-time.Hour).UTC(),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, expiredTmpl, expiredTmpl, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg = parse(expired, key)
+	if err := msg.Verify(); err == nil {
+		t.Error("expected verification to fail for an expired signer certificate")
+	}
+}
+
+func TestVerifyAttributes(t *testing.T) {
+	key, err := newRSAKey(2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signerCert := selfSign(t, key, "verify")
+
+	// sign builds a PKCSReq with the SCEP attributes in attrs
+	sign := func(attrs map[string]interface{}) []byte {
+		t.Helper()
+		oids := map[string]asn1.ObjectIdentifier{
+			"messageType":   {2, 16, 840, 1, 113733, 1, 9, 2},
+			"senderNonce":   {2, 16, 840, 1, 113733, 1, 9, 5},
+			"transactionID": {2, 16, 840, 1, 113733, 1, 9, 7},
+		}
+		var config pkcs7.SignerInfoConfig
+		for name, value := range attrs {
+			config.ExtraSignedAttributes = append(config.ExtraSignedAttributes, pkcs7.Attribute{
+				Type:  oids[name],
+				Value: value,
+			})
+		}
+		sd, err := pkcs7.NewSignedData([]byte("envelope"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := sd.AddSigner(signerCert, key, config); err != nil {
+			t.Fatal(err)
+		}
+		data, err := sd.Finish()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+	complete := func() map[string]interface{} {
+		return map[string]interface{}{
+			"messageType":   scep.PKCSReq,
+			"senderNonce":   []byte("nonce"),
+			"transactionID": "transaction",
+		}
+	}
+
+	msg := testParsePKIMessage(t, sign(complete()))
+	if err := msg.Verify(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"messageType", "transactionID", "senderNonce"} {
+		missing := complete()
+		delete(missing, name)
+		empty := complete()
+		if name == "senderNonce" {
+			empty[name] = []byte{}
+		} else {
+			empty[name] = ""
+		}
+		for _, attrs := range []map[string]interface{}{missing, empty} {
+			msg, err := scep.ParsePKIMessage(sign(attrs))
+			if err == nil {
+				err = msg.Verify()
+			}
+			if err == nil {
+				t.Errorf("expected verification to fail without a %s attribute", name)
+			}
+		}
+	}
+}
+
+func TestECDSAClient(t *testing.T) {
+	cacert, cakey := loadCACredentials(t)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csrBytes, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: "ecdsa client"},
+	}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.ParseCertificateRequest(csrBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signerCert := selfSign(t, key, "ecdsa signer")
+
+	// the response can't be encrypted to an ECDSA key, use an RSA certificate
+	transportKey, err := newRSAKey(2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transportCert := selfSign(t, transportKey, "transport")
+
+	tmpl := &scep.PKIMessage{
+		MessageType:    scep.PKCSReq,
+		Recipients:     []*x509.Certificate{cacert},
+		SignerKey:      key,
+		SignerCert:     signerCert,
+		EncryptionCert: transportCert,
+	}
+	pkcsreq, err := scep.NewCSRRequest(csr, tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := testParsePKIMessage(t, pkcsreq.Raw)
+	if err := msg.DecryptPKIEnvelope(cacert, cakey); err != nil {
+		t.Fatal(err)
+	}
+	id, err := GenerateSubjectKeyID(msg.CSRReqMessage.CSR.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certTmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(5),
+		Subject:      msg.CSRReqMessage.CSR.Subject,
+		NotBefore:    time.Now().Add(-600).UTC(),
+		NotAfter:     time.Now().AddDate(1, 0, 0).UTC(),
+		SubjectKeyId: id,
+	}
+	certRep, err := msg.SignCSR(cacert, cakey, cacert, cakey, certTmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rep := testParsePKIMessage(t, certRep.Raw)
+	if err := rep.DecryptPKIEnvelope(transportCert, transportKey); err != nil {
+		t.Fatal(err)
+	}
+	crt := rep.CertRepMessage.Certificate
+	if have, want := crt.PublicKeyAlgorithm, x509.ECDSA; have != want {
+		t.Errorf("have %s, want %s", have, want)
+	}
+	if have, want := crt.Subject.CommonName, "ecdsa client"; have != want {
+		t.Errorf("have %s, want %s", have, want)
+	}
+}
+
+func TestNewCertPollRequest(t *testing.T) {
+	key, err := newRSAKey(2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	derBytes, err := newCSR(key, "john.doe@example.com", "US", "com.apple.scep.2379B935-294B-4AF1-A213-9BD44A2C6688")
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.ParseCertificateRequest(derBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientcert, clientkey := loadClientCredentials(t)
+	cacert, cakey := loadCACredentials(t)
+	tmpl := &scep.PKIMessage{
+		MessageType: scep.PKCSReq,
+		Recipients:  []*x509.Certificate{cacert},
+		SignerCert:  clientcert,
+		SignerKey:   clientkey,
+	}
+	pkcsreq, err := scep.NewCSRRequest(csr, tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPoll, err := scep.NewCertPollRequest(csr, cacert, tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := testParsePKIMessage(t, certPoll.Raw)
+	if have, want := msg.MessageType, scep.MessageType(scep.CertPoll); have != want {
+		t.Errorf("have %s, want %s", have, want)
+	}
+	if have, want := msg.TransactionID, pkcsreq.TransactionID; have != want {
+		t.Errorf("CertPoll must reuse the transaction ID, have %s, want %s", have, want)
+	}
+	if err := msg.DecryptPKIEnvelope(cacert, cakey); err != nil {
+		t.Fatal(err)
+	}
+	if have, want := msg.CertPollMessage.Subject.CommonName, csr.Subject.CommonName; have != want {
+		t.Errorf("have %s, want %s", have, want)
+	}
+	if have, want := msg.CertPollMessage.Issuer.CommonName, cacert.Subject.CommonName; have != want {
+		t.Errorf("have %s, want %s", have, want)
+	}
+
+	// answer the poll with PENDING
+	certRep, err := msg.Pending(cacert, cakey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rep := testParsePKIMessage(t, certRep.Raw)
+	if have, want := rep.PKIStatus, scep.PKIStatus(scep.PENDING); have != want {
+		t.Errorf("have %s, want %s", have, want)
+	}
+	if have, want := rep.TransactionID, msg.TransactionID; have != want {
+		t.Errorf("have %s, want %s", have, want)
+	}
+}
+
+func TestNewGetCertRequest(t *testing.T) {
+	clientcert, clientkey := loadClientCredentials(t)
+	cacert, cakey := loadCACredentials(t)
+	tmpl := &scep.PKIMessage{
+		Recipients: []*x509.Certificate{cacert},
+		SignerCert: clientcert,
+		SignerKey:  clientkey,
+	}
+	serial := big.NewInt(42)
+	getCert, err := scep.NewGetCertRequest(cacert, serial, tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := testParsePKIMessage(t, getCert.Raw)
+	if have, want := msg.MessageType, scep.MessageType(scep.GetCert); have != want {
+		t.Errorf("have %s, want %s", have, want)
+	}
+	if err := msg.DecryptPKIEnvelope(cacert, cakey); err != nil {
+		t.Fatal(err)
+	}
+	if have, want := msg.GetCertMessage.SerialNumber, serial; have.Cmp(want) != 0 {
+		t.Errorf("have %s, want %s", have, want)
+	}
+	if have, want := msg.GetCertMessage.Issuer.String(), cacert.Subject.String(); have != want {
+		t.Errorf("have %s, want %s", have, want)
+	}
+
+	// return the client certificate, encrypted to the requester
+	certRep, err := msg.Success(cacert, cakey, []*x509.Certificate{clientcert})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rep := testParsePKIMessage(t, certRep.Raw)
+	if err := rep.DecryptPKIEnvelope(clientcert, clientkey); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(rep.CertRepMessage.Certificate.Raw, clientcert.Raw) {
+		t.Errorf("CertRep does not contain the requested certificate")
+	}
+}
+
+func TestNewGetCRLRequest(t *testing.T) {
+	clientcert, clientkey := loadClientCredentials(t)
+	cacert, cakey := loadCACredentials(t)
+	tmpl := &scep.PKIMessage{
+		Recipients: []*x509.Certificate{cacert},
+		SignerCert: clientcert,
+		SignerKey:  clientkey,
+	}
+	getCRL, err := scep.NewGetCRLRequest(cacert, clientcert.SerialNumber, tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := testParsePKIMessage(t, getCRL.Raw)
+	if have, want := msg.MessageType, scep.MessageType(scep.GetCRL); have != want {
+		t.Errorf("have %s, want %s", have, want)
+	}
+	if err := msg.DecryptPKIEnvelope(cacert, cakey); err != nil {
+		t.Fatal(err)
+	}
+	if have, want := msg.GetCRLMessage.SerialNumber, clientcert.SerialNumber; have.Cmp(want) != 0 {
+		t.Errorf("have %s, want %s", have, want)
+	}
+
+	revoked := []pkix.RevokedCertificate{
+		{SerialNumber: clientcert.SerialNumber, RevocationTime: time.Now().UTC()},
+	}
+	crl, err := cacert.CreateCRL(rand.Reader, cakey, revoked, time.Now(), time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	certRep, err := msg.SuccessCRL(cacert, cakey, crl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rep := testParsePKIMessage(t, certRep.Raw)
+	if err := rep.DecryptPKIEnvelope(clientcert, clientkey); err != nil {
+		t.Fatal(err)
+	}
+	if rep.CertRepMessage.CRL == nil {
+		t.Fatal("CertRep does not contain a CRL")
+	}
+	entries := rep.CertRepMessage.CRL.TBSCertList.RevokedCertificates
+	if have, want := len(entries), 1; have != want {
+		t.Fatalf("have %d revoked certificates, want %d", have, want)
+	}
+	if have, want := entries[0].SerialNumber, clientcert.SerialNumber; have.Cmp(want) != 0 {
+		t.Errorf("have %s, want %s", have, want)
+	}
+}
+
 // create a new RSA private key
 func newRSAKey(bits int) (*rsa.PrivateKey, error) {
 	private, err := rsa.GenerateKey(rand.Reader, bits)
@@ -154,6 +705,25 @@ func newCSR(priv *rsa.PrivateKey, email, country, cname string) ([]byte, error)
 	return x509.CreateCertificateRequest(rand.Reader, template, priv)
 }
 
+func selfSign(t *testing.T, key crypto.Signer, cn string) *x509.Certificate {
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-600).UTC(),
+		NotAfter:     time.Now().Add(time.Hour).UTC(),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
 func loadTestFile(t *testing.T, path string) []byte {
 	data, err := ioutil.ReadFile(path)
 	if err != nil {
@@ -256,8 +826,10 @@ func GenerateSubjectKeyID(pub crypto.PublicKey) ([]byte, error) {
 		if err != nil {
 			return nil, err
 		}
+	case *ecdsa.PublicKey:
+		pubBytes = elliptic.Marshal(pub.Curve, pub.X, pub.Y)
 	default:
-		return nil, errors.New("only RSA public key is supported")
+		return nil, errors.New("only RSA and ECDSA public keys are supported")
 	}
 
 	hash := sha1.Sum(pubBytes)
@@ -0,0 +1,185 @@
+package scep
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"sort"
+	"time"
+
+	"github.com/fullsailor/pkcs7"
+	"github.com/pkg/errors"
+)
+
+var (
+	oidDigestAlgorithmSHA1      = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+	oidDigestAlgorithmSHA256    = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidSignatureSHA1WithRSA     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 5}
+	oidSignatureECDSAWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+	oidAttributeContentType     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 3}
+	oidAttributeMessageDigest   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+	oidAttributeSigningTime     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 5}
+)
+
+type signedData struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	ContentInfo      envelope
+	Certificates     asn1.RawValue `asn1:"optional,tag:0"`
+	SignerInfos      []signerInfo  `asn1:"set"`
+}
+
+type signerInfo struct {
+	Version                   int
+	IssuerAndSerialNumber     issuerAndSerial
+	DigestAlgorithm           pkix.AlgorithmIdentifier
+	AuthenticatedAttributes   asn1.RawValue `asn1:"optional,tag:0"`
+	DigestEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedDigest           []byte
+}
+
+type signedAttribute struct {
+	Type  asn1.ObjectIdentifier
+	Value asn1.RawValue
+}
+
+// signData creates the pkcs#7 signed data of content, signed by crtAuth
+// with the attributes of config. certs are added before crtAuth.
+func signData(content []byte, crtAuth *x509.Certificate, keyAuth crypto.Signer, config pkcs7.SignerInfoConfig, certs ...*x509.Certificate) ([]byte, error) {
+	if _, ok := keyAuth.(*rsa.PrivateKey); !ok {
+		// pkcs7 fails to sign with any other key, such as an ECDSA
+		// key or a key held in an HSM
+		return signDataWithSigner(content, crtAuth, keyAuth, config, certs)
+	}
+	sd, err := pkcs7.NewSignedData(content)
+	if err != nil {
+		return nil, err
+	}
+	for _, crt := range certs {
+		sd.AddCertificate(crt)
+	}
+	if err := sd.AddSigner(crtAuth, keyAuth, config); err != nil {
+		return nil, err
+	}
+	return sd.Finish()
+}
+
+// signatureAlgorithm is the digest and signature algorithm of a key.
+type signatureAlgorithm struct {
+	hash      crypto.Hash
+	digest    asn1.ObjectIdentifier
+	signature asn1.ObjectIdentifier
+}
+
+// signatureAlgorithmOf returns the algorithm signDataWithSigner uses for
+// key: SHA-1 with RSA like pkcs7, and ECDSA with SHA-256.
+func signatureAlgorithmOf(key crypto.Signer) (signatureAlgorithm, error) {
+	switch key.Public().(type) {
+	case *rsa.PublicKey:
+		return signatureAlgorithm{crypto.SHA1, oidDigestAlgorithmSHA1, oidSignatureSHA1WithRSA}, nil
+	case *ecdsa.PublicKey:
+		return signatureAlgorithm{crypto.SHA256, oidDigestAlgorithmSHA256, oidSignatureECDSAWithSHA256}, nil
+	}
+	return signatureAlgorithm{}, errors.New("scep: only RSA and ECDSA keys can sign")
+}
+
+// signDataWithSigner creates the same signed data as pkcs7 with a key
+// which pkcs7 can not sign with, such as an ECDSA key or a key held in an
+// HSM which only implements crypto.Signer.
+func signDataWithSigner(content []byte, crtAuth *x509.Certificate, keyAuth crypto.Signer, config pkcs7.SignerInfoConfig, certs []*x509.Certificate) ([]byte, error) {
+	alg, err := signatureAlgorithmOf(keyAuth)
+	if err != nil {
+		return nil, err
+	}
+	data, err := asn1.Marshal(content)
+	if err != nil {
+		return nil, err
+	}
+	h := alg.hash.New()
+	h.Write(content)
+	digest := h.Sum(nil)
+
+	attrs := []pkcs7.Attribute{
+		{Type: oidAttributeContentType, Value: oidData},
+		{Type: oidAttributeMessageDigest, Value: digest},
+		{Type: oidAttributeSigningTime, Value: time.Now().UTC()},
+	}
+	attrs = append(attrs, config.ExtraSignedAttributes...)
+	encodedAttrs, err := marshalAttributes(attrs)
+	if err != nil {
+		return nil, err
+	}
+
+	// the signature is over the DER encoded SET OF the attributes
+	signed, err := asn1.Marshal(asn1.RawValue{Tag: asn1.TagSet, IsCompound: true, Bytes: encodedAttrs})
+	if err != nil {
+		return nil, err
+	}
+	h = alg.hash.New()
+	h.Write(signed)
+	signature, err := keyAuth.Sign(rand.Reader, h.Sum(nil), alg.hash)
+	if err != nil {
+		return nil, err
+	}
+
+	var raw bytes.Buffer
+	for _, crt := range append(certs, crtAuth) {
+		raw.Write(crt.Raw)
+	}
+	digestAlg := pkix.AlgorithmIdentifier{Algorithm: alg.digest}
+	sd := signedData{
+		Version:          1,
+		DigestAlgorithms: []pkix.AlgorithmIdentifier{digestAlg},
+		ContentInfo: envelope{
+			ContentType: oidData,
+			Content:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: data},
+		},
+		Certificates: asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: raw.Bytes()},
+		SignerInfos: []signerInfo{{
+			Version: 1,
+			IssuerAndSerialNumber: issuerAndSerial{
+				Issuer:       asn1.RawValue{FullBytes: crtAuth.RawIssuer},
+				SerialNumber: crtAuth.SerialNumber,
+			},
+			DigestAlgorithm:           digestAlg,
+			AuthenticatedAttributes:   asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: encodedAttrs},
+			DigestEncryptionAlgorithm: pkix.AlgorithmIdentifier{Algorithm: alg.signature},
+			EncryptedDigest:           signature,
+		}},
+	}
+	inner, err := asn1.Marshal(sd)
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(envelope{
+		ContentType: oidSignedData,
+		Content:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: inner},
+	})
+}
+
+// marshalAttributes DER encodes the attributes in the order of a SET OF.
+func marshalAttributes(attrs []pkcs7.Attribute) ([]byte, error) {
+	encoded := make([][]byte, len(attrs))
+	for i, attr := range attrs {
+		value, err := asn1.Marshal(attr.Value)
+		if err != nil {
+			return nil, err
+		}
+		encoded[i], err = asn1.Marshal(signedAttribute{
+			Type:  attr.Type,
+			Value: asn1.RawValue{Tag: asn1.TagSet, IsCompound: true, Bytes: value},
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	sort.Slice(encoded, func(i, j int) bool {
+		return bytes.Compare(encoded[i], encoded[j]) < 0
+	})
+	return bytes.Join(encoded, nil), nil
+}
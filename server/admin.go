@@ -0,0 +1,197 @@
+package scepserver
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	kitlog "github.com/go-kit/kit/log"
+	"github.com/syncsynchalt/scep/challenge"
+	"github.com/syncsynchalt/scep/scep"
+)
+
+// ChallengeAdminPath is where NDES serves its challenge password page.
+const ChallengeAdminPath = "/certsrv/mscep_admin/"
+
+// ChallengeAdmin configures the handler made by MakeChallengeAdminHandler.
+type ChallengeAdmin struct {
+	// User and Password authenticate requests with HTTP basic auth.
+	User     string
+	Password string
+
+	// TTL is the lifetime of new challenges, if the store supports it.
+	TTL time.Duration
+
+	// Path is where the handler is mounted, ChallengeAdminPath if it is
+	// empty. Other paths are not found, so that a mistyped tenant path
+	// does not hand out a challenge of another service.
+	Path string
+}
+
+// MakeChallengeAdminHandler serves a new dynamic challenge from store for
+// each authenticated GET request. Like the NDES mscep_admin page, the
+// response is a UTF-16 HTML page which shows the MD5 thumbprint of the CA
+// certificate of svc and the challenge. With ?format=text, the response is
+// only the challenge, as plain text.
+func MakeChallengeAdminHandler(svc Service, store challenge.Store, admin ChallengeAdmin, logger kitlog.Logger) http.Handler {
+	return &challengeAdminHandler{
+		svc:    svc,
+		store:  store,
+		admin:  admin,
+		logger: logger,
+	}
+}
+
+type challengeAdminHandler struct {
+	svc    Service
+	store  challenge.Store
+	admin  ChallengeAdmin
+	logger kitlog.Logger
+}
+
+func (h *challengeAdminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := h.admin.Path
+	if path == "" {
+		path = ChallengeAdminPath
+	}
+	if r.URL.Path != path {
+		http.NotFound(w, r)
+		return
+	}
+	if !h.authenticated(r) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="mscep_admin"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	user, _, _ := r.BasicAuth()
+	pw, err := h.newChallenge()
+	if err != nil {
+		h.logger.Log("msg", "create challenge", "user", user, "err", err)
+		http.Error(w, "could not create a challenge", http.StatusInternalServerError)
+		return
+	}
+	h.logger.Log("msg", "created challenge", "user", user, "remote", r.RemoteAddr)
+
+	w.Header().Set("Cache-Control", "no-store")
+	if r.URL.Query().Get("format") == "text" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintln(w, pw)
+		return
+	}
+	thumbprint, err := h.thumbprint(r.Context())
+	if err != nil {
+		h.logger.Log("msg", "CA thumbprint", "err", err)
+		http.Error(w, "could not read the CA certificate", http.StatusInternalServerError)
+		return
+	}
+	var page bytes.Buffer
+	err = challengeAdminPage.Execute(&page, struct {
+		Thumbprint string
+		Challenge  string
+		Minutes    int
+	}{thumbprint, pw, h.ttlMinutes()})
+	if err != nil {
+		h.logger.Log("msg", "render challenge page", "err", err)
+		http.Error(w, "could not render the page", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-16")
+	w.Write(encodeUTF16LE(page.String()))
+}
+
+// authenticated compares the hashes of the credentials, so that the
+// comparison takes the same time for credentials of any length.
+func (h *challengeAdminHandler) authenticated(r *http.Request) bool {
+	user, password, ok := r.BasicAuth()
+	if !ok || h.admin.Password == "" {
+		return false
+	}
+	userHave, userWant := sha256.Sum256([]byte(user)), sha256.Sum256([]byte(h.admin.User))
+	pwHave, pwWant := sha256.Sum256([]byte(password)), sha256.Sum256([]byte(h.admin.Password))
+	userOK := subtle.ConstantTimeCompare(userHave[:], userWant[:])
+	pwOK := subtle.ConstantTimeCompare(pwHave[:], pwWant[:])
+	return userOK&pwOK == 1
+}
+
+// newChallenge creates a one-time challenge, in hex like NDES challenges
+// if the store supports options.
+func (h *challengeAdminHandler) newChallenge() (string, error) {
+	if store, ok := h.store.(challenge.BindingStore); ok {
+		return store.NewChallenge(challenge.Options{TTL: h.admin.TTL, Hex: true})
+	}
+	return h.store.SCEPChallenge()
+}
+
+// ttlMinutes returns the lifetime of new challenges in minutes, or 0 if
+// they do not expire.
+func (h *challengeAdminHandler) ttlMinutes() int {
+	if _, ok := h.store.(challenge.BindingStore); !ok || h.admin.TTL <= 0 {
+		return 0
+	}
+	minutes := int(h.admin.TTL / time.Minute)
+	if minutes == 0 {
+		minutes = 1
+	}
+	return minutes
+}
+
+// thumbprint returns the MD5 thumbprint of the CA certificate in the
+// format of NDES, which the -ca-fingerprint flag of scepclient accepts.
+func (h *challengeAdminHandler) thumbprint(ctx context.Context) (string, error) {
+	data, num, err := h.svc.GetCACert(ctx)
+	if err != nil {
+		return "", err
+	}
+	var certs []*x509.Certificate
+	if num == 1 {
+		cert, err := x509.ParseCertificate(data)
+		if err != nil {
+			return "", err
+		}
+		certs = append(certs, cert)
+	} else if certs, err = scep.CACerts(data); err != nil {
+		return "", err
+	}
+	if len(certs) == 0 {
+		return "", fmt.Errorf("no CA certificate")
+	}
+	sum := md5.Sum(certs[0].Raw)
+	hexSum := strings.ToUpper(fmt.Sprintf("%x", sum))
+	var groups []string
+	for i := 0; i < len(hexSum); i += 8 {
+		groups = append(groups, hexSum[i:i+8])
+	}
+	return strings.Join(groups, " "), nil
+}
+
+// encodeUTF16LE encodes s in UTF-16, little endian with a byte order mark,
+// as NDES does.
+func encodeUTF16LE(s string) []byte {
+	codes := utf16.Encode(append([]rune{0xfeff}, []rune(s)...))
+	b := make([]byte, 0, 2*len(codes))
+	for _, c := range codes {
+		b = append(b, byte(c), byte(c>>8))
+	}
+	return b
+}
+
+var challengeAdminPage = template.Must(template.New("mscep_admin").Parse(`<HTML><Head><Meta HTTP-Equiv="Content-Type" Content="text/html; charset=UTF-16"><Title>Network Device Enrollment Service</Title></Head>
+<Body BgColor=#FFFFFF><Font ID=Application Face="Arial" Color=#000000 Size=2>
+<P ID=locPageTitle> <Font Face="Arial" Size=+1><B>Network Device Enrollment Service</B></Font></P>
+<P> Network Device Enrollment Service allows you to obtain certificates for routers or other network devices using the Simple Certificate Enrollment Protocol (SCEP). </P>
+<P> To complete certificate enrollment for your network device you will need the following information: <P> The thumbprint (hash value) for the CA certificate is: <B> {{.Thumbprint}} </B> <P> The enrollment challenge password is: <B> {{.Challenge}} </B> <P> This password can be used only once{{if .Minutes}} and will expire within {{.Minutes}} minutes{{end}}. <P> Each enrollment requires a new challenge password. You can refresh this web page to obtain a new challenge password. </P>
+<P></Font></Body></HTML>
+`))
@@ -0,0 +1,148 @@
+package scepserver_test
+
+import (
+	"context"
+	"crypto/md5"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf16"
+
+	"github.com/boltdb/bolt"
+	kitlog "github.com/go-kit/kit/log"
+
+	challengestore "github.com/syncsynchalt/scep/challenge/bolt"
+	scepserver "github.com/syncsynchalt/scep/server"
+)
+
+func TestChallengeAdmin(t *testing.T) {
+	store := newChallengeStore(t)
+	_, svc, teardown := newServer(t, scepserver.WithDynamicChallenges(store))
+	defer teardown()
+	admin := scepserver.ChallengeAdmin{User: "mdm", Password: "secret", TTL: time.Hour}
+	server := httptest.NewServer(scepserver.MakeChallengeAdminHandler(svc, store, admin, kitlog.NewNopLogger()))
+	defer server.Close()
+
+	get := func(user, password, query string) *http.Response {
+		req, err := http.NewRequest("GET", server.URL+scepserver.ChallengeAdminPath+query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if user != "" {
+			req.SetBasicAuth(user, password)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	// only the page itself is served, not a mistyped tenant path below it
+	for _, path := range []string{"acme/", "acme"} {
+		resp := get("mdm", "secret", path)
+		resp.Body.Close()
+		if have, want := resp.StatusCode, http.StatusNotFound; have != want {
+			t.Errorf("%s: have %d, want %d", path, have, want)
+		}
+	}
+
+	for _, creds := range [][2]string{{"", ""}, {"mdm", "wrong"}, {"other", "secret"}} {
+		resp := get(creds[0], creds[1], "")
+		resp.Body.Close()
+		if have, want := resp.StatusCode, http.StatusUnauthorized; have != want {
+			t.Errorf("%q: have %d, want %d", creds, have, want)
+		}
+	}
+
+	resp := get("mdm", "secret", "")
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := resp.StatusCode, http.StatusOK; have != want {
+		t.Fatalf("have %d, want %d", have, want)
+	}
+	page := decodeUTF16LE(t, body)
+	m := regexp.MustCompile(`The enrollment challenge password is: <B> ([0-9A-F]+) </B>`).FindStringSubmatch(page)
+	if m == nil {
+		t.Fatalf("no challenge in page %s", page)
+	}
+	if !strings.Contains(page, "will expire within 60 minutes") {
+		t.Errorf("no expiry in page %s", page)
+	}
+	caCert, _, err := svc.GetCACert(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	thumbprint := fmt.Sprintf("%X", md5.Sum(caCert))
+	m2 := regexp.MustCompile(`The thumbprint \(hash value\) for the CA certificate is: <B> ([0-9A-F ]+) </B>`).FindStringSubmatch(page)
+	if m2 == nil {
+		t.Fatalf("no thumbprint in page %s", page)
+	}
+	if have, want := strings.Replace(m2[1], " ", "", -1), thumbprint; have != want {
+		t.Errorf("have %s, want %s", have, want)
+	}
+	for i, want := range []bool{true, false} {
+		have, err := store.HasChallenge(m[1])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if have != want {
+			t.Errorf("use %d: have %v, want %v", i+1, have, want)
+		}
+	}
+
+	resp = get("mdm", "secret", "?format=text")
+	body, err = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := resp.Header.Get("Content-Type"), "text/plain; charset=utf-8"; have != want {
+		t.Errorf("have %s, want %s", have, want)
+	}
+	if ok, err := store.HasChallenge(strings.TrimSpace(string(body))); err != nil || !ok {
+		t.Errorf("challenge %q from text response is not stored: %v", body, err)
+	}
+}
+
+func decodeUTF16LE(t *testing.T, b []byte) string {
+	if len(b) < 2 || len(b)%2 != 0 || b[0] != 0xff || b[1] != 0xfe {
+		t.Fatalf("response is not UTF-16LE with a byte order mark")
+	}
+	codes := make([]uint16, 0, len(b)/2-1)
+	for i := 2; i < len(b); i += 2 {
+		codes = append(codes, uint16(b[i])|uint16(b[i+1])<<8)
+	}
+	return string(utf16.Decode(codes))
+}
+
+func newChallengeStore(t *testing.T) *challengestore.Depot {
+	f, err := ioutil.TempFile("", "bolt-challenge-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	os.Remove(f.Name())
+	db, err := bolt.Open(f.Name(), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+		os.Remove(f.Name())
+	})
+	store, err := challengestore.NewBoltDepot(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
@@ -0,0 +1,304 @@
+package scepserver
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/syncsynchalt/scep/depot"
+	filedepot "github.com/syncsynchalt/scep/depot/file"
+	"github.com/syncsynchalt/scep/scep"
+)
+
+// TestConcurrentPKIOperation enrolls in parallel through two services,
+// each with its own depot instance on the same directory like two
+// scepserver processes on a shared volume. Run it with -race.
+func TestConcurrentPKIOperation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "scep-depot-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	caCert := writeCA(t, dir, "ca", "SCEP CA")
+
+	var services []Service
+	for i := 0; i < 2; i++ {
+		d, err := filedepot.NewFileDepot(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		svc, err := NewService(d, CAKeyPassword([]byte("secret")), ClientValidity(365))
+		if err != nil {
+			t.Fatal(err)
+		}
+		services = append(services, svc)
+	}
+
+	const workers, perWorker = 8, 4
+	var (
+		wg      sync.WaitGroup
+		mtx     sync.Mutex
+		serials = make(map[string]bool)
+		errs    = make(chan error, workers*perWorker)
+	)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			svc := services[w%len(services)]
+			for i := 0; i < perWorker; i++ {
+				cert, err := enroll(svc, caCert, fmt.Sprintf("device-%d-%d", w, i))
+				if err != nil {
+					errs <- err
+					continue
+				}
+				mtx.Lock()
+				if serials[cert.SerialNumber.String()] {
+					errs <- fmt.Errorf("serial %s issued twice", cert.SerialNumber)
+				}
+				serials[cert.SerialNumber.String()] = true
+				mtx.Unlock()
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	index, err := ioutil.ReadFile(filepath.Join(dir, "index.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := strings.Count(string(index), "\n"), workers*perWorker; have != want {
+		t.Errorf("have %d entries in index.txt, want %d", have, want)
+	}
+}
+
+// enroll requests a certificate for cn without failing the test, so
+// that it can be called from other goroutines.
+func enroll(svc Service, caCert *x509.Certificate, cn string) (*x509.Certificate, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: cn},
+	}, key)
+	if err != nil {
+		return nil, err
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		return nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "SCEP SIGNER"},
+		NotBefore:    time.Now().Add(-time.Minute).UTC(),
+		NotAfter:     time.Now().Add(time.Hour).UTC(),
+	}
+	selfDER, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		return nil, err
+	}
+	self, err := x509.ParseCertificate(selfDER)
+	if err != nil {
+		return nil, err
+	}
+	msg, err := scep.NewCSRRequest(csr, &scep.PKIMessage{
+		MessageType: scep.PKCSReq,
+		Recipients:  []*x509.Certificate{caCert},
+		SignerKey:   key,
+		SignerCert:  self,
+	})
+	if err != nil {
+		return nil, err
+	}
+	data, err := svc.PKIOperation(context.Background(), msg.Raw)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := scep.ParsePKIMessage(data)
+	if err != nil {
+		return nil, err
+	}
+	if resp.PKIStatus != scep.SUCCESS {
+		return nil, errors.New(cn + ": " + resp.FailInfo.String())
+	}
+	if err := resp.DecryptPKIEnvelope(self, key); err != nil {
+		return nil, err
+	}
+	return resp.CertRepMessage.Certificate, nil
+}
+
+// blockingVerifier approves CSRs once release is closed.
+type blockingVerifier struct {
+	called  chan struct{}
+	release chan struct{}
+}
+
+func (v *blockingVerifier) Verify(transactionID string, data []byte) (bool, error) {
+	close(v.called)
+	<-v.release
+	return true, nil
+}
+
+// TestHookWithoutCALock checks that a slow hook does not hold up a CA
+// rollover, which takes caMtx for writing.
+func TestHookWithoutCALock(t *testing.T) {
+	d, caCert := createFileDepot(t)
+	verifier := &blockingVerifier{called: make(chan struct{}), release: make(chan struct{})}
+	svc, err := NewService(d, CAKeyPassword([]byte("secret")), ClientValidity(365), WithCSRVerifier(verifier))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &renewalClient{t: t, svc: svc, ca: caCert}
+	key := r.newKey()
+	msg, err := scep.NewCSRRequest(r.csr(key, "slow"), &scep.PKIMessage{
+		MessageType: scep.PKCSReq,
+		Recipients:  []*x509.Certificate{caCert},
+		SignerKey:   key,
+		SignerCert:  r.selfSign(key),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, err := svc.PKIOperation(context.Background(), msg.Raw)
+		done <- err
+	}()
+
+	<-verifier.called
+	locked := make(chan struct{})
+	go func() {
+		svc.(*service).caMtx.Lock()
+		svc.(*service).caMtx.Unlock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+	case <-time.After(5 * time.Second):
+		t.Error("the CA lock is held while the hook runs")
+	}
+	close(verifier.release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+// blockingSuccesser approves certificates once release is closed.
+type blockingSuccesser struct {
+	called  chan struct{}
+	release chan struct{}
+}
+
+func (s *blockingSuccesser) Success(transactionID string, csr []byte, certfile string) (bool, error) {
+	close(s.called)
+	<-s.release
+	return true, nil
+}
+
+// TestConcurrentCertPoll checks that only one of the polls of an approved
+// request issues its certificate.
+func TestConcurrentCertPoll(t *testing.T) {
+	d, caCert := createFileDepot(t)
+	store := d.(depot.PendingStore)
+	successer := &blockingSuccesser{called: make(chan struct{}), release: make(chan struct{})}
+	svc, err := NewService(d, CAKeyPassword([]byte("secret")), ClientValidity(365),
+		WithManualApproval(store), WithCertSuccesser(successer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &renewalClient{t: t, svc: svc, ca: caCert}
+	key := r.newKey()
+	csr := r.csr(key, "polled")
+	signerCert := r.selfSign(key)
+	tmpl := &scep.PKIMessage{
+		MessageType: scep.PKCSReq,
+		Recipients:  []*x509.Certificate{caCert},
+		SignerKey:   key,
+		SignerCert:  signerCert,
+	}
+	pkiOperation := func(msg *scep.PKIMessage) (*scep.PKIMessage, error) {
+		data, err := svc.PKIOperation(context.Background(), msg.Raw)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := scep.ParsePKIMessage(data)
+		if err != nil {
+			return nil, err
+		}
+		if resp.PKIStatus == scep.SUCCESS {
+			err = resp.DecryptPKIEnvelope(signerCert, key)
+		}
+		return resp, err
+	}
+
+	msg, err := scep.NewCSRRequest(csr, tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := pkiOperation(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := resp.PKIStatus, scep.PKIStatus(scep.PENDING); have != want {
+		t.Fatalf("PKCSReq: have %s, want %s", have, want)
+	}
+	if err := store.SetPendingStatus(string(msg.TransactionID), depot.StatusApproved); err != nil {
+		t.Fatal(err)
+	}
+	poll, err := scep.NewCertPollRequest(csr, caCert, tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type result struct {
+		resp *scep.PKIMessage
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		resp, err := pkiOperation(poll)
+		done <- result{resp, err}
+	}()
+
+	// the first poll is issuing the certificate
+	<-successer.called
+	resp, err = pkiOperation(poll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := resp.PKIStatus, scep.PKIStatus(scep.PENDING); have != want {
+		t.Errorf("concurrent CertPoll: have %s, want %s", have, want)
+	}
+	close(successer.release)
+	first := <-done
+	if first.err != nil {
+		t.Fatal(first.err)
+	}
+	crt := r.issued(first.resp)
+
+	resp, err = pkiOperation(poll)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := r.issued(resp).SerialNumber, crt.SerialNumber; have.Cmp(want) != 0 {
+		t.Errorf("CertPoll after issuance: have serial %s, want %s", have, want)
+	}
+}
@@ -0,0 +1,246 @@
+package scepserver
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"time"
+
+	"github.com/syncsynchalt/scep/depot"
+	"github.com/syncsynchalt/scep/scep"
+)
+
+// GetCRL returns the current DER encoded CRL of the CA.
+func (svc *service) GetCRL(ctx context.Context) ([]byte, error) {
+	if svc.crlLifetime == 0 {
+		return nil, errors.New("CRL generation is not enabled")
+	}
+	svc.crlMtx.RLock()
+	defer svc.crlMtx.RUnlock()
+	return svc.crl, nil
+}
+
+// GetPreviousCRL returns the current DER encoded CRL of the CA which was
+// replaced by the last rollover.
+func (svc *service) GetPreviousCRL(ctx context.Context) ([]byte, error) {
+	if svc.crlLifetime == 0 {
+		return nil, errors.New("CRL generation is not enabled")
+	}
+	svc.crlMtx.RLock()
+	defer svc.crlMtx.RUnlock()
+	if svc.prevCRL == nil {
+		return nil, errors.New("the CA was not rolled over")
+	}
+	return svc.prevCRL, nil
+}
+
+// updateCRL builds and signs new CRLs from the revocation data in the
+// depot, for the CA and the previous CA if there was a rollover.
+// The caller must hold caMtx.
+func (svc *service) updateCRL() error {
+	lister, ok := svc.depot.(depot.RevocationLister)
+	if !ok {
+		return errors.New("depot does not support listing revoked certificates")
+	}
+	revoked, err := lister.RevokedCerts()
+	if err != nil {
+		return err
+	}
+
+	var prevCRL []byte
+	if len(svc.prevCA) > 0 {
+		var prevRevoked []pkix.RevokedCertificate
+		revoked, prevRevoked, err = svc.splitRevoked(revoked)
+		if err != nil {
+			return err
+		}
+		prevCRL, err = svc.signCRL(prevRevoked, svc.prevCA[0], svc.prevCAKey)
+		if err != nil {
+			return err
+		}
+	}
+	crl, err := svc.signCRL(revoked, svc.ca[0], svc.caKey)
+	if err != nil {
+		return err
+	}
+
+	svc.crlMtx.Lock()
+	svc.crl, svc.prevCRL = crl, prevCRL
+	svc.crlMtx.Unlock()
+	return nil
+}
+
+// signCRL creates the CRL of ca.
+func (svc *service) signCRL(revoked []pkix.RevokedCertificate, ca *x509.Certificate, key crypto.Signer) ([]byte, error) {
+	now := time.Now().UTC()
+	// must increase with every CRL, the time in nanoseconds stands in
+	// for depots which do not count them
+	number := big.NewInt(now.UnixNano())
+	if numberer, ok := svc.depot.(depot.CRLNumberer); ok {
+		var err error
+		if number, err = numberer.CRLNumber(); err != nil {
+			return nil, err
+		}
+	}
+	tmpl := &x509.RevocationList{
+		Number:              number,
+		ThisUpdate:          now,
+		NextUpdate:          now.Add(svc.crlLifetime),
+		RevokedCertificates: revoked,
+	}
+	return x509.CreateRevocationList(rand.Reader, tmpl, ca, key)
+}
+
+// splitRevoked separates the revoked certificates issued by the previous
+// CA. Certificates which are not found in the depot stay with the CA.
+func (svc *service) splitRevoked(revoked []pkix.RevokedCertificate) (current, previous []pkix.RevokedCertificate, err error) {
+	for _, rc := range revoked {
+		prev, err := svc.issuedByPrevious(rc.SerialNumber)
+		if err != nil {
+			return nil, nil, err
+		}
+		if prev {
+			previous = append(previous, rc)
+		} else {
+			current = append(current, rc)
+		}
+	}
+	return current, previous, nil
+}
+
+// issuedByPrevious reports whether the certificate with the serial was
+// issued by the CA which was replaced by the last rollover. The CAs of a
+// rollover usually share their name, so the key identifier or signature
+// tells them apart.
+func (svc *service) issuedByPrevious(serial *big.Int) (bool, error) {
+	getter, ok := svc.depot.(depot.CertGetter)
+	if len(svc.prevCA) == 0 || !ok {
+		return false, nil
+	}
+	crt, err := getter.GetCert(serial)
+	if err == depot.ErrNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return issuedBy(crt, svc.prevCA[0]), nil
+}
+
+// issuedBy reports whether crt was signed by ca.
+func issuedBy(crt, ca *x509.Certificate) bool {
+	if len(crt.AuthorityKeyId) > 0 && len(ca.SubjectKeyId) > 0 {
+		return bytes.Equal(crt.AuthorityKeyId, ca.SubjectKeyId)
+	}
+	return crt.CheckSignatureFrom(ca) == nil
+}
+
+// Revoker is implemented by the Service of NewService.
+type Revoker interface {
+	// Revoke revokes an issued certificate in the depot, and regenerates
+	// the CRL right away if CRL generation is enabled. Certificates
+	// revoked in the depot by other means only appear in the CRL when it
+	// is next regenerated.
+	Revoke(ctx context.Context, serial *big.Int, reason depot.RevocationReason) error
+}
+
+// PreviousCRLGetter is implemented by the Service of NewService.
+type PreviousCRLGetter interface {
+	// GetPreviousCRL returns the current CRL of the CA which was replaced
+	// by the last rollover, DER encoded.
+	GetPreviousCRL(ctx context.Context) ([]byte, error)
+}
+
+// Revoke revokes an issued certificate and updates the CRL.
+func (svc *service) Revoke(ctx context.Context, serial *big.Int, reason depot.RevocationReason) error {
+	revoker, ok := svc.depot.(depot.Revoker)
+	if !ok {
+		return errors.New("depot can not revoke certificates")
+	}
+	if err := revoker.Revoke(serial, reason); err != nil {
+		return err
+	}
+	if svc.crlLifetime == 0 {
+		return nil
+	}
+	svc.caMtx.RLock()
+	defer svc.caMtx.RUnlock()
+	return svc.updateCRL()
+}
+
+// refreshCRL regenerates the CRL at half its lifetime, so that clients
+// always find a CRL which is still valid.
+func (svc *service) refreshCRL() {
+	ticker := time.NewTicker(svc.crlLifetime / 2)
+	defer ticker.Stop()
+	for range ticker.C {
+		svc.caMtx.RLock()
+		err := svc.updateCRL()
+		svc.caMtx.RUnlock()
+		if err != nil {
+			svc.debugLogger.Log("err", err, "msg", "updating CRL")
+		}
+	}
+}
+
+// getCRL answers a GetCRL request with the current CRL.
+func (svc *service) getCRL(ctx context.Context, msg *scep.PKIMessage) (*scep.PKIMessage, error) {
+	if svc.crlLifetime == 0 {
+		svc.debugLogger.Log("err", "GetCRL received but CRL generation is not enabled")
+		return msg.Fail(svc.raCert, svc.raKey, scep.BadRequest)
+	}
+	issuer := msg.GetCRLMessage.Issuer.String()
+	if issuer != svc.ca[0].Subject.String() && (len(svc.prevCA) == 0 || issuer != svc.prevCA[0].Subject.String()) {
+		svc.debugLogger.Log("err", "GetCRL issuer does not match the CA", "serial", msg.GetCRLMessage.SerialNumber)
+		return msg.Fail(svc.raCert, svc.raKey, scep.BadCertID)
+	}
+	prev, err := svc.issuedByPrevious(msg.GetCRLMessage.SerialNumber)
+	if err != nil {
+		return nil, err
+	}
+	getCRL := svc.GetCRL
+	if prev {
+		getCRL = svc.GetPreviousCRL
+	}
+	crl, err := getCRL(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return msg.SuccessCRL(svc.raCert, svc.raKey, crl)
+}
+
+// WithCRL is an option argument to NewService which enables CRL
+// generation from the revocation data of the depot. Each CRL is valid
+// for lifetime, and is regenerated at half of it as well as after an
+// issued certificate superseded an older one, and after every
+// revocation through Revoker. After a CA rollover the
+// previous CA signs a separate CRL, see PreviousCRLGetter. The depot must
+// implement depot.RevocationLister, and should implement depot.CRLNumberer
+// and depot.CertGetter to tell the certificates of the two CAs apart.
+func WithCRL(lifetime time.Duration) ServiceOption {
+	return func(s *service) error {
+		if lifetime <= 0 {
+			return errors.New("CRL lifetime must be positive")
+		}
+		if _, ok := s.depot.(depot.RevocationLister); !ok {
+			return errors.New("depot does not support listing revoked certificates")
+		}
+		s.crlLifetime = lifetime
+		return nil
+	}
+}
+
+// CRLDistributionPoints is an optional argument to NewService which
+// adds the URLs to the CRL distribution points extension of issued
+// certificates.
+func CRLDistributionPoints(urls ...string) ServiceOption {
+	return func(s *service) error {
+		s.crlURLs = urls
+		return nil
+	}
+}
@@ -0,0 +1,86 @@
+package scepserver
+
+import (
+	"context"
+	"crypto/x509"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/syncsynchalt/scep/depot"
+	"github.com/syncsynchalt/scep/scep"
+)
+
+func TestRevoke(t *testing.T) {
+	d, caCert := createFileDepot(t)
+	svc, err := NewService(d, CAKeyPassword([]byte("secret")), ClientValidity(365), WithCRL(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &renewalClient{t: t, svc: svc, ca: caCert}
+	key := r.newKey()
+	crt := r.issued(r.send(scep.PKCSReq, r.csr(key, "revoke"), r.selfSign(key), key))
+
+	ctx := context.Background()
+	before := currentCRL(t, svc)
+	revoker := NewLoggingService(log.NewNopLogger(), svc).(Revoker)
+	if err := revoker.Revoke(ctx, crt.SerialNumber, depot.ReasonKeyCompromise); err != nil {
+		t.Fatal(err)
+	}
+	after := currentCRL(t, svc)
+	if len(after.RevokedCertificateEntries) != 1 || after.RevokedCertificateEntries[0].SerialNumber.Cmp(crt.SerialNumber) != 0 {
+		t.Errorf("the revoked certificate is not in the CRL: %v", after.RevokedCertificateEntries)
+	}
+	if after.Number.Cmp(before.Number) <= 0 {
+		t.Errorf("CRL number %s did not increase from %s", after.Number, before.Number)
+	}
+
+	// another server sharing the depot continues the count
+	other, err := NewService(d, CAKeyPassword([]byte("secret")), WithCRL(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have := currentCRL(t, other).Number; have.Cmp(after.Number) <= 0 {
+		t.Errorf("CRL number %s of the other server did not increase from %s", have, after.Number)
+	}
+
+	if err := revoker.Revoke(ctx, big.NewInt(1000), depot.ReasonKeyCompromise); err != depot.ErrNotFound {
+		t.Errorf("revoking an unknown serial: have %v, want %v", err, depot.ErrNotFound)
+	}
+}
+
+func currentCRL(t *testing.T, svc Service) *x509.RevocationList {
+	t.Helper()
+	data, err := svc.GetCRL(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	crl, err := x509.ParseRevocationList(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return crl
+}
+
+func TestCRLAfterIssuance(t *testing.T) {
+	d, caCert := createFileDepot(t)
+	svc, err := NewService(d, CAKeyPassword([]byte("secret")), ClientValidity(365), WithCRL(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &renewalClient{t: t, svc: svc, ca: caCert}
+	before := currentCRL(t, svc)
+	key := r.newKey()
+	old := r.issued(r.send(scep.PKCSReq, r.csr(key, "device"), r.selfSign(key), key))
+	if have := currentCRL(t, svc).Number; have.Cmp(before.Number) != 0 {
+		t.Errorf("CRL was rebuilt to number %s although nothing was revoked", have)
+	}
+
+	key = r.newKey()
+	r.issued(r.send(scep.PKCSReq, r.csr(key, "device"), r.selfSign(key), key))
+	after := currentCRL(t, svc)
+	if len(after.RevokedCertificateEntries) != 1 || after.RevokedCertificateEntries[0].SerialNumber.Cmp(old.SerialNumber) != 0 {
+		t.Errorf("the superseded certificate is not in the CRL: %v", after.RevokedCertificateEntries)
+	}
+}
@@ -20,6 +20,7 @@ const (
 	getCACert     = "GetCACert"
 	pkiOperation  = "PKIOperation"
 	getNextCACert = "GetNextCACert"
+	getCRL        = "GetCRL"
 )
 
 type Endpoints struct {
@@ -85,7 +86,19 @@ func (e *Endpoints) PKIOperation(ctx context.Context, msg []byte) ([]byte, error
 }
 
 func (e *Endpoints) GetNextCACert(ctx context.Context) ([]byte, error) {
-	var request SCEPRequest
+	request := SCEPRequest{Operation: getNextCACert}
+	response, err := e.GetEndpoint(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	resp := response.(SCEPResponse)
+	return resp.Data, resp.Err
+}
+
+// GetCRL fetches the current CRL of the CA. This is not a SCEP
+// operation, it is only supported by this server.
+func (e *Endpoints) GetCRL(ctx context.Context) ([]byte, error) {
+	request := SCEPRequest{Operation: getCRL}
 	response, err := e.GetEndpoint(ctx, request)
 	if err != nil {
 		return nil, err
@@ -143,6 +156,19 @@ func MakeSCEPEndpoint(svc Service) endpoint.Endpoint {
 			resp.Data, resp.CACertNum, resp.Err = svc.GetCACert(ctx)
 		case "PKIOperation":
 			resp.Data, resp.Err = svc.PKIOperation(ctx, req.Message)
+		case "GetNextCACert":
+			resp.Data, resp.Err = svc.GetNextCACert(ctx)
+		case "GetCRL":
+			if string(req.Message) != previousCRL {
+				resp.Data, resp.Err = svc.GetCRL(ctx)
+				break
+			}
+			getter, ok := svc.(PreviousCRLGetter)
+			if !ok {
+				resp.Err = errors.New("service has no previous CRL")
+				break
+			}
+			resp.Data, resp.Err = getter.GetPreviousCRL(ctx)
 		default:
 			return nil, errors.New("operation not implemented")
 		}
@@ -0,0 +1,172 @@
+package scepserver
+
+import (
+	"crypto/x509"
+	"encoding/asn1"
+	"fmt"
+	"net"
+	"net/url"
+)
+
+// ExtensionAction is what happens to a SubjectAltName type or an
+// extension which is requested in a CSR.
+type ExtensionAction int
+
+// Possible actions, the zero value drops the requested values.
+const (
+	ExtensionDrop   ExtensionAction = iota // not copied into the certificate
+	ExtensionCopy                          // copied into the certificate
+	ExtensionReject                        // the request is refused
+)
+
+// ParseExtensionAction parses "drop", "copy" or "reject".
+func ParseExtensionAction(s string) (ExtensionAction, error) {
+	switch s {
+	case "drop", "":
+		return ExtensionDrop, nil
+	case "copy":
+		return ExtensionCopy, nil
+	case "reject":
+		return ExtensionReject, nil
+	}
+	return 0, fmt.Errorf("unknown extension action %q", s)
+}
+
+// SANPolicy controls one type of SubjectAltName requested in a CSR.
+type SANPolicy struct {
+	Action ExtensionAction
+
+	// Rewrite, if set, is called for each name which is copied. It may
+	// change the name, drop it by returning an empty string, or refuse the
+	// request by returning an error.
+	Rewrite func(name string) (string, error)
+}
+
+// ExtensionPolicy controls which SubjectAltNames and other extensions
+// requested in a CSR are copied into the issued certificate. The zero
+// value copies none of them.
+type ExtensionPolicy struct {
+	DNSNames       SANPolicy
+	EmailAddresses SANPolicy
+	IPAddresses    SANPolicy
+	URIs           SANPolicy
+
+	// Extensions maps the dotted OIDs of other requested extensions to
+	// their action. Extensions which are not listed are dropped.
+	Extensions map[string]ExtensionAction
+}
+
+var oidExtensionSubjectAltName = asn1.ObjectIdentifier{2, 5, 29, 17}
+
+// extensions which are set by the CA and must not be copied from a CSR
+var protectedExtensions = map[string]string{
+	"2.5.29.14": "subjectKeyIdentifier",
+	"2.5.29.17": "subjectAltName",
+	"2.5.29.19": "basicConstraints",
+	"2.5.29.30": "nameConstraints",
+	"2.5.29.31": "cRLDistributionPoints",
+	"2.5.29.35": "authorityKeyIdentifier",
+}
+
+// WithExtensionPolicy is an option argument to NewService which copies
+// SubjectAltNames and extensions from CSRs into issued certificates
+// according to policy.
+func WithExtensionPolicy(policy ExtensionPolicy) ServiceOption {
+	return func(s *service) error {
+		for oid, action := range policy.Extensions {
+			if name, ok := protectedExtensions[oid]; ok && action == ExtensionCopy {
+				return fmt.Errorf("the %s extension can not be copied from a CSR", name)
+			}
+		}
+		s.extensionPolicy = policy
+		return nil
+	}
+}
+
+// apply copies the SubjectAltNames and extensions of csr which the policy
+// honors into tmpl. It returns an error if the request must be refused.
+func (p *ExtensionPolicy) apply(csr *x509.CertificateRequest, tmpl *x509.Certificate) error {
+	var err error
+	tmpl.DNSNames, err = p.DNSNames.apply("DNS", csr.DNSNames)
+	if err != nil {
+		return err
+	}
+	tmpl.EmailAddresses, err = p.EmailAddresses.apply("email", csr.EmailAddresses)
+	if err != nil {
+		return err
+	}
+
+	var ips []string
+	for _, ip := range csr.IPAddresses {
+		ips = append(ips, ip.String())
+	}
+	ips, err = p.IPAddresses.apply("IP", ips)
+	if err != nil {
+		return err
+	}
+	tmpl.IPAddresses = nil
+	for _, s := range ips {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return fmt.Errorf("invalid IP SubjectAltName %q", s)
+		}
+		tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+	}
+
+	var uris []string
+	for _, u := range csr.URIs {
+		uris = append(uris, u.String())
+	}
+	uris, err = p.URIs.apply("URI", uris)
+	if err != nil {
+		return err
+	}
+	tmpl.URIs = nil
+	for _, s := range uris {
+		u, err := url.Parse(s)
+		if err != nil {
+			return fmt.Errorf("invalid URI SubjectAltName %q: %s", s, err)
+		}
+		tmpl.URIs = append(tmpl.URIs, u)
+	}
+
+	for _, ext := range csr.Extensions {
+		if ext.Id.Equal(oidExtensionSubjectAltName) {
+			continue
+		}
+		switch p.Extensions[ext.Id.String()] {
+		case ExtensionCopy:
+			tmpl.ExtraExtensions = append(tmpl.ExtraExtensions, ext)
+		case ExtensionReject:
+			return fmt.Errorf("requested extension %s is not allowed", ext.Id)
+		}
+	}
+	return nil
+}
+
+func (p SANPolicy) apply(kind string, names []string) ([]string, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	switch p.Action {
+	case ExtensionCopy:
+	case ExtensionReject:
+		return nil, fmt.Errorf("%s SubjectAltNames are not allowed", kind)
+	default:
+		return nil, nil
+	}
+	if p.Rewrite == nil {
+		return names, nil
+	}
+	var out []string
+	for _, name := range names {
+		rewritten, err := p.Rewrite(name)
+		if err != nil {
+			return nil, err
+		}
+		if rewritten != "" {
+			out = append(out, rewritten)
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,190 @@
+package scepserver
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"net"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/syncsynchalt/scep/scep"
+)
+
+var oidTestExtension = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 99999, 1}
+
+func TestExtensionPolicy(t *testing.T) {
+	csr, _ := sanCSR(t)
+	copyAll := SANPolicy{Action: ExtensionCopy}
+	domainOnly := func(name string) (string, error) {
+		if !strings.HasSuffix(name, ".example.com") {
+			return "", nil
+		}
+		return strings.ToLower(name), nil
+	}
+
+	var tests = []struct {
+		name    string
+		policy  ExtensionPolicy
+		dns     []string
+		emails  []string
+		ips     []string
+		uris    int
+		extra   int
+		wantErr bool
+	}{
+		{name: "default drops everything"},
+		{
+			name: "copy",
+			policy: ExtensionPolicy{
+				DNSNames: copyAll, EmailAddresses: copyAll, IPAddresses: copyAll, URIs: copyAll,
+				Extensions: map[string]ExtensionAction{oidTestExtension.String(): ExtensionCopy},
+			},
+			dns:    []string{"Host.example.com", "host.example.org"},
+			emails: []string{"admin@example.com"},
+			ips:    []string{"192.0.2.1"},
+			uris:   1,
+			extra:  1,
+		},
+		{
+			name:   "rewrite",
+			policy: ExtensionPolicy{DNSNames: SANPolicy{Action: ExtensionCopy, Rewrite: domainOnly}},
+			dns:    []string{"host.example.com"},
+		},
+		{
+			name: "rewrite error",
+			policy: ExtensionPolicy{DNSNames: SANPolicy{Action: ExtensionCopy, Rewrite: func(string) (string, error) {
+				return "", errors.New("refused")
+			}}},
+			wantErr: true,
+		},
+		{
+			name:    "reject SAN",
+			policy:  ExtensionPolicy{DNSNames: copyAll, URIs: SANPolicy{Action: ExtensionReject}},
+			wantErr: true,
+		},
+		{
+			name:    "reject extension",
+			policy:  ExtensionPolicy{Extensions: map[string]ExtensionAction{oidTestExtension.String(): ExtensionReject}},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpl := &x509.Certificate{}
+			err := tt.policy.apply(csr, tmpl)
+			if have, want := err != nil, tt.wantErr; have != want {
+				t.Fatalf("have error %v, want error %v", err, want)
+			}
+			if tt.wantErr {
+				return
+			}
+			if have, want := tmpl.DNSNames, tt.dns; !reflect.DeepEqual(have, want) {
+				t.Errorf("have %v, want %v", have, want)
+			}
+			if have, want := tmpl.EmailAddresses, tt.emails; !reflect.DeepEqual(have, want) {
+				t.Errorf("have %v, want %v", have, want)
+			}
+			var ips []string
+			for _, ip := range tmpl.IPAddresses {
+				ips = append(ips, ip.String())
+			}
+			if have, want := ips, tt.ips; !reflect.DeepEqual(have, want) {
+				t.Errorf("have %v, want %v", have, want)
+			}
+			if have, want := len(tmpl.URIs), tt.uris; have != want {
+				t.Errorf("have %d URIs, want %d", have, want)
+			}
+			if have, want := len(tmpl.ExtraExtensions), tt.extra; have != want {
+				t.Errorf("have %d extensions, want %d", have, want)
+			}
+		})
+	}
+}
+
+func TestExtensionPolicyProtected(t *testing.T) {
+	depot, _ := createFileDepot(t)
+	_, err := NewService(depot, CAKeyPassword([]byte("secret")), WithExtensionPolicy(ExtensionPolicy{
+		Extensions: map[string]ExtensionAction{"2.5.29.19": ExtensionCopy},
+	}))
+	if err == nil {
+		t.Error("expected copying basicConstraints to be refused")
+	}
+}
+
+func TestExtensionPolicyIssue(t *testing.T) {
+	depot, caCert := createFileDepot(t)
+	svc, err := NewService(depot,
+		CAKeyPassword([]byte("secret")),
+		ClientValidity(365),
+		WithExtensionPolicy(ExtensionPolicy{
+			DNSNames:    SANPolicy{Action: ExtensionCopy},
+			IPAddresses: SANPolicy{Action: ExtensionCopy},
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &renewalClient{t: t, svc: svc, ca: caCert}
+	csr, key := sanCSR(t)
+
+	cert := r.issued(r.send(scep.PKCSReq, csr, r.selfSign(key), key))
+	if have, want := cert.DNSNames, csr.DNSNames; !reflect.DeepEqual(have, want) {
+		t.Errorf("have %v, want %v", have, want)
+	}
+	if have, want := len(cert.IPAddresses), 1; have != want {
+		t.Errorf("have %d IP addresses, want %d", have, want)
+	}
+	if have, want := len(cert.EmailAddresses), 0; have != want {
+		t.Errorf("have %d email addresses, want %d", have, want)
+	}
+
+	svc, err = NewService(depot,
+		CAKeyPassword([]byte("secret")),
+		ClientValidity(365),
+		WithExtensionPolicy(ExtensionPolicy{EmailAddresses: SANPolicy{Action: ExtensionReject}}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.svc = svc
+	r.failed(r.send(scep.PKCSReq, csr, r.selfSign(key), key), scep.BadRequest)
+}
+
+// sanCSR creates a CSR which requests SubjectAltNames of every type
+// and a private extension.
+func sanCSR(t *testing.T) (*x509.CertificateRequest, *rsa.PrivateKey) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uri, err := url.Parse("urn:example:device:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:        pkix.Name{CommonName: "san"},
+		DNSNames:       []string{"Host.example.com", "host.example.org"},
+		EmailAddresses: []string{"admin@example.com"},
+		IPAddresses:    []net.IP{net.ParseIP("192.0.2.1")},
+		URIs:           []*url.URL{uri},
+		ExtraExtensions: []pkix.Extension{
+			{Id: oidTestExtension, Value: []byte{0x05, 0x00}},
+		},
+	}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return csr, key
+}
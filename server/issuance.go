@@ -0,0 +1,134 @@
+package scepserver
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+
+	"github.com/syncsynchalt/scep/depot"
+	"github.com/syncsynchalt/scep/scep"
+)
+
+// commit records a signed certificate as issued. With a depot which can
+// stage certificates, the CertSuccesser approves the certificate before it
+// is put, and its file is removed if it does not. Otherwise, and for the
+// steps after the certificate was put, a failure revokes it. With a
+// depot.Superseder, older certificates with the same name stay valid until
+// every other step succeeded. The certificate must not be delivered if
+// commit returns an error. The caller must hold caMtx for reading.
+func (svc *service) commit(msg *scep.PKIMessage, name string, crt *x509.Certificate, renewal bool) error {
+	stager, staged := svc.depot.(depot.Stager)
+	staged = staged && svc.certSuccesser != nil
+	if staged {
+		certfile, err := stager.Stage(name, crt)
+		if err != nil {
+			return err
+		}
+		if err := svc.certSuccess(msg, certfile); err != nil {
+			svc.unstage(stager, name, crt)
+			return err
+		}
+	}
+
+	put := svc.depot.Put
+	superseder, deferred := svc.depot.(depot.Superseder)
+	if deferred {
+		put = superseder.PutWithoutSuperseding
+	}
+	if err := put(name, crt); err != nil {
+		if staged {
+			svc.unstage(stager, name, crt)
+		}
+		return err
+	}
+
+	// the CRL is only rebuilt if a certificate was revoked, which Put
+	// of a depot without a Superseder may have done
+	revoked := !deferred
+	defer func() {
+		if revoked && svc.crlLifetime != 0 {
+			if err := svc.updateCRL(); err != nil {
+				svc.debugLogger.Log("err", err, "msg", "updating CRL")
+			}
+		}
+	}()
+
+	var steps []func() error
+	if !staged && svc.certSuccesser != nil {
+		steps = append(steps, func() error {
+			certfile, err := svc.depot.CertFilename(name, crt)
+			if err != nil {
+				return err
+			}
+			return svc.certSuccess(msg, certfile)
+		})
+	}
+	if svc.pendingStore != nil {
+		steps = append(steps, func() error {
+			// the issued transaction is kept to answer retransmissions
+			err := svc.pendingStore.SetPendingStatus(string(msg.TransactionID), depot.StatusIssued)
+			if err == depot.ErrNotFound {
+				return nil
+			}
+			return err
+		})
+	}
+	// revocations come last, they are not undone if a later step fails
+	if deferred {
+		steps = append(steps, func() error {
+			superseded, err := superseder.Supersede(name, crt)
+			revoked = revoked || superseded
+			return err
+		})
+	}
+	if renewal {
+		steps = append(steps, func() error {
+			revoked = true
+			return svc.supersede(msg.SignerCert)
+		})
+	}
+	for _, step := range steps {
+		if err := step(); err != nil {
+			revoked = true
+			if rerr := svc.revokeUndelivered(crt); rerr != nil {
+				return fmt.Errorf("%s, and the certificate could not be revoked: %s", err, rerr)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// certSuccess asks the CertSuccesser to approve the certificate in
+// certfile. The caller must hold caMtx for reading.
+func (svc *service) certSuccess(msg *scep.PKIMessage, certfile string) error {
+	var ok bool
+	var err error
+	svc.withoutCALock(func() {
+		ok, err = svc.certSuccesser.Success(string(msg.TransactionID), msg.CSRReqMessage.RawDecrypted, certfile)
+	})
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("CertSuccesser denied the cert")
+	}
+	return nil
+}
+
+// unstage removes a staged certificate, a leftover file is only logged.
+func (svc *service) unstage(stager depot.Stager, name string, crt *x509.Certificate) {
+	if err := stager.Unstage(name, crt); err != nil {
+		svc.debugLogger.Log("err", err, "msg", "removing staged certificate", "serial", crt.SerialNumber)
+	}
+}
+
+// revokeUndelivered revokes a certificate which was put but will not be
+// delivered.
+func (svc *service) revokeUndelivered(crt *x509.Certificate) error {
+	revoker, ok := svc.depot.(depot.Revoker)
+	if !ok {
+		return errors.New("depot can not revoke certificates")
+	}
+	return revoker.Revoke(crt.SerialNumber, depot.ReasonCessationOfOperation)
+}
@@ -0,0 +1,145 @@
+package scepserver
+
+import (
+	"os"
+	"testing"
+
+	"github.com/syncsynchalt/scep/depot"
+	"github.com/syncsynchalt/scep/scep"
+)
+
+// testSuccesser approves certificates if approve is set, and records
+// whether the certificate file existed when it was called.
+type testSuccesser struct {
+	approve  bool
+	certfile string
+	existed  bool
+}
+
+func (s *testSuccesser) Success(transactionID string, data []byte, certfile string) (bool, error) {
+	s.certfile = certfile
+	_, err := os.Stat(certfile)
+	s.existed = err == nil
+	return s.approve, nil
+}
+
+func TestCertSuccesserDenies(t *testing.T) {
+	d, caCert := createFileDepot(t)
+	successer := &testSuccesser{}
+	svc, err := NewService(d, CAKeyPassword([]byte("secret")), ClientValidity(365), WithCertSuccesser(successer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &renewalClient{t: t, svc: svc, ca: caCert}
+
+	key := r.newKey()
+	r.failed(r.send(scep.PKCSReq, r.csr(key, "denied"), r.selfSign(key), key), scep.BadRequest)
+	if !successer.existed {
+		t.Error("the certificate file did not exist for the CertSuccesser")
+	}
+	if _, err := os.Stat(successer.certfile); !os.IsNotExist(err) {
+		t.Errorf("the file of the denied certificate was not removed: %v", err)
+	}
+	records, err := d.(depot.Repository).List(depot.CertFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 0 {
+		t.Errorf("the denied certificate was stored: %d records", len(records))
+	}
+
+	successer.approve = true
+	crt := r.issued(r.send(scep.PKCSReq, r.csr(key, "denied"), r.selfSign(key), key))
+	if _, err := d.(depot.CertGetter).GetCert(crt.SerialNumber); err != nil {
+		t.Errorf("the approved certificate was not stored: %v", err)
+	}
+}
+
+// unstagedDepot hides the Stager of a depot.
+type unstagedDepot struct {
+	depot.Depot
+	depot.Revoker
+	depot.RevocationLister
+}
+
+func TestCertSuccesserDeniesUnstaged(t *testing.T) {
+	fd, caCert := createFileDepot(t)
+	d := &unstagedDepot{fd, fd.(depot.Revoker), fd.(depot.RevocationLister)}
+	svc, err := NewService(d, CAKeyPassword([]byte("secret")), ClientValidity(365), WithCertSuccesser(&testSuccesser{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &renewalClient{t: t, svc: svc, ca: caCert}
+
+	key := r.newKey()
+	r.failed(r.send(scep.PKCSReq, r.csr(key, "denied"), r.selfSign(key), key), scep.BadRequest)
+	records, err := fd.(depot.Repository).List(depot.CertFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 {
+		t.Fatalf("have %d records, want 1", len(records))
+	}
+	if have, want := records[0].Status, depot.CertRevoked; have != want {
+		t.Errorf("have %s, want %s", have, want)
+	}
+	if have, want := records[0].RevocationReason, depot.ReasonCessationOfOperation; have != want {
+		t.Errorf("have %d, want %d", have, want)
+	}
+}
+
+// unstagedSuperseder hides the Stager of a depot which can supersede
+// certificates after they are put.
+type unstagedSuperseder struct {
+	unstagedDepot
+	depot.Superseder
+}
+
+func TestFailedIssuanceKeepsOlderCertificates(t *testing.T) {
+	fd, caCert := createFileDepot(t)
+	d := &unstagedSuperseder{
+		unstagedDepot{fd, fd.(depot.Revoker), fd.(depot.RevocationLister)},
+		fd.(depot.Superseder),
+	}
+	successer := &testSuccesser{approve: true}
+	svc, err := NewService(d, CAKeyPassword([]byte("secret")), ClientValidity(365), WithCertSuccesser(successer))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &renewalClient{t: t, svc: svc, ca: caCert}
+
+	key := r.newKey()
+	old := r.issued(r.send(scep.PKCSReq, r.csr(key, "device"), r.selfSign(key), key))
+
+	// the CertSuccesser is called after the new certificate was put
+	successer.approve = false
+	r.failed(r.send(scep.PKCSReq, r.csr(key, "device"), r.selfSign(key), key), scep.BadRequest)
+
+	records, err := fd.(depot.Repository).List(depot.CertFilter{CN: "device"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 {
+		t.Fatalf("have %d records, want 2", len(records))
+	}
+	for _, record := range records {
+		want := depot.CertRevoked
+		if record.Certificate.SerialNumber.Cmp(old.SerialNumber) == 0 {
+			want = depot.CertValid
+		}
+		if have := record.Status; have != want {
+			t.Errorf("serial %s: have %s, want %s", record.Certificate.SerialNumber, have, want)
+		}
+	}
+
+	// once issued, the new certificate supersedes the old one
+	successer.approve = true
+	crt := r.issued(r.send(scep.PKCSReq, r.csr(key, "device"), r.selfSign(key), key))
+	records, err = fd.(depot.Repository).List(depot.CertFilter{CN: "device", Status: depot.CertValid})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || records[0].Certificate.SerialNumber.Cmp(crt.SerialNumber) != 0 {
+		t.Errorf("have %d valid certificates, want only the new one", len(records))
+	}
+}
@@ -0,0 +1,302 @@
+package scepserver
+
+import (
+	"context"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/syncsynchalt/scep/profilechooser"
+	"github.com/syncsynchalt/scep/scep"
+)
+
+// Profile describes a kind of certificate issued by the service.
+type Profile struct {
+	Name               string
+	KeyUsage           x509.KeyUsage
+	ExtKeyUsage        []x509.ExtKeyUsage
+	UnknownExtKeyUsage []asn1.ObjectIdentifier
+	Validity           int // days, 0 for the ClientValidity of the service
+
+	// BasicConstraints adds the basicConstraints extension with IsCA
+	// and MaxPathLen, which is -1 for no limit.
+	BasicConstraints bool
+	IsCA             bool
+	MaxPathLen       int
+
+	PolicyIdentifiers []asn1.ObjectIdentifier
+	ExtraExtensions   []pkix.Extension
+}
+
+// defaultProfileName is used when no profile is selected for a request.
+const defaultProfileName = "default"
+
+// builtinProfile is the default profile unless one is configured.
+var builtinProfile = &Profile{
+	Name:        defaultProfileName,
+	KeyUsage:    x509.KeyUsageDigitalSignature,
+	ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+}
+
+// apply sets the key usage, validity and extensions of tmpl. Extensions
+// of the profile replace the ones with the same OID copied from the CSR.
+func (p *Profile) apply(tmpl *x509.Certificate, clientValidity int) {
+	validity := p.Validity
+	if validity == 0 {
+		validity = clientValidity
+	}
+	tmpl.NotAfter = tmpl.NotBefore.AddDate(0, 0, validity)
+	tmpl.KeyUsage = p.KeyUsage
+	tmpl.ExtKeyUsage = p.ExtKeyUsage
+	tmpl.UnknownExtKeyUsage = p.UnknownExtKeyUsage
+	if p.BasicConstraints {
+		tmpl.BasicConstraintsValid = true
+		tmpl.IsCA = p.IsCA
+		tmpl.MaxPathLen = p.MaxPathLen
+		tmpl.MaxPathLenZero = p.MaxPathLen == 0
+	}
+	tmpl.PolicyIdentifiers = p.PolicyIdentifiers
+
+	for _, ext := range p.ExtraExtensions {
+		for i := 0; i < len(tmpl.ExtraExtensions); i++ {
+			if tmpl.ExtraExtensions[i].Id.Equal(ext.Id) {
+				tmpl.ExtraExtensions = append(tmpl.ExtraExtensions[:i], tmpl.ExtraExtensions[i+1:]...)
+				i--
+			}
+		}
+		tmpl.ExtraExtensions = append(tmpl.ExtraExtensions, ext)
+	}
+}
+
+// WithProfiles is an option argument to NewService which configures the
+// certificate profiles. A profile named "default" is used for requests
+// which do not select one, otherwise they get a client authentication
+// certificate.
+func WithProfiles(profiles ...Profile) ServiceOption {
+	return func(s *service) error {
+		s.profiles = make(map[string]*Profile)
+		for i := range profiles {
+			p := &profiles[i]
+			if p.Name == "" {
+				return errors.New("profile without a name")
+			}
+			if _, ok := s.profiles[p.Name]; ok {
+				return fmt.Errorf("duplicate profile %q", p.Name)
+			}
+			s.profiles[p.Name] = p
+		}
+		return nil
+	}
+}
+
+// WithProfileChooser is an option argument to NewService which lets a
+// ProfileChooser select the profile of requests which do not select one
+// by the endpoint.
+func WithProfileChooser(profileChooser profilechooser.ProfileChooser) ServiceOption {
+	return func(s *service) error {
+		s.profileChooser = profileChooser
+		return nil
+	}
+}
+
+type profileKey struct{}
+
+// NewProfileContext returns a context which selects the named profile
+// for PKIOperation, it is used for the /scep/{profile} endpoint.
+func NewProfileContext(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, profileKey{}, name)
+}
+
+// profile selects the profile for a request, by the endpoint, the
+// ProfileChooser or the certificate template name in the CSR, in that
+// order. It returns an error for unknown profiles.
+func (svc *service) profile(ctx context.Context, msg *scep.PKIMessage) (*Profile, error) {
+	name, _ := ctx.Value(profileKey{}).(string)
+	if name == "" && svc.profileChooser != nil {
+		var err error
+		name, err = svc.profileChooser.Choose(msg.CSRReqMessage.RawDecrypted)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if name == "" {
+		name = templateName(msg.CSRReqMessage.CSR)
+	}
+	if name == "" {
+		name = defaultProfileName
+	}
+	if p, ok := svc.profiles[name]; ok {
+		return p, nil
+	}
+	if name == defaultProfileName {
+		return builtinProfile, nil
+	}
+	return nil, fmt.Errorf("unknown profile %q", name)
+}
+
+// Microsoft certificate template name extension
+var oidCertificateTemplateName = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 311, 20, 2}
+
+// templateName returns the Microsoft certificate template name
+// requested in csr, or an empty string.
+func templateName(csr *x509.CertificateRequest) string {
+	for _, ext := range csr.Extensions {
+		if !ext.Id.Equal(oidCertificateTemplateName) {
+			continue
+		}
+		var raw asn1.RawValue
+		if _, err := asn1.Unmarshal(ext.Value, &raw); err != nil {
+			return ""
+		}
+		switch raw.Tag {
+		case asn1.TagBMPString:
+			if len(raw.Bytes)%2 != 0 {
+				return ""
+			}
+			u := make([]uint16, len(raw.Bytes)/2)
+			for i := range u {
+				u[i] = uint16(raw.Bytes[2*i])<<8 | uint16(raw.Bytes[2*i+1])
+			}
+			return string(utf16.Decode(u))
+		case asn1.TagUTF8String, asn1.TagPrintableString, asn1.TagIA5String:
+			return string(raw.Bytes)
+		}
+	}
+	return ""
+}
+
+// profileConfig is the JSON form of a Profile.
+type profileConfig struct {
+	Name             string   `json:"name"`
+	KeyUsage         []string `json:"key_usage"`
+	ExtKeyUsage      []string `json:"ext_key_usage"`
+	ValidityDays     int      `json:"validity_days"`
+	BasicConstraints *struct {
+		CA         bool `json:"ca"`
+		MaxPathLen *int `json:"max_path_len"`
+	} `json:"basic_constraints"`
+	Policies   []string `json:"policies"`
+	Extensions []struct {
+		OID      string `json:"oid"`
+		Critical bool   `json:"critical"`
+		Value    []byte `json:"value"` // base64 encoded DER
+	} `json:"extensions"`
+}
+
+var keyUsages = map[string]x509.KeyUsage{
+	"digitalSignature":  x509.KeyUsageDigitalSignature,
+	"contentCommitment": x509.KeyUsageContentCommitment,
+	"keyEncipherment":   x509.KeyUsageKeyEncipherment,
+	"dataEncipherment":  x509.KeyUsageDataEncipherment,
+	"keyAgreement":      x509.KeyUsageKeyAgreement,
+	"keyCertSign":       x509.KeyUsageCertSign,
+	"cRLSign":           x509.KeyUsageCRLSign,
+	"encipherOnly":      x509.KeyUsageEncipherOnly,
+	"decipherOnly":      x509.KeyUsageDecipherOnly,
+}
+
+var extKeyUsages = map[string]x509.ExtKeyUsage{
+	"any":             x509.ExtKeyUsageAny,
+	"serverAuth":      x509.ExtKeyUsageServerAuth,
+	"clientAuth":      x509.ExtKeyUsageClientAuth,
+	"codeSigning":     x509.ExtKeyUsageCodeSigning,
+	"emailProtection": x509.ExtKeyUsageEmailProtection,
+	"ipsecEndSystem":  x509.ExtKeyUsageIPSECEndSystem,
+	"ipsecTunnel":     x509.ExtKeyUsageIPSECTunnel,
+	"ipsecUser":       x509.ExtKeyUsageIPSECUser,
+	"timeStamping":    x509.ExtKeyUsageTimeStamping,
+	"OCSPSigning":     x509.ExtKeyUsageOCSPSigning,
+}
+
+// ParseProfiles parses a JSON array of profiles, such as
+//
+//	[{
+//		"name": "server-tls",
+//		"key_usage": ["digitalSignature", "keyEncipherment"],
+//		"ext_key_usage": ["serverAuth"],
+//		"validity_days": 90,
+//		"basic_constraints": {"ca": false},
+//		"policies": ["2.23.140.1.2.1"],
+//		"extensions": [{"oid": "1.2.3.4", "critical": false, "value": "BQA="}]
+//	}]
+//
+// Extended key usages which are not known by name are given as OIDs,
+// extension values as base64 encoded DER.
+func ParseProfiles(data []byte) ([]Profile, error) {
+	var configs []profileConfig
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return nil, err
+	}
+	profiles := make([]Profile, 0, len(configs))
+	for _, c := range configs {
+		p := Profile{Name: c.Name, Validity: c.ValidityDays}
+		for _, name := range c.KeyUsage {
+			ku, ok := keyUsages[name]
+			if !ok {
+				return nil, fmt.Errorf("profile %q: unknown key usage %q", c.Name, name)
+			}
+			p.KeyUsage |= ku
+		}
+		for _, name := range c.ExtKeyUsage {
+			if eku, ok := extKeyUsages[name]; ok {
+				p.ExtKeyUsage = append(p.ExtKeyUsage, eku)
+				continue
+			}
+			oid, err := parseOID(name)
+			if err != nil {
+				return nil, fmt.Errorf("profile %q: unknown extended key usage %q", c.Name, name)
+			}
+			p.UnknownExtKeyUsage = append(p.UnknownExtKeyUsage, oid)
+		}
+		if bc := c.BasicConstraints; bc != nil {
+			p.BasicConstraints = true
+			p.IsCA = bc.CA
+			p.MaxPathLen = -1
+			if bc.MaxPathLen != nil {
+				p.MaxPathLen = *bc.MaxPathLen
+			}
+		}
+		for _, s := range c.Policies {
+			oid, err := parseOID(s)
+			if err != nil {
+				return nil, fmt.Errorf("profile %q: %s", c.Name, err)
+			}
+			p.PolicyIdentifiers = append(p.PolicyIdentifiers, oid)
+		}
+		for _, ext := range c.Extensions {
+			oid, err := parseOID(ext.OID)
+			if err != nil {
+				return nil, fmt.Errorf("profile %q: %s", c.Name, err)
+			}
+			p.ExtraExtensions = append(p.ExtraExtensions, pkix.Extension{
+				Id:       oid,
+				Critical: ext.Critical,
+				Value:    ext.Value,
+			})
+		}
+		profiles = append(profiles, p)
+	}
+	return profiles, nil
+}
+
+func parseOID(s string) (asn1.ObjectIdentifier, error) {
+	parts := strings.Split(s, ".")
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("invalid OID %q", s)
+	}
+	oid := make(asn1.ObjectIdentifier, len(parts))
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid OID %q", s)
+		}
+		oid[i] = n
+	}
+	return oid, nil
+}
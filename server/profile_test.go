@@ -0,0 +1,186 @@
+package scepserver
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/syncsynchalt/scep/scep"
+)
+
+const testProfiles = `[
+	{"name": "default", "validity_days": 30, "key_usage": ["digitalSignature"], "ext_key_usage": ["clientAuth"]},
+	{
+		"name": "server",
+		"validity_days": 90,
+		"key_usage": ["digitalSignature", "keyEncipherment"],
+		"ext_key_usage": ["serverAuth", "1.3.6.1.4.1.311.20.2.2"],
+		"basic_constraints": {"ca": false},
+		"policies": ["2.23.140.1.2.1"],
+		"extensions": [{"oid": "1.3.6.1.4.1.99999.1", "value": "BQA="}]
+	},
+	{"name": "wifi", "ext_key_usage": ["clientAuth", "serverAuth"]}
+]`
+
+func TestParseProfiles(t *testing.T) {
+	profiles, err := ParseProfiles([]byte(testProfiles))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := len(profiles), 3; have != want {
+		t.Fatalf("have %d profiles, want %d", have, want)
+	}
+	p := profiles[1]
+	if have, want := p.KeyUsage, x509.KeyUsageDigitalSignature|x509.KeyUsageKeyEncipherment; have != want {
+		t.Errorf("have %v, want %v", have, want)
+	}
+	if have, want := p.ExtKeyUsage, []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}; !reflect.DeepEqual(have, want) {
+		t.Errorf("have %v, want %v", have, want)
+	}
+	if have, want := p.UnknownExtKeyUsage, []asn1.ObjectIdentifier{{1, 3, 6, 1, 4, 1, 311, 20, 2, 2}}; !reflect.DeepEqual(have, want) {
+		t.Errorf("have %v, want %v", have, want)
+	}
+	if !p.BasicConstraints || p.IsCA || p.MaxPathLen != -1 {
+		t.Errorf("unexpected basic constraints %v %v %d", p.BasicConstraints, p.IsCA, p.MaxPathLen)
+	}
+	if have, want := len(p.ExtraExtensions), 1; have != want {
+		t.Errorf("have %d extensions, want %d", have, want)
+	}
+
+	for _, bad := range []string{
+		`[{"name": "x", "key_usage": ["nope"]}]`,
+		`[{"name": "x", "ext_key_usage": ["nope"]}]`,
+		`[{"name": "x", "policies": ["1"]}]`,
+	} {
+		if _, err := ParseProfiles([]byte(bad)); err == nil {
+			t.Errorf("expected %s to fail", bad)
+		}
+	}
+}
+
+type profileChooserFunc func([]byte) (string, error)
+
+func (f profileChooserFunc) Choose(csr []byte) (string, error) { return f(csr) }
+
+func TestProfileSelection(t *testing.T) {
+	profiles, err := ParseProfiles([]byte(testProfiles))
+	if err != nil {
+		t.Fatal(err)
+	}
+	depot, caCert := createFileDepot(t)
+	var chosen string
+	svc, err := NewService(depot,
+		CAKeyPassword([]byte("secret")),
+		ClientValidity(365),
+		WithProfiles(profiles...),
+		WithProfileChooser(profileChooserFunc(func([]byte) (string, error) { return chosen, nil })),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &renewalClient{t: t, svc: svc, ca: caCert}
+	key := r.newKey()
+
+	// the default profile
+	cert := r.issued(r.send(scep.PKCSReq, profileCSR(t, key, ""), r.selfSign(key), key))
+	if have, want := validityDays(cert), 30; have != want {
+		t.Errorf("have %d days, want %d", have, want)
+	}
+
+	// the template name in the CSR
+	cert = r.issued(r.send(scep.PKCSReq, profileCSR(t, key, "server"), r.selfSign(key), key))
+	if have, want := validityDays(cert), 90; have != want {
+		t.Errorf("have %d days, want %d", have, want)
+	}
+	if have, want := cert.ExtKeyUsage, []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}; !reflect.DeepEqual(have, want) {
+		t.Errorf("have %v, want %v", have, want)
+	}
+	if have, want := len(cert.PolicyIdentifiers), 1; have != want {
+		t.Errorf("have %d policies, want %d", have, want)
+	}
+
+	// the chooser takes precedence over the template name
+	chosen = "wifi"
+	cert = r.issued(r.send(scep.PKCSReq, profileCSR(t, key, "server"), r.selfSign(key), key))
+	if have, want := validityDays(cert), 365; have != want {
+		t.Errorf("have %d days, want %d", have, want)
+	}
+
+	// the endpoint takes precedence over the chooser
+	r.ctx = NewProfileContext(context.Background(), "server")
+	cert = r.issued(r.send(scep.PKCSReq, profileCSR(t, key, ""), r.selfSign(key), key))
+	if have, want := validityDays(cert), 90; have != want {
+		t.Errorf("have %d days, want %d", have, want)
+	}
+
+	r.ctx = NewProfileContext(context.Background(), "unknown")
+	r.failed(r.send(scep.PKCSReq, profileCSR(t, key, ""), r.selfSign(key), key), scep.BadRequest)
+}
+
+func TestProfileEndpoint(t *testing.T) {
+	profiles, err := ParseProfiles([]byte(testProfiles))
+	if err != nil {
+		t.Fatal(err)
+	}
+	depot, caCert := createFileDepot(t)
+	svc, err := NewService(depot, CAKeyPassword([]byte("secret")), WithProfiles(profiles...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(MakeHTTPHandler(MakeServerEndpoints(svc), svc, log.NewNopLogger()))
+	defer server.Close()
+	client, err := MakeClientEndpoints(server.URL + "/scep/server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &renewalClient{t: t, svc: client, ca: caCert}
+	key := r.newKey()
+	cert := r.issued(r.send(scep.PKCSReq, profileCSR(t, key, ""), r.selfSign(key), key))
+	if have, want := validityDays(cert), 90; have != want {
+		t.Errorf("have %d days, want %d", have, want)
+	}
+}
+
+// profileCSR creates a CSR, requesting the Microsoft certificate
+// template name unless it is empty.
+func profileCSR(t *testing.T, key *rsa.PrivateKey, template string) *x509.CertificateRequest {
+	t.Helper()
+	req := &x509.CertificateRequest{Subject: pkix.Name{CommonName: "profile"}}
+	if template != "" {
+		value, err := asn1.MarshalWithParams(template, "utf8")
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.ExtraExtensions = []pkix.Extension{{Id: oidCertificateTemplateName, Value: value}}
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, req, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return csr
+}
+
+func validityDays(cert *x509.Certificate) int {
+	return int(cert.NotAfter.Sub(cert.NotBefore).Round(time.Hour).Hours() / 24)
+}
+
+func TestTemplateName(t *testing.T) {
+	// "Wi" as a BMPString
+	bmp := []byte{0x1e, 0x04, 0x00, 'W', 0x00, 'i'}
+	csr := &x509.CertificateRequest{Extensions: []pkix.Extension{{Id: oidCertificateTemplateName, Value: bmp}}}
+	if have, want := templateName(csr), "Wi"; have != want {
+		t.Errorf("have %q, want %q", have, want)
+	}
+}
@@ -0,0 +1,166 @@
+package scepserver
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"sort"
+
+	"github.com/syncsynchalt/scep/depot"
+	"github.com/syncsynchalt/scep/scep"
+)
+
+// RenewalPolicy controls which certificates a RenewalReq may request.
+// The zero value requires the subject, SubjectAltNames and copied
+// extensions of the existing certificate and allows a new key.
+type RenewalPolicy struct {
+	AllowSubjectChange bool // also allows other SubjectAltNames and extensions
+	RequireSameKey     bool
+}
+
+// WithRenewalPolicy is an option argument to NewService which sets the
+// policy applied to RenewalReq and UpdateReq messages. The depot must be
+// able to list and revoke certificates.
+func WithRenewalPolicy(policy RenewalPolicy) ServiceOption {
+	return func(s *service) error {
+		if !canRenew(s.depot) {
+			return errors.New("renewals need a depot which can list and revoke certificates")
+		}
+		s.renewalPolicy = policy
+		return nil
+	}
+}
+
+// canRenew reports whether d can check the revocation of a renewed
+// certificate and revoke it once it is superseded.
+func canRenew(d depot.Depot) bool {
+	_, lister := d.(depot.RevocationLister)
+	_, revoker := d.(depot.Revoker)
+	return lister && revoker
+}
+
+// checkRenewal authenticates a renewal by the certificate which signed the
+// message: it must be issued by one of the signing CAs, or by the CA
+// replaced by the last rollover, and not be revoked. Verify has already
+// checked that it is unexpired. It returns a CertRep if the renewal is
+// refused, or nil if the certificate should be issued.
+func (svc *service) checkRenewal(msg *scep.PKIMessage, signerCa []*x509.Certificate) (*scep.PKIMessage, error) {
+	signer := msg.SignerCert
+	issued := false
+	for _, cas := range [][]*x509.Certificate{signerCa, svc.prevCA} {
+		for _, ca := range cas {
+			if signer.CheckSignatureFrom(ca) == nil {
+				issued = true
+				break
+			}
+		}
+	}
+	if !issued {
+		svc.debugLogger.Log("err", "renewal is not signed by a certificate of the CA", "signer", signer.Subject)
+		return msg.Fail(svc.raCert, svc.raKey, scep.BadMessageCheck)
+	}
+
+	if !canRenew(svc.depot) {
+		svc.debugLogger.Log("err", "renewal refused, depot can not check or revoke the signer certificate")
+		return msg.Fail(svc.raCert, svc.raKey, scep.BadRequest)
+	}
+	revoked, err := svc.depot.(depot.RevocationLister).RevokedCerts()
+	if err != nil {
+		return nil, err
+	}
+	for _, rc := range revoked {
+		if rc.SerialNumber.Cmp(signer.SerialNumber) == 0 {
+			svc.debugLogger.Log("err", "renewal is signed by a revoked certificate", "serial", signer.SerialNumber)
+			return msg.Fail(svc.raCert, svc.raKey, scep.BadMessageCheck)
+		}
+	}
+
+	csr := msg.CSRReqMessage.CSR
+	if !svc.renewalPolicy.AllowSubjectChange && csr.Subject.String() != signer.Subject.String() {
+		svc.debugLogger.Log("err", "renewal changes the subject", "subject", csr.Subject, "signer", signer.Subject)
+		return msg.Fail(svc.raCert, svc.raKey, scep.BadRequest)
+	}
+	if svc.renewalPolicy.RequireSameKey {
+		pub, ok := signer.PublicKey.(interface{ Equal(crypto.PublicKey) bool })
+		if !ok || !pub.Equal(csr.PublicKey) {
+			svc.debugLogger.Log("err", "renewal changes the key", "signer", signer.Subject)
+			return msg.Fail(svc.raCert, svc.raKey, scep.BadRequest)
+		}
+	}
+	return nil, nil
+}
+
+// checkRenewedNames refuses a renewal whose SubjectAltNames or copied
+// extensions differ from the certificate being renewed, unless the policy
+// allows a subject change. tmpl holds what the extension policy copied
+// from the CSR.
+func (svc *service) checkRenewedNames(msg *scep.PKIMessage, tmpl *x509.Certificate) (*scep.PKIMessage, error) {
+	if svc.renewalPolicy.AllowSubjectChange {
+		return nil, nil
+	}
+	signer := msg.SignerCert
+	var ips, signerIPs, uris, signerURIs []string
+	for _, ip := range tmpl.IPAddresses {
+		ips = append(ips, ip.String())
+	}
+	for _, ip := range signer.IPAddresses {
+		signerIPs = append(signerIPs, ip.String())
+	}
+	for _, u := range tmpl.URIs {
+		uris = append(uris, u.String())
+	}
+	for _, u := range signer.URIs {
+		signerURIs = append(signerURIs, u.String())
+	}
+	if !sameNames(tmpl.DNSNames, signer.DNSNames) ||
+		!sameNames(tmpl.EmailAddresses, signer.EmailAddresses) ||
+		!sameNames(ips, signerIPs) ||
+		!sameNames(uris, signerURIs) {
+		svc.debugLogger.Log("err", "renewal changes the SubjectAltNames", "signer", signer.Subject)
+		return msg.Fail(svc.raCert, svc.raKey, scep.BadRequest)
+	}
+	for _, ext := range tmpl.ExtraExtensions {
+		if !hasExtension(signer, ext) {
+			svc.debugLogger.Log("err", "renewal requests a new extension", "oid", ext.Id, "signer", signer.Subject)
+			return msg.Fail(svc.raCert, svc.raKey, scep.BadRequest)
+		}
+	}
+	return nil, nil
+}
+
+// sameNames reports whether a and b hold the same names in any order.
+func sameNames(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	a = append([]string(nil), a...)
+	b = append([]string(nil), b...)
+	sort.Strings(a)
+	sort.Strings(b)
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func hasExtension(crt *x509.Certificate, ext pkix.Extension) bool {
+	for _, e := range crt.Extensions {
+		if e.Id.Equal(ext.Id) && e.Critical == ext.Critical && bytes.Equal(e.Value, ext.Value) {
+			return true
+		}
+	}
+	return false
+}
+
+// supersede revokes the certificate which was renewed.
+func (svc *service) supersede(old *x509.Certificate) error {
+	revoker, ok := svc.depot.(depot.Revoker)
+	if !ok {
+		return errors.New("depot can not revoke the renewed certificate")
+	}
+	return revoker.Revoke(old.SerialNumber, depot.ReasonSuperseded)
+}
@@ -0,0 +1,299 @@
+package scepserver
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/syncsynchalt/scep/depot"
+	filedepot "github.com/syncsynchalt/scep/depot/file"
+	"github.com/syncsynchalt/scep/scep"
+)
+
+func TestRenewal(t *testing.T) {
+	depot, caCert := createFileDepot(t)
+	svc, err := NewService(depot, CAKeyPassword([]byte("secret")), ClientValidity(365))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &renewalClient{t: t, svc: svc, ca: caCert}
+
+	key1 := r.newKey()
+	cert1 := r.issued(r.send(scep.PKCSReq, r.csr(key1, "renewal"), r.selfSign(key1), key1))
+
+	// a new key, signed by the existing certificate
+	key2 := r.newKey()
+	cert2 := r.issued(r.send(scep.RenewalReq, r.csr(key2, "renewal"), cert1, key1))
+	if have, want := cert2.Subject.CommonName, "renewal"; have != want {
+		t.Errorf("have %s, want %s", have, want)
+	}
+	if !isRevoked(t, depot, cert1) {
+		t.Error("expected the renewed certificate to be revoked")
+	}
+
+	// not issued by the CA
+	resp := r.send(scep.RenewalReq, r.csr(key2, "renewal"), r.selfSign(key2), key2)
+	r.failed(resp, scep.BadMessageCheck)
+
+	// revoked
+	resp = r.send(scep.RenewalReq, r.csr(key2, "renewal"), cert1, key1)
+	r.failed(resp, scep.BadMessageCheck)
+
+	// a different subject
+	resp = r.send(scep.RenewalReq, r.csr(key2, "other"), cert2, key2)
+	r.failed(resp, scep.BadRequest)
+}
+
+func TestRenewalPolicy(t *testing.T) {
+	depot, caCert := createFileDepot(t)
+	svc, err := NewService(depot,
+		CAKeyPassword([]byte("secret")),
+		ClientValidity(365),
+		WithRenewalPolicy(RenewalPolicy{AllowSubjectChange: true, RequireSameKey: true}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &renewalClient{t: t, svc: svc, ca: caCert}
+
+	key := r.newKey()
+	cert1 := r.issued(r.send(scep.PKCSReq, r.csr(key, "renewal"), r.selfSign(key), key))
+
+	resp := r.send(scep.RenewalReq, r.csr(r.newKey(), "renewal"), cert1, key)
+	r.failed(resp, scep.BadRequest)
+
+	cert2 := r.issued(r.send(scep.RenewalReq, r.csr(key, "renamed"), cert1, key))
+	if have, want := cert2.Subject.CommonName, "renamed"; have != want {
+		t.Errorf("have %s, want %s", have, want)
+	}
+	if !isRevoked(t, depot, cert1) {
+		t.Error("expected the renewed certificate to be revoked")
+	}
+}
+
+func TestRenewalNames(t *testing.T) {
+	depot, caCert := createFileDepot(t)
+	svc, err := NewService(depot,
+		CAKeyPassword([]byte("secret")),
+		ClientValidity(365),
+		WithExtensionPolicy(ExtensionPolicy{DNSNames: SANPolicy{Action: ExtensionCopy}}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &renewalClient{t: t, svc: svc, ca: caCert}
+
+	key := r.newKey()
+	cert1 := r.issued(r.send(scep.PKCSReq, r.csr(key, "renewal", "a.example.com"), r.selfSign(key), key))
+
+	// a SubjectAltName which is not in the renewed certificate
+	resp := r.send(scep.RenewalReq, r.csr(key, "renewal", "a.example.com", "b.example.com"), cert1, key)
+	r.failed(resp, scep.BadRequest)
+	resp = r.send(scep.RenewalReq, r.csr(key, "renewal"), cert1, key)
+	r.failed(resp, scep.BadRequest)
+	if isRevoked(t, depot, cert1) {
+		t.Error("expected the certificate to stay valid after a refused renewal")
+	}
+
+	cert2 := r.issued(r.send(scep.RenewalReq, r.csr(key, "renewal", "a.example.com"), cert1, key))
+	if have, want := cert2.DNSNames, []string{"a.example.com"}; len(have) != 1 || have[0] != want[0] {
+		t.Errorf("have %v, want %v", have, want)
+	}
+
+	// a subject change also allows other SubjectAltNames
+	svc, err = NewService(depot,
+		CAKeyPassword([]byte("secret")),
+		ClientValidity(365),
+		WithExtensionPolicy(ExtensionPolicy{DNSNames: SANPolicy{Action: ExtensionCopy}}),
+		WithRenewalPolicy(RenewalPolicy{AllowSubjectChange: true}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.svc = svc
+	r.issued(r.send(scep.RenewalReq, r.csr(key, "renewal", "b.example.com"), cert2, key))
+}
+
+// listOnlyDepot can not revoke certificates.
+type listOnlyDepot struct {
+	depot.Depot
+	depot.RevocationLister
+}
+
+func TestRenewalPolicyDepot(t *testing.T) {
+	d, _ := createFileDepot(t)
+	_, err := NewService(listOnlyDepot{d, d.(depot.RevocationLister)},
+		CAKeyPassword([]byte("secret")),
+		WithRenewalPolicy(RenewalPolicy{}),
+	)
+	if err == nil {
+		t.Error("expected an error for a depot which can not revoke the renewed certificate")
+	}
+}
+
+// renewalClient sends requests directly to the service.
+type renewalClient struct {
+	t   *testing.T
+	svc Service
+	ca  *x509.Certificate
+	ctx context.Context // nil for context.Background()
+}
+
+func (r *renewalClient) newKey() *rsa.PrivateKey {
+	r.t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	return key
+}
+
+func (r *renewalClient) csr(key *rsa.PrivateKey, cn string, dnsNames ...string) *x509.CertificateRequest {
+	r.t.Helper()
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: cn},
+		DNSNames: dnsNames,
+	}, key)
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	return csr
+}
+
+func (r *renewalClient) selfSign(key *rsa.PrivateKey) *x509.Certificate {
+	r.t.Helper()
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "SCEP SIGNER"},
+		NotBefore:    time.Now().Add(-600).UTC(),
+		NotAfter:     time.Now().Add(time.Hour).UTC(),
+	}
+	return createCert(r.t, tmpl, tmpl, key.Public(), key)
+}
+
+// send returns the response, decrypted if it was successful.
+func (r *renewalClient) send(msgType scep.MessageType, csr *x509.CertificateRequest, signerCert *x509.Certificate, signerKey crypto.Signer) *scep.PKIMessage {
+	r.t.Helper()
+	msg, err := scep.NewCSRRequest(csr, &scep.PKIMessage{
+		MessageType: msgType,
+		Recipients:  []*x509.Certificate{r.ca},
+		SignerKey:   signerKey,
+		SignerCert:  signerCert,
+	})
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	ctx := r.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	data, err := r.svc.PKIOperation(ctx, msg.Raw)
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	resp, err := scep.ParsePKIMessage(data)
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	if resp.PKIStatus == scep.SUCCESS {
+		if err := resp.DecryptPKIEnvelope(signerCert, signerKey); err != nil {
+			r.t.Fatal(err)
+		}
+	}
+	return resp
+}
+
+func (r *renewalClient) issued(resp *scep.PKIMessage) *x509.Certificate {
+	r.t.Helper()
+	if have, want := resp.PKIStatus, scep.SUCCESS; have != want {
+		r.t.Fatalf("have %s, want %s", have, want)
+	}
+	return resp.CertRepMessage.Certificate
+}
+
+func (r *renewalClient) failed(resp *scep.PKIMessage, info scep.FailInfo) {
+	r.t.Helper()
+	if have, want := resp.PKIStatus, scep.PKIStatus(scep.FAILURE); have != want {
+		r.t.Fatalf("have %s, want %s", have, want)
+	}
+	if have, want := resp.FailInfo, info; have != want {
+		r.t.Errorf("have %s, want %s", have, want)
+	}
+}
+
+func isRevoked(t *testing.T, d depot.Depot, crt *x509.Certificate) bool {
+	t.Helper()
+	revoked, err := d.(depot.RevocationLister).RevokedCerts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, rc := range revoked {
+		if rc.SerialNumber.Cmp(crt.SerialNumber) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// createFileDepot creates a file depot with a new CA, its key is
+// encrypted with the password "secret".
+func createFileDepot(t *testing.T) (depot.Depot, *x509.Certificate) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "scep-depot-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	caCert := writeCA(t, dir, "ca", "SCEP CA")
+
+	d, err := filedepot.NewFileDepot(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d, caCert
+}
+
+// writeCA creates a CA as <name>.pem and <name>.key in dir.
+func writeCA(t *testing.T, dir, name, cn string) *x509.Certificate {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-600).UTC(),
+		NotAfter:              time.Now().AddDate(1, 0, 0).UTC(),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caCert := createCert(t, tmpl, tmpl, key.Public(), key)
+	block, err := x509.EncryptPEMBlock(rand.Reader, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(key), []byte("secret"), x509.PEMCipher3DES)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, name+".key"), pem.EncodeToMemory(block), 0400); err != nil {
+		t.Fatal(err)
+	}
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caCert.Raw})
+	if err := ioutil.WriteFile(filepath.Join(dir, name+".pem"), caPEM, 0400); err != nil {
+		t.Fatal(err)
+	}
+	return caCert
+}
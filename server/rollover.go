@@ -0,0 +1,137 @@
+package scepserver
+
+import (
+	"context"
+	"crypto"
+	"crypto/x509"
+	"errors"
+	"time"
+
+	"github.com/syncsynchalt/scep/depot"
+	"github.com/syncsynchalt/scep/scep"
+)
+
+// GetNextCACert returns the staged next CA certificate, signed by the
+// current CA.
+func (svc *service) GetNextCACert(ctx context.Context) ([]byte, error) {
+	svc.caMtx.RLock()
+	defer svc.caMtx.RUnlock()
+	if len(svc.nextCA) == 0 {
+		return nil, errors.New("no next CA certificate is staged")
+	}
+	return scep.SignNextCACerts(svc.nextCA, svc.ca[0], svc.caKey)
+}
+
+// loadNextCA loads the next CA staged in the depot, if any. Until the
+// rollover SCEP messages may be encrypted to either CA.
+func (s *service) loadNextCA() error {
+	nextDepot, ok := s.depot.(depot.NextCADepot)
+	if ok {
+		var err error
+		s.nextCA, s.nextCAKey, err = nextDepot.NextCA(s.caKeyPassword)
+		if err != nil {
+			return err
+		}
+	}
+	if len(s.nextCA) == 0 {
+		// once the rollover time has passed it is recorded in the depot
+		if !s.rolloverAt.IsZero() && time.Now().Before(s.rolloverAt) {
+			return errors.New("CA rollover requires a next CA in the depot")
+		}
+		return nil
+	}
+	if !s.rolloverAt.IsZero() && s.caKeyProvider != nil {
+		return errors.New("CA rollover can not replace a CA key from a key provider")
+	}
+	_, ok = s.nextCAKey.(crypto.Decrypter)
+	s.nextCADecrypts = ok && s.nextCA[0].PublicKeyAlgorithm == x509.RSA
+	if !s.nextCADecrypts && s.raCert == s.ca[0] {
+		return errors.New("next CA key can not decrypt SCEP messages, an RSA RA certificate is required")
+	}
+	return nil
+}
+
+// loadPreviousCA loads the CA which was replaced by the last rollover, if
+// any. It keeps signing the CRL of the certificates it issued, and they
+// can still be renewed.
+func (s *service) loadPreviousCA() error {
+	rolloverDepot, ok := s.depot.(depot.RolloverDepot)
+	if !ok {
+		return nil
+	}
+	var err error
+	s.prevCA, s.prevCAKey, err = rolloverDepot.PreviousCA(s.caKeyPassword)
+	return err
+}
+
+// rolloverRetry is how long a rollover waits to be retried after the
+// depot failed to record it.
+var rolloverRetry = time.Minute
+
+// rollover records the rollover in the depot and then makes the next CA
+// the current one, the current CA becomes the previous one. A separate RA
+// keeps decrypting and signing SCEP messages.
+func (svc *service) rollover() {
+	svc.caMtx.Lock()
+	defer svc.caMtx.Unlock()
+	// the current CA keeps issuing until the depot has the next CA as
+	// the current one, a restart would go back to it otherwise
+	if err := svc.depot.(depot.RolloverDepot).RolloverCA(); err != nil {
+		svc.debugLogger.Log("err", err, "msg", "recording the CA rollover in the depot", "retry", rolloverRetry)
+		time.AfterFunc(rolloverRetry, svc.rollover)
+		return
+	}
+	if svc.raCert == svc.ca[0] {
+		svc.raCert, svc.raKey = svc.nextCA[0], svc.nextCAKey
+	}
+	svc.prevCA, svc.prevCAKey = svc.ca, svc.caKey
+	svc.ca, svc.caKey = svc.nextCA, svc.nextCAKey
+	svc.nextCA, svc.nextCAKey = nil, nil
+	svc.debugLogger.Log("msg", "rolled over to the next CA", "subject", svc.ca[0].Subject)
+
+	if svc.crlLifetime != 0 {
+		if err := svc.updateCRL(); err != nil {
+			svc.debugLogger.Log("err", err, "msg", "updating CRL")
+		}
+	}
+}
+
+// scheduleRollover rolls over to the next CA at rolloverAt, or right
+// away if that time has passed.
+func (s *service) scheduleRollover() {
+	if len(s.nextCA) == 0 || s.rolloverAt.IsZero() {
+		return
+	}
+	wait := time.Until(s.rolloverAt)
+	if wait <= 0 {
+		s.rollover()
+		return
+	}
+	time.AfterFunc(wait, s.rollover)
+}
+
+// decryptPKIEnvelope decrypts the message with the RA, or with the next
+// CA for clients which already use it.
+func (svc *service) decryptPKIEnvelope(msg *scep.PKIMessage) error {
+	err := msg.DecryptPKIEnvelope(svc.raCert, svc.raKey)
+	if err != nil && svc.nextCADecrypts && len(svc.nextCA) > 0 {
+		if msg.DecryptPKIEnvelope(svc.nextCA[0], svc.nextCAKey) == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// WithCARollover is an option argument to NewService which replaces the
+// CA with the next CA staged in the depot at the given time. Until then
+// the next CA is served by GetNextCACert. The depot must implement
+// depot.RolloverDepot.
+func WithCARollover(at time.Time) ServiceOption {
+	return func(s *service) error {
+		if _, ok := s.depot.(depot.RolloverDepot); !ok {
+			return errors.New("depot does not support a CA rollover")
+		}
+		s.rolloverAt = at
+		return nil
+	}
+}
@@ -0,0 +1,303 @@
+package scepserver
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	"github.com/syncsynchalt/scep/depot"
+	filedepot "github.com/syncsynchalt/scep/depot/file"
+	"github.com/syncsynchalt/scep/scep"
+)
+
+func TestGetNextCACert(t *testing.T) {
+	dir, caCert, nextCA := createRolloverDepot(t)
+	svc := newRolloverService(t, dir)
+	ctx := context.Background()
+
+	caps, err := svc.GetCACaps(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(caps, []byte("GetNextCACert")) {
+		t.Errorf("expected GetNextCACert in capabilities, have %q", caps)
+	}
+
+	data, err := svc.GetNextCACert(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certs, signer, err := scep.NextCACerts(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(certs) != 1 || !bytes.Equal(certs[0].Raw, nextCA.Raw) {
+		t.Error("GetNextCACert did not return the next CA")
+	}
+	if !bytes.Equal(signer.Raw, caCert.Raw) {
+		t.Error("GetNextCACert is not signed by the current CA")
+	}
+
+	// until the rollover, requests to either CA are issued by the current CA
+	for _, recipient := range []*x509.Certificate{caCert, nextCA} {
+		r := &renewalClient{t: t, svc: svc, ca: recipient}
+		key := r.newKey()
+		crt := r.issued(r.send(scep.PKCSReq, r.csr(key, recipient.Subject.CommonName), r.selfSign(key), key))
+		if err := crt.CheckSignatureFrom(caCert); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestCARollover(t *testing.T) {
+	dir, caCert, nextCA := createRolloverDepot(t)
+	svc := newRolloverService(t, dir, WithCARollover(time.Now().Add(500*time.Millisecond)))
+	ctx := context.Background()
+
+	caCertOf := func() *x509.Certificate {
+		t.Helper()
+		data, _, err := svc.GetCACert(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		crt, err := x509.ParseCertificate(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return crt
+	}
+	if !bytes.Equal(caCertOf().Raw, caCert.Raw) {
+		t.Fatal("expected the current CA before the rollover")
+	}
+	r := &renewalClient{t: t, svc: svc, ca: caCert}
+	oldKey := r.newKey()
+	oldCrt := r.issued(r.send(scep.PKCSReq, r.csr(oldKey, "before"), r.selfSign(oldKey), oldKey))
+
+	time.Sleep(time.Second)
+	if !bytes.Equal(caCertOf().Raw, nextCA.Raw) {
+		t.Fatal("expected the next CA after the rollover")
+	}
+	if _, err := svc.GetNextCACert(ctx); err == nil {
+		t.Error("expected no next CA after the rollover")
+	}
+	r = &renewalClient{t: t, svc: svc, ca: nextCA}
+	key := r.newKey()
+	crt := r.issued(r.send(scep.PKCSReq, r.csr(key, "rolled over"), r.selfSign(key), key))
+	if err := crt.CheckSignatureFrom(nextCA); err != nil {
+		t.Error(err)
+	}
+
+	// the rollover is recorded in the depot
+	for name, want := range map[string]*x509.Certificate{"ca.pem": nextCA, "prev_ca.pem": caCert} {
+		if have := readCert(t, filepath.Join(dir, name)); !bytes.Equal(have.Raw, want.Raw) {
+			t.Errorf("have %s in %s", have.Subject, name)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "next_ca.pem")); !os.IsNotExist(err) {
+		t.Errorf("expected next_ca.pem to be moved, have %v", err)
+	}
+
+	// a restarted server keeps the next CA and renews certificates of
+	// the previous one
+	svc = newRolloverService(t, dir, WithCARollover(time.Now().Add(-time.Minute)))
+	if !bytes.Equal(caCertOf().Raw, nextCA.Raw) {
+		t.Error("expected the next CA after a restart past the rollover")
+	}
+	r = &renewalClient{t: t, svc: svc, ca: nextCA}
+	renewed := r.issued(r.send(scep.RenewalReq, r.csr(oldKey, "before"), oldCrt, oldKey))
+	if err := renewed.CheckSignatureFrom(nextCA); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCARolloverCRL(t *testing.T) {
+	dir, caCert, nextCA := createRolloverDepot(t)
+	svc := newRolloverService(t, dir, WithCRL(time.Hour), WithCARollover(time.Now().Add(500*time.Millisecond)))
+	ctx := context.Background()
+
+	r := &renewalClient{t: t, svc: svc, ca: caCert}
+	key := r.newKey()
+	oldCrt := r.issued(r.send(scep.PKCSReq, r.csr(key, "old"), r.selfSign(key), key))
+	time.Sleep(time.Second)
+	r = &renewalClient{t: t, svc: svc, ca: nextCA}
+	newCrt := r.issued(r.send(scep.PKCSReq, r.csr(key, "new"), r.selfSign(key), key))
+
+	for _, crt := range []*x509.Certificate{oldCrt, newCrt} {
+		if err := svc.(Revoker).Revoke(ctx, crt.SerialNumber, depot.ReasonKeyCompromise); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	prevData, err := svc.(PreviousCRLGetter).GetPreviousCRL(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prevCRL, err := x509.ParseRevocationList(prevData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		crl      *x509.RevocationList
+		ca       *x509.Certificate
+		revoked  *x509.Certificate
+		excluded *x509.Certificate
+	}{
+		{currentCRL(t, svc), nextCA, newCrt, oldCrt},
+		{prevCRL, caCert, oldCrt, newCrt},
+	} {
+		if err := tc.crl.CheckSignatureFrom(tc.ca); err != nil {
+			t.Errorf("CRL of %s: %s", tc.ca.Subject, err)
+		}
+		if !crlContains(tc.crl, tc.revoked) {
+			t.Errorf("expected %s in the CRL of %s", tc.revoked.Subject, tc.ca.Subject)
+		}
+		if crlContains(tc.crl, tc.excluded) {
+			t.Errorf("expected no %s in the CRL of %s", tc.excluded.Subject, tc.ca.Subject)
+		}
+	}
+
+	// the previous CRL is served over plain HTTP
+	server := httptest.NewServer(MakeHTTPHandler(MakeServerEndpoints(svc), svc, log.NewNopLogger()))
+	defer server.Close()
+	resp, err := http.Get(server.URL + "/crl?ca=previous")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(body, prevData) {
+		t.Error("expected the CRL of the previous CA")
+	}
+}
+
+// failingRolloverDepot fails to record a rollover until fail is cleared.
+type failingRolloverDepot struct {
+	depot.Depot
+	depot.RolloverDepot
+	fail int32
+}
+
+func (d *failingRolloverDepot) RolloverCA() error {
+	if atomic.LoadInt32(&d.fail) != 0 {
+		return errors.New("disk full")
+	}
+	return d.RolloverDepot.RolloverCA()
+}
+
+func TestCARolloverFailure(t *testing.T) {
+	retry := rolloverRetry
+	rolloverRetry = 100 * time.Millisecond
+	defer func() { rolloverRetry = retry }()
+
+	dir, caCert, nextCA := createRolloverDepot(t)
+	fd, err := filedepot.NewFileDepot(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &failingRolloverDepot{Depot: fd, RolloverDepot: fd, fail: 1}
+	svc, err := NewService(d, CAKeyPassword([]byte("secret")), ClientValidity(365), WithCARollover(time.Now().Add(-time.Minute)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCertOf := func() *x509.Certificate {
+		t.Helper()
+		data, _, err := svc.GetCACert(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		crt, err := x509.ParseCertificate(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return crt
+	}
+
+	// the current CA stays until the depot records the rollover
+	if !bytes.Equal(caCertOf().Raw, caCert.Raw) {
+		t.Fatal("expected the current CA while the depot fails")
+	}
+	r := &renewalClient{t: t, svc: svc, ca: caCert}
+	key := r.newKey()
+	crt := r.issued(r.send(scep.PKCSReq, r.csr(key, "failed rollover"), r.selfSign(key), key))
+	if err := crt.CheckSignatureFrom(caCert); err != nil {
+		t.Error(err)
+	}
+
+	atomic.StoreInt32(&d.fail, 0)
+	deadline := time.Now().Add(5 * time.Second)
+	for !bytes.Equal(caCertOf().Raw, nextCA.Raw) {
+		if time.Now().After(deadline) {
+			t.Fatal("the rollover was not retried")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if have := readCert(t, filepath.Join(dir, "ca.pem")); !bytes.Equal(have.Raw, nextCA.Raw) {
+		t.Errorf("have %s in ca.pem", have.Subject)
+	}
+}
+
+func crlContains(crl *x509.RevocationList, crt *x509.Certificate) bool {
+	for _, rc := range crl.RevokedCertificateEntries {
+		if rc.SerialNumber.Cmp(crt.SerialNumber) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func readCert(t *testing.T, path string) *x509.Certificate {
+	t.Helper()
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		t.Fatalf("no PEM data in %s", path)
+	}
+	crt, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return crt
+}
+
+func createRolloverDepot(t *testing.T) (dir string, caCert, nextCA *x509.Certificate) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "scep-depot-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	caCert = writeCA(t, dir, "ca", "SCEP CA")
+	nextCA = writeCA(t, dir, "next_ca", "SCEP CA 2")
+	return dir, caCert, nextCA
+}
+
+func newRolloverService(t *testing.T, dir string, opts ...ServiceOption) Service {
+	t.Helper()
+	depot, err := filedepot.NewFileDepot(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts = append([]ServiceOption{CAKeyPassword([]byte("secret")), ClientValidity(365)}, opts...)
+	svc, err := NewService(depot, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return svc
+}
@@ -1,14 +1,21 @@
 package scepserver
 
 import (
+	"bytes"
 	"context"
 	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rsa"
 	"crypto/sha1"
+	"crypto/sha256"
 	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/asn1"
+	"encoding/hex"
 	"errors"
 	"math/big"
+	"sync"
 	"time"
 
 	"github.com/go-kit/kit/log"
@@ -18,6 +25,8 @@ import (
 	"github.com/syncsynchalt/scep/challenge"
 	"github.com/syncsynchalt/scep/csrverifier"
 	"github.com/syncsynchalt/scep/depot"
+	"github.com/syncsynchalt/scep/keyprovider"
+	"github.com/syncsynchalt/scep/profilechooser"
 	"github.com/syncsynchalt/scep/scep"
 	"github.com/syncsynchalt/scep/subjectfilter"
 )
@@ -41,13 +50,25 @@ type Service interface {
 	// when the old one expires. The response format is a PKCS#7 Degenerate
 	// Certificates type.
 	GetNextCACert(ctx context.Context) ([]byte, error)
+
+	// GetCRL returns the current CRL of the CA, DER encoded.
+	GetCRL(ctx context.Context) ([]byte, error)
 }
 
 type service struct {
 	depot                   depot.Depot
 	ca                      []*x509.Certificate // CA cert or chain
-	caKey                   *rsa.PrivateKey
+	caKey                   crypto.Signer
+	raCert                  *x509.Certificate   // decrypts and signs SCEP messages
+	raKey                   crypto.Signer       // the CA key, unless an RA is configured
+	nextCA                  []*x509.Certificate // staged for a CA rollover
+	nextCAKey               crypto.Signer
+	nextCADecrypts          bool                // SCEP messages may be encrypted to the next CA
+	prevCA                  []*x509.Certificate // replaced by the last rollover
+	prevCAKey               crypto.Signer
+	rolloverAt              time.Time // zero to never roll over
 	caKeyPassword           []byte
+	caKeyProvider           keyprovider.KeyProvider // nil to use the depot's key
 	csrTemplate             *x509.Certificate
 	challengePassword       string
 	supportDynamciChallenge bool
@@ -57,8 +78,22 @@ type service struct {
 	certFailer              certfailer.CertFailer
 	caChooser               cachooser.CAChooser
 	subjectFilter           subjectfilter.SubjectFilter
-	allowRenewal            int // days before expiry, 0 to disable
-	clientValidity          int // client cert validity in days
+	pendingStore            depot.PendingStore
+	renewalPolicy           RenewalPolicy
+	extensionPolicy         ExtensionPolicy
+	profiles                map[string]*Profile
+	profileChooser          profilechooser.ProfileChooser
+	allowRenewal            int           // days before expiry, 0 to disable
+	clientValidity          int           // client cert validity in days
+	crlLifetime             time.Duration // 0 if CRLs are disabled
+	crlURLs                 []string      // CRL distribution points
+
+	// caMtx guards the CA, RA, next and previous CA fields, which change at a rollover.
+	caMtx sync.RWMutex
+
+	crlMtx  sync.RWMutex
+	crl     []byte // current DER encoded CRL
+	prevCRL []byte // current CRL of the previous CA
 
 	/// info logging is implemented in the service middleware layer.
 	debugLogger log.Logger
@@ -75,18 +110,29 @@ func (svc *service) SCEPChallenge() (string, error) {
 
 func (svc *service) GetCACaps(ctx context.Context) ([]byte, error) {
 	defaultCaps := []byte("SHA-1\nSHA-256\nAES\nDES3\nSCEPStandard\nPOSTPKIOperation")
+	svc.caMtx.RLock()
+	defer svc.caMtx.RUnlock()
+	if len(svc.nextCA) > 0 {
+		defaultCaps = append(defaultCaps, "\nGetNextCACert"...)
+	}
 	return defaultCaps, nil
 }
 
 func (svc *service) GetCACert(ctx context.Context) ([]byte, int, error) {
+	svc.caMtx.RLock()
+	defer svc.caMtx.RUnlock()
 	if len(svc.ca) == 0 {
 		return nil, 0, errors.New("missing CA Cert")
 	}
-	if len(svc.ca) == 1 {
-		return svc.ca[0].Raw, 1, nil
+	certs := svc.ca
+	if svc.raCert != svc.ca[0] {
+		certs = append(append([]*x509.Certificate{}, svc.ca...), svc.raCert)
 	}
-	data, err := scep.DegenerateCertificates(svc.ca)
-	return data, len(svc.ca), err
+	if len(certs) == 1 {
+		return certs[0].Raw, 1, nil
+	}
+	data, err := scep.DegenerateCertificates(certs)
+	return data, len(certs), err
 }
 
 func (svc *service) PKIOperation(ctx context.Context, data []byte) ([]byte, error) {
@@ -94,13 +140,72 @@ func (svc *service) PKIOperation(ctx context.Context, data []byte) ([]byte, erro
 	if err != nil {
 		return nil, err
 	}
+	svc.caMtx.RLock()
+	defer svc.caMtx.RUnlock()
+	if err := msg.Verify(); err != nil {
+		return svc.badMessageCheck(msg, err)
+	}
 
-	if err := msg.DecryptPKIEnvelope(svc.ca[0], svc.caKey); err != nil {
+	if err := svc.decryptPKIEnvelope(msg); err != nil {
 		return nil, err
 	}
 
+	// an approved request claimed by checkPending is approved again if
+	// its certificate is not issued
+	var claimed, issued bool
+	defer func() {
+		if claimed && !issued {
+			svc.releasePending(string(msg.TransactionID))
+		}
+	}()
+
+	switch msg.MessageType {
+	case scep.PKCSReq, scep.RenewalReq, scep.UpdateReq:
+		if err := msg.VerifyCSR(); err != nil {
+			return svc.badMessageCheck(msg, err)
+		}
+	case scep.CertPoll:
+		// a CertPoll carries no CSR, restore the one from the original
+		// request once it has been approved.
+		if svc.pendingStore == nil {
+			svc.debugLogger.Log("err", "CertPoll received but manual approval is not enabled")
+			certRep, err := msg.Fail(svc.raCert, svc.raKey, scep.BadRequest)
+			if err != nil {
+				return nil, err
+			}
+			return certRep.Raw, nil
+		}
+		pending, err := svc.pendingRequest(msg)
+		if err != nil {
+			return nil, err
+		}
+		certRep, err := svc.checkPending(msg, pending)
+		if err != nil {
+			return nil, err
+		}
+		if certRep != nil {
+			return certRep.Raw, nil
+		}
+		claimed = true
+	case scep.GetCert:
+		certRep, err := svc.getCert(msg)
+		if err != nil {
+			return nil, err
+		}
+		return certRep.Raw, nil
+	case scep.GetCRL:
+		certRep, err := svc.getCRL(ctx, msg)
+		if err != nil {
+			return nil, err
+		}
+		return certRep.Raw, nil
+	}
+
 	if svc.subjectFilter != nil {
-		newSubj, err := svc.subjectFilter.Filter(msg.CSRReqMessage.RawDecrypted)
+		var newSubj *pkix.Name
+		svc.withoutCALock(func() {
+			newSubj, err = svc.subjectFilter.Filter(msg.CSRReqMessage.RawDecrypted)
+		})
 		if err != nil {
 			return nil, err
 		}
@@ -110,7 +215,9 @@ func (svc *service) PKIOperation(ctx context.Context, data []byte) ([]byte, erro
 	signerCa := svc.ca
 	signerCaKey := svc.caKey
 	if svc.caChooser != nil {
-		signerCaKey, signerCa, err = svc.caChooser.Choose(msg.CSRReqMessage.RawDecrypted, svc.caKeyPassword)
+		svc.withoutCALock(func() {
+			signerCaKey, signerCa, err = svc.caChooser.Choose(msg.CSRReqMessage.RawDecrypted, svc.caKeyPassword)
+		})
 		if err != nil {
 			return nil, err
 		}
@@ -119,16 +226,47 @@ func (svc *service) PKIOperation(ctx context.Context, data []byte) ([]byte, erro
 	var callbackErr error = nil
 	defer func() {
 		if callbackErr != nil && svc.certFailer != nil {
-			svc.certFailer.Fail(string(msg.TransactionID), msg.CSRReqMessage.RawDecrypted, callbackErr.Error())
+			svc.withoutCALock(func() {
+				svc.certFailer.Fail(string(msg.TransactionID), msg.CSRReqMessage.RawDecrypted, callbackErr.Error())
+			})
 		}
 	}()
 
+	// the profile is selected first, challenges may be bound to one
+	var profile *Profile
+	svc.withoutCALock(func() {
+		profile, err = svc.profile(ctx, msg)
+	})
+	if err != nil {
+		svc.debugLogger.Log("err", err, "msg", "selecting certificate profile")
+		certRep, err := msg.Fail(svc.raCert, svc.raKey, scep.BadRequest)
+		if err != nil {
+			callbackErr = err
+			return nil, err
+		}
+		return certRep.Raw, nil
+	}
+
+	// a PKCSReq resent for a transaction which is already known was
+	// verified before, its challenge is not used up again
+	var pending *depot.PendingRequest
+	if msg.MessageType == scep.PKCSReq && svc.pendingStore != nil {
+		pending, err = svc.pendingRequest(msg)
+		if err != nil {
+			callbackErr = err
+			return nil, err
+		}
+	}
+
 	// validate challenge passwords
-	if msg.MessageType == scep.PKCSReq {
+	if msg.MessageType == scep.PKCSReq && pending == nil {
 		CSRIsValid := false
 
 		if svc.csrVerifier != nil {
-			result, err := svc.csrVerifier.Verify(string(msg.TransactionID), msg.CSRReqMessage.RawDecrypted)
+			var result bool
+			svc.withoutCALock(func() {
+				result, err = svc.csrVerifier.Verify(string(msg.TransactionID), msg.CSRReqMessage.RawDecrypted)
+			})
 			if err != nil {
 				callbackErr = err
 				return nil, err
@@ -138,14 +276,14 @@ func (svc *service) PKIOperation(ctx context.Context, data []byte) ([]byte, erro
 				svc.debugLogger.Log("err", "CSR is not valid")
 			}
 		} else {
-			CSRIsValid = svc.challengePasswordMatch(msg.CSRReqMessage.ChallengePassword)
+			CSRIsValid = svc.challengePasswordMatch(msg.CSRReqMessage.ChallengePassword, msg.CSRReqMessage.CSR, profile)
 			if !CSRIsValid {
 				svc.debugLogger.Log("err", "scep challenge password does not match")
 			}
 		}
 
 		if !CSRIsValid {
-			certRep, err := msg.Fail(svc.ca[0], svc.caKey, scep.BadRequest)
+			certRep, err := msg.Fail(svc.raCert, svc.raKey, scep.BadRequest)
 			if err != nil {
 				callbackErr = errors.New("CSR is not valid")
 				return nil, err
@@ -153,6 +291,30 @@ func (svc *service) PKIOperation(ctx context.Context, data []byte) ([]byte, erro
 			return certRep.Raw, nil
 		}
 	}
+	if msg.MessageType == scep.PKCSReq && svc.pendingStore != nil {
+		certRep, err := svc.checkPending(msg, pending)
+		if err != nil {
+			callbackErr = err
+			return nil, err
+		}
+		if certRep != nil {
+			return certRep.Raw, nil
+		}
+		claimed = true
+	}
+
+	// renewals are authenticated by the existing certificate
+	renewal := msg.MessageType == scep.RenewalReq || msg.MessageType == scep.UpdateReq
+	if renewal {
+		certRep, err := svc.checkRenewal(msg, signerCa)
+		if err != nil {
+			callbackErr = err
+			return nil, err
+		}
+		if certRep != nil {
+			return certRep.Raw, nil
+		}
+	}
 
 	csr := msg.CSRReqMessage.CSR
 	id, err := generateSubjectKeyID(csr.PublicKey)
@@ -167,23 +329,37 @@ func (svc *service) PKIOperation(ctx context.Context, data []byte) ([]byte, erro
 		return nil, err
 	}
 
-	duration := svc.clientValidity
-
-	// create cert template
+	// create cert template, the profile sets its usage and validity
 	tmpl := &x509.Certificate{
-		SerialNumber: serial,
-		Subject:      csr.Subject,
-		NotBefore:    time.Now().Add(-600).UTC(),
-		NotAfter:     time.Now().AddDate(0, 0, duration).UTC(),
-		SubjectKeyId: id,
-		KeyUsage:     x509.KeyUsageDigitalSignature,
-		ExtKeyUsage: []x509.ExtKeyUsage{
-			x509.ExtKeyUsageClientAuth,
-		},
-		SignatureAlgorithm: csr.SignatureAlgorithm,
-	}
-
-	certRep, err := msg.SignCSR(svc.ca[0], svc.caKey, signerCa[0], signerCaKey, tmpl)
+		SerialNumber:          serial,
+		Subject:               csr.Subject,
+		NotBefore:             time.Now().Add(-600).UTC(),
+		SubjectKeyId:          id,
+		SignatureAlgorithm:    signatureAlgorithm(csr.SignatureAlgorithm, signerCaKey),
+		CRLDistributionPoints: svc.crlURLs,
+	}
+	if err := svc.extensionPolicy.apply(csr, tmpl); err != nil {
+		svc.debugLogger.Log("err", err, "msg", "CSR refused by the extension policy")
+		certRep, err := msg.Fail(svc.raCert, svc.raKey, scep.BadRequest)
+		if err != nil {
+			callbackErr = err
+			return nil, err
+		}
+		return certRep.Raw, nil
+	}
+	if renewal {
+		certRep, err := svc.checkRenewedNames(msg, tmpl)
+		if err != nil {
+			callbackErr = err
+			return nil, err
+		}
+		if certRep != nil {
+			return certRep.Raw, nil
+		}
+	}
+	profile.apply(tmpl, svc.clientValidity)
+
+	certRep, err := msg.SignCSR(svc.raCert, svc.raKey, signerCa[0], signerCaKey, tmpl)
 	if err != nil {
 		callbackErr = err
 		return nil, err
@@ -201,44 +377,220 @@ func (svc *service) PKIOperation(ctx context.Context, data []byte) ([]byte, erro
 		return nil, err
 	}
 
-	if err := svc.depot.Put(name, crt); err != nil {
+	// the certificate is only recorded as issued once it is approved,
+	// a FAILURE is answered if it is rolled back
+	if err := svc.commit(msg, name, crt, renewal); err != nil {
 		callbackErr = err
+		svc.debugLogger.Log("err", err, "msg", "certificate not issued", "transaction_id", msg.TransactionID)
+		certRep, err := msg.Fail(svc.raCert, svc.raKey, scep.BadRequest)
+		if err != nil {
+			return nil, err
+		}
+		return certRep.Raw, nil
+	}
+
+	issued = true
+	return certRep.Raw, nil
+}
+
+// withoutCALock calls a hook with caMtx, which the caller holds for
+// reading, released, so that slow hooks and their retries do not hold up
+// a CA rollover. The CA may have rolled over when the hook returns.
+func (svc *service) withoutCALock(hook func()) {
+	svc.caMtx.RUnlock()
+	defer svc.caMtx.RLock()
+	hook()
+}
+
+// badMessageCheck answers a message which failed verification.
+func (svc *service) badMessageCheck(msg *scep.PKIMessage, err error) ([]byte, error) {
+	svc.debugLogger.Log("err", err, "msg", "rejecting pkiMessage", "transaction_id", msg.TransactionID)
+	certRep, err := msg.Fail(svc.raCert, svc.raKey, scep.BadMessageCheck)
+	if err != nil {
+		return nil, err
+	}
+	return certRep.Raw, nil
+}
+
+// pendingRequest returns the stored request of the transaction, or nil
+// if there is none.
+func (svc *service) pendingRequest(msg *scep.PKIMessage) (*depot.PendingRequest, error) {
+	req, err := svc.pendingStore.Pending(string(msg.TransactionID))
+	if err == depot.ErrNotFound {
+		return nil, nil
+	}
+	return req, err
+}
+
+// checkPending answers a request or poll for a transaction held for
+// manual approval, with req its stored request or nil if there is none.
+// It returns a CertRep to send back to the client, or nil if the request
+// was approved and claimed, and the certificate should be issued. For a
+// CertPoll the CSR of the approved request is restored into msg.
+func (svc *service) checkPending(msg *scep.PKIMessage, req *depot.PendingRequest) (*scep.PKIMessage, error) {
+	tid := string(msg.TransactionID)
+	if req == nil {
+		if msg.MessageType == scep.CertPoll {
+			svc.debugLogger.Log("err", "no pending request for transaction", "transaction_id", tid)
+			return msg.Fail(svc.raCert, svc.raKey, scep.BadCertID)
+		}
+		if err := svc.pendingStore.PutPending(tid, msg.CSRReqMessage.RawDecrypted); err != nil {
+			return nil, err
+		}
+		return msg.Pending(svc.raCert, svc.raKey)
+	}
+
+	// only the requester may poll or resend, with the key of its CSR
+	csr, err := x509.ParseCertificateRequest(req.CSR)
+	if err != nil {
 		return nil, err
 	}
+	requester := msg.SignerCert.RawSubjectPublicKeyInfo
+	if msg.MessageType == scep.PKCSReq {
+		requester = msg.CSRReqMessage.CSR.RawSubjectPublicKeyInfo
+	}
+	if !bytes.Equal(requester, csr.RawSubjectPublicKeyInfo) {
+		svc.debugLogger.Log("err", "key does not match the pending request", "transaction_id", tid)
+		return msg.Fail(svc.raCert, svc.raKey, scep.BadRequest)
+	}
 
-	if svc.certSuccesser != nil {
-		certfile, err := svc.depot.CertFilename(name, crt)
+	switch req.Status {
+	case depot.StatusApproved:
+		claimed, err := svc.claimPending(tid)
 		if err != nil {
-			callbackErr = err
 			return nil, err
 		}
-		result, err := svc.certSuccesser.Success(string(msg.TransactionID), msg.CSRReqMessage.RawDecrypted, certfile)
+		if !claimed {
+			// a concurrent poll or request issues the certificate
+			return svc.issuedCert(msg, csr)
+		}
+		if msg.MessageType == scep.CertPoll {
+			msg.CSRReqMessage = &scep.CSRReqMessage{
+				RawDecrypted: req.CSR,
+				CSR:          csr,
+			}
+		}
+		return nil, nil
+	case depot.StatusIssued:
+		return svc.issuedCert(msg, csr)
+	case depot.StatusRejected:
+		return msg.Fail(svc.raCert, svc.raKey, scep.BadRequest)
+	default:
+		return msg.Pending(svc.raCert, svc.raKey)
+	}
+}
+
+// claimPending marks an approved request as issued before its certificate
+// is signed, and reports false if a concurrent poll or request did first.
+// The claim is released by releasePending if no certificate is issued.
+func (svc *service) claimPending(tid string) (bool, error) {
+	swapper, ok := svc.pendingStore.(depot.PendingSwapper)
+	if !ok {
+		return true, nil
+	}
+	return swapper.SwapPendingStatus(tid, depot.StatusApproved, depot.StatusIssued)
+}
+
+// releasePending approves a claimed request again, so that the next poll
+// retries the issuance.
+func (svc *service) releasePending(tid string) {
+	swapper, ok := svc.pendingStore.(depot.PendingSwapper)
+	if !ok {
+		return
+	}
+	if _, err := swapper.SwapPendingStatus(tid, depot.StatusIssued, depot.StatusApproved); err != nil {
+		svc.debugLogger.Log("err", err, "msg", "releasing pending request", "transaction_id", tid)
+	}
+}
+
+// issuedCert answers a retransmitted poll or request of an issued
+// transaction with the certificate issued for the key of csr. The request
+// is claimed before its certificate is stored, until then the client is
+// told to poll again.
+func (svc *service) issuedCert(msg *scep.PKIMessage, csr *x509.CertificateRequest) (*scep.PKIMessage, error) {
+	var issued *x509.Certificate
+	repo, _ := svc.depot.(depot.Repository)
+	if repo != nil {
+		hash := sha256.Sum256(csr.RawSubjectPublicKeyInfo)
+		records, err := repo.List(depot.CertFilter{
+			CN:            csr.Subject.CommonName,
+			Status:        depot.CertValid,
+			PublicKeyHash: hash[:],
+		})
 		if err != nil {
-			callbackErr = err
 			return nil, err
 		}
-		CertIsSuccessful := result
-		if !CertIsSuccessful {
-			callbackErr = errors.New("CertSuccesser denied the cert")
-			svc.debugLogger.Log("err", "CertSuccesser denied the cert")
+		for _, r := range records {
+			if issued == nil || r.Certificate.NotBefore.After(issued.NotBefore) {
+				issued = r.Certificate
+			}
 		}
 	}
+	if issued == nil && repo != nil {
+		return msg.Pending(svc.raCert, svc.raKey)
+	}
+	if issued == nil {
+		svc.debugLogger.Log("err", "issued certificate not found", "transaction_id", msg.TransactionID)
+		return msg.Fail(svc.raCert, svc.raKey, scep.BadCertID)
+	}
+	return msg.Success(svc.raCert, svc.raKey, []*x509.Certificate{issued})
+}
 
-	return certRep.Raw, nil
+// getCert answers a GetCert request with a previously issued certificate.
+func (svc *service) getCert(msg *scep.PKIMessage) (*scep.PKIMessage, error) {
+	getter, ok := svc.depot.(depot.CertGetter)
+	if !ok {
+		svc.debugLogger.Log("err", "GetCert received but depot does not support certificate lookup")
+		return msg.Fail(svc.raCert, svc.raKey, scep.BadRequest)
+	}
+
+	req := msg.GetCertMessage
+	crt, err := getter.GetCert(req.SerialNumber)
+	if err == depot.ErrNotFound {
+		svc.debugLogger.Log("err", "no certificate for serial", "serial", req.SerialNumber)
+		return msg.Fail(svc.raCert, svc.raKey, scep.BadCertID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if crt.Issuer.String() != req.Issuer.String() {
+		svc.debugLogger.Log("err", "certificate issuer does not match GetCert request", "serial", req.SerialNumber)
+		return msg.Fail(svc.raCert, svc.raKey, scep.BadCertID)
+	}
+	return msg.Success(svc.raCert, svc.raKey, []*x509.Certificate{crt})
+}
+
+// signatureAlgorithm returns the signature algorithm of the CSR if it can
+// be used with the CA key, or zero to let x509 pick the default for the key.
+func signatureAlgorithm(csrAlgo x509.SignatureAlgorithm, key crypto.Signer) x509.SignatureAlgorithm {
+	switch key.Public().(type) {
+	case *rsa.PublicKey:
+		switch csrAlgo {
+		case x509.SHA1WithRSA, x509.SHA256WithRSA, x509.SHA384WithRSA, x509.SHA512WithRSA:
+			return csrAlgo
+		}
+	case *ecdsa.PublicKey:
+		switch csrAlgo {
+		case x509.ECDSAWithSHA256, x509.ECDSAWithSHA384, x509.ECDSAWithSHA512:
+			return csrAlgo
+		}
+	}
+	return 0
 }
 
+// certName returns the name under which crt is stored, its CN or else
+// the hex encoded hash of its signature.
 func certName(crt *x509.Certificate) string {
 	if crt.Subject.CommonName != "" {
 		return crt.Subject.CommonName
 	}
-	return string(crt.Signature)
-}
-
-func (svc *service) GetNextCACert(ctx context.Context) ([]byte, error) {
-	panic("not implemented")
+	sum := sha256.Sum256(crt.Signature)
+	return hex.EncodeToString(sum[:])
 }
 
-func (svc *service) challengePasswordMatch(pw string) bool {
+// challengePasswordMatch checks the challenge password of a request for
+// csr with the profile, and uses a dynamic challenge.
+func (svc *service) challengePasswordMatch(pw string, csr *x509.CertificateRequest, profile *Profile) bool {
 	if svc.challengePassword == "" && !svc.supportDynamciChallenge {
 		// empty password, don't validate
 		return true
@@ -247,6 +599,14 @@ func (svc *service) challengePasswordMatch(pw string) bool {
 		return true
 	}
 
+	if store, ok := svc.dynamicChallengeStore.(challenge.BindingStore); ok {
+		valid, err := store.UseChallenge(pw, challengeRequest(csr, profile))
+		if err != nil {
+			svc.debugLogger.Log("err", err)
+			return false
+		}
+		return valid
+	}
 	if svc.supportDynamciChallenge {
 		valid, err := svc.dynamicChallengeStore.HasChallenge(pw)
 		if err != nil {
@@ -259,6 +619,39 @@ func (svc *service) challengePasswordMatch(pw string) bool {
 	return false
 }
 
+// challengeRequest describes the request for csr with the profile to a
+// challenge store.
+func challengeRequest(csr *x509.CertificateRequest, profile *Profile) challenge.Request {
+	r := challenge.Request{
+		CN:             csr.Subject.CommonName,
+		Subject:        csr.Subject.String(),
+		Profile:        profile.Name,
+		DNSNames:       csr.DNSNames,
+		EmailAddresses: csr.EmailAddresses,
+	}
+	for _, ip := range csr.IPAddresses {
+		r.IPAddresses = append(r.IPAddresses, ip.String())
+	}
+	for _, uri := range csr.URIs {
+		r.URIs = append(r.URIs, uri.String())
+	}
+	return r
+}
+
+// challengePurgeInterval is how often expired challenges are removed.
+const challengePurgeInterval = 10 * time.Minute
+
+// purgeChallenges removes expired challenges from the store.
+func (svc *service) purgeChallenges(store challenge.BindingStore) {
+	ticker := time.NewTicker(challengePurgeInterval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		if _, err := store.Purge(now); err != nil {
+			svc.debugLogger.Log("err", err, "msg", "purging expired challenges")
+		}
+	}
+}
+
 // ServiceOption is a server configuration option
 type ServiceOption func(*service) error
 
@@ -325,6 +718,16 @@ func CAKeyPassword(pw []byte) ServiceOption {
 	}
 }
 
+// WithCAKeyProvider is an option argument to NewService which loads the
+// CA key from provider instead of the depot, e.g. from an HSM. The depot
+// must implement depot.CACertDepot.
+func WithCAKeyProvider(provider keyprovider.KeyProvider) ServiceOption {
+	return func(s *service) error {
+		s.caKeyProvider = provider
+		return nil
+	}
+}
+
 // allowRenewal sets the days before expiry which we are allowed to renew (optional)
 func AllowRenewal(duration int) ServiceOption {
 	return func(s *service) error {
@@ -350,6 +753,20 @@ func WithLogger(logger log.Logger) ServiceOption {
 	}
 }
 
+// WithManualApproval is an option argument to NewService which holds
+// PKCSReq requests in the store until they are approved.
+// Clients are answered with a PENDING status and poll for the
+// result using CertPoll messages.
+func WithManualApproval(store depot.PendingStore) ServiceOption {
+	return func(s *service) error {
+		s.pendingStore = store
+		return nil
+	}
+}
+
+// WithDynamicChallenges is an option argument to NewService which
+// requires the challenges of the store. The expired challenges of a
+// challenge.BindingStore are purged in the background.
 func WithDynamicChallenges(cache challenge.Store) ServiceOption {
 	return func(s *service) error {
 		s.supportDynamciChallenge = true
@@ -370,14 +787,80 @@ func NewService(depot depot.Depot, opts ...ServiceOption) (Service, error) {
 		}
 	}
 
-	var err error
-	s.ca, s.caKey, err = depot.CA(s.caKeyPassword)
-	if err != nil {
+	if err := s.loadCA(); err != nil {
+		return nil, err
+	}
+	if err := s.loadRA(); err != nil {
+		return nil, err
+	}
+	if err := s.loadNextCA(); err != nil {
+		return nil, err
+	}
+	if err := s.loadPreviousCA(); err != nil {
 		return nil, err
 	}
+	s.scheduleRollover()
+
+	if s.crlLifetime != 0 {
+		if err := s.updateCRL(); err != nil {
+			return nil, err
+		}
+		go s.refreshCRL()
+	}
+	if store, ok := s.dynamicChallengeStore.(challenge.BindingStore); ok {
+		go s.purgeChallenges(store)
+	}
 	return s, nil
 }
 
+// loadCA loads the CA certificates and key from the depot, or only the
+// certificates if the key comes from a key provider.
+func (s *service) loadCA() error {
+	if s.caKeyProvider == nil {
+		var err error
+		s.ca, s.caKey, err = s.depot.CA(s.caKeyPassword)
+		return err
+	}
+	certDepot, ok := s.depot.(depot.CACertDepot)
+	if !ok {
+		return errors.New("depot can not load the CA certificates without the CA key")
+	}
+	ca, err := certDepot.CACerts()
+	if err != nil {
+		return err
+	}
+	key, err := s.caKeyProvider.CAKey(s.caKeyPassword)
+	if err != nil {
+		return err
+	}
+	pub, ok := ca[0].PublicKey.(interface{ Equal(crypto.PublicKey) bool })
+	if !ok || !pub.Equal(key.Public()) {
+		return errors.New("CA key does not match the CA certificate")
+	}
+	s.ca, s.caKey = ca, key
+	return nil
+}
+
+// loadRA sets up the certificate and key used for SCEP messages.
+// SCEP messages use RSA key transport, so a CA with another key type
+// needs an RSA RA certificate.
+func (s *service) loadRA() error {
+	s.raCert, s.raKey = s.ca[0], s.caKey
+	if raDepot, ok := s.depot.(depot.RADepot); ok {
+		raCert, raKey, err := raDepot.RA(s.caKeyPassword)
+		if err != nil {
+			return err
+		}
+		if raCert != nil {
+			s.raCert, s.raKey = raCert, raKey
+		}
+	}
+	if _, ok := s.raKey.(crypto.Decrypter); !ok || s.raCert.PublicKeyAlgorithm != x509.RSA {
+		return errors.New("CA key can not decrypt SCEP messages, an RSA RA certificate is required")
+	}
+	return nil
+}
+
 // rsaPublicKey reflects the ASN.1 structure of a PKCS#1 public key.
 type rsaPublicKey struct {
 	N *big.Int
@@ -398,8 +881,10 @@ func generateSubjectKeyID(pub crypto.PublicKey) ([]byte, error) {
 		if err != nil {
 			return nil, err
 		}
+	case *ecdsa.PublicKey:
+		pubBytes = elliptic.Marshal(pub.Curve, pub.X, pub.Y)
 	default:
-		return nil, errors.New("only RSA public key is supported")
+		return nil, errors.New("only RSA and ECDSA public keys are supported")
 	}
 
 	hash := sha1.Sum(pubBytes)
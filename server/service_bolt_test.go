@@ -3,19 +3,29 @@ package scepserver
 import (
 	"bytes"
 	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
 	"crypto/x509/pkix"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"math/big"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"testing"
 	"time"
 
 	"github.com/boltdb/bolt"
+	"github.com/go-kit/kit/log"
+	scepchallenge "github.com/syncsynchalt/scep/challenge"
 	challengestore "github.com/syncsynchalt/scep/challenge/bolt"
+	"github.com/syncsynchalt/scep/crypto/x509util"
+	scepdepot "github.com/syncsynchalt/scep/depot"
 	boltdepot "github.com/syncsynchalt/scep/depot/bolt"
 	"github.com/syncsynchalt/scep/scep"
 )
@@ -51,13 +61,45 @@ func TestDynamicChallenge(t *testing.T) {
 	}
 
 	impl := svc.(*service)
-	if !impl.challengePasswordMatch(challenge) {
+	csr := &x509.CertificateRequest{Subject: pkix.Name{CommonName: "device", Organization: []string{"acme"}}}
+	if !impl.challengePasswordMatch(challenge, csr, builtinProfile) {
 		t.Errorf("challenge password does not match")
 	}
-	if impl.challengePasswordMatch(challenge) {
+	if impl.challengePasswordMatch(challenge, csr, builtinProfile) {
 		t.Errorf("challenge password matched but should only be used once")
 	}
 
+	bound, err := challengeDepot.NewChallenge(scepchallenge.Options{
+		Binding: scepchallenge.Binding{CN: "device", SubjectPattern: "CN=device,O=.*", Profile: defaultProfileName},
+		Uses:    2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := &x509.CertificateRequest{Subject: pkix.Name{CommonName: "other", Organization: []string{"acme"}}}
+	if impl.challengePasswordMatch(bound, other, builtinProfile) {
+		t.Error("challenge bound to CN device matched CN other")
+	}
+	if impl.challengePasswordMatch(bound, csr, &Profile{Name: "server"}) {
+		t.Error("challenge bound to the default profile matched profile server")
+	}
+	for i := 0; i < 2; i++ {
+		if !impl.challengePasswordMatch(bound, csr, builtinProfile) {
+			t.Errorf("use %d of the bound challenge does not match", i+1)
+		}
+	}
+	if impl.challengePasswordMatch(bound, csr, builtinProfile) {
+		t.Error("challenge matched after its last use")
+	}
+
+	expiring, err := challengeDepot.NewChallenge(scepchallenge.Options{TTL: time.Nanosecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond)
+	if impl.challengePasswordMatch(expiring, csr, builtinProfile) {
+		t.Error("expired challenge matched")
+	}
 }
 
 func TestCaCert(t *testing.T) {
@@ -137,6 +179,745 @@ func TestCaCert(t *testing.T) {
 
 }
 
+func TestManualApproval(t *testing.T) {
+	depot := createDB(0666, nil)
+	key, err := depot.CreateOrLoadKey(2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, err := depot.CreateOrLoadCA(key, 5, "MicroMDM", "US")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts := []ServiceOption{
+		ClientValidity(365),
+		WithManualApproval(depot),
+	}
+	svc, err := NewService(depot, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	selfKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csrBytes, err := newCSR(selfKey, "ou", "loc", "province", "country", "cname", "org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.ParseCertificateRequest(csrBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signerCert, err := selfSign(selfKey, csr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &scep.PKIMessage{
+		MessageType: scep.PKCSReq,
+		Recipients:  []*x509.Certificate{caCert},
+		SignerKey:   selfKey,
+		SignerCert:  signerCert,
+	}
+
+	ctx := context.Background()
+	pkiOperation := func(msg *scep.PKIMessage) *scep.PKIMessage {
+		t.Helper()
+		data, err := svc.PKIOperation(ctx, msg.Raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := scep.ParsePKIMessage(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	msg, err := scep.NewCSRRequest(csr, tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := pkiOperation(msg).PKIStatus, scep.PKIStatus(scep.PENDING); have != want {
+		t.Fatalf("PKCSReq: have %s, want %s", have, want)
+	}
+
+	poll, err := scep.NewCertPollRequest(csr, caCert, tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := pkiOperation(poll).PKIStatus, scep.PKIStatus(scep.PENDING); have != want {
+		t.Fatalf("CertPoll before approval: have %s, want %s", have, want)
+	}
+
+	if err := depot.SetPendingStatus(string(msg.TransactionID), scepdepot.StatusApproved); err != nil {
+		t.Fatal(err)
+	}
+
+	resp := pkiOperation(poll)
+	if have, want := resp.PKIStatus, scep.SUCCESS; have != want {
+		t.Fatalf("CertPoll after approval: have %s, want %s", have, want)
+	}
+	if err := resp.DecryptPKIEnvelope(signerCert, selfKey); err != nil {
+		t.Fatal(err)
+	}
+	if have, want := resp.CertRepMessage.Certificate.Subject.CommonName, "cname"; have != want {
+		t.Errorf("have %s, want %s", have, want)
+	}
+
+	// the transaction is complete, retransmitted polls get the certificate
+	issued := resp.CertRepMessage.Certificate
+	resp = pkiOperation(poll)
+	if have, want := resp.PKIStatus, scep.SUCCESS; have != want {
+		t.Fatalf("CertPoll after issuance: have %s, want %s", have, want)
+	}
+	if err := resp.DecryptPKIEnvelope(signerCert, selfKey); err != nil {
+		t.Fatal(err)
+	}
+	if have, want := resp.CertRepMessage.Certificate.SerialNumber, issued.SerialNumber; have.Cmp(want) != 0 {
+		t.Errorf("have serial %s, want %s", have, want)
+	}
+}
+
+func TestManualApprovalRetransmit(t *testing.T) {
+	depot := createDB(0666, nil)
+	key, err := depot.CreateOrLoadKey(2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, err := depot.CreateOrLoadCA(key, 5, "MicroMDM", "US")
+	if err != nil {
+		t.Fatal(err)
+	}
+	challengeDepot := createChallengeStore(0666, nil)
+	svc, err := NewService(depot,
+		ClientValidity(365),
+		WithManualApproval(depot),
+		WithDynamicChallenges(challengeDepot),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	challenge, err := challengeDepot.SCEPChallenge()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	selfKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csrBytes, err := x509util.CreateCertificateRequest(rand.Reader, &x509util.CertificateRequest{
+		CertificateRequest: x509.CertificateRequest{Subject: pkix.Name{CommonName: "retransmit"}},
+		ChallengePassword:  challenge,
+	}, selfKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.ParseCertificateRequest(csrBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signerCert, err := selfSign(selfKey, csr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &scep.PKIMessage{
+		MessageType: scep.PKCSReq,
+		Recipients:  []*x509.Certificate{caCert},
+		SignerKey:   selfKey,
+		SignerCert:  signerCert,
+	}
+	pkiOperation := func(msg *scep.PKIMessage) *scep.PKIMessage {
+		t.Helper()
+		data, err := svc.PKIOperation(context.Background(), msg.Raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := scep.ParsePKIMessage(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	msg, err := scep.NewCSRRequest(csr, tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if have, want := pkiOperation(msg).PKIStatus, scep.PKIStatus(scep.PENDING); have != want {
+			t.Fatalf("PKCSReq %d: have %s, want %s", i+1, have, want)
+		}
+	}
+
+	// a poll signed with another key is refused
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherCert, err := selfSign(otherKey, csr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := scep.NewCertPollRequest(csr, caCert, &scep.PKIMessage{
+		TransactionID: msg.TransactionID,
+		Recipients:    []*x509.Certificate{caCert},
+		SignerKey:     otherKey,
+		SignerCert:    otherCert,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := pkiOperation(other)
+	if have, want := resp.PKIStatus, scep.PKIStatus(scep.FAILURE); have != want {
+		t.Fatalf("CertPoll with another key: have %s, want %s", have, want)
+	}
+
+	if err := depot.SetPendingStatus(string(msg.TransactionID), scepdepot.StatusApproved); err != nil {
+		t.Fatal(err)
+	}
+	var serial *big.Int
+	for i := 0; i < 2; i++ {
+		resp := pkiOperation(msg)
+		if have, want := resp.PKIStatus, scep.SUCCESS; have != want {
+			t.Fatalf("PKCSReq %d after approval: have %s, want %s", i+1, have, want)
+		}
+		if err := resp.DecryptPKIEnvelope(signerCert, selfKey); err != nil {
+			t.Fatal(err)
+		}
+		crt := resp.CertRepMessage.Certificate
+		if serial != nil && crt.SerialNumber.Cmp(serial) != 0 {
+			t.Errorf("resent PKCSReq: have serial %s, want %s", crt.SerialNumber, serial)
+		}
+		serial = crt.SerialNumber
+	}
+}
+
+func TestGetCert(t *testing.T) {
+	depot := createDB(0666, nil)
+	key, err := depot.CreateOrLoadKey(2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, err := depot.CreateOrLoadCA(key, 5, "MicroMDM", "US")
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc, err := NewService(depot, ClientValidity(365))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	selfKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csrBytes, err := newCSR(selfKey, "ou", "loc", "province", "country", "cname", "org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.ParseCertificateRequest(csrBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signerCert, err := selfSign(selfKey, csr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &scep.PKIMessage{
+		MessageType: scep.PKCSReq,
+		Recipients:  []*x509.Certificate{caCert},
+		SignerKey:   selfKey,
+		SignerCert:  signerCert,
+	}
+
+	ctx := context.Background()
+	pkiOperation := func(msg *scep.PKIMessage) *scep.PKIMessage {
+		t.Helper()
+		data, err := svc.PKIOperation(ctx, msg.Raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := scep.ParsePKIMessage(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.PKIStatus == scep.SUCCESS {
+			if err := resp.DecryptPKIEnvelope(signerCert, selfKey); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return resp
+	}
+
+	msg, err := scep.NewCSRRequest(csr, tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issued := pkiOperation(msg).CertRepMessage.Certificate
+
+	getCert, err := scep.NewGetCertRequest(caCert, issued.SerialNumber, tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp := pkiOperation(getCert)
+	if have, want := resp.PKIStatus, scep.SUCCESS; have != want {
+		t.Fatalf("have %s, want %s", have, want)
+	}
+	if !bytes.Equal(resp.CertRepMessage.Certificate.Raw, issued.Raw) {
+		t.Errorf("GetCert returned a different certificate")
+	}
+
+	getCert, err = scep.NewGetCertRequest(caCert, big.NewInt(1000), tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp = pkiOperation(getCert)
+	if have, want := resp.PKIStatus, scep.PKIStatus(scep.FAILURE); have != want {
+		t.Fatalf("unknown serial: have %s, want %s", have, want)
+	}
+	if have, want := resp.FailInfo, scep.FailInfo(scep.BadCertID); have != want {
+		t.Errorf("have %s, want %s", have, want)
+	}
+}
+
+func TestBadMessageCheck(t *testing.T) {
+	depot := createDB(0666, nil)
+	key, err := depot.CreateOrLoadKey(2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, err := depot.CreateOrLoadCA(key, 5, "MicroMDM", "US")
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc, err := NewService(depot, ClientValidity(365))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	selfKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csrBytes, err := newCSR(selfKey, "ou", "loc", "province", "country", "cname", "org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.ParseCertificateRequest(csrBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the message is signed by a key which does not belong to the CSR
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signerCert, err := selfSign(otherKey, csr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := scep.NewCSRRequest(csr, &scep.PKIMessage{
+		MessageType: scep.PKCSReq,
+		Recipients:  []*x509.Certificate{caCert},
+		SignerKey:   otherKey,
+		SignerCert:  signerCert,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := svc.PKIOperation(context.Background(), msg.Raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := scep.ParsePKIMessage(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := resp.PKIStatus, scep.PKIStatus(scep.FAILURE); have != want {
+		t.Fatalf("have %s, want %s", have, want)
+	}
+	if have, want := resp.FailInfo, scep.FailInfo(scep.BadMessageCheck); have != want {
+		t.Errorf("have %s, want %s", have, want)
+	}
+	serial, err := depot.Serial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := serial.Int64(), int64(2); have != want {
+		t.Errorf("certificate was issued: serial is %d, want %d", have, want)
+	}
+}
+
+// revokingDepot adds a fixed list of revoked certificates to a bolt depot.
+type revokingDepot struct {
+	*boltdepot.Depot
+	revoked []pkix.RevokedCertificate
+}
+
+func (d *revokingDepot) RevokedCerts() ([]pkix.RevokedCertificate, error) {
+	return d.revoked, nil
+}
+
+func TestCRL(t *testing.T) {
+	db := createDB(0666, nil)
+	key, err := db.CreateOrLoadKey(2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, err := db.CreateOrLoadCA(key, 5, "MicroMDM", "US")
+	if err != nil {
+		t.Fatal(err)
+	}
+	revokedSerial := big.NewInt(42)
+	depot := &revokingDepot{
+		Depot: db,
+		revoked: []pkix.RevokedCertificate{
+			{SerialNumber: revokedSerial, RevocationTime: time.Now().UTC()},
+		},
+	}
+	svc, err := NewService(depot, WithCRL(time.Hour), CRLDistributionPoints("http://example.com/crl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	selfKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csrBytes, err := newCSR(selfKey, "ou", "loc", "province", "country", "cname", "org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.ParseCertificateRequest(csrBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signerCert, err := selfSign(selfKey, csr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &scep.PKIMessage{
+		MessageType: scep.PKCSReq,
+		Recipients:  []*x509.Certificate{caCert},
+		SignerKey:   selfKey,
+		SignerCert:  signerCert,
+	}
+
+	ctx := context.Background()
+	pkiOperation := func(msg *scep.PKIMessage) *scep.PKIMessage {
+		t.Helper()
+		data, err := svc.PKIOperation(ctx, msg.Raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := scep.ParsePKIMessage(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.PKIStatus != scep.SUCCESS {
+			t.Fatalf("have %s, want %s", resp.PKIStatus, scep.SUCCESS)
+		}
+		if err := resp.DecryptPKIEnvelope(signerCert, selfKey); err != nil {
+			t.Fatal(err)
+		}
+		return resp
+	}
+
+	msg, err := scep.NewCSRRequest(csr, tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	issued := pkiOperation(msg).CertRepMessage.Certificate
+	if have, want := issued.CRLDistributionPoints, []string{"http://example.com/crl"}; len(have) != 1 || have[0] != want[0] {
+		t.Errorf("have %v, want %v", have, want)
+	}
+
+	getCRL, err := scep.NewGetCRLRequest(caCert, issued.SerialNumber, tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crl := pkiOperation(getCRL).CertRepMessage.CRL
+	if crl == nil {
+		t.Fatal("GetCRL response does not contain a CRL")
+	}
+	if err := caCert.CheckCRLSignature(crl); err != nil {
+		t.Fatal(err)
+	}
+	entries := crl.TBSCertList.RevokedCertificates
+	if len(entries) != 1 || entries[0].SerialNumber.Cmp(revokedSerial) != 0 {
+		t.Errorf("CRL does not list the revoked serial %s", revokedSerial)
+	}
+
+	// the same CRL is served over plain HTTP
+	server := httptest.NewServer(MakeHTTPHandler(MakeServerEndpoints(svc), svc, log.NewNopLogger()))
+	defer server.Close()
+	resp, err := http.Get(server.URL + "/crl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if have, want := resp.Header.Get("Content-Type"), "application/pkix-crl"; have != want {
+		t.Errorf("have %s, want %s", have, want)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := x509.ParseRevocationList(body); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// ecdsaDepot replaces the CA of a bolt depot with an ECDSA CA and RSA RA.
+type ecdsaDepot struct {
+	*boltdepot.Depot
+	ca    *x509.Certificate
+	caKey *ecdsa.PrivateKey
+	ra    *x509.Certificate
+	raKey *rsa.PrivateKey
+}
+
+func (d *ecdsaDepot) CA(pass []byte) ([]*x509.Certificate, crypto.Signer, error) {
+	return []*x509.Certificate{d.ca}, d.caKey, nil
+}
+
+func (d *ecdsaDepot) RA(pass []byte) (*x509.Certificate, *rsa.PrivateKey, error) {
+	return d.ra, d.raKey, nil
+}
+
+func TestECDSA(t *testing.T) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ECDSA CA"},
+		NotBefore:             time.Now().Add(-600).UTC(),
+		NotAfter:              time.Now().AddDate(1, 0, 0).UTC(),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caCert := createCert(t, caTmpl, caTmpl, caKey.Public(), caKey)
+	raKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	raTmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "SCEP RA"},
+		NotBefore:    time.Now().Add(-600).UTC(),
+		NotAfter:     time.Now().AddDate(1, 0, 0).UTC(),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+	}
+	raCert := createCert(t, raTmpl, caCert, raKey.Public(), caKey)
+
+	depot := &ecdsaDepot{createDB(0666, nil), caCert, caKey, raCert, raKey}
+	svc, err := NewService(depot, ClientValidity(365))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	caBytes, num, err := svc.GetCACert(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := num, 2; have != want {
+		t.Fatalf("have %d, want %d", have, want)
+	}
+	certs, err := scep.CACerts(caBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// an ECDSA client, with an RSA certificate to receive the response
+	clientKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csrBytes, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: "ecdsa client"},
+	}, clientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.ParseCertificateRequest(csrBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signerTmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: "SCEP SIGNER"},
+		NotBefore:    time.Now().Add(-600).UTC(),
+		NotAfter:     time.Now().Add(time.Hour).UTC(),
+	}
+	signerCert := createCert(t, signerTmpl, signerTmpl, clientKey.Public(), clientKey)
+	transportKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	transportCert, err := selfSign(transportKey, csr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &scep.PKIMessage{
+		MessageType:    scep.PKCSReq,
+		Recipients:     certs,
+		SignerKey:      clientKey,
+		SignerCert:     signerCert,
+		EncryptionCert: transportCert,
+	}
+	msg, err := scep.NewCSRRequest(csr, tmpl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := svc.PKIOperation(ctx, msg.Raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := scep.ParsePKIMessage(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := resp.PKIStatus, scep.SUCCESS; have != want {
+		t.Fatalf("have %s, want %s", have, want)
+	}
+	if err := resp.DecryptPKIEnvelope(transportCert, transportKey); err != nil {
+		t.Fatal(err)
+	}
+	crt := resp.CertRepMessage.Certificate
+	if err := crt.CheckSignatureFrom(caCert); err != nil {
+		t.Fatal(err)
+	}
+	if have, want := crt.PublicKeyAlgorithm, x509.ECDSA; have != want {
+		t.Errorf("have %s, want %s", have, want)
+	}
+}
+
+// opaqueKey hides the private key behind crypto.Signer and crypto.Decrypter,
+// like a key held in an HSM.
+type opaqueKey struct {
+	crypto.Signer
+	crypto.Decrypter
+}
+
+func (k opaqueKey) Public() crypto.PublicKey {
+	return k.Signer.Public()
+}
+
+type keyProviderFunc func(pass []byte) (crypto.Signer, error)
+
+func (f keyProviderFunc) CAKey(pass []byte) (crypto.Signer, error) {
+	return f(pass)
+}
+
+// keylessDepot is a bolt depot which fails to load the CA key.
+type keylessDepot struct {
+	*boltdepot.Depot
+}
+
+func (d keylessDepot) CA(pass []byte) ([]*x509.Certificate, crypto.Signer, error) {
+	return nil, nil, errors.New("CA key is not in the depot")
+}
+
+func TestCAKeyProvider(t *testing.T) {
+	boltDepot := createDB(0666, nil)
+	key, err := boltDepot.CreateOrLoadKey(2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, err := boltDepot.CreateOrLoadCA(key, 5, "MicroMDM", "US")
+	if err != nil {
+		t.Fatal(err)
+	}
+	depot := keylessDepot{boltDepot}
+	if _, err := NewService(depot); err == nil {
+		t.Fatal("expected an error without the CA key")
+	}
+
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = NewService(depot, WithCAKeyProvider(keyProviderFunc(func(pass []byte) (crypto.Signer, error) {
+		return otherKey, nil
+	})))
+	if err == nil {
+		t.Fatal("expected an error for a key which does not match the CA")
+	}
+
+	svc, err := NewService(depot, ClientValidity(365), WithCAKeyProvider(keyProviderFunc(func(pass []byte) (crypto.Signer, error) {
+		return opaqueKey{key, key}, nil
+	})))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	selfKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	csrBytes, err := newCSR(selfKey, "ou", "loc", "province", "country", "cname", "org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, err := x509.ParseCertificateRequest(csrBytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signerCert, err := selfSign(selfKey, csr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := scep.NewCSRRequest(csr, &scep.PKIMessage{
+		MessageType: scep.PKCSReq,
+		Recipients:  []*x509.Certificate{caCert},
+		SignerKey:   selfKey,
+		SignerCert:  signerCert,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := svc.PKIOperation(context.Background(), msg.Raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := scep.ParsePKIMessage(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := resp.PKIStatus, scep.SUCCESS; have != want {
+		t.Fatalf("have %s, want %s", have, want)
+	}
+	if err := resp.DecryptPKIEnvelope(signerCert, selfKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := resp.CertRepMessage.Certificate.CheckSignatureFrom(caCert); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func createCert(t *testing.T, tmpl, parent *x509.Certificate, pub crypto.PublicKey, key crypto.Signer) *x509.Certificate {
+	t.Helper()
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, pub, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
 func createDB(mode os.FileMode, options *bolt.Options) *boltdepot.Depot {
 	// Create temporary path.
 	f, _ := ioutil.TempFile("", "bolt-")
@@ -2,9 +2,13 @@ package scepserver
 
 import (
 	"context"
+	"errors"
+	"math/big"
 	"time"
 
 	"github.com/go-kit/kit/log"
+	"github.com/syncsynchalt/scep/depot"
+	"github.com/syncsynchalt/scep/scep"
 )
 
 type loggingService struct {
@@ -52,3 +56,67 @@ func (mw *loggingService) PKIOperation(ctx context.Context, data []byte) (certRe
 	certRep, err = mw.Service.PKIOperation(ctx, data)
 	return
 }
+
+func (mw *loggingService) GetNextCACert(ctx context.Context) (data []byte, err error) {
+	defer func(begin time.Time) {
+		_ = mw.logger.Log(
+			"method", "GetNextCACert",
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	data, err = mw.Service.GetNextCACert(ctx)
+	return
+}
+
+func (mw *loggingService) GetCRL(ctx context.Context) (crl []byte, err error) {
+	defer func(begin time.Time) {
+		_ = mw.logger.Log(
+			"method", "GetCRL",
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	crl, err = mw.Service.GetCRL(ctx)
+	return
+}
+
+// GetPreviousCRL forwards to the PreviousCRLGetter of the service.
+func (mw *loggingService) GetPreviousCRL(ctx context.Context) (crl []byte, err error) {
+	defer func(begin time.Time) {
+		_ = mw.logger.Log(
+			"method", "GetPreviousCRL",
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	getter, ok := mw.Service.(PreviousCRLGetter)
+	if !ok {
+		return nil, errors.New("service has no previous CRL")
+	}
+	return getter.GetPreviousCRL(ctx)
+}
+
+// Revoke forwards to the Revoker of the service.
+func (mw *loggingService) Revoke(ctx context.Context, serial *big.Int, reason depot.RevocationReason) (err error) {
+	defer func(begin time.Time) {
+		_ = mw.logger.Log(
+			"method", "Revoke",
+			"serial", serial,
+			"err", err,
+			"took", time.Since(begin),
+		)
+	}(time.Now())
+	revoker, ok := mw.Service.(Revoker)
+	if !ok {
+		return errors.New("service can not revoke certificates")
+	}
+	return revoker.Revoke(ctx, serial, reason)
+}
+
+// IsRecipient forwards to the RecipientMatcher of the service. It is not
+// logged, since the tenant router calls it for every PKIOperation.
+func (mw *loggingService) IsRecipient(msg *scep.PKIMessage) bool {
+	m, ok := mw.Service.(RecipientMatcher)
+	return ok && m.IsRecipient(msg)
+}
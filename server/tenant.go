@@ -0,0 +1,142 @@
+package scepserver
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/syncsynchalt/scep/scep"
+)
+
+// Tenant is a separately configured SCEP service, with its own CA, depot
+// and hooks, which is served by the same HTTP handler.
+type Tenant struct {
+	Name      string
+	Endpoints *Endpoints
+
+	// Service routes PKIOperation requests to /scep without a tenant in
+	// the path, if it implements RecipientMatcher.
+	Service Service
+}
+
+// RecipientMatcher is implemented by the Service of NewService.
+type RecipientMatcher interface {
+	// IsRecipient reports whether the pkiEnvelope of msg is encrypted
+	// to the service, by the issuer and serial number of its recipient.
+	IsRecipient(msg *scep.PKIMessage) bool
+}
+
+// IsRecipient reports whether msg is encrypted to the RA, or to the next
+// CA for clients which already use it. The envelope is only decrypted by
+// the service which PKIOperation is routed to.
+func (svc *service) IsRecipient(msg *scep.PKIMessage) bool {
+	svc.caMtx.RLock()
+	defer svc.caMtx.RUnlock()
+	return msg.EncryptedTo(svc.raCert) ||
+		svc.nextCADecrypts && len(svc.nextCA) > 0 && msg.EncryptedTo(svc.nextCA[0])
+}
+
+type tenantKey struct{}
+
+// tenantFromPath records the tenant and profile named in the path. The
+// tenantRouter decides whether the single segment of /scep/{profile}
+// names a tenant or a profile.
+func tenantFromPath(ctx context.Context, r *http.Request) context.Context {
+	vars := mux.Vars(r)
+	if name, ok := vars["tenant"]; ok {
+		ctx = context.WithValue(ctx, tenantKey{}, name)
+	}
+	if name, ok := vars["profile"]; ok {
+		ctx = NewProfileContext(ctx, name)
+	}
+	return ctx
+}
+
+// tenantRouter dispatches requests to the endpoints of the tenant
+// selected by the path, or by the CA-identifier message parameter of
+// GetCACaps, GetCACert and GetNextCACert. A PKIOperation without a
+// tenant in the path goes to the tenant whose RA the pkiEnvelope is
+// encrypted to. Other requests go to the default endpoints.
+type tenantRouter struct {
+	def     Tenant
+	tenants map[string]Tenant
+	order   []string // names of the tenants, to match recipients in order
+}
+
+func newTenantRouter(def Tenant, tenants []Tenant) *tenantRouter {
+	router := &tenantRouter{def: def, tenants: make(map[string]Tenant)}
+	for _, t := range tenants {
+		router.tenants[t.Name] = t
+		router.order = append(router.order, t.Name)
+	}
+	return router
+}
+
+func (t *tenantRouter) endpoints(ctx context.Context, req SCEPRequest) (context.Context, *Endpoints, error) {
+	if name, ok := ctx.Value(tenantKey{}).(string); ok {
+		tenant, ok := t.tenants[name]
+		if !ok {
+			return ctx, nil, fmt.Errorf("unknown tenant %q", name)
+		}
+		return ctx, tenant.Endpoints, nil
+	}
+	if name, _ := ctx.Value(profileKey{}).(string); name != "" {
+		if tenant, ok := t.tenants[name]; ok {
+			return NewProfileContext(ctx, ""), tenant.Endpoints, nil
+		}
+	}
+	switch req.Operation {
+	case getCACaps, getCACert, getNextCACert:
+		if tenant, ok := t.tenants[string(req.Message)]; ok {
+			return ctx, tenant.Endpoints, nil
+		}
+	case pkiOperation:
+		return ctx, t.recipient(req.Message), nil
+	}
+	return ctx, t.def.Endpoints, nil
+}
+
+// recipient returns the endpoints of the tenant whose RA the PKIOperation
+// message is encrypted to, preferring the default endpoints. RAs are told
+// apart by issuer and serial number, which the random serial numbers of
+// scepserver ca -init keep distinct.
+func (t *tenantRouter) recipient(data []byte) *Endpoints {
+	if len(t.tenants) == 0 {
+		return t.def.Endpoints
+	}
+	msg, err := scep.ParsePKIMessage(data)
+	if err != nil {
+		// the default service reports the error
+		return t.def.Endpoints
+	}
+	isRecipient := func(tenant Tenant) bool {
+		m, ok := tenant.Service.(RecipientMatcher)
+		return ok && m.IsRecipient(msg)
+	}
+	if isRecipient(t.def) {
+		return t.def.Endpoints
+	}
+	for _, name := range t.order {
+		if tenant := t.tenants[name]; isRecipient(tenant) {
+			return tenant.Endpoints
+		}
+	}
+	return t.def.Endpoints
+}
+
+func (t *tenantRouter) get(ctx context.Context, request interface{}) (interface{}, error) {
+	ctx, e, err := t.endpoints(ctx, request.(SCEPRequest))
+	if err != nil {
+		return nil, err
+	}
+	return e.GetEndpoint(ctx, request)
+}
+
+func (t *tenantRouter) post(ctx context.Context, request interface{}) (interface{}, error) {
+	ctx, e, err := t.endpoints(ctx, request.(SCEPRequest))
+	if err != nil {
+		return nil, err
+	}
+	return e.PostEndpoint(ctx, request)
+}
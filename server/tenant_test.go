@@ -0,0 +1,126 @@
+package scepserver
+
+import (
+	"crypto/x509"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	filedepot "github.com/syncsynchalt/scep/depot/file"
+	"github.com/syncsynchalt/scep/scep"
+)
+
+func TestTenants(t *testing.T) {
+	profiles, err := ParseProfiles([]byte(testProfiles))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// PKIOperation is routed by the issuer and serial number of the
+	// recipient, the CAs differ by name
+	newService := func(cn string) (Service, *x509.Certificate) {
+		dir, err := ioutil.TempDir("", "scep-depot-")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { os.RemoveAll(dir) })
+		caCert := writeCA(t, dir, "ca", cn)
+		depot, err := filedepot.NewFileDepot(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		svc, err := NewService(depot, CAKeyPassword([]byte("secret")), WithProfiles(profiles...))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return svc, caCert
+	}
+	defSvc, defCA := newService("SCEP CA")
+	acmeSvc, acmeCA := newService("ACME SCEP CA")
+	handler := MakeHTTPHandler(MakeServerEndpoints(defSvc), defSvc, log.NewNopLogger(),
+		Tenant{Name: "acme", Endpoints: MakeServerEndpoints(acmeSvc), Service: NewLoggingService(log.NewNopLogger(), acmeSvc)},
+	)
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	getCACert := func(path, caIdent string) *x509.Certificate {
+		t.Helper()
+		query := url.Values{"operation": {getCACert}}
+		if caIdent != "" {
+			query.Set("message", caIdent)
+		}
+		resp, err := http.Get(server.URL + path + "?" + query.Encode())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		data, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cert, err := x509.ParseCertificate(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return cert
+	}
+	var tests = []struct {
+		path    string
+		caIdent string
+		want    *x509.Certificate
+	}{
+		{"/scep", "", defCA},
+		{"/scep", "CAIdentifier", defCA},
+		{"/scep", "acme", acmeCA},
+		{"/scep/acme", "", acmeCA},
+		{"/scep/server", "", defCA},
+		{"/scep/acme/server", "", acmeCA},
+	}
+	for _, tt := range tests {
+		if have := getCACert(tt.path, tt.caIdent); !have.Equal(tt.want) {
+			t.Errorf("%s %q: have CA %s, want %s", tt.path, tt.caIdent, have.Subject, tt.want.Subject)
+		}
+	}
+
+	// a profile of the tenant
+	client, err := MakeClientEndpoints(server.URL + "/scep/acme/server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &renewalClient{t: t, svc: client, ca: acmeCA}
+	key := r.newKey()
+	cert := r.issued(r.send(scep.PKCSReq, profileCSR(t, key, ""), r.selfSign(key), key))
+	if err := cert.CheckSignatureFrom(acmeCA); err != nil {
+		t.Error(err)
+	}
+	if have, want := validityDays(cert), 90; have != want {
+		t.Errorf("have %d days, want %d", have, want)
+	}
+
+	// a PKIOperation without the tenant in the path, routed by the
+	// recipient of its pkiEnvelope
+	for _, ca := range []*x509.Certificate{acmeCA, defCA} {
+		client, err := MakeClientEndpoints(server.URL + "/scep")
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := &renewalClient{t: t, svc: client, ca: ca}
+		key := r.newKey()
+		cert := r.issued(r.send(scep.PKCSReq, r.csr(key, "routed"), r.selfSign(key), key))
+		if err := cert.CheckSignatureFrom(ca); err != nil {
+			t.Errorf("CA %s: %s", ca.Subject, err)
+		}
+	}
+
+	resp, err := http.Get(server.URL + "/scep/unknown/server?operation=GetCACert")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		t.Error("expected an unknown tenant to fail")
+	}
+}
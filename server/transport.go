@@ -16,25 +16,41 @@ import (
 	"github.com/pkg/errors"
 )
 
-func MakeHTTPHandler(e *Endpoints, svc Service, logger kitlog.Logger) http.Handler {
+// MakeHTTPHandler serves the endpoints at /scep, and each tenant at
+// /scep/{tenant}. A path segment which does not name a tenant selects a
+// certificate profile, as does /scep/{tenant}/{profile}.
+func MakeHTTPHandler(e *Endpoints, svc Service, logger kitlog.Logger, tenants ...Tenant) http.Handler {
 	opts := []kithttp.ServerOption{
 		kithttp.ServerErrorLogger(logger),
 		kithttp.ServerFinalizer(logutil.NewHTTPLogger(logger).LoggingFinalizer),
+		kithttp.ServerBefore(tenantFromPath),
 	}
+	router := newTenantRouter(Tenant{Endpoints: e, Service: svc}, tenants)
 
 	r := mux.NewRouter()
-	r.Methods("GET").Path("/scep").Handler(kithttp.NewServer(
-		e.GetEndpoint,
-		decodeSCEPRequest,
-		encodeSCEPResponse,
-		opts...,
-	))
-	r.Methods("POST").Path("/scep").Handler(kithttp.NewServer(
-		e.PostEndpoint,
-		decodeSCEPRequest,
-		encodeSCEPResponse,
-		opts...,
-	))
+	for _, path := range []string{"/scep", "/scep/{profile}", "/scep/{tenant}/{profile}"} {
+		r.Methods("GET").Path(path).Handler(kithttp.NewServer(
+			router.get,
+			decodeSCEPRequest,
+			encodeSCEPResponse,
+			opts...,
+		))
+		r.Methods("POST").Path(path).Handler(kithttp.NewServer(
+			router.post,
+			decodeSCEPRequest,
+			encodeSCEPResponse,
+			opts...,
+		))
+	}
+	// plain HTTP CRL distribution points
+	for _, path := range []string{"/crl", "/crl/{tenant}"} {
+		r.Methods("GET").Path(path).Handler(kithttp.NewServer(
+			router.get,
+			decodeCRLRequest,
+			encodeSCEPResponse,
+			opts...,
+		))
+	}
 
 	return r
 }
@@ -86,6 +102,18 @@ func decodeSCEPRequest(ctx context.Context, r *http.Request) (interface{}, error
 	return request, nil
 }
 
+// previousCRL is the message of a GetCRL request for the CRL of the CA
+// replaced by the last rollover, requested with ?ca=previous.
+const previousCRL = "previous"
+
+func decodeCRLRequest(ctx context.Context, r *http.Request) (interface{}, error) {
+	request := SCEPRequest{Operation: getCRL}
+	if r.URL.Query().Get("ca") == previousCRL {
+		request.Message = []byte(previousCRL)
+	}
+	return request, nil
+}
+
 // extract message from request
 func message(r *http.Request) ([]byte, error) {
 	switch r.Method {
@@ -145,6 +173,8 @@ const (
 	certChainHeader = "application/x-x509-ca-ra-cert"
 	leafHeader      = "application/x-x509-ca-cert"
 	pkiOpHeader     = "application/x-pki-message"
+	crlHeader       = "application/pkix-crl"
+	nextCAHeader    = "application/x-x509-next-ca-cert"
 )
 
 func contentHeader(op string, certNum int) string {
@@ -156,6 +186,10 @@ func contentHeader(op string, certNum int) string {
 		return leafHeader
 	case "PKIOperation":
 		return pkiOpHeader
+	case "GetNextCACert":
+		return nextCAHeader
+	case "GetCRL":
+		return crlHeader
 	default:
 		return "text/plain"
 	}
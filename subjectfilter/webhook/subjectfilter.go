@@ -0,0 +1,54 @@
+// Package webhooksubjectfilter defines the WebhookSubjectFilter subjectfilter.SubjectFilter.
+package webhooksubjectfilter
+
+import (
+	"crypto/x509/pkix"
+	"errors"
+
+	"github.com/go-kit/kit/log"
+	"github.com/syncsynchalt/scep/webhook"
+)
+
+// New creates a webhooksubjectfilter.WebhookSubjectFilter.
+func New(config webhook.Config, logger log.Logger) (*WebhookSubjectFilter, error) {
+	client, err := webhook.NewClient(config)
+	if err != nil {
+		return nil, err
+	}
+	return &WebhookSubjectFilter{client: client, logger: logger}, nil
+}
+
+// WebhookSubjectFilter implements a subjectfilter.SubjectFilter.
+// It posts the raw decrypted CSR to a webhook, which answers with the
+// attributes of the subject to be signed in "subject", each in an RDN of
+// its own, in order.
+type WebhookSubjectFilter struct {
+	client *webhook.Client
+	logger log.Logger
+}
+
+func (v *WebhookSubjectFilter) Filter(data []byte) (*pkix.Name, error) {
+	resp, err := v.client.Post(webhook.NewRequest("subjectfilter", "", data))
+	if err != nil {
+		v.logger.Log("err", err)
+		return nil, err
+	}
+	if len(resp.Subject) == 0 {
+		return nil, errors.New("subjectfilter webhook returned no subject")
+	}
+	var subjSeq pkix.RDNSequence
+	for _, attr := range resp.Subject {
+		oid, err := webhook.ParseOID(attr.Type)
+		if err != nil {
+			return nil, err
+		}
+		subjSeq = append(subjSeq, pkix.RelativeDistinguishedNameSET{
+			{Type: oid, Value: attr.Value},
+		})
+	}
+
+	var newSubject pkix.Name
+	newSubject.FillFromRDNSequence(&subjSeq)
+
+	return &newSubject, nil
+}
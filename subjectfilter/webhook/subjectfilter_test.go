@@ -0,0 +1,36 @@
+package webhooksubjectfilter
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-kit/kit/log"
+	"github.com/syncsynchalt/scep/webhook"
+)
+
+func TestFilter(t *testing.T) {
+	response := `{"subject": [{"type": "2.5.4.10", "value": "acme"}, {"type": "2.5.4.3", "value": "device"}]}`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(response))
+	}))
+	defer server.Close()
+
+	f, err := New(webhook.Config{URL: server.URL}, log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	name, err := f.Filter([]byte("csr"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := name.String(), "CN=device,O=acme"; have != want {
+		t.Errorf("have %s, want %s", have, want)
+	}
+
+	for _, response = range []string{`{}`, `{"subject": [{"type": "cn", "value": "device"}]}`} {
+		if _, err := f.Filter([]byte("csr")); err == nil {
+			t.Errorf("%s: filtered the subject", response)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package webhook
+
+import (
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/pem"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Request is the JSON document posted to a webhook.
+type Request struct {
+	Hook          string `json:"hook"` // e.g. "csrverifier"
+	TransactionID string `json:"transaction_id,omitempty"`
+
+	// CSR is the PEM encoded CSR. Subject and SANs are parsed from it,
+	// and are nil if it could not be parsed.
+	CSR     string   `json:"csr"`
+	Subject *Subject `json:"subject,omitempty"`
+	SANs    *SANs    `json:"sans,omitempty"`
+
+	// the result of the request, for the certsuccesser and certfailer
+	Certificate string `json:"certificate,omitempty"` // PEM
+	Error       string `json:"error,omitempty"`
+}
+
+// Subject is the subject of a CSR.
+type Subject struct {
+	String     string      `json:"string"` // RFC 4514
+	CommonName string      `json:"cn,omitempty"`
+	Attributes []Attribute `json:"attributes"`
+}
+
+// Attribute is an attribute of a subject, with its type as a dotted OID.
+// Attributes of multi-valued RDNs follow each other.
+type Attribute struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+// SANs are the SubjectAltNames requested in a CSR.
+type SANs struct {
+	DNSNames       []string `json:"dns,omitempty"`
+	EmailAddresses []string `json:"email,omitempty"`
+	IPAddresses    []string `json:"ip,omitempty"`
+	URIs           []string `json:"uri,omitempty"`
+}
+
+// NewRequest describes the raw decrypted CSR data to the hook.
+func NewRequest(hook, transactionID string, data []byte) *Request {
+	r := &Request{
+		Hook:          hook,
+		TransactionID: transactionID,
+		CSR:           string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: data})),
+	}
+	csr, err := x509.ParseCertificateRequest(data)
+	if err != nil {
+		return r
+	}
+	r.Subject = &Subject{
+		String:     csr.Subject.String(),
+		CommonName: csr.Subject.CommonName,
+		Attributes: []Attribute{},
+	}
+	for _, rdn := range csr.Subject.ToRDNSequence() {
+		for _, atv := range rdn {
+			r.Subject.Attributes = append(r.Subject.Attributes, Attribute{
+				Type:  atv.Type.String(),
+				Value: fmt.Sprint(atv.Value),
+			})
+		}
+	}
+	r.SANs = &SANs{
+		DNSNames:       csr.DNSNames,
+		EmailAddresses: csr.EmailAddresses,
+	}
+	for _, ip := range csr.IPAddresses {
+		r.SANs.IPAddresses = append(r.SANs.IPAddresses, ip.String())
+	}
+	for _, uri := range csr.URIs {
+		r.SANs.URIs = append(r.SANs.URIs, uri.String())
+	}
+	return r
+}
+
+// Response is the JSON document a webhook answers with. Each hook reads
+// its own fields.
+type Response struct {
+	// Allow approves the CSR or certificate, for the csrverifier and
+	// certsuccesser.
+	Allow bool `json:"allow"`
+
+	// Subject replaces the subject of the CSR, for the subjectfilter.
+	Subject []Attribute `json:"subject,omitempty"`
+
+	// Profile names the certificate profile, for the profilechooser.
+	Profile string `json:"profile,omitempty"`
+
+	// CAKey is the PEM encoded CA key, encrypted with the CA key
+	// password, and CACerts the PEM encoded CA certificate and chain,
+	// for the cachooser.
+	CAKey   string `json:"ca_key,omitempty"`
+	CACerts string `json:"ca_certs,omitempty"`
+}
+
+// ParseOID parses a dotted OID.
+func ParseOID(s string) (asn1.ObjectIdentifier, error) {
+	var oid asn1.ObjectIdentifier
+	for _, part := range strings.Split(s, ".") {
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid OID %q", s)
+		}
+		oid = append(oid, n)
+	}
+	if len(oid) < 2 {
+		return nil, fmt.Errorf("invalid OID %q", s)
+	}
+	return oid, nil
+}
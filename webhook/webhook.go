@@ -0,0 +1,192 @@
+// Package webhook implements the HTTP client of the webhook hooks. A hook
+// POSTs a JSON Request describing the CSR of a SCEP request to a URL and
+// reads a JSON Response.
+//
+// Requests are signed if a secret is configured. The X-SCEP-Timestamp
+// header holds the Unix time of the request and X-SCEP-Signature is
+// "sha256=" and the hex encoded HMAC-SHA256 of the timestamp, a dot and
+// the body, see Sign. Receivers should reject old timestamps.
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Headers of a signed request.
+const (
+	TimestampHeader = "X-SCEP-Timestamp"
+	SignatureHeader = "X-SCEP-Signature"
+)
+
+// maxResponseSize limits the responses read from a webhook.
+const maxResponseSize = 1 << 20
+
+// Config configures a Client.
+type Config struct {
+	URL    string
+	Secret string // signs requests, optional
+
+	Timeout   time.Duration // of each attempt, 10 seconds if 0
+	Retries   int           // attempts after a failed one
+	RetryWait time.Duration // before the first retry, doubled for each further one, 1 second if 0
+
+	CAFile             string // PEM CA certificates to verify the server with instead of the system roots
+	CertFile           string // PEM client certificate
+	KeyFile            string // PEM key of the client certificate
+	InsecureSkipVerify bool
+}
+
+// Client posts requests to a webhook.
+type Client struct {
+	url       string
+	secret    []byte
+	retries   int
+	retryWait time.Duration
+	client    *http.Client
+}
+
+// NewClient creates a client for the webhook configured by c.
+func NewClient(c Config) (*Client, error) {
+	if c.URL == "" {
+		return nil, errors.New("webhook URL is empty")
+	}
+	if c.Retries < 0 {
+		return nil, fmt.Errorf("invalid number of webhook retries %d", c.Retries)
+	}
+	if c.Timeout == 0 {
+		c.Timeout = 10 * time.Second
+	}
+	if c.RetryWait == 0 {
+		c.RetryWait = time.Second
+	}
+	tlsConfig := &tls.Config{InsecureSkipVerify: c.InsecureSkipVerify}
+	if c.CAFile != "" {
+		data, err := ioutil.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates in %s", c.CAFile)
+		}
+	}
+	if c.CertFile != "" || c.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return &Client{
+		url:       c.URL,
+		secret:    []byte(c.Secret),
+		retries:   c.Retries,
+		retryWait: c.RetryWait,
+		client:    &http.Client{Timeout: c.Timeout, Transport: transport},
+	}, nil
+}
+
+// Post sends r to the webhook and decodes its response. Failed attempts
+// are retried if the connection failed or the webhook answered with a 5xx
+// or 429 status.
+func (c *Client) Post(r *Request) (*Response, error) {
+	body, err := json.Marshal(r)
+	if err != nil {
+		return nil, err
+	}
+	wait := c.retryWait
+	for attempt := 0; ; attempt++ {
+		resp, retry, err := c.post(body)
+		if err == nil {
+			return resp, nil
+		}
+		if !retry || attempt >= c.retries {
+			return nil, fmt.Errorf("%s webhook: %s", r.Hook, err)
+		}
+		time.Sleep(wait)
+		wait *= 2
+	}
+}
+
+// post makes one attempt, and reports whether a failed one can be retried.
+func (c *Client) post(body []byte) (*Response, bool, error) {
+	req, err := http.NewRequest("POST", c.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(c.secret) > 0 {
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set(TimestampHeader, timestamp)
+		req.Header.Set(SignatureHeader, Sign(c.secret, timestamp, body))
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, true, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return nil, true, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+		return nil, retry, fmt.Errorf("status %s: %s", resp.Status, bytes.TrimSpace(data))
+	}
+	response := new(Response)
+	if len(bytes.TrimSpace(data)) == 0 {
+		return response, false, nil
+	}
+	if err := json.Unmarshal(data, response); err != nil {
+		return nil, false, fmt.Errorf("decode response: %s", err)
+	}
+	return response, false, nil
+}
+
+// Sign returns the signature of a request with the body, sent at the
+// timestamp.
+func Sign(secret []byte, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks the signature of a request to a webhook. It is meant for
+// receivers written in Go.
+func Verify(secret []byte, r *http.Request, body []byte, maxAge time.Duration) error {
+	timestamp := r.Header.Get(TimestampHeader)
+	sent, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid %s header", TimestampHeader)
+	}
+	if age := time.Since(time.Unix(sent, 0)); age > maxAge || age < -maxAge {
+		return errors.New("request is too old")
+	}
+	if !hmac.Equal([]byte(r.Header.Get(SignatureHeader)), []byte(Sign(secret, timestamp, body))) {
+		return errors.New("invalid signature")
+	}
+	return nil
+}
+
+// EncodeCertificate returns the PEM encoding of a DER certificate.
+func EncodeCertificate(der []byte) string {
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+}
@@ -0,0 +1,195 @@
+package webhook
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPost(t *testing.T) {
+	secret := []byte("secret")
+	var req Request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		if err := Verify(secret, r, body, time.Minute); err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		if err := json.Unmarshal(body, &req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(`{"allow": true, "profile": "wifi"}`))
+	}))
+	defer server.Close()
+
+	client, err := NewClient(Config{URL: server.URL, Secret: string(secret)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Post(NewRequest("csrverifier", "tid", testCSR(t)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resp.Allow || resp.Profile != "wifi" {
+		t.Errorf("have response %+v", resp)
+	}
+	if have, want := req.TransactionID, "tid"; have != want {
+		t.Errorf("have %s, want %s", have, want)
+	}
+	if req.Subject == nil || req.SANs == nil {
+		t.Fatalf("CSR was not parsed: %+v", req)
+	}
+	if have, want := req.Subject.String, "CN=device,O=acme"; have != want {
+		t.Errorf("have %s, want %s", have, want)
+	}
+	if have, want := req.Subject.Attributes[1], (Attribute{Type: "2.5.4.3", Value: "device"}); have != want {
+		t.Errorf("have %v, want %v", have, want)
+	}
+	if len(req.SANs.DNSNames) != 1 || req.SANs.DNSNames[0] != "device.example.com" {
+		t.Errorf("have DNS names %v", req.SANs.DNSNames)
+	}
+	if len(req.SANs.IPAddresses) != 1 || req.SANs.IPAddresses[0] != "192.0.2.1" {
+		t.Errorf("have IP addresses %v", req.SANs.IPAddresses)
+	}
+
+	wrong, err := NewClient(Config{URL: server.URL, Secret: "wrong"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := wrong.Post(NewRequest("csrverifier", "tid", testCSR(t))); err == nil {
+		t.Error("request with a wrong signature succeeded")
+	}
+}
+
+func TestRetries(t *testing.T) {
+	var attempts, status int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&attempts, 1) < 3 {
+			w.WriteHeader(int(atomic.LoadInt32(&status)))
+			return
+		}
+		w.Write([]byte(`{"allow": true}`))
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		status   int
+		retries  int
+		attempts int32
+		ok       bool
+	}{
+		{http.StatusServiceUnavailable, 2, 3, true},
+		{http.StatusServiceUnavailable, 1, 2, false},
+		{http.StatusTooManyRequests, 2, 3, true},
+		{http.StatusBadRequest, 2, 1, false},
+	}
+	for _, tt := range tests {
+		atomic.StoreInt32(&attempts, 0)
+		atomic.StoreInt32(&status, int32(tt.status))
+		client, err := NewClient(Config{URL: server.URL, Retries: tt.retries, RetryWait: time.Millisecond})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = client.Post(&Request{Hook: "test"})
+		if have, want := err == nil, tt.ok; have != want {
+			t.Errorf("status %d, %d retries: have success %v, want %v: %v", tt.status, tt.retries, have, want, err)
+		}
+		if have, want := atomic.LoadInt32(&attempts), tt.attempts; have != want {
+			t.Errorf("status %d, %d retries: have %d attempts, want %d", tt.status, tt.retries, have, want)
+		}
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	done := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+		}
+	}))
+	defer server.Close()
+	defer close(done)
+
+	client, err := NewClient(Config{URL: server.URL, Timeout: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	begin := time.Now()
+	if _, err := client.Post(&Request{Hook: "test"}); err == nil {
+		t.Error("request to a slow webhook succeeded")
+	}
+	if took := time.Since(begin); took > 500*time.Millisecond {
+		t.Errorf("request took %s", took)
+	}
+}
+
+func TestTLS(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"allow": true}`))
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "webhook-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	caFile := filepath.Join(dir, "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := ioutil.WriteFile(caFile, caPEM, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		config Config
+		ok     bool
+	}{
+		{"system roots", Config{URL: server.URL}, false},
+		{"CA file", Config{URL: server.URL, CAFile: caFile}, true},
+		{"insecure", Config{URL: server.URL, InsecureSkipVerify: true}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, err := NewClient(tt.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = client.Post(&Request{Hook: "test"})
+			if have, want := err == nil, tt.ok; have != want {
+				t.Errorf("have success %v, want %v: %v", have, want, err)
+			}
+		})
+	}
+}
+
+func testCSR(t *testing.T) []byte {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject:     pkix.Name{CommonName: "device", Organization: []string{"acme"}},
+		DNSNames:    []string{"device.example.com"},
+		IPAddresses: []net.IP{net.ParseIP("192.0.2.1")},
+	}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}